@@ -0,0 +1,181 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+
+	"github.com/raintank/metrictank/consolidation"
+	"github.com/raintank/metrictank/idx"
+	"github.com/raintank/metrictank/mdata"
+	"github.com/raintank/worldping-api/pkg/log"
+	"gopkg.in/raintank/schema.v1"
+)
+
+var (
+	errBackfillNoTs  = errors.New("datapoints must have a timestamp")
+	errBackfillBadTs = errors.New("timestamps must be whole numbers of seconds between 1 and 4294967295")
+)
+
+// backfillSeries is a series with historical data to backfill, as sent to the backfill api
+type backfillSeries struct {
+	Name       string           `json:"name"`
+	Interval   int              `json:"interval"`
+	Unit       string           `json:"unit"`
+	Mtype      string           `json:"mtype"`
+	Tags       []string         `json:"tags"`
+	Datapoints [][2]*float64    `json:"datapoints"` // [value, timestamp] pairs, like in graphite's render output. null values are skipped
+	Rollups    []backfillRollup `json:"rollups"`
+}
+
+// backfillRollup is data of the series that was rolled up already, e.g. an archive of a whisper file
+type backfillRollup struct {
+	Span          uint32        `json:"span"`
+	ConsolidateBy string        `json:"consolidateBy"` // how the raw points were rolled up: avg, min, max, sum or last
+	Datapoints    [][2]*float64 `json:"datapoints"`    // like those of the series, timestamped at the end of their span
+}
+
+// rollups returns the rollups as mdata expects them
+func (s backfillSeries) rollups() ([]mdata.BackfillRollup, error) {
+	rollups := make([]mdata.BackfillRollup, 0, len(s.Rollups))
+	for _, r := range s.Rollups {
+		if r.Span == 0 {
+			return nil, errors.New("rollups must have a span")
+		}
+		consolidator, err := consolidation.FromConsolidateBy(r.ConsolidateBy)
+		if err != nil || consolidator == consolidation.P50 || consolidator == consolidation.P90 || consolidator == consolidation.P99 {
+			return nil, fmt.Errorf("invalid consolidateBy %q of rollup with span %d", r.ConsolidateBy, r.Span)
+		}
+		points, err := backfillPoints(r.Datapoints)
+		if err != nil {
+			return nil, err
+		}
+		rollups = append(rollups, mdata.BackfillRollup{Span: r.Span, Consolidator: consolidator, Points: points})
+	}
+	return rollups, nil
+}
+
+// backfillPoints returns the non-null datapoints as points
+func backfillPoints(datapoints [][2]*float64) ([]schema.Point, error) {
+	points := make([]schema.Point, 0, len(datapoints))
+	for _, dp := range datapoints {
+		if dp[1] == nil {
+			return nil, errBackfillNoTs
+		}
+		if ts := *dp[1]; ts < 1 || ts > math.MaxUint32 || ts != math.Trunc(ts) {
+			return nil, errBackfillBadTs
+		}
+		if dp[0] == nil {
+			continue
+		}
+		points = append(points, schema.Point{Val: *dp[0], Ts: uint32(*dp[1])})
+	}
+	return points, nil
+}
+
+// Backfill imports historical data: it adds the series to the index if needed,
+// and builds and saves the chunks of their data and rollups, bypassing the chunks in memory.
+// all series are checked before any of them is saved, so a request is either saved entirely or not at all.
+// the chunks that we and our peers cache of the saved series are invalidated, as they may be outdated now.
+func Backfill(metricIndex idx.MetricIndex) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		org, err := getOrg(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		var in []backfillSeries
+		err = json.NewDecoder(r.Body).Decode(&in)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("failed to decode body: %s", err), http.StatusBadRequest)
+			return
+		}
+
+		datas := make([]*schema.MetricData, 0, len(in))
+		backfills := make([]*mdata.PreparedBackfill, 0, len(in))
+		for _, s := range in {
+			points, err := backfillPoints(s.Datapoints)
+			if err != nil {
+				http.Error(w, fmt.Sprintf("%s: %s", s.Name, err), http.StatusBadRequest)
+				return
+			}
+			rollups, err := s.rollups()
+			if err != nil {
+				http.Error(w, fmt.Sprintf("%s: %s", s.Name, err), http.StatusBadRequest)
+				return
+			}
+			last := lastTs(points, rollups)
+			if last == 0 {
+				continue
+			}
+			data := &schema.MetricData{
+				OrgId:    org,
+				Name:     s.Name,
+				Metric:   s.Name,
+				Interval: s.Interval,
+				Unit:     s.Unit,
+				Time:     int64(last),
+				Mtype:    s.Mtype,
+				Tags:     s.Tags,
+			}
+			err = data.Validate()
+			if err != nil {
+				http.Error(w, fmt.Sprintf("%s: %s", s.Name, err), http.StatusBadRequest)
+				return
+			}
+			data.SetId()
+			b, err := metrics.PrepareBackfill(data.Id, data.Name, uint32(data.Interval), points, rollups...)
+			if err != nil {
+				http.Error(w, fmt.Sprintf("%s: %s", s.Name, err), http.StatusBadRequest)
+				return
+			}
+			datas = append(datas, data)
+			backfills = append(backfills, b)
+		}
+
+		chunks := 0
+		var keys []string
+		for i, data := range datas {
+			num := metrics.SaveBackfill(backfills[i])
+			// adding a series that is already in the index would set its last update to the time of our last point
+			if _, err := metricIndex.Get(data.Id); err != nil {
+				metricIndex.Add(data)
+			}
+			chunks += num
+			keys = append(keys, backfills[i].Keys()...)
+			log.Debug("backfilled %d chunks of %s", num, data.Id)
+		}
+		if err := invalidatePeers(keys); err != nil {
+			log.Error(3, "failed to invalidate the chunk caches of peers after a backfill. %s", err)
+			http.Error(w, fmt.Sprintf("the data was saved, but peers may serve outdated data from their chunk caches. retry the backfill. %s", err), http.StatusInternalServerError)
+			return
+		}
+
+		resp := make(map[string]interface{})
+		resp["success"] = true
+		resp["series"] = len(in)
+		resp["chunks"] = chunks
+		b, err := json.Marshal(resp)
+		if err != nil {
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+		writeResponse(w, b, httpTypeJSON, "")
+	}
+}
+
+// lastTs returns the timestamp of the last point of the series, 0 if it has none
+func lastTs(points []schema.Point, rollups []mdata.BackfillRollup) uint32 {
+	var last uint32
+	if len(points) > 0 {
+		last = points[len(points)-1].Ts
+	}
+	for _, r := range rollups {
+		if len(r.Points) > 0 && r.Points[len(r.Points)-1].Ts > last {
+			last = r.Points[len(r.Points)-1].Ts
+		}
+	}
+	return last
+}
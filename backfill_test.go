@@ -0,0 +1,108 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/raintank/met/helper"
+	"github.com/raintank/metrictank/idx/memory"
+	"github.com/raintank/metrictank/mdata"
+	"gopkg.in/raintank/schema.v1"
+)
+
+func TestBackfillPoints(t *testing.T) {
+	f := func(v float64) *float64 { return &v }
+	cases := []struct {
+		datapoints [][2]*float64
+		points     []schema.Point
+		err        error
+	}{
+		{[][2]*float64{{f(1), f(10)}, {nil, f(20)}, {f(3), f(4294967295)}}, []schema.Point{{1, 10}, {3, 4294967295}}, nil},
+		{[][2]*float64{{f(1), nil}}, nil, errBackfillNoTs},
+		{[][2]*float64{{f(1), f(0)}}, nil, errBackfillBadTs},
+		{[][2]*float64{{f(1), f(-10)}}, nil, errBackfillBadTs},
+		{[][2]*float64{{f(1), f(10.5)}}, nil, errBackfillBadTs},
+		{[][2]*float64{{f(1), f(4294967296)}}, nil, errBackfillBadTs},
+		// null values are skipped, but their timestamps must still be valid
+		{[][2]*float64{{nil, f(10.5)}}, nil, errBackfillBadTs},
+	}
+	for i, c := range cases {
+		points, err := backfillPoints(c.datapoints)
+		if err != c.err {
+			t.Fatalf("case %d: expected error %v, got %v", i, c.err, err)
+		}
+		if len(points) != len(c.points) {
+			t.Fatalf("case %d: expected points %v, got %v", i, c.points, points)
+		}
+		for j := range points {
+			if points[j] != c.points[j] {
+				t.Fatalf("case %d: expected points %v, got %v", i, c.points, points)
+			}
+		}
+	}
+}
+
+// countingStore counts the chunks that are added, and the keys that are invalidated
+type countingStore struct {
+	mdata.Store
+	added       int
+	invalidated []string
+}
+
+func (c *countingStore) Add(cwr *mdata.ChunkWriteRequest) {
+	c.added++
+}
+
+func (c *countingStore) Invalidate(key string) {
+	c.invalidated = append(c.invalidated, key)
+}
+
+func TestBackfill(t *testing.T) {
+	stats, _ := helper.New(false, "", "standard", "metrictank", "")
+	mdata.CluStatus = mdata.NewClusterStatus("default", true)
+	mdata.InitMetrics(stats)
+	initMetrics(stats)
+
+	store := &countingStore{Store: mdata.NewDevnullStore()}
+	metrics = mdata.NewAggMetrics(store, 600, 10, 800, 8000, 10000, 0, 0, make([]mdata.AggSetting, 0), nil, nil)
+	metricIndex := memory.New()
+	metricIndex.Init(stats)
+
+	peerStore := &countingStore{Store: mdata.NewDevnullStore()}
+	srv := httptest.NewServer(CacheInvalidate(peerStore))
+	defer srv.Close()
+	peers = []*Peer{{Addr: strings.TrimPrefix(srv.URL, "http://")}}
+	defer func() { peers = nil }()
+
+	now := time.Now().Unix()
+	backfill := func(names ...string) *httptest.ResponseRecorder {
+		var series []string
+		for _, name := range names {
+			series = append(series, fmt.Sprintf(`{"name":%q,"interval":10,"mtype":"gauge","datapoints":[[1,%d],[2,%d]]}`, name, now-3600, now-3590))
+		}
+		req, _ := http.NewRequest("POST", "/metrics/backfill", strings.NewReader("["+strings.Join(series, ",")+"]"))
+		req.Header.Set("x-org-id", "1")
+		w := httptest.NewRecorder()
+		Backfill(metricIndex)(w, req)
+		return w
+	}
+
+	// b has data in memory that the backfill would overlap with, so a isn't saved either
+	data := &schema.MetricData{OrgId: 1, Name: "b", Metric: "b", Interval: 10, Mtype: "gauge"}
+	data.SetId()
+	metrics.GetOrCreate(data.Id, data.Name).Add(uint32(now-3600), 1)
+	if w := backfill("a", "b"); w.Code != http.StatusBadRequest || store.added != 0 || len(metricIndex.List(1)) != 0 {
+		t.Fatalf("expected a 400 without saving anything, got %d with %d chunks saved: %s", w.Code, store.added, w.Body.String())
+	}
+
+	if w := backfill("a", "c"); w.Code != http.StatusOK || store.added != 2 || len(metricIndex.List(1)) != 2 {
+		t.Fatalf("expected both series to be saved, got %d with %d chunks saved: %s", w.Code, store.added, w.Body.String())
+	}
+	if len(store.invalidated) != 2 || len(peerStore.invalidated) != 2 || peerStore.invalidated[0] != store.invalidated[0] {
+		t.Fatalf("expected the keys of both series to be invalidated here and on the peer, got %v and %v", store.invalidated, peerStore.invalidated)
+	}
+}
@@ -6,6 +6,7 @@ package batch
 import (
 	"gopkg.in/raintank/schema.v1"
 	"math"
+	"sort"
 )
 
 type AggFunc func(in []schema.Point) float64
@@ -95,3 +96,49 @@ func Sum(in []schema.Point) float64 {
 	}
 	return sum
 }
+
+// Lst returns the last non-NaN value
+func Lst(in []schema.Point) float64 {
+	for i := len(in) - 1; i >= 0; i-- {
+		if !math.IsNaN(in[i].Val) {
+			return in[i].Val
+		}
+	}
+	return math.NaN()
+}
+
+func P50(in []schema.Point) float64 {
+	return percentile(in, 50)
+}
+
+func P90(in []schema.Point) float64 {
+	return percentile(in, 90)
+}
+
+func P99(in []schema.Point) float64 {
+	return percentile(in, 99)
+}
+
+func percentile(in []schema.Point, p float64) float64 {
+	vals := make([]float64, 0, len(in))
+	for _, term := range in {
+		if !math.IsNaN(term.Val) {
+			vals = append(vals, term.Val)
+		}
+	}
+	return Percentile(vals, p)
+}
+
+// Percentile returns the p-th percentile of the values, using the nearest-rank method. NaN if there are none.
+// note: it sorts the values in place.
+func Percentile(vals []float64, p float64) float64 {
+	if len(vals) == 0 {
+		return math.NaN()
+	}
+	sort.Float64s(vals)
+	rank := int(math.Ceil(p / 100 * float64(len(vals))))
+	if rank < 1 {
+		rank = 1
+	}
+	return vals[rank-1]
+}
@@ -0,0 +1,293 @@
+// mt-whisper-importer imports the data of whisper files into metrictank, using its backfill api.
+// metrictank adds the series to its index, and builds and saves the chunks of their data and rollups.
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/lomik/go-whisper"
+)
+
+var (
+	whisperDirectory = flag.String("whisper-directory", "/opt/graphite/storage/whisper", "directory to import the whisper files from. the names of the series are their paths relative to it")
+	httpEndpoint     = flag.String("http-endpoint", "http://127.0.0.1:6060/metrics/backfill", "backfill api of metrictank to send the data to")
+	orgId            = flag.Int("org-id", 1, "org to import the series into")
+	namePrefix       = flag.String("name-prefix", "", "prefix to prepend to the names of the series")
+	mtype            = flag.String("mtype", "gauge", "metric type of the series (gauge|rate|count|counter|timestamp)")
+	threads          = flag.Int("threads", 10, "number of files to import concurrently")
+	resumeFile       = flag.String("resume-file", "", "file to record the imported files in. files that are in it already are skipped, so that an interrupted import can be resumed. empty disables this")
+	httpTimeout      = flag.Duration("http-timeout", 5*time.Minute, "timeout for requests to metrictank")
+	importUntil      = flag.Int("import-until", 0, "unix timestamp until which to import the data (exclusive). must be before the chunks metrictank has in memory for the series, as the backfill api rejects data that overlaps with those. 0 means now")
+)
+
+// series is a series to backfill, as expected by the backfill api
+type series struct {
+	Name       string        `json:"name"`
+	Interval   int           `json:"interval"`
+	Mtype      string        `json:"mtype"`
+	Datapoints [][2]*float64 `json:"datapoints"`
+	Rollups    []rollup      `json:"rollups,omitempty"`
+}
+
+// rollup is an archive of a whisper file after the first one, as expected by the backfill api
+type rollup struct {
+	Span          int           `json:"span"`
+	ConsolidateBy string        `json:"consolidateBy"`
+	Datapoints    [][2]*float64 `json:"datapoints"`
+}
+
+type backfillResponse struct {
+	Chunks int `json:"chunks"`
+}
+
+// result is the outcome of the import of one file
+type result struct {
+	path   string
+	points int
+	chunks int
+	err    error
+}
+
+func main() {
+	flag.Usage = func() {
+		fmt.Fprintln(os.Stderr, "mt-whisper-importer")
+		fmt.Fprintln(os.Stderr)
+		fmt.Fprintln(os.Stderr, "Imports the whisper files of a directory tree into metrictank, using its backfill api.")
+		fmt.Fprintln(os.Stderr, "Each file is reported on a line, after which a summary is printed.")
+		fmt.Fprintln(os.Stderr)
+		fmt.Fprintln(os.Stderr, "Flags:")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	done := make(map[string]bool)
+	var resume *os.File
+	if *resumeFile != "" {
+		var err error
+		done, err = readResumeFile(*resumeFile)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "failed to read resume file: %s\n", err)
+			os.Exit(1)
+		}
+		resume, err = os.OpenFile(*resumeFile, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "failed to open resume file: %s\n", err)
+			os.Exit(1)
+		}
+		defer resume.Close()
+	}
+
+	client := &http.Client{Timeout: *httpTimeout}
+	paths := make(chan string, *threads)
+	results := make(chan result, *threads)
+	var wg sync.WaitGroup
+	for i := 0; i < *threads; i++ {
+		wg.Add(1)
+		go func() {
+			for path := range paths {
+				results <- importFile(client, path)
+			}
+			wg.Done()
+		}()
+	}
+	go func() {
+		err := filepath.Walk(*whisperDirectory, func(path string, info os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+			if info.IsDir() || !strings.HasSuffix(path, ".wsp") {
+				return nil
+			}
+			if done[path] {
+				fmt.Printf("%s: skipped, imported already\n", path)
+				return nil
+			}
+			paths <- path
+			return nil
+		})
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "failed to walk %s: %s\n", *whisperDirectory, err)
+		}
+		close(paths)
+		wg.Wait()
+		close(results)
+	}()
+
+	var imported, failed, points, chunks int
+	for r := range results {
+		if r.err != nil {
+			failed++
+			fmt.Printf("%s: failed: %s\n", r.path, r.err)
+			continue
+		}
+		imported++
+		points += r.points
+		chunks += r.chunks
+		fmt.Printf("%s: imported %d points in %d chunks\n", r.path, r.points, r.chunks)
+		if resume != nil {
+			fmt.Fprintln(resume, r.path)
+		}
+	}
+	fmt.Printf("imported %d files with %d points in %d chunks. %d files failed\n", imported, points, chunks, failed)
+	if failed > 0 {
+		os.Exit(2)
+	}
+}
+
+// readResumeFile returns the files listed in the resume file. it's fine if the file does not exist yet.
+func readResumeFile(path string) (map[string]bool, error) {
+	done := make(map[string]bool)
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return done, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		done[scanner.Text()] = true
+	}
+	return done, scanner.Err()
+}
+
+// seriesName returns the name of the series of a whisper file, which is its path relative to the whisper directory
+func seriesName(path string) string {
+	name := strings.TrimPrefix(path, *whisperDirectory)
+	name = strings.TrimPrefix(name, string(os.PathSeparator))
+	name = strings.TrimSuffix(name, ".wsp")
+	return *namePrefix + strings.Replace(name, string(os.PathSeparator), ".", -1)
+}
+
+func importFile(client *http.Client, path string) result {
+	r := result{path: path}
+	s, err := readFile(path)
+	if err != nil {
+		r.err = err
+		return r
+	}
+	r.points = len(s.Datapoints)
+	for _, ro := range s.Rollups {
+		r.points += len(ro.Datapoints)
+	}
+	if r.points == 0 {
+		return r
+	}
+	body, err := json.Marshal([]series{s})
+	if err != nil {
+		r.err = err
+		return r
+	}
+	req, err := http.NewRequest("POST", *httpEndpoint, bytes.NewReader(body))
+	if err != nil {
+		r.err = err
+		return r
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Org-Id", fmt.Sprintf("%d", *orgId))
+	resp, err := client.Do(req)
+	if err != nil {
+		r.err = err
+		return r
+	}
+	defer resp.Body.Close()
+	b, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		r.err = err
+		return r
+	}
+	if resp.StatusCode != http.StatusOK {
+		r.err = fmt.Errorf("metrictank returned %s: %s", resp.Status, strings.TrimSpace(string(b)))
+		return r
+	}
+	var br backfillResponse
+	err = json.Unmarshal(b, &br)
+	if err != nil {
+		r.err = err
+		return r
+	}
+	r.chunks = br.Chunks
+	return r
+}
+
+// readFile reads the data of a whisper file into a series: the first archive as its raw data, and the others as its rollups.
+// metrictank saves each rollup as its rollup archive with the same span, and builds the rollup archives that have no
+// matching whisper archive from the data with the highest resolution it has for each time range.
+func readFile(path string) (series, error) {
+	s := series{
+		Name:  seriesName(path),
+		Mtype: *mtype,
+	}
+	w, err := whisper.Open(path)
+	if err != nil {
+		return s, err
+	}
+	defer w.Close()
+
+	retentions := w.Retentions()
+	if len(retentions) == 0 {
+		return s, fmt.Errorf("no archives")
+	}
+	s.Interval = retentions[0].SecondsPerPoint()
+	consolidateBy := strings.ToLower(w.AggregationMethod())
+
+	now := int(time.Now().Unix())
+	until := now
+	if *importUntil != 0 && *importUntil < now {
+		until = *importUntil
+	}
+	for i, r := range retentions {
+		// Fetch picks the archive based on how far back we go. we start a bit later than the archive reaches,
+		// so that we get this archive rather than the next one, even if the clock ticks in the meantime.
+		from := now - r.MaxRetention() + r.SecondsPerPoint()
+		if from >= until {
+			continue
+		}
+		ts, err := w.Fetch(from, until)
+		if err != nil {
+			return s, err
+		}
+		if ts == nil {
+			continue
+		}
+		var datapoints [][2]*float64
+		for _, p := range ts.Points() {
+			if math.IsNaN(p.Value) {
+				continue
+			}
+			// whisper timestamps points at the start of their interval, metrictank rollups at the end of their span
+			val, t := p.Value, float64(p.Time)
+			if i > 0 {
+				t += float64(r.SecondsPerPoint())
+			}
+			// leave out the points that hold data from until onwards
+			if (i == 0 && int(t) >= until) || (i > 0 && int(t) > until) {
+				continue
+			}
+			datapoints = append(datapoints, [2]*float64{&val, &t})
+		}
+		if i == 0 {
+			s.Datapoints = datapoints
+			continue
+		}
+		s.Rollups = append(s.Rollups, rollup{
+			Span:          r.SecondsPerPoint(),
+			ConsolidateBy: consolidateBy,
+			Datapoints:    datapoints,
+		})
+	}
+	return s, nil
+}
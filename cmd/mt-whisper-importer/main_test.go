@@ -0,0 +1,121 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/lomik/go-whisper"
+)
+
+func TestReadFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mt-whisper-importer")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	*whisperDirectory = dir
+
+	retentions, err := whisper.ParseRetentionDefs("1m:1h,10m:1d")
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, "foo", "bar.wsp")
+	os.MkdirAll(filepath.Dir(path), 0755)
+	w, err := whisper.Create(path, retentions, whisper.Average, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// a point every minute for the last 3 hours
+	now := int(time.Now().Unix())
+	var points []*whisper.TimeSeriesPoint
+	for ts := now - 3*3600; ts < now; ts += 60 {
+		points = append(points, &whisper.TimeSeriesPoint{Time: ts, Value: 1})
+	}
+	err = w.UpdateMany(points)
+	w.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s, err := readFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.Name != "foo.bar" || s.Interval != 60 {
+		t.Fatalf("expected series foo.bar with interval 60, got %s with interval %d", s.Name, s.Interval)
+	}
+	// the last hour at minutely resolution, as the raw data
+	if len(s.Datapoints) < 55 || len(s.Datapoints) > 60 {
+		t.Fatalf("expected about 60 raw points, got %d", len(s.Datapoints))
+	}
+	// the 3 hours at 10 minutely resolution, as the rollup with a span of 10 minutes
+	if len(s.Rollups) != 1 || s.Rollups[0].Span != 600 || s.Rollups[0].ConsolidateBy != "average" {
+		t.Fatalf("expected the 10 minutely archive as an average rollup, got %+v", s.Rollups)
+	}
+	r := s.Rollups[0]
+	if len(r.Datapoints) < 17 || len(r.Datapoints) > 19 {
+		t.Fatalf("expected about 18 rollup points, got %d", len(r.Datapoints))
+	}
+	for _, dps := range [][][2]*float64{s.Datapoints, r.Datapoints} {
+		for i := 1; i < len(dps); i++ {
+			if *dps[i][1] <= *dps[i-1][1] {
+				t.Fatalf("expected points to be sorted by time, got %v after %v", *dps[i][1], *dps[i-1][1])
+			}
+		}
+	}
+	// rollups are timestamped at the end of their span
+	if first := int(*r.Datapoints[0][1]); first%600 != 0 || first > now-3*3600+1200 {
+		t.Fatalf("expected rollup points from 3 hours ago, at the end of their span. the first one is at %d", first)
+	}
+}
+
+func TestReadFileUntil(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mt-whisper-importer")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	*whisperDirectory = dir
+
+	retentions, err := whisper.ParseRetentionDefs("1m:1h,10m:1d")
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, "foo.wsp")
+	w, err := whisper.Create(path, retentions, whisper.Average, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := int(time.Now().Unix())
+	var points []*whisper.TimeSeriesPoint
+	for ts := now - 3*3600; ts < now; ts += 60 {
+		points = append(points, &whisper.TimeSeriesPoint{Time: ts, Value: 1})
+	}
+	err = w.UpdateMany(points)
+	w.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the live data of the last half hour is left out
+	until := now - 1800
+	*importUntil = until
+	defer func() { *importUntil = 0 }()
+	s, err := readFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(s.Datapoints) == 0 || len(s.Rollups) != 1 || len(s.Rollups[0].Datapoints) == 0 {
+		t.Fatalf("expected raw points and rollups from before %d, got %+v", until, s)
+	}
+	if last := int(*s.Datapoints[len(s.Datapoints)-1][1]); last >= until || last < until-120 {
+		t.Fatalf("expected the raw points to end right before %d, the last one is at %d", until, last)
+	}
+	r := s.Rollups[0].Datapoints
+	if last := int(*r[len(r)-1][1]); last > until || last <= until-600 {
+		t.Fatalf("expected the last rollup to end by %d, it ends at %d", until, last)
+	}
+}
@@ -21,6 +21,10 @@ const (
 	Min
 	Max
 	Sum
+	Lst
+	P50
+	P90
+	P99
 )
 
 // String provides human friendly names
@@ -38,6 +42,14 @@ func (c Consolidator) String() string {
 		return "MaximumConsolidator"
 	case Sum:
 		return "SumConsolidator"
+	case Lst:
+		return "LastConsolidator"
+	case P50:
+		return "P50Consolidator"
+	case P90:
+		return "P90Consolidator"
+	case P99:
+		return "P99Consolidator"
 	}
 	panic(fmt.Sprintf("Consolidator.String(): unknown consolidator %d", c))
 }
@@ -58,6 +70,14 @@ func (c Consolidator) Archive() string {
 		return "max"
 	case Sum:
 		return "sum"
+	case Lst:
+		return "lst"
+	case P50:
+		return "p50"
+	case P90:
+		return "p90"
+	case P99:
+		return "p99"
 	}
 	panic(fmt.Sprintf("Consolidator.Archive(): unknown consolidator %q", c))
 }
@@ -76,6 +96,14 @@ func GetAggFunc(consolidator Consolidator) batch.AggFunc {
 		consFunc = batch.Max
 	case Sum:
 		consFunc = batch.Sum
+	case Lst:
+		consFunc = batch.Lst
+	case P50:
+		consFunc = batch.P50
+	case P90:
+		consFunc = batch.P90
+	case P99:
+		consFunc = batch.P99
 	}
 	return consFunc
 }
@@ -89,6 +117,11 @@ func GetConsolidator(def *schema.MetricDefinition, pref string) (Consolidator, e
 			consolidateBy = "max"
 		}
 	}
+	return FromConsolidateBy(consolidateBy)
+}
+
+// FromConsolidateBy returns the consolidator for the given name, as used by the http api and the aggregations file
+func FromConsolidateBy(consolidateBy string) (Consolidator, error) {
 	var consolidator Consolidator
 	switch consolidateBy {
 	case "avg", "average":
@@ -99,6 +132,14 @@ func GetConsolidator(def *schema.MetricDefinition, pref string) (Consolidator, e
 		consolidator = Max
 	case "sum":
 		consolidator = Sum
+	case "last":
+		consolidator = Lst
+	case "p50":
+		consolidator = P50
+	case "p90":
+		consolidator = P90
+	case "p99":
+		consolidator = P99
 	default:
 		return consolidator, errUnknownConsolidationFunction
 	}
@@ -310,7 +310,17 @@ func aggMetricKey(key, archive string, aggSpan uint32) string {
 
 // getSeries just gets the needed raw iters from mem and/or cassandra, based on from/to
 // it can query for data within aggregated archives, by using fn min/max/sum/cnt and providing the matching agg span.
+// it panics if the store fails, see loadSeries for a version that returns the error.
 func getSeries(store mdata.Store, key string, consolidator consolidation.Consolidator, aggSpan, fromUnix, toUnix uint32) []schema.Point {
+	points, err := loadSeries(store, key, consolidator, aggSpan, fromUnix, toUnix)
+	if err != nil {
+		panic(err)
+	}
+	return points
+}
+
+// loadSeries is like getSeries, but returns the error if the store fails
+func loadSeries(store mdata.Store, key string, consolidator consolidation.Consolidator, aggSpan, fromUnix, toUnix uint32) ([]schema.Point, error) {
 	iters := make([]iter.Iter, 0)
 	memIters := make([]iter.Iter, 0)
 	oldest := toUnix
@@ -334,7 +344,7 @@ func getSeries(store mdata.Store, key string, consolidator consolidation.Consoli
 		logLoad("cassan", key, fromUnix, until)
 		storeIters, err := store.Search(key, fromUnix, until)
 		if err != nil {
-			panic(err)
+			return nil, err
 		}
 		iters = append(iters, storeIters...)
 	} else {
@@ -364,7 +374,7 @@ func getSeries(store mdata.Store, key string, consolidator consolidation.Consoli
 		}
 	}
 	itersToPointsDuration.Value(time.Now().Sub(pre))
-	return points
+	return points, nil
 }
 
 // check for duplicate series names. If found merge the results.
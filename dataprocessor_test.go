@@ -179,6 +179,60 @@ func TestConsolidationFunctions(t *testing.T) {
 				{7, 1449178161},
 			},
 		},
+		{
+			[]schema.Point{
+				{1, 1449178131},
+				{2, 1449178141},
+				{3, 1449178151},
+				{math.NaN(), 1449178161},
+			},
+			consolidation.Lst,
+			2,
+			[]schema.Point{
+				{2, 1449178141},
+				{3, 1449178161},
+			},
+		},
+		{
+			[]schema.Point{
+				{1, 1449178131},
+				{2, 1449178141},
+				{3, 1449178151},
+				{4, 1449178161},
+				{5, 1449178171},
+				{6, 1449178181},
+				{7, 1449178191},
+				{8, 1449178201},
+				{9, 1449178211},
+				{10, 1449178221},
+			},
+			consolidation.P50,
+			5,
+			[]schema.Point{
+				{3, 1449178171},
+				{8, 1449178221},
+			},
+		},
+		{
+			[]schema.Point{
+				{1, 1449178131},
+				{2, 1449178141},
+				{3, 1449178151},
+				{4, 1449178161},
+				{5, 1449178171},
+				{6, 1449178181},
+				{7, 1449178191},
+				{8, 1449178201},
+				{9, 1449178211},
+				{10, 1449178221},
+			},
+			consolidation.P90,
+			5,
+			[]schema.Point{
+				{5, 1449178171},
+				{10, 1449178221},
+			},
+		},
 	}
 	validate(cases, t)
 }
@@ -413,7 +467,28 @@ func reqOut(key string, from, to, maxPoints, rawInterval uint32, consolidator co
 	return req
 }
 
+func reqSchema(req Req, schema *mdata.Schema) Req {
+	req.schema = schema
+	return req
+}
+
+func reqAggRule(req Req, aggRule *mdata.AggRule) Req {
+	req.aggRule = aggRule
+	return req
+}
+
 func TestAlignRequests(t *testing.T) {
+	sumOnly := &mdata.AggRule{Name: "sum", Methods: []consolidation.Consolidator{consolidation.Sum}}
+	// series may have their own aggSettings, via the schema they match
+	schemaA := &mdata.Schema{Name: "a", AggSettings: []mdata.AggSetting{
+		{60, 600, 2, 0, true},
+		{600, 21600, 1, 0, true},
+		{7200, 21600, 1, 0, true},
+	}}
+	schemaB := &mdata.Schema{Name: "b", AggSettings: []mdata.AggSetting{
+		{600, 21600, 1, 0, true},
+		{7200, 21600, 1, 0, true},
+	}}
 	input := []alignCase{
 		{
 			// real example seen with alerting queries
@@ -840,6 +915,53 @@ func TestAlignRequests(t *testing.T) {
 			},
 			nil,
 		},
+		// a month of data, for series with different rollups. a and b have schemas, c uses the default aggSettings.
+		// only the 600 and 7200 rollups are common to all, and the archive index of the 7200 one differs per series.
+		// raw 3600*24*30/10 -> 259200, 600 -> 4320, 7200 -> 360
+		{
+			[]Req{
+				reqSchema(reqRaw("a", 0, 3600*24*30, 1000, 10, consolidation.Avg), schemaA),
+				reqSchema(reqRaw("b", 0, 3600*24*30, 1000, 10, consolidation.Avg), schemaB),
+				reqRaw("c", 0, 3600*24*30, 1000, 10, consolidation.Avg),
+			},
+			[]mdata.AggSetting{
+				{7200, 21600, 1, 0, true},
+				{600, 21600, 1, 0, true},
+			},
+			[]Req{
+				reqSchema(reqOut("a", 0, 3600*24*30, 1000, 10, consolidation.Avg, 3, 7200, 7200, 1), schemaA),
+				reqSchema(reqOut("b", 0, 3600*24*30, 1000, 10, consolidation.Avg, 2, 7200, 7200, 1), schemaB),
+				reqOut("c", 0, 3600*24*30, 1000, 10, consolidation.Avg, 2, 7200, 7200, 1),
+			},
+			nil,
+		},
+		// same, but b only has the sum rollups, so we can't use rollups to get its average
+		// raw 3600*24*30/10 -> 259200 -> aggNum 260 to stay under 1000 points
+		{
+			[]Req{
+				reqSchema(reqRaw("a", 0, 3600*24*30, 1000, 10, consolidation.Avg), schemaA),
+				reqAggRule(reqSchema(reqRaw("b", 0, 3600*24*30, 1000, 10, consolidation.Avg), schemaB), sumOnly),
+			},
+			[]mdata.AggSetting{},
+			[]Req{
+				reqSchema(reqOut("a", 0, 3600*24*30, 1000, 10, consolidation.Avg, 0, 10, 2600, 260), schemaA),
+				reqAggRule(reqSchema(reqOut("b", 0, 3600*24*30, 1000, 10, consolidation.Avg, 0, 10, 2600, 260), schemaB), sumOnly),
+			},
+			nil,
+		},
+		// but we can for its sum
+		{
+			[]Req{
+				reqSchema(reqRaw("a", 0, 3600*24*30, 1000, 10, consolidation.Sum), schemaA),
+				reqAggRule(reqSchema(reqRaw("b", 0, 3600*24*30, 1000, 10, consolidation.Sum), schemaB), sumOnly),
+			},
+			[]mdata.AggSetting{},
+			[]Req{
+				reqSchema(reqOut("a", 0, 3600*24*30, 1000, 10, consolidation.Sum, 3, 7200, 7200, 1), schemaA),
+				reqAggRule(reqSchema(reqOut("b", 0, 3600*24*30, 1000, 10, consolidation.Sum, 2, 7200, 7200, 1), schemaB), sumOnly),
+			},
+			nil,
+		},
 	}
 	for i, ac := range input {
 		out, err := alignRequests(ac.reqs, ac.aggSettings)
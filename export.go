@@ -0,0 +1,268 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/raintank/dur"
+	"github.com/raintank/metrictank/consolidation"
+	"github.com/raintank/metrictank/idx"
+	"github.com/raintank/metrictank/mdata"
+	"github.com/raintank/metrictank/mdata/chunk"
+	"github.com/raintank/worldping-api/pkg/log"
+	"gopkg.in/raintank/schema.v1"
+)
+
+var errExportBadCursor = errors.New("invalid parameter `cursor`")
+
+// exportCursor is the position at which an export continues: the index of the series in the request, and the timestamp within it
+type exportCursor struct {
+	series int
+	ts     uint32
+}
+
+func parseExportCursor(s string) (exportCursor, error) {
+	parts := strings.Split(s, ":")
+	if len(parts) != 2 {
+		return exportCursor{}, errExportBadCursor
+	}
+	series, err := strconv.Atoi(parts[0])
+	if err != nil || series < 0 {
+		return exportCursor{}, errExportBadCursor
+	}
+	ts, err := strconv.ParseUint(parts[1], 10, 32)
+	if err != nil {
+		return exportCursor{}, errExportBadCursor
+	}
+	return exportCursor{series, uint32(ts)}, nil
+}
+
+func (c exportCursor) String() string {
+	return fmt.Sprintf("%d:%d", c.series, c.ts)
+}
+
+// Export streams the raw data of the given series: either their points, or their chunks as encoded in the store.
+// unlike the query apis, the data is never consolidated. instead, the output is paginated:
+// each response holds up to `limit` points or chunks, and a cursor to request the next page with.
+// if loading the data fails once the response is underway, it ends early, with the error and a cursor to retry from.
+func Export(metricIndex idx.MetricIndex, store mdata.Store) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		org, err := getOrg(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		r.ParseForm()
+
+		ids := r.Form["id"]
+		if len(ids) == 0 {
+			http.Error(w, "missing parameter `id`", http.StatusBadRequest)
+			return
+		}
+		defs := make([]schema.MetricDefinition, len(ids))
+		for i, id := range ids {
+			def, err := metricIndex.Get(id)
+			if err != nil || (def.OrgId != org && def.OrgId != -1) {
+				http.Error(w, fmt.Sprintf("unknown series %s", id), http.StatusNotFound)
+				return
+			}
+			defs[i] = def
+		}
+
+		format := r.Form.Get("format")
+		if format == "" {
+			format = "points"
+		}
+		if format != "points" && format != "chunks" {
+			http.Error(w, "invalid parameter `format`", http.StatusBadRequest)
+			return
+		}
+
+		limit := 10000
+		if r.Form.Get("limit") != "" {
+			limit, err = strconv.Atoi(r.Form.Get("limit"))
+			if err != nil || limit <= 0 {
+				http.Error(w, "invalid parameter `limit`", http.StatusBadRequest)
+				return
+			}
+		}
+
+		now := time.Now()
+		defaultFrom := uint32(now.Add(-time.Duration(24) * time.Hour).Unix())
+		defaultTo := uint32(now.Add(time.Duration(1) * time.Second).Unix())
+		fromUnix, err := dur.ParseTSpec(r.Form.Get("from"), now, defaultFrom)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		toUnix, err := dur.ParseTSpec(r.Form.Get("to"), now, defaultTo)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if fromUnix >= toUnix {
+			http.Error(w, "to must be higher than from", http.StatusBadRequest)
+			return
+		}
+
+		cursor := exportCursor{0, fromUnix}
+		if r.Form.Get("cursor") != "" {
+			cursor, err = parseExportCursor(r.Form.Get("cursor"))
+			if err != nil || cursor.series >= len(defs) {
+				http.Error(w, errExportBadCursor.Error(), http.StatusBadRequest)
+				return
+			}
+			if cursor.ts < fromUnix {
+				cursor.ts = fromUnix
+			}
+		}
+
+		w.Header().Set("Content-Type", contentTypeJSON)
+		w.Write([]byte(`{"series":[`))
+		flusher, _ := w.(http.Flusher)
+		var next *exportCursor
+		var exportErr error
+		written := 0
+		for i := cursor.series; i < len(defs) && limit > 0; i++ {
+			start := fromUnix
+			if i == cursor.series {
+				start = cursor.ts
+			}
+			if start >= toUnix {
+				continue
+			}
+			var b []byte
+			var n int
+			if format == "points" {
+				b, n, next, err = exportPoints(store, defs[i], i, start, toUnix, limit)
+			} else {
+				b, n, next, err = exportChunks(defs[i], i, start, toUnix, limit)
+			}
+			if err != nil {
+				// the response is underway, so all we can do is cut it short
+				log.Error(3, "failed to export %s of %s. %s", format, defs[i].Id, err)
+				exportErr = err
+				next = &exportCursor{i, start}
+				break
+			}
+			if written > 0 {
+				w.Write([]byte{','})
+			}
+			w.Write(b)
+			written++
+			if flusher != nil {
+				flusher.Flush()
+			}
+			limit -= n
+			if next == nil && limit == 0 && i+1 < len(defs) {
+				next = &exportCursor{i + 1, fromUnix}
+			}
+		}
+		w.Write([]byte(`],"next":`))
+		if next == nil {
+			w.Write([]byte(`null`))
+		} else {
+			w.Write([]byte(`"` + next.String() + `"`))
+		}
+		if exportErr != nil {
+			msg, _ := json.Marshal(exportErr.Error())
+			w.Write([]byte(`,"error":`))
+			w.Write(msg)
+		}
+		w.Write([]byte{'}'})
+	}
+}
+
+// exportPoints returns the json of the series with up to limit of its points from start until end, the number of points,
+// and the cursor to continue at if there are more.
+// rather than loading all points of the range, it loads a chunkspan at a time, until it has more than limit.
+func exportPoints(store mdata.Store, def schema.MetricDefinition, i int, start, end uint32, limit int) ([]byte, int, *exportCursor, error) {
+	span := metrics.ChunkSpan()
+	points := make([]schema.Point, 0)
+	for from := start; from < end && len(points) <= limit; {
+		to := from - from%span + span
+		if to > end {
+			to = end
+		}
+		window, err := loadSeries(store, def.Id, consolidation.None, 0, from, to)
+		if err != nil {
+			return nil, 0, nil, err
+		}
+		points = append(points, window...)
+		pointSlicePool.Put(window[:0])
+		from = to
+	}
+	var next *exportCursor
+	if len(points) > limit {
+		next = &exportCursor{i, points[limit].Ts}
+		points = points[:limit]
+	}
+	b := exportSeriesHeader(def)
+	b = append(b, `"points":[`...)
+	for _, p := range points {
+		b = append(b, '[')
+		if math.IsNaN(p.Val) {
+			b = append(b, `null`...)
+		} else {
+			b = strconv.AppendFloat(b, p.Val, 'f', -1, 64)
+		}
+		b = append(b, ',')
+		b = strconv.AppendUint(b, uint64(p.Ts), 10)
+		b = append(b, `],`...)
+	}
+	if len(points) != 0 {
+		b = b[:len(b)-1] // cut last comma
+	}
+	b = append(b, `]}`...)
+	return b, len(points), next, nil
+}
+
+// exportChunks returns the json of the series with up to limit of its chunks holding data from start until end, the number of chunks,
+// and the cursor to continue at if there are more. the data of the chunks is base64 encoded, and starts with the byte of its chunk.Format
+func exportChunks(def schema.MetricDefinition, i int, start, end uint32, limit int) ([]byte, int, *exportCursor, error) {
+	igs, err := metrics.ExportChunks(def.Id, start, end)
+	if err != nil {
+		return nil, 0, nil, err
+	}
+	var next *exportCursor
+	if len(igs) > limit {
+		next = &exportCursor{i, igs[limit].T0}
+		igs = igs[:limit]
+	}
+	b := exportSeriesHeader(def)
+	b = append(b, `"chunks":[`...)
+	for _, ig := range igs {
+		b = append(b, `{"t0":`...)
+		b = strconv.AppendUint(b, uint64(ig.T0), 10)
+		b = append(b, `,"format":`...)
+		b = strconv.AppendUint(b, uint64(chunk.Format(ig.B[0])), 10)
+		b = append(b, `,"data":"`...)
+		b = append(b, base64.StdEncoding.EncodeToString(ig.B)...)
+		b = append(b, `"},`...)
+	}
+	if len(igs) != 0 {
+		b = b[:len(b)-1] // cut last comma
+	}
+	b = append(b, `]}`...)
+	return b, len(igs), next, nil
+}
+
+func exportSeriesHeader(def schema.MetricDefinition) []byte {
+	id, _ := json.Marshal(def.Id)
+	name, _ := json.Marshal(def.Name)
+	b := []byte(`{"id":`)
+	b = append(b, id...)
+	b = append(b, `,"name":`...)
+	b = append(b, name...)
+	b = append(b, `,"interval":`...)
+	b = strconv.AppendInt(b, int64(def.Interval), 10)
+	b = append(b, ',')
+	return b
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/raintank/met/helper"
+	"github.com/raintank/metrictank/idx/memory"
+	"github.com/raintank/metrictank/iter"
+	"github.com/raintank/metrictank/mdata"
+	"github.com/raintank/metrictank/mdata/chunk"
+	"gopkg.in/raintank/schema.v1"
+)
+
+// failingStore fails to load chunks
+type failingStore struct {
+	mdata.Store
+}
+
+func (f failingStore) Search(key string, start, end uint32) ([]iter.Iter, error) {
+	return nil, errors.New("store unavailable")
+}
+
+func (f failingStore) SearchChunks(key string, start, end uint32) ([]chunk.IterGen, error) {
+	return nil, errors.New("store unavailable")
+}
+
+type exportResponse struct {
+	Series []struct {
+		Id     string
+		Points [][2]float64
+		Chunks []struct {
+			T0     uint32
+			Format chunk.Format
+			Data   string
+		}
+	}
+	Next  *string
+	Error string
+}
+
+func TestExport(t *testing.T) {
+	stats, _ := helper.New(false, "", "standard", "metrictank", "")
+	mdata.CluStatus = mdata.NewClusterStatus("default", true)
+	mdata.InitMetrics(stats)
+	initMetrics(stats)
+
+	store := mdata.NewDevnullStore()
+	metrics = mdata.NewAggMetrics(store, 600, 10, 800, 8000, 10000, 0, 0, nil, nil, nil)
+	metricIndex := memory.New()
+	metricIndex.Init(stats)
+
+	var ids []string
+	for _, name := range []string{"a.b", "a.c"} {
+		data := &schema.MetricData{OrgId: 1, Name: name, Metric: name, Interval: 10, Time: 100, Mtype: "gauge"}
+		data.SetId()
+		metricIndex.Add(data)
+		m := metrics.GetOrCreate(data.Id, data.Name)
+		// 3 chunks of 60 points each
+		for ts := uint32(1200); ts < 3000; ts += 10 {
+			m.Add(ts, float64(ts))
+		}
+		ids = append(ids, data.Id)
+	}
+
+	var exportStore mdata.Store = store
+	export := func(format, limit, cursor string) exportResponse {
+		form := url.Values{"id": ids, "from": {"1000"}, "to": {"3000"}, "format": {format}, "limit": {limit}, "cursor": {cursor}}
+		req, _ := http.NewRequest("GET", "/export?"+form.Encode(), nil)
+		req.Header.Set("x-org-id", "1")
+		w := httptest.NewRecorder()
+		Export(metricIndex, exportStore)(w, req)
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected status 200, got %d: %s", w.Code, w.Body.String())
+		}
+		var resp exportResponse
+		if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+			t.Fatalf("failed to decode %s: %s", w.Body.String(), err)
+		}
+		return resp
+	}
+
+	// page through all points, 70 at a time
+	points := make(map[string][][2]float64)
+	cursor := ""
+	for pages := 1; ; pages++ {
+		resp := export("points", "70", cursor)
+		for _, s := range resp.Series {
+			points[s.Id] = append(points[s.Id], s.Points...)
+		}
+		if resp.Next == nil {
+			if pages != 6 {
+				t.Fatalf("expected 360 points to take 6 pages, got %d", pages)
+			}
+			break
+		}
+		cursor = *resp.Next
+	}
+	for _, id := range ids {
+		if len(points[id]) != 180 {
+			t.Fatalf("expected 180 points for %s, got %d", id, len(points[id]))
+		}
+		for i, p := range points[id] {
+			if ts := float64(1200 + 10*i); p[0] != ts || p[1] != ts {
+				t.Fatalf("expected point %d of %s to be %f@%f, got %f@%f", i, id, ts, ts, p[0], p[1])
+			}
+		}
+	}
+
+	resp := export("chunks", "2", "")
+	if len(resp.Series) != 1 || len(resp.Series[0].Chunks) != 2 || resp.Next == nil || *resp.Next != "0:2400" {
+		t.Fatalf("expected the first 2 chunks of the first series and a cursor to the third, got %v", resp)
+	}
+	c := resp.Series[0].Chunks[1]
+	data, err := base64.StdEncoding.DecodeString(c.Data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.T0 != 1800 || c.Format != chunk.FormatStandardGoTsz || data[0] != byte(c.Format) {
+		t.Fatalf("expected a tsz chunk at 1800, got %v", c)
+	}
+	it, err := chunk.NewIterator(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	num := 0
+	for it.Next() {
+		num++
+	}
+	if num != 60 {
+		t.Fatalf("expected 60 points in the chunk, got %d", num)
+	}
+
+	// without the data in memory, it's loaded from the store. failing to do so ends the response early, but valid
+	exportStore = failingStore{store}
+	metrics = mdata.NewAggMetrics(exportStore, 600, 10, 800, 8000, 10000, 0, 0, nil, nil, nil)
+	for _, format := range []string{"points", "chunks"} {
+		resp = export(format, "10", "1:1000")
+		if len(resp.Series) != 0 || resp.Next == nil || *resp.Next != "1:1000" || resp.Error != "store unavailable" {
+			t.Fatalf("expected the %s export to end with the error and a cursor to retry from, got %v", format, resp)
+		}
+	}
+
+	req, _ := http.NewRequest("GET", "/export?id="+ids[0], nil)
+	req.Header.Set("x-org-id", "2")
+	w := httptest.NewRecorder()
+	Export(metricIndex, store)(w, req)
+	if w.Code != http.StatusNotFound {
+		t.Fatalf("expected series of other orgs to be not found, got %d", w.Code)
+	}
+}
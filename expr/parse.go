@@ -0,0 +1,175 @@
+// Package expr parses graphite target expressions such as
+// sumSeries(scale(foo.*.bar, 2), consolidateBy(baz.{a,b}, 'max'))
+package expr
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+var (
+	ErrMissingExpr    = errors.New("missing expression")
+	ErrMissingParen   = errors.New("missing closing parenthesis")
+	ErrMissingQuote   = errors.New("missing quote")
+	ErrUnexpectedChar = errors.New("unexpected character")
+)
+
+type ExprType int
+
+const (
+	EtName   ExprType = iota // a metric name or pattern, like foo.*.bar
+	EtFunc                   // a function call, like sumSeries(...)
+	EtFloat                  // a numeric literal
+	EtString                 // a quoted string literal
+	EtBool                   // true or false
+)
+
+func (t ExprType) String() string {
+	switch t {
+	case EtName:
+		return "name"
+	case EtFunc:
+		return "func"
+	case EtFloat:
+		return "float"
+	case EtString:
+		return "string"
+	case EtBool:
+		return "bool"
+	}
+	return fmt.Sprintf("ExprType(%d)", int(t))
+}
+
+// Expr is a node in the parse tree of a target expression
+type Expr struct {
+	Type    ExprType
+	Str     string  // the name (EtName), function name (EtFunc) or unquoted string literal (EtString)
+	Float   float64 // value of EtFloat
+	Bool    bool    // value of EtBool
+	Args    []*Expr // arguments of EtFunc
+	ArgsStr string  // arguments of EtFunc as they were written, used for naming output series like graphite does
+}
+
+func (e *Expr) String() string {
+	switch e.Type {
+	case EtName:
+		return e.Str
+	case EtFunc:
+		return fmt.Sprintf("%s(%s)", e.Str, e.ArgsStr)
+	case EtFloat:
+		return strconv.FormatFloat(e.Float, 'f', -1, 64)
+	case EtString:
+		return fmt.Sprintf("'%s'", e.Str)
+	case EtBool:
+		return strconv.FormatBool(e.Bool)
+	}
+	return fmt.Sprintf("unknown expr type %d", e.Type)
+}
+
+// Parse parses a complete target expression
+func Parse(s string) (*Expr, error) {
+	e, rest, err := parse(s)
+	if err != nil {
+		return nil, err
+	}
+	rest = strings.TrimSpace(rest)
+	if rest != "" {
+		return nil, fmt.Errorf("%s: %q after expression", ErrUnexpectedChar, rest)
+	}
+	return e, nil
+}
+
+// parse parses the first expression in s and returns it along with the remaining, unparsed input
+func parse(s string) (*Expr, string, error) {
+	s = strings.TrimSpace(s)
+	if s == "" {
+		return nil, "", ErrMissingExpr
+	}
+
+	if s[0] == '\'' || s[0] == '"' {
+		return parseString(s)
+	}
+
+	token, rest := parseToken(s)
+	if token == "" {
+		return nil, "", fmt.Errorf("%s: %q", ErrUnexpectedChar, s[0])
+	}
+
+	if rest != "" && rest[0] == '(' {
+		return parseCall(token, rest)
+	}
+
+	if strings.ContainsAny(token[:1], "0123456789.+-") {
+		if f, err := strconv.ParseFloat(token, 64); err == nil {
+			return &Expr{Type: EtFloat, Float: f}, rest, nil
+		}
+	}
+	if token == "true" || token == "false" {
+		return &Expr{Type: EtBool, Bool: token == "true"}, rest, nil
+	}
+	return &Expr{Type: EtName, Str: token}, rest, nil
+}
+
+// parseToken reads a bare token: a name, a number or a function name.
+// commas within {} belong to the token, as in foo.{bar,baz}
+func parseToken(s string) (string, string) {
+	braces := 0
+	for i := 0; i < len(s); i++ {
+		switch s[i] {
+		case '{':
+			braces++
+		case '}':
+			braces--
+		case ',':
+			if braces == 0 {
+				return s[:i], s[i:]
+			}
+		case '(', ')', ' ', '\t', '\'', '"':
+			if braces == 0 {
+				return s[:i], s[i:]
+			}
+		}
+	}
+	return s, ""
+}
+
+// parseString reads a string literal delimited by either single or double quotes
+func parseString(s string) (*Expr, string, error) {
+	quote := s[0]
+	end := strings.IndexByte(s[1:], quote)
+	if end == -1 {
+		return nil, "", ErrMissingQuote
+	}
+	return &Expr{Type: EtString, Str: s[1 : end+1]}, s[end+2:], nil
+}
+
+// parseCall reads the arguments of the function call to name. s starts at the opening paren.
+func parseCall(name, s string) (*Expr, string, error) {
+	e := &Expr{Type: EtFunc, Str: name}
+	argsStart := s[1:]
+	s = strings.TrimSpace(argsStart)
+	if s != "" && s[0] == ')' {
+		return e, s[1:], nil
+	}
+	for {
+		arg, rest, err := parse(s)
+		if err != nil {
+			return nil, "", err
+		}
+		e.Args = append(e.Args, arg)
+		rest = strings.TrimSpace(rest)
+		if rest == "" {
+			return nil, "", ErrMissingParen
+		}
+		if rest[0] == ')' {
+			e.ArgsStr = strings.TrimSpace(argsStart[:len(argsStart)-len(rest)])
+			return e, rest[1:], nil
+		}
+		if rest[0] != ',' {
+			return nil, "", fmt.Errorf("%s: %q in arguments of %s", ErrUnexpectedChar, rest[0], name)
+		}
+		s = rest[1:]
+	}
+}
@@ -0,0 +1,89 @@
+package expr
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParse(t *testing.T) {
+	cases := []struct {
+		in  string
+		out *Expr
+	}{
+		{
+			"foo.bar",
+			&Expr{Type: EtName, Str: "foo.bar"},
+		},
+		{
+			" foo.*.b[ae]r.{a,b} ",
+			&Expr{Type: EtName, Str: "foo.*.b[ae]r.{a,b}"},
+		},
+		{
+			"sumSeries(foo.*)",
+			&Expr{Type: EtFunc, Str: "sumSeries", ArgsStr: "foo.*", Args: []*Expr{
+				{Type: EtName, Str: "foo.*"},
+			}},
+		},
+		{
+			"sumSeries()",
+			&Expr{Type: EtFunc, Str: "sumSeries"},
+		},
+		{
+			"consolidateBy(foo.{a,b}, 'sum')",
+			&Expr{Type: EtFunc, Str: "consolidateBy", ArgsStr: "foo.{a,b}, 'sum'", Args: []*Expr{
+				{Type: EtName, Str: "foo.{a,b}"},
+				{Type: EtString, Str: "sum"},
+			}},
+		},
+		{
+			`alias(scale(foo, -2.5),"my, alias")`,
+			&Expr{Type: EtFunc, Str: "alias", ArgsStr: `scale(foo, -2.5),"my, alias"`, Args: []*Expr{
+				{Type: EtFunc, Str: "scale", ArgsStr: "foo, -2.5", Args: []*Expr{
+					{Type: EtName, Str: "foo"},
+					{Type: EtFloat, Float: -2.5},
+				}},
+				{Type: EtString, Str: "my, alias"},
+			}},
+		},
+		{
+			"aliasByNode(1min.load, 0, 1)",
+			&Expr{Type: EtFunc, Str: "aliasByNode", ArgsStr: "1min.load, 0, 1", Args: []*Expr{
+				{Type: EtName, Str: "1min.load"},
+				{Type: EtFloat, Float: 0},
+				{Type: EtFloat, Float: 1},
+			}},
+		},
+		{
+			"foo(true)",
+			&Expr{Type: EtFunc, Str: "foo", ArgsStr: "true", Args: []*Expr{
+				{Type: EtBool, Bool: true},
+			}},
+		},
+	}
+	for i, c := range cases {
+		e, err := Parse(c.in)
+		if err != nil {
+			t.Fatalf("case %d: %q: unexpected error %s", i, c.in, err)
+		}
+		if !reflect.DeepEqual(e, c.out) {
+			t.Fatalf("case %d: %q: expected %#v, got %#v", i, c.in, c.out, e)
+		}
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	cases := []string{
+		"",
+		"sumSeries(foo",
+		"sumSeries(foo,",
+		"alias(foo, 'bar)",
+		"foo bar",
+		"sumSeries(foo bar)",
+		"sumSeries(,foo)",
+	}
+	for i, c := range cases {
+		if _, err := Parse(c); err == nil {
+			t.Fatalf("case %d: %q: expected an error, got none", i, c)
+		}
+	}
+}
@@ -0,0 +1,393 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/raintank/metrictank/batch"
+	"github.com/raintank/metrictank/expr"
+	"gopkg.in/raintank/schema.v1"
+)
+
+var (
+	errUnknownFunction = errors.New("unknown function")
+	errSeriesLenDiff   = errors.New("series have different lengths, cannot combine them")
+)
+
+// the kinds of arguments graphite functions take
+type argKind int
+
+const (
+	argSeries argKind = iota // a name/pattern or a nested function call, yielding a list of series
+	argFloat
+	argInt
+	argString
+)
+
+func (a argKind) String() string {
+	switch a {
+	case argSeries:
+		return "series"
+	case argFloat:
+		return "float"
+	case argInt:
+		return "int"
+	case argString:
+		return "string"
+	}
+	return fmt.Sprintf("argKind(%d)", int(a))
+}
+
+// graphiteFunc describes a graphite function: its signature and its implementation
+type graphiteFunc struct {
+	args     []argKind
+	optional int  // how many of the trailing args may be omitted
+	variadic bool // whether the last arg may be repeated
+	// fn is called with the expression of the function call (to get at its non-series args)
+	// and a list of series for each series argument.
+	// functions without fn, like seriesByTag, are leaves: their series are resolved via the index.
+	fn func(e *expr.Expr, in [][]Series) ([]Series, error)
+}
+
+var funcs map[string]graphiteFunc
+
+func init() {
+	funcs = map[string]graphiteFunc{
+		"alias":                 {args: []argKind{argSeries, argString}, fn: alias},
+		"aliasByNode":           {args: []argKind{argSeries, argInt}, variadic: true, fn: aliasByNode},
+		"aliasSub":              {args: []argKind{argSeries, argString, argString}, fn: aliasSub},
+		"consolidateBy":         {args: []argKind{argSeries, argString}, fn: consolidateBy},
+		"sumSeries":             {args: []argKind{argSeries}, variadic: true, fn: combine("sumSeries", batch.Sum)},
+		"sum":                   {args: []argKind{argSeries}, variadic: true, fn: combine("sumSeries", batch.Sum)},
+		"averageSeries":         {args: []argKind{argSeries}, variadic: true, fn: combine("averageSeries", batch.Avg)},
+		"avg":                   {args: []argKind{argSeries}, variadic: true, fn: combine("averageSeries", batch.Avg)},
+		"minSeries":             {args: []argKind{argSeries}, variadic: true, fn: combine("minSeries", batch.Min)},
+		"maxSeries":             {args: []argKind{argSeries}, variadic: true, fn: combine("maxSeries", batch.Max)},
+		"diffSeries":            {args: []argKind{argSeries}, variadic: true, fn: combine("diffSeries", diff)},
+		"multiplySeries":        {args: []argKind{argSeries}, variadic: true, fn: combine("multiplySeries", multiply)},
+		"divideSeries":          {args: []argKind{argSeries, argSeries}, fn: divideSeries},
+		"scale":                 {args: []argKind{argSeries, argFloat}, fn: scale},
+		"offset":                {args: []argKind{argSeries, argFloat}, fn: offset},
+		"absolute":              {args: []argKind{argSeries}, fn: absolute},
+		"derivative":            {args: []argKind{argSeries}, fn: derivative},
+		"nonNegativeDerivative": {args: []argKind{argSeries, argFloat}, optional: 1, fn: nonNegativeDerivative},
+		"perSecond":             {args: []argKind{argSeries, argFloat}, optional: 1, fn: perSecond},
+		"integral":              {args: []argKind{argSeries}, fn: integral},
+		"seriesByTag":           {args: []argKind{argString}, variadic: true},
+	}
+}
+
+// validateCall checks whether the function called in e exists and whether it was given the right arguments
+func validateCall(e *expr.Expr) (graphiteFunc, error) {
+	f, ok := funcs[e.Str]
+	if !ok {
+		return f, fmt.Errorf("%s %q", errUnknownFunction, e.Str)
+	}
+	if len(e.Args) < len(f.args)-f.optional || (!f.variadic && len(e.Args) > len(f.args)) {
+		return f, fmt.Errorf("%s: expected %d arguments, got %d", e.Str, len(f.args), len(e.Args))
+	}
+	for i, arg := range e.Args {
+		kind := f.args[len(f.args)-1]
+		if i < len(f.args) {
+			kind = f.args[i]
+		}
+		var ok bool
+		switch kind {
+		case argSeries:
+			ok = arg.Type == expr.EtName || arg.Type == expr.EtFunc
+		case argFloat:
+			ok = arg.Type == expr.EtFloat
+		case argInt:
+			ok = arg.Type == expr.EtFloat && arg.Float == math.Floor(arg.Float)
+		case argString:
+			ok = arg.Type == expr.EtString
+		}
+		if !ok {
+			return f, fmt.Errorf("%s: argument %d must be a %s, not %s", e.Str, i+1, kind, arg)
+		}
+	}
+	return f, nil
+}
+
+// evalExpr computes the output series of the expression, given the series that its leaves (names/patterns)
+// resolved to and were fetched as.
+// consolidateBy is the consolidation function set by an enclosing consolidateBy() call, if any.
+func evalExpr(e *expr.Expr, consolidateBy string, data map[leaf][]Series) ([]Series, error) {
+	if e.Type == expr.EtName {
+		return data[leaf{pattern: e.Str, consolidateBy: consolidateBy}], nil
+	}
+	f, err := validateCall(e)
+	if err != nil {
+		return nil, err
+	}
+	if f.fn == nil {
+		return data[leaf{pattern: e.String(), byTag: true, consolidateBy: consolidateBy}], nil
+	}
+	if e.Str == "consolidateBy" {
+		consolidateBy = e.Args[1].Str
+	}
+	in := make([][]Series, 0, len(e.Args))
+	for _, arg := range e.Args {
+		if arg.Type != expr.EtName && arg.Type != expr.EtFunc {
+			continue
+		}
+		series, err := evalExpr(arg, consolidateBy, data)
+		if err != nil {
+			return nil, err
+		}
+		in = append(in, series)
+	}
+	return f.fn(e, in)
+}
+
+// newSeries returns a series like in, but with a new name and a fresh slice of datapoints to be filled in
+func newSeries(in Series, target string) Series {
+	return Series{
+		Target:     target,
+		Datapoints: make([]schema.Point, len(in.Datapoints)),
+		Interval:   in.Interval,
+	}
+}
+
+func formatFloat(f float64) string {
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
+
+func alias(e *expr.Expr, in [][]Series) ([]Series, error) {
+	out := make([]Series, len(in[0]))
+	for i, s := range in[0] {
+		s.Target = e.Args[1].Str
+		out[i] = s
+	}
+	return out, nil
+}
+
+// aliasByNode takes the given (zero-indexed) nodes of the metric name, joined by dots.
+// any function calls wrapped around the name are ignored.
+func aliasByNode(e *expr.Expr, in [][]Series) ([]Series, error) {
+	out := make([]Series, len(in[0]))
+	for i, s := range in[0] {
+		name := s.Target
+		if pos := strings.LastIndex(name, "("); pos != -1 {
+			name = name[pos+1:]
+		}
+		if pos := strings.IndexAny(name, ",)"); pos != -1 {
+			name = name[:pos]
+		}
+		nodes := strings.Split(name, ".")
+		parts := make([]string, 0, len(e.Args)-1)
+		for _, arg := range e.Args[1:] {
+			n := int(arg.Float)
+			if n < 0 {
+				n += len(nodes)
+			}
+			if n < 0 || n >= len(nodes) {
+				return nil, fmt.Errorf("aliasByNode: node %d out of range for %q", int(arg.Float), name)
+			}
+			parts = append(parts, nodes[n])
+		}
+		s.Target = strings.Join(parts, ".")
+		out[i] = s
+	}
+	return out, nil
+}
+
+// aliasSub runs a regex substitution on the series names. replacements can use \1 style backreferences, like graphite
+func aliasSub(e *expr.Expr, in [][]Series) ([]Series, error) {
+	re, err := regexp.Compile(e.Args[1].Str)
+	if err != nil {
+		return nil, err
+	}
+	replace := regexp.MustCompile(`\\(\d+)`).ReplaceAllString(e.Args[2].Str, "$${$1}")
+	out := make([]Series, len(in[0]))
+	for i, s := range in[0] {
+		s.Target = re.ReplaceAllString(s.Target, replace)
+		out[i] = s
+	}
+	return out, nil
+}
+
+// the consolidation function itself has already been applied while fetching the data, we only need to update the names
+func consolidateBy(e *expr.Expr, in [][]Series) ([]Series, error) {
+	out := make([]Series, len(in[0]))
+	for i, s := range in[0] {
+		s.Target = fmt.Sprintf("consolidateBy(%s,'%s')", s.Target, e.Args[1].Str)
+		out[i] = s
+	}
+	return out, nil
+}
+
+// combine returns a function that merges all input series into one, by applying agg to all the points of each timestamp
+func combine(name string, agg batch.AggFunc) func(e *expr.Expr, in [][]Series) ([]Series, error) {
+	return func(e *expr.Expr, in [][]Series) ([]Series, error) {
+		var series []Series
+		for _, list := range in {
+			series = append(series, list...)
+		}
+		if len(series) == 0 {
+			return []Series{}, nil
+		}
+		for _, s := range series[1:] {
+			if len(s.Datapoints) != len(series[0].Datapoints) {
+				return nil, errSeriesLenDiff
+			}
+		}
+		out := newSeries(series[0], fmt.Sprintf("%s(%s)", name, e.ArgsStr))
+		points := make([]schema.Point, len(series))
+		for i := range out.Datapoints {
+			for j, s := range series {
+				points[j] = s.Datapoints[i]
+			}
+			out.Datapoints[i] = schema.Point{Val: agg(points), Ts: series[0].Datapoints[i].Ts}
+		}
+		return []Series{out}, nil
+	}
+}
+
+// diff subtracts all other non-null values from the first non-null value
+func diff(in []schema.Point) float64 {
+	out := math.NaN()
+	for _, p := range in {
+		if math.IsNaN(p.Val) {
+			continue
+		}
+		if math.IsNaN(out) {
+			out = p.Val
+		} else {
+			out -= p.Val
+		}
+	}
+	return out
+}
+
+// multiply returns the product of all values, or null if any of them is null
+func multiply(in []schema.Point) float64 {
+	out := float64(1)
+	for _, p := range in {
+		out *= p.Val
+	}
+	return out
+}
+
+func divideSeries(e *expr.Expr, in [][]Series) ([]Series, error) {
+	if len(in[1]) != 1 {
+		return nil, fmt.Errorf("divideSeries: divisor must be a single series, got %d", len(in[1]))
+	}
+	divisor := in[1][0]
+	out := make([]Series, 0, len(in[0]))
+	for _, s := range in[0] {
+		if len(s.Datapoints) != len(divisor.Datapoints) {
+			return nil, errSeriesLenDiff
+		}
+		o := newSeries(s, fmt.Sprintf("divideSeries(%s,%s)", s.Target, divisor.Target))
+		for i, p := range s.Datapoints {
+			val := math.NaN()
+			if divisor.Datapoints[i].Val != 0 {
+				val = p.Val / divisor.Datapoints[i].Val
+			}
+			o.Datapoints[i] = schema.Point{Val: val, Ts: p.Ts}
+		}
+		out = append(out, o)
+	}
+	return out, nil
+}
+
+// transform returns a new series for every input series, with every value passed through fn
+func transform(in []Series, name func(s Series) string, fn func(val float64) float64) []Series {
+	out := make([]Series, len(in))
+	for i, s := range in {
+		o := newSeries(s, name(s))
+		for j, p := range s.Datapoints {
+			o.Datapoints[j] = schema.Point{Val: fn(p.Val), Ts: p.Ts}
+		}
+		out[i] = o
+	}
+	return out
+}
+
+func scale(e *expr.Expr, in [][]Series) ([]Series, error) {
+	factor := e.Args[1].Float
+	name := func(s Series) string { return fmt.Sprintf("scale(%s,%s)", s.Target, formatFloat(factor)) }
+	return transform(in[0], name, func(val float64) float64 { return val * factor }), nil
+}
+
+func offset(e *expr.Expr, in [][]Series) ([]Series, error) {
+	amount := e.Args[1].Float
+	name := func(s Series) string { return fmt.Sprintf("offset(%s,%s)", s.Target, formatFloat(amount)) }
+	return transform(in[0], name, func(val float64) float64 { return val + amount }), nil
+}
+
+func absolute(e *expr.Expr, in [][]Series) ([]Series, error) {
+	name := func(s Series) string { return fmt.Sprintf("absolute(%s)", s.Target) }
+	return transform(in[0], name, math.Abs), nil
+}
+
+func integral(e *expr.Expr, in [][]Series) ([]Series, error) {
+	out := make([]Series, len(in[0]))
+	for i, s := range in[0] {
+		o := newSeries(s, fmt.Sprintf("integral(%s)", s.Target))
+		current := float64(0)
+		for j, p := range s.Datapoints {
+			if math.IsNaN(p.Val) {
+				o.Datapoints[j] = p
+				continue
+			}
+			current += p.Val
+			o.Datapoints[j] = schema.Point{Val: current, Ts: p.Ts}
+		}
+		out[i] = o
+	}
+	return out, nil
+}
+
+// deltas returns a new series for every input series, with the difference of each value to the previous one.
+// if nonNegative is set, negative deltas are treated as counter wraps (if maxValue is set) or resets (nulls)
+// the first point, and points following a null, are null.
+func deltas(in []Series, name string, nonNegative bool, maxValue float64, perSecond bool) []Series {
+	out := make([]Series, len(in))
+	for i, s := range in {
+		o := newSeries(s, fmt.Sprintf("%s(%s)", name, s.Target))
+		prev := math.NaN()
+		for j, p := range s.Datapoints {
+			delta := p.Val - prev
+			if nonNegative && delta < 0 {
+				if !math.IsNaN(maxValue) && maxValue >= p.Val {
+					delta = (maxValue - prev) + p.Val + 1
+				} else {
+					delta = math.NaN()
+				}
+			}
+			if perSecond {
+				delta /= float64(s.Interval)
+			}
+			o.Datapoints[j] = schema.Point{Val: delta, Ts: p.Ts}
+			prev = p.Val
+		}
+		out[i] = o
+	}
+	return out
+}
+
+func derivative(e *expr.Expr, in [][]Series) ([]Series, error) {
+	return deltas(in[0], "derivative", false, math.NaN(), false), nil
+}
+
+func nonNegativeDerivative(e *expr.Expr, in [][]Series) ([]Series, error) {
+	maxValue := math.NaN()
+	if len(e.Args) > 1 {
+		maxValue = e.Args[1].Float
+	}
+	return deltas(in[0], "nonNegativeDerivative", true, maxValue, false), nil
+}
+
+func perSecond(e *expr.Expr, in [][]Series) ([]Series, error) {
+	maxValue := math.NaN()
+	if len(e.Args) > 1 {
+		maxValue = e.Args[1].Float
+	}
+	return deltas(in[0], "perSecond", true, maxValue, true), nil
+}
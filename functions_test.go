@@ -0,0 +1,164 @@
+package main
+
+import (
+	"math"
+	"testing"
+
+	"gopkg.in/raintank/schema.v1"
+)
+
+func testPoints(vals ...float64) []schema.Point {
+	out := make([]schema.Point, len(vals))
+	for i, v := range vals {
+		out[i] = schema.Point{Val: v, Ts: uint32(10 * (i + 1))}
+	}
+	return out
+}
+
+func equalSeries(a, b []Series) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i].Target != b[i].Target || len(a[i].Datapoints) != len(b[i].Datapoints) {
+			return false
+		}
+		for j, p := range a[i].Datapoints {
+			q := b[i].Datapoints[j]
+			if p.Ts != q.Ts || (p.Val != q.Val && !(math.IsNaN(p.Val) && math.IsNaN(q.Val))) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+func TestEvalTargets(t *testing.T) {
+	nan := math.NaN()
+	fetched := []Series{
+		{Target: "a.x", Datapoints: testPoints(1, 2, nan, 4), Interval: 10},
+		{Target: "a.y", Datapoints: testPoints(10, nan, nan, 40), Interval: 10},
+		{Target: "consolidateBy(a.x,'max')", Datapoints: testPoints(5, 6, 7, 8), Interval: 10},
+	}
+	cases := []struct {
+		target string
+		out    []Series
+	}{
+		{
+			"a.*",
+			[]Series{
+				{Target: "a.x", Datapoints: testPoints(1, 2, nan, 4)},
+				{Target: "a.y", Datapoints: testPoints(10, nan, nan, 40)},
+			},
+		},
+		{
+			"sumSeries(a.*)",
+			[]Series{{Target: "sumSeries(a.*)", Datapoints: testPoints(11, 2, nan, 44)}},
+		},
+		{
+			"averageSeries(a.x, a.y)",
+			[]Series{{Target: "averageSeries(a.x, a.y)", Datapoints: testPoints(5.5, 2, nan, 22)}},
+		},
+		{
+			"diffSeries(a.y, a.x)",
+			[]Series{{Target: "diffSeries(a.y, a.x)", Datapoints: testPoints(9, 2, nan, 36)}},
+		},
+		{
+			"scale(a.x, 0.5)",
+			[]Series{{Target: "scale(a.x,0.5)", Datapoints: testPoints(0.5, 1, nan, 2)}},
+		},
+		{
+			"alias(offset(a.x, -1), 'foo')",
+			[]Series{{Target: "foo", Datapoints: testPoints(0, 1, nan, 3)}},
+		},
+		{
+			"aliasByNode(scale(a.y, 2), 1)",
+			[]Series{{Target: "y", Datapoints: testPoints(20, nan, nan, 80)}},
+		},
+		{
+			`aliasSub(a.x, "^a\.(.*)$", "b.\1")`,
+			[]Series{{Target: "b.x", Datapoints: testPoints(1, 2, nan, 4)}},
+		},
+		{
+			"consolidateBy(a.x, 'max')",
+			[]Series{{Target: "consolidateBy(a.x,'max')", Datapoints: testPoints(5, 6, 7, 8)}},
+		},
+		{
+			"scale(consolidateBy(a.x, 'max'), 2)",
+			[]Series{{Target: "scale(consolidateBy(a.x,'max'),2)", Datapoints: testPoints(10, 12, 14, 16)}},
+		},
+		{
+			"consolidateBy(scale(a.x, 2), 'max')",
+			[]Series{{Target: "consolidateBy(scale(a.x,2),'max')", Datapoints: testPoints(10, 12, 14, 16)}},
+		},
+		{
+			"derivative(a.x)",
+			[]Series{{Target: "derivative(a.x)", Datapoints: testPoints(nan, 1, nan, nan)}},
+		},
+		{
+			"perSecond(a.y)",
+			[]Series{{Target: "perSecond(a.y)", Datapoints: testPoints(nan, nan, nan, nan)}},
+		},
+		{
+			"perSecond(consolidateBy(a.x, 'max'))",
+			[]Series{{Target: "perSecond(consolidateBy(a.x,'max'))", Datapoints: testPoints(nan, 0.1, 0.1, 0.1)}},
+		},
+		{
+			"integral(a.x)",
+			[]Series{{Target: "integral(a.x)", Datapoints: testPoints(1, 3, nan, 7)}},
+		},
+		{
+			"divideSeries(a.*, a.x)",
+			[]Series{
+				{Target: "divideSeries(a.x,a.x)", Datapoints: testPoints(1, 1, nan, 1)},
+				{Target: "divideSeries(a.y,a.x)", Datapoints: testPoints(10, nan, nan, 10)},
+			},
+		},
+		{
+			"sumSeries(seriesByTag('dc=us-east', 'role=~web.*'))",
+			[]Series{{Target: "sumSeries(seriesByTag('dc=us-east', 'role=~web.*'))", Datapoints: testPoints(11, 2, nan, 44)}},
+		},
+	}
+	for i, c := range cases {
+		exprs, leaves, err := parseTargets([]string{c.target})
+		if err != nil {
+			t.Fatalf("case %d: %q: parse error %s", i, c.target, err)
+		}
+		for l := range leaves {
+			switch l.pattern {
+			case "a.*", "seriesByTag('dc=us-east', 'role=~web.*')":
+				leaves[l] = []string{"a.x", "a.y"}
+			case "a.x", "a.y":
+				leaves[l] = []string{l.pattern}
+			}
+		}
+		out, err := evalTargets(exprs, leaves, fetched)
+		if err != nil {
+			t.Fatalf("case %d: %q: eval error %s", i, c.target, err)
+		}
+		if !equalSeries(out, c.out) {
+			t.Fatalf("case %d: %q: expected %v, got %v", i, c.target, c.out, out)
+		}
+	}
+}
+
+func TestParseTargetsErrors(t *testing.T) {
+	cases := []string{
+		"sumSeries(a.*",
+		"noSuchFunction(a.*)",
+		"scale(a.*)",
+		"scale(a.*, 'foo')",
+		"alias(a.*, 'foo', 'bar')",
+		"aliasByNode(a.*, 1.5)",
+		"'just a string'",
+		"seriesByTag(a.*)",
+		"seriesByTag('dc')",
+		"seriesByTag('dc!=us-east')",
+		"seriesByTag('role=~web(')",
+	}
+	for i, c := range cases {
+		if _, _, err := parseTargets([]string{c}); err == nil {
+			t.Fatalf("case %d: %q: expected an error, got none", i, c)
+		}
+	}
+}
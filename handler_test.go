@@ -32,7 +32,7 @@ func Test_HandleMessage(t *testing.T) {
 func test_HandleMessage(t *testing.T, stats met.Backend) {
 
 	store := mdata.NewDevnullStore()
-	aggmetrics := mdata.NewAggMetrics(store, 600, 10, 800, 8000, 10000, 0, make([]mdata.AggSetting, 0))
+	aggmetrics := mdata.NewAggMetrics(store, 600, 10, 800, 8000, 10000, 0, 0, make([]mdata.AggSetting, 0), nil, nil)
 	metricIndex := memory.New()
 	metricIndex.Init(stats)
 
@@ -163,7 +163,7 @@ func BenchmarkHandler_HandleMessage(b *testing.B) {
 	mdata.InitMetrics(stats)
 
 	store := mdata.NewDevnullStore()
-	aggmetrics := mdata.NewAggMetrics(store, 600, 10, 800, 8000, 10000, 0, make([]mdata.AggSetting, 0))
+	aggmetrics := mdata.NewAggMetrics(store, 600, 10, 800, 8000, 10000, 0, 0, make([]mdata.AggSetting, 0), nil, nil)
 	metricIndex := memory.New()
 	metricIndex.Init(stats)
 	handler := Nsq.NewHandler(aggmetrics, metricIndex, nil, stats)
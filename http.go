@@ -6,8 +6,9 @@ import (
 	"errors"
 	"fmt"
 	"github.com/raintank/dur"
-	"github.com/raintank/metrictank/consolidation"
+	"github.com/raintank/metrictank/expr"
 	"github.com/raintank/metrictank/idx"
+	"github.com/raintank/metrictank/limits"
 	"github.com/raintank/metrictank/mdata"
 	"github.com/raintank/worldping-api/pkg/log"
 	"gopkg.in/raintank/schema.v1"
@@ -79,8 +80,8 @@ func listJSON(b []byte, defs []schema.MetricDefinition) ([]byte, error) {
 	return b, nil
 }
 
-// regular graphite output
-func graphiteJSON(b []byte, series []Series) ([]byte, error) {
+// regular graphite output. values are rounded to the given number of decimals, or not at all with precision -1
+func graphiteJSON(b []byte, series []Series, precision int) ([]byte, error) {
 	b = append(b, '[')
 	for _, s := range series {
 		b = append(b, `{"target":"`...)
@@ -91,7 +92,7 @@ func graphiteJSON(b []byte, series []Series) ([]byte, error) {
 			if math.IsNaN(p.Val) {
 				b = append(b, `null,`...)
 			} else {
-				b = strconv.AppendFloat(b, p.Val, 'f', 3, 64)
+				b = strconv.AppendFloat(b, p.Val, 'f', precision, 64)
 				b = append(b, ',')
 			}
 			b = strconv.AppendUint(b, uint64(p.Ts), 10)
@@ -110,7 +111,7 @@ func graphiteJSON(b []byte, series []Series) ([]byte, error) {
 }
 
 // data output for graphite raintank target -> Target, datapoints -> Datapoints, and adds Interval field
-func graphiteRaintankJSON(b []byte, series []Series) ([]byte, error) {
+func graphiteRaintankJSON(b []byte, series []Series, precision int) ([]byte, error) {
 	b = append(b, '[')
 	for _, s := range series {
 		b = append(b, `{"Target":"`...)
@@ -121,7 +122,7 @@ func graphiteRaintankJSON(b []byte, series []Series) ([]byte, error) {
 			if math.IsNaN(p.Val) {
 				b = append(b, `null,`...)
 			} else {
-				b = strconv.AppendFloat(b, p.Val, 'f', 3, 64)
+				b = strconv.AppendFloat(b, p.Val, 'f', precision, 64)
 				b = append(b, ',')
 			}
 			b = strconv.AppendUint(b, uint64(p.Ts), 10)
@@ -150,6 +151,45 @@ func getOrg(req *http.Request) (int, error) {
 	return org, nil
 }
 
+// getGraphiteWebOrg returns the org of a request that may come from graphite-web, which can't set headers
+// on the requests to its cluster servers. without a header, we serve the graphite-web-org, if it's set.
+func getGraphiteWebOrg(req *http.Request) (int, error) {
+	if req.Header.Get("x-org-id") == "" && *graphiteWebOrg != 0 {
+		return *graphiteWebOrg, nil
+	}
+	return getOrg(req)
+}
+
+// getFormatOrg returns the org of a request to the graphite api, which may be one of graphite-web if it has the pickle format
+func getFormatOrg(req *http.Request) (int, error) {
+	if req.FormValue("format") == "pickle" {
+		return getGraphiteWebOrg(req)
+	}
+	return getOrg(req)
+}
+
+// getSeriesOrg returns the org of a request to the native api. its series ids start with their org,
+// so without a header, it's the org of the first of them.
+func getSeriesOrg(req *http.Request) (int, error) {
+	if req.Header.Get("x-org-id") != "" {
+		return getOrg(req)
+	}
+	req.ParseForm()
+	targets := req.Form["target"]
+	if len(targets) == 0 {
+		return 0, errors.New("missing target arg")
+	}
+	id, _, err := parseIdTarget(targets[0])
+	if err != nil {
+		return 0, err
+	}
+	org, err := strconv.Atoi(strings.SplitN(id, ".", 2)[0])
+	if err != nil {
+		return 0, fmt.Errorf("invalid id %q", id)
+	}
+	return org, nil
+}
+
 func IndexJson(metricIndex idx.MetricIndex) http.HandlerFunc {
 	return func(w http.ResponseWriter, req *http.Request) {
 		org, err := getOrg(req)
@@ -186,14 +226,14 @@ func Get(w http.ResponseWriter, req *http.Request, store mdata.Store, metricInde
 	pre := time.Now()
 	org := 0
 	var err error
+	req.ParseForm()
 	if legacy {
-		org, err = getOrg(req)
+		org, err = getFormatOrg(req)
 		if err != nil {
 			http.Error(w, err.Error(), http.StatusBadRequest)
 			return
 		}
 	}
-	req.ParseForm()
 
 	maxDataPoints := uint32(800)
 	maxDataPointsStr := req.Form.Get("maxDataPoints")
@@ -206,12 +246,27 @@ func Get(w http.ResponseWriter, req *http.Request, store mdata.Store, metricInde
 		maxDataPoints = uint32(tmp)
 	}
 
+	format := req.Form.Get("format")
+	if format == "" {
+		format = "json"
+	}
+	if _, ok := renderFormats[format]; !ok {
+		http.Error(w, "invalid format", http.StatusBadRequest)
+		return
+	}
+	// graphite-web doesn't send maxDataPoints when it fetches data from its cluster servers, as it consolidates the data itself.
+	// so we return all points, the number of which we only know once we know the intervals of the series.
+	unconsolidated := format == "pickle" && maxDataPointsStr == ""
+	if unconsolidated {
+		maxDataPoints = math.MaxUint32
+	}
+
 	targets, ok := req.Form["target"]
 	if !ok {
 		http.Error(w, "missing target arg", http.StatusBadRequest)
 		return
 	}
-	if *maxPointsPerReq != 0 && len(targets)*int(maxDataPoints) > *maxPointsPerReq {
+	if *maxPointsPerReq != 0 && !unconsolidated && len(targets)*int(maxDataPoints) > *maxPointsPerReq {
 		http.Error(w, "too many targets/maxDataPoints requested", http.StatusBadRequest)
 		return
 	}
@@ -255,81 +310,51 @@ func Get(w http.ResponseWriter, req *http.Request, store mdata.Store, metricInde
 		return
 	}
 
+	var exprs []*expr.Expr
+	var leaves map[leaf][]string
 	reqs := make([]Req, 0)
-	for _, target := range targets {
-		var consolidateBy string
-		id := target
-		// yes, i am aware of the arguably grossness of the below.
-		// however, it is solid based on the documented allowed input format.
-		// once we need to support several functions, we can implement
-		// a proper expression parser
-		if strings.HasPrefix(target, "consolidateBy(") {
-			var q1, q2 int
-			t := target
-			if t[len(t)-2:] == "')" && (strings.Contains(t, ",'") || strings.Contains(t, ", '")) && strings.Count(t, "'") == 2 {
-				q1 = strings.Index(t, "'")
-				q2 = strings.LastIndex(t, "'")
-			} else if t[len(t)-2:] == "\")" && (strings.Contains(t, ",\"") || strings.Contains(t, ", \"")) && strings.Count(t, "\"") == 2 {
-				q1 = strings.Index(t, "\"")
-				q2 = strings.LastIndex(t, "\"")
-			} else {
-				http.Error(w, errTargetParse.Error(), http.StatusBadRequest)
-				return
-			}
-			consolidateBy = t[q1+1 : q2]
-			id = t[strings.Index(t, "(")+1 : strings.LastIndex(t, ",")]
+	if legacy {
+		exprs, leaves, err = parseTargets(targets)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
 		}
-
-		if legacy {
-			// metricDefs only get updated periodically, so we add a 1day (86400seconds) buffer when
-			// filtering by our From timestamp.  This should be moved to a configuration option,
-			// but that will require significant refactoring to expose the updateInterval used
-			// in the MetricIdx.
-			seenAfter := int64(fromUnix)
-			if seenAfter != 0 {
-				seenAfter -= 86400
-			}
-			nodes, err := metricIndex.Find(org, id, seenAfter)
-			if err != nil {
-				http.Error(w, err.Error(), http.StatusBadRequest)
-				return
-			}
-			if len(nodes) == 0 {
-				http.Error(w, errMetricNotFound.Error(), http.StatusBadRequest)
-				return
-			}
-			for _, node := range nodes {
-				for _, def := range node.Defs {
-					consolidator, err := consolidation.GetConsolidator(&def, consolidateBy)
-					if err != nil {
-						http.Error(w, err.Error(), http.StatusBadRequest)
-						return
-					}
-					// target is like foo.bar or foo.* or consolidateBy(foo.*,'sum')
-					// id is like foo.bar or foo.*
-					// def.Name is like foo.concretebar
-					// so we want target to contain the concrete graphite name, potentially wrapped with consolidateBy().
-					target := strings.Replace(target, id, def.Name, -1)
-					reqs = append(reqs, NewReq(def.Id, target, fromUnix, toUnix, maxDataPoints, uint32(def.Interval), consolidator))
-				}
-			}
-		} else {
-			// querying for a MT id
-			def, err := metricIndex.Get(id)
-			if err == idx.DefNotFound {
-				e := fmt.Sprintf("metric %q not found", id)
-				log.Error(0, e)
-				http.Error(w, e, http.StatusBadRequest)
-				return
-			}
-			consolidator, err := consolidation.GetConsolidator(&def, consolidateBy)
-			if err != nil {
-				http.Error(w, err.Error(), http.StatusBadRequest)
-				return
-			}
-			reqs = append(reqs, NewReq(id, target, fromUnix, toUnix, maxDataPoints, uint32(def.Interval), consolidator))
+		reqs, err = resolveLeaves(metricIndex, org, leaves, fromUnix, toUnix, maxDataPoints)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	} else {
+		// querying for MT ids
+		reqs, err = resolveIds(metricIndex, targets, fromUnix, toUnix, maxDataPoints)
+		if err != nil {
+			log.Error(0, err.Error())
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	// the native api doesn't need the org, but we still enforce its limits
+	limitsOrg := org
+	if !legacy {
+		limitsOrg, err = getSeriesOrg(req)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	points := len(reqs) * int(maxDataPoints)
+	if unconsolidated {
+		points = rawPoints(reqs)
+		if *maxPointsPerReq != 0 && points > *maxPointsPerReq {
+			http.Error(w, "too many series/points requested", http.StatusBadRequest)
+			return
 		}
 	}
+	if max := queryLimits.Get(limitsOrg).MaxPointsPerReq; max != 0 && points > max {
+		queryLimits.Error(w, limitsOrg, limits.ReasonPoints, "too many series/maxDataPoints requested for the limits of the org")
+		return
+	}
+
 	if (toUnix - fromUnix) >= logMinDur {
 		log.Info("http.Get(): INCOMING REQ %q from: %q, to: %q targets: %q, maxDataPoints: %q",
 			req.Method, req.Form.Get("from"), req.Form.Get("to"), req.Form["target"], req.Form.Get("maxDataPoints"))
@@ -347,22 +372,50 @@ func Get(w http.ResponseWriter, req *http.Request, store mdata.Store, metricInde
 		return
 	}
 
-	out, err := getTargets(store, reqs)
+	out, err := fetchTargets(store, reqs)
 	if err != nil {
 		log.Error(0, err.Error())
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
 
-	js := bufPool.Get().([]byte)
+	var result []Series
 	if legacy {
-		merged := mergeSeries(out)
-		sort.Sort(SeriesByTarget(merged))
-		js, err = graphiteJSON(js, merged)
+		result, err = evalTargets(exprs, leaves, mergeSeries(out))
+		if err != nil {
+			for _, serie := range out {
+				pointSlicePool.Put(serie.Datapoints[:0])
+			}
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	if legacy {
+		sort.Sort(SeriesByTarget(result))
 	} else {
 		// we dont merge here as graphite is expecting all metric.Ids it reqested.
 		// graphite will then handle the merging itself.
-		js, err = graphiteRaintankJSON(js, out)
+		result = out
+	}
+	js := bufPool.Get().([]byte)
+	switch format {
+	case "json", "json-full":
+		precision := 3
+		if format == "json-full" {
+			precision = -1
+		}
+		if legacy {
+			js, err = graphiteJSON(js, result, precision)
+		} else {
+			js, err = graphiteRaintankJSON(js, result, precision)
+		}
+	case "msgpack":
+		js, err = graphiteMsgpack(js, result)
+	case "pickle":
+		js, err = graphitePickle(js, result)
+	case "protobuf":
+		js, err = graphiteProtobuf(js, result)
 	}
 	for _, serie := range out {
 		pointSlicePool.Put(serie.Datapoints[:0])
@@ -375,10 +428,23 @@ func Get(w http.ResponseWriter, req *http.Request, store mdata.Store, metricInde
 	}
 
 	reqHandleDuration.Value(time.Now().Sub(pre))
-	writeResponse(w, js, httpTypeJSON, "")
+	writeResponse(w, js, renderFormats[format], "")
 	bufPool.Put(js[:0])
 }
 
+// rawPoints returns how many points the requests return at most without consolidation
+func rawPoints(reqs []Req) int {
+	points := 0
+	for _, r := range reqs {
+		interval := r.rawInterval
+		if interval == 0 {
+			interval = 1
+		}
+		points += int((r.to-r.from)/interval) + 1
+	}
+	return points
+}
+
 // report ApplicationStatus for use by loadBalancer healthChecks.
 // We only want requests to be sent to this node if it is the primary
 // node or if it has been online for at *warmUpPeriod
@@ -403,7 +469,7 @@ func Find(metricIndex idx.MetricIndex) http.HandlerFunc {
 		query := r.FormValue("query")
 		from, _ := strconv.ParseInt(r.FormValue("from"), 10, 64)
 
-		org, err := getOrg(r)
+		org, err := getFormatOrg(r)
 		if err != nil {
 			http.Error(w, err.Error(), http.StatusBadRequest)
 			return
@@ -414,7 +480,7 @@ func Find(metricIndex idx.MetricIndex) http.HandlerFunc {
 			return
 		}
 
-		if format != "" && format != "treejson" && format != "json" && format != "completer" {
+		if format != "" && format != "treejson" && format != "json" && format != "completer" && format != "pickle" {
 			http.Error(w, "invalid format", http.StatusBadRequest)
 			return
 		}
@@ -425,11 +491,21 @@ func Find(metricIndex idx.MetricIndex) http.HandlerFunc {
 		if from != 0 {
 			from -= 86400
 		}
-		nodes, err := metricIndex.Find(org, query, from)
+		nodes, err := findCluster(metricIndex, findReq{Org: org, Pattern: query, From: from})
 		if err != nil {
 			http.Error(w, err.Error(), http.StatusBadRequest)
 			return
 		}
+		if max := queryLimits.Get(org).MaxSeriesPerFind; max != 0 {
+			series := 0
+			for _, n := range nodes {
+				series += len(n.Defs)
+			}
+			if series > max {
+				queryLimits.Error(w, org, limits.ReasonSeries, fmt.Sprintf("query matches %d series, more than the limit of the org of %d", series, max))
+				return
+			}
+		}
 
 		var b []byte
 		switch format {
@@ -437,6 +513,8 @@ func Find(metricIndex idx.MetricIndex) http.HandlerFunc {
 			b, err = findTreejson(query, nodes)
 		case "completer":
 			b, err = findCompleter(nodes)
+		case "pickle":
+			b, err = findPickle(nodes)
 		}
 
 		if err != nil {
@@ -444,11 +522,25 @@ func Find(metricIndex idx.MetricIndex) http.HandlerFunc {
 			return
 		}
 
+		if format == "pickle" {
+			writeResponse(w, b, httpTypePickle, "")
+			return
+		}
 		writeResponse(w, b, httpTypeJSON, jsonp)
 	}
 }
 
-func Delete(metricIndex idx.MetricIndex) http.HandlerFunc {
+// deletedSeries describes a series removed by Delete, and the keys of the data in the store that were deleted with it
+type deletedSeries struct {
+	Id   string   `json:"id"`
+	Name string   `json:"name"`
+	Keys []string `json:"keys"`
+}
+
+// Delete deletes the series matching the query from the index, as well as their data, from memory and from the store.
+// in a sharded cluster, the delete is fanned out to all peers, so that it applies to all of them.
+// with dryRun=true, it only returns what it would delete.
+func Delete(metricIndex idx.MetricIndex, store mdata.Store) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		query := r.FormValue("query")
 		org, err := getOrg(r)
@@ -461,16 +553,38 @@ func Delete(metricIndex idx.MetricIndex) http.HandlerFunc {
 			http.Error(w, "missing parameter `query`", http.StatusBadRequest)
 			return
 		}
+		dryRun := false
+		if r.FormValue("dryRun") != "" {
+			dryRun, err = strconv.ParseBool(r.FormValue("dryRun"))
+			if err != nil {
+				http.Error(w, "invalid parameter `dryRun`", http.StatusBadRequest)
+				return
+			}
+		}
 
-		defs, err := metricIndex.Delete(org, query)
+		d := deleteReq{org, query, dryRun}
+		local, code, err := deleteLocal(metricIndex, store, d)
 		if err != nil {
-			http.Error(w, err.Error(), http.StatusBadRequest)
+			http.Error(w, err.Error(), code)
+			return
+		}
+		remote, err := deletePeers(d)
+		if err != nil {
+			log.Error(3, "failed to delete %s on all peers. %s", query, err)
+			http.Error(w, fmt.Sprintf("failed to delete on all peers, retry the delete: %s", err), http.StatusInternalServerError)
 			return
 		}
+		resps := []deleteResp{local}
+		for _, p := range peers {
+			resps = append(resps, remote[p])
+		}
+		series, defs := mergeDeleted(resps...)
 
 		resp := make(map[string]interface{})
 		resp["success"] = true
-		resp["deletedDefs"] = len(defs)
+		resp["dryRun"] = dryRun
+		resp["deletedDefs"] = defs
+		resp["deletedSeries"] = series
 		b, err := json.Marshal(resp)
 		if err != nil {
 			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
@@ -480,12 +594,120 @@ func Delete(metricIndex idx.MetricIndex) http.HandlerFunc {
 	}
 }
 
+// deleteLocal executes the delete against the local index, memory and store.
+// if it fails, it returns the http status code to fail the request with.
+func deleteLocal(metricIndex idx.MetricIndex, store mdata.Store, d deleteReq) (deleteResp, int, error) {
+	defs, err := findDeletable(metricIndex, d.Org, d.Query)
+	if err != nil {
+		return deleteResp{}, http.StatusBadRequest, err
+	}
+	resp := deleteResp{
+		Series: make([]deletedSeries, 0, len(defs)),
+	}
+	for _, def := range defs {
+		keys, ttl, chunkSpan := metrics.StoredKeys(def.Id, def.Name)
+		resp.Series = append(resp.Series, deletedSeries{def.Id, def.Name, keys})
+		if d.DryRun {
+			continue
+		}
+		metrics.Remove(def.Id)
+		for _, key := range keys {
+			err = store.Delete(key, ttl, chunkSpan)
+			if err != nil {
+				log.Error(3, "failed to delete data of %s from the store. %s", key, err)
+				return deleteResp{}, http.StatusInternalServerError, fmt.Errorf("failed to delete data of %s: %s", def.Name, err)
+			}
+		}
+	}
+	if d.DryRun {
+		for _, def := range defs {
+			resp.Defs = append(resp.Defs, def.Id)
+		}
+		return resp, 0, nil
+	}
+	// the data is gone, so we can delete the series from the index.
+	// if deleting the data failed, we keep them there, so that the delete can be retried.
+	deleted, err := metricIndex.Delete(d.Org, d.Query)
+	if err != nil {
+		return deleteResp{}, http.StatusBadRequest, err
+	}
+	for _, def := range deleted {
+		resp.Defs = append(resp.Defs, def.Id)
+	}
+	return resp, 0, nil
+}
+
+// findDeletable returns the definitions that metricIndex.Delete would delete: those of the org
+// of all leaf nodes matching the pattern, and of all leaf nodes under the branches matching it.
+func findDeletable(metricIndex idx.MetricIndex, org int, pattern string) ([]schema.MetricDefinition, error) {
+	nodes, err := metricIndex.Find(org, pattern, 0)
+	if err != nil {
+		return nil, err
+	}
+	defs := make([]schema.MetricDefinition, 0)
+	for _, n := range nodes {
+		if !n.Leaf {
+			children, err := findDeletable(metricIndex, org, n.Path+".*")
+			if err != nil {
+				return nil, err
+			}
+			defs = append(defs, children...)
+			continue
+		}
+		for _, def := range n.Defs {
+			if def.OrgId == org {
+				defs = append(defs, def)
+			}
+		}
+	}
+	return defs, nil
+}
+
 type completer struct {
 	Path   string `json:"path"`
 	Name   string `json:"name"`
 	IsLeaf string `json:"is_leaf"`
 }
 
+// Tags serves the tag api:
+// /tags lists all tag keys, /tags/<tag>/values lists the values of a tag.
+// both take an optional `filter` regex to limit the results.
+func Tags(metricIndex idx.MetricIndex) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		jsonp := r.FormValue("jsonp")
+		filter := r.FormValue("filter")
+		org, err := getOrg(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		var list []string
+		path := strings.Trim(strings.TrimPrefix(r.URL.Path, "/tags"), "/")
+		if path == "" {
+			list, err = metricIndex.Tags(org, filter)
+		} else {
+			parts := strings.Split(path, "/")
+			if len(parts) != 2 || parts[1] != "values" {
+				http.Error(w, "not found", http.StatusNotFound)
+				return
+			}
+			list, err = metricIndex.TagValues(org, parts[0], filter)
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		b, err := json.Marshal(list)
+		if err != nil {
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+		writeResponse(w, b, httpTypeJSON, jsonp)
+	}
+}
+
 func findCompleter(nodes []idx.Node) ([]byte, error) {
 	var b bytes.Buffer
 
@@ -519,6 +741,60 @@ func findCompleter(nodes []idx.Node) ([]byte, error) {
 	return b.Bytes(), err
 }
 
+// findPickle returns the nodes the way graphite-web's cluster servers do: a pickled list of dicts with their path and whether they are a leaf,
+// under the keys of both graphite-web 0.9 and 1.x. leafs also have the interval we have data for, from the oldest data we keep until their last update.
+func findPickle(nodes []idx.Node) ([]byte, error) {
+	now := uint32(time.Now().Unix())
+	b := []byte{pickleProto, 2, pickleEmptyList}
+	if len(nodes) != 0 {
+		b = append(b, pickleMark)
+	}
+	for _, n := range nodes {
+		b = append(b, pickleEmptyDict, pickleMark)
+		b = pickleString(b, "path")
+		b = pickleString(b, n.Path)
+		b = pickleString(b, "metric_path")
+		b = pickleString(b, n.Path)
+		b = pickleString(b, "is_leaf")
+		b = pickleBool(b, n.Leaf)
+		b = pickleString(b, "isLeaf")
+		b = pickleBool(b, n.Leaf)
+		if n.Leaf {
+			var end, ttl uint32
+			for _, def := range n.Defs {
+				if uint32(def.LastUpdate) > end {
+					end = uint32(def.LastUpdate)
+				}
+				if t := maxTtl(metrics.Schema(def.Name)); t > ttl {
+					ttl = t
+				}
+			}
+			start := now - ttl
+			if start > end {
+				start = end
+			}
+			b = pickleString(b, "intervals")
+			b = pickleIntervals(b, start, end)
+		}
+		b = append(b, pickleSetItems)
+	}
+	if len(nodes) != 0 {
+		b = append(b, pickleAppends)
+	}
+	return append(b, pickleStop), nil
+}
+
+// maxTtl returns the longest ttl of the raw data and the rollups of the schema
+func maxTtl(s *mdata.Schema) uint32 {
+	ttl := s.Ttl
+	for _, as := range s.AggSettings {
+		if as.Ttl > ttl {
+			ttl = as.Ttl
+		}
+	}
+	return ttl
+}
+
 type treejson struct {
 	AllowChildren int            `json:"allowChildren"`
 	Expandable    int            `json:"expandable"`
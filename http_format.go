@@ -0,0 +1,273 @@
+package main
+
+import (
+	"encoding/binary"
+	"math"
+
+	"github.com/tinylib/msgp/msgp"
+)
+
+// renderFormats are the output formats of the query apis, by the value of their format parameter
+var renderFormats = map[string]httpType{
+	"json":      httpTypeJSON,
+	"json-full": httpTypeJSON, // json without rounding the values to 3 decimals
+	"msgpack":   httpTypeMsgpack,
+	"pickle":    httpTypePickle,
+	"protobuf":  httpTypeProtobuf,
+}
+
+// remoteSeries describes a series the way graphite-web's remote fetch expects it:
+// values on a fixed interval, from start (inclusive) to end (exclusive).
+func remoteSeries(s Series) (start, end, step uint32) {
+	step = s.Interval
+	if len(s.Datapoints) == 0 {
+		return 0, 0, step
+	}
+	start = s.Datapoints[0].Ts
+	end = s.Datapoints[len(s.Datapoints)-1].Ts + step
+	return start, end, step
+}
+
+// msgpack output, with the same structure as the pickle output
+func graphiteMsgpack(b []byte, series []Series) ([]byte, error) {
+	b = msgp.AppendArrayHeader(b, uint32(len(series)))
+	for _, s := range series {
+		start, end, step := remoteSeries(s)
+		b = msgp.AppendMapHeader(b, 6)
+		b = msgp.AppendString(b, "name")
+		b = msgp.AppendString(b, s.Target)
+		b = msgp.AppendString(b, "pathExpression")
+		b = msgp.AppendString(b, s.Target)
+		b = msgp.AppendString(b, "start")
+		b = msgp.AppendUint32(b, start)
+		b = msgp.AppendString(b, "end")
+		b = msgp.AppendUint32(b, end)
+		b = msgp.AppendString(b, "step")
+		b = msgp.AppendUint32(b, step)
+		b = msgp.AppendString(b, "values")
+		b = msgp.AppendArrayHeader(b, uint32(len(s.Datapoints)))
+		for _, p := range s.Datapoints {
+			if math.IsNaN(p.Val) {
+				b = msgp.AppendNil(b)
+			} else {
+				b = msgp.AppendFloat64(b, p.Val)
+			}
+		}
+	}
+	return b, nil
+}
+
+// pickle opcodes, see python's pickletools
+const (
+	pickleProto      = 0x80
+	pickleStop       = '.'
+	pickleMark       = '('
+	pickleEmptyList  = ']'
+	pickleAppends    = 'e'
+	pickleEmptyDict  = '}'
+	pickleSetItems   = 'u'
+	pickleBinUnicode = 'X'
+	pickleBinInt     = 'J'
+	pickleLong1      = 0x8a
+	pickleBinFloat   = 'G'
+	pickleNone       = 'N'
+	pickleShortBin   = 'U'
+	pickleGlobal     = 'c'
+	pickleObj        = 'o'
+	pickleBuild      = 'b'
+	pickleTuple2     = 0x86
+	pickleNewTrue    = 0x88
+	pickleNewFalse   = 0x89
+)
+
+// pickle output (protocol 2), as used by graphite-web's remote fetch:
+// a list of dicts with the name, pathExpression, start, end, step and values of each series. null values are None.
+func graphitePickle(b []byte, series []Series) ([]byte, error) {
+	b = append(b, pickleProto, 2, pickleEmptyList)
+	if len(series) != 0 {
+		b = append(b, pickleMark)
+	}
+	for _, s := range series {
+		start, end, step := remoteSeries(s)
+		b = append(b, pickleEmptyDict, pickleMark)
+		b = pickleString(b, "name")
+		b = pickleString(b, s.Target)
+		b = pickleString(b, "pathExpression")
+		b = pickleString(b, s.Target)
+		b = pickleString(b, "start")
+		b = pickleInt(b, start)
+		b = pickleString(b, "end")
+		b = pickleInt(b, end)
+		b = pickleString(b, "step")
+		b = pickleInt(b, step)
+		b = pickleString(b, "values")
+		b = append(b, pickleEmptyList)
+		if len(s.Datapoints) != 0 {
+			b = append(b, pickleMark)
+			for _, p := range s.Datapoints {
+				if math.IsNaN(p.Val) {
+					b = append(b, pickleNone)
+				} else {
+					b = pickleFloat(b, p.Val)
+				}
+			}
+			b = append(b, pickleAppends)
+		}
+		b = append(b, pickleSetItems)
+	}
+	if len(series) != 0 {
+		b = append(b, pickleAppends)
+	}
+	return append(b, pickleStop), nil
+}
+
+// pickleIntervals appends a graphite.intervals.IntervalSet holding a single interval, as graphite-web has in the find results of its cluster servers.
+// the objects are built from their attributes, which works for both the old style classes of python 2, and the __slots__ of python 3.
+func pickleIntervals(b []byte, start, end uint32) []byte {
+	b = append(b, pickleMark)
+	b = pickleClass(b, "graphite.intervals", "IntervalSet")
+	b = append(b, pickleObj, pickleNone, pickleEmptyDict, pickleMark)
+	b = pickleAttr(b, "intervals")
+	b = append(b, pickleEmptyList, pickleMark)
+	b = append(b, pickleMark)
+	b = pickleClass(b, "graphite.intervals", "Interval")
+	b = append(b, pickleObj, pickleNone, pickleEmptyDict, pickleMark)
+	b = pickleAttr(b, "start")
+	b = pickleFloat(b, float64(start))
+	b = pickleAttr(b, "end")
+	b = pickleFloat(b, float64(end))
+	b = pickleAttr(b, "tuple")
+	b = pickleFloat(b, float64(start))
+	b = pickleFloat(b, float64(end))
+	b = append(b, pickleTuple2)
+	b = pickleAttr(b, "size")
+	b = pickleFloat(b, float64(end-start))
+	b = append(b, pickleSetItems, pickleTuple2, pickleBuild)
+	b = append(b, pickleAppends)
+	b = pickleAttr(b, "size")
+	b = pickleFloat(b, float64(end-start))
+	return append(b, pickleSetItems, pickleTuple2, pickleBuild)
+}
+
+func pickleClass(b []byte, module, name string) []byte {
+	b = append(b, pickleGlobal)
+	b = append(b, module...)
+	b = append(b, '\n')
+	b = append(b, name...)
+	return append(b, '\n')
+}
+
+// pickleAttr appends the name of an attribute, which must be shorter than 256 bytes
+func pickleAttr(b []byte, name string) []byte {
+	b = append(b, pickleShortBin, byte(len(name)))
+	return append(b, name...)
+}
+
+func pickleFloat(b []byte, v float64) []byte {
+	b = append(b, pickleBinFloat)
+	return appendUint64BE(b, math.Float64bits(v))
+}
+
+func pickleBool(b []byte, v bool) []byte {
+	if v {
+		return append(b, pickleNewTrue)
+	}
+	return append(b, pickleNewFalse)
+}
+
+func pickleString(b []byte, s string) []byte {
+	b = append(b, pickleBinUnicode)
+	b = appendUint32LE(b, uint32(len(s)))
+	return append(b, s...)
+}
+
+func pickleInt(b []byte, v uint32) []byte {
+	if v <= math.MaxInt32 {
+		b = append(b, pickleBinInt)
+		return appendUint32LE(b, v)
+	}
+	// a 5 byte little endian long, so that the sign bit stays clear
+	b = append(b, pickleLong1, 5)
+	b = appendUint32LE(b, v)
+	return append(b, 0)
+}
+
+// protobuf output. the messages are:
+//
+//	message Series {
+//	  string target = 1;
+//	  uint32 interval = 2;
+//	  repeated uint32 timestamps = 3 [packed=true];
+//	  repeated double values = 4 [packed=true]; // null values are NaN
+//	}
+//	message Response {
+//	  repeated Series series = 1;
+//	}
+func graphiteProtobuf(b []byte, series []Series) ([]byte, error) {
+	var msg []byte
+	for _, s := range series {
+		msg = msg[:0]
+		msg = protoKey(msg, 1, protoWireBytes)
+		msg = protoVarint(msg, uint64(len(s.Target)))
+		msg = append(msg, s.Target...)
+		msg = protoKey(msg, 2, protoWireVarint)
+		msg = protoVarint(msg, uint64(s.Interval))
+		if len(s.Datapoints) != 0 {
+			size := 0
+			for _, p := range s.Datapoints {
+				size += protoVarintSize(uint64(p.Ts))
+			}
+			msg = protoKey(msg, 3, protoWireBytes)
+			msg = protoVarint(msg, uint64(size))
+			for _, p := range s.Datapoints {
+				msg = protoVarint(msg, uint64(p.Ts))
+			}
+			msg = protoKey(msg, 4, protoWireBytes)
+			msg = protoVarint(msg, uint64(8*len(s.Datapoints)))
+			for _, p := range s.Datapoints {
+				msg = appendUint64LE(msg, math.Float64bits(p.Val))
+			}
+		}
+		b = protoKey(b, 1, protoWireBytes)
+		b = protoVarint(b, uint64(len(msg)))
+		b = append(b, msg...)
+	}
+	return b, nil
+}
+
+// protobuf wire types
+const (
+	protoWireVarint = 0
+	protoWireBytes  = 2
+)
+
+func protoKey(b []byte, field, wire int) []byte {
+	return protoVarint(b, uint64(field<<3|wire))
+}
+
+func protoVarint(b []byte, v uint64) []byte {
+	var buf [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(buf[:], v)
+	return append(b, buf[:n]...)
+}
+
+func protoVarintSize(v uint64) int {
+	n := 1
+	for v >= 0x80 {
+		v >>= 7
+		n++
+	}
+	return n
+}
+
+func appendUint32LE(b []byte, v uint32) []byte {
+	return append(b, byte(v), byte(v>>8), byte(v>>16), byte(v>>24))
+}
+
+func appendUint64LE(b []byte, v uint64) []byte {
+	return append(b, byte(v), byte(v>>8), byte(v>>16), byte(v>>24), byte(v>>32), byte(v>>40), byte(v>>48), byte(v>>56))
+}
+
+func appendUint64BE(b []byte, v uint64) []byte {
+	return append(b, byte(v>>56), byte(v>>48), byte(v>>40), byte(v>>32), byte(v>>24), byte(v>>16), byte(v>>8), byte(v))
+}
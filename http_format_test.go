@@ -0,0 +1,92 @@
+package main
+
+import (
+	"bytes"
+	"math"
+	"testing"
+
+	"github.com/raintank/metrictank/idx"
+	"github.com/tinylib/msgp/msgp"
+	"gopkg.in/raintank/schema.v1"
+)
+
+var formatTestSeries = []Series{
+	{
+		Target:     "a.b",
+		Datapoints: []schema.Point{{1.5, 10}, {math.NaN(), 20}},
+		Interval:   10,
+	},
+}
+
+func TestJsonFullPrecision(t *testing.T) {
+	series := []Series{{Target: "a", Datapoints: []schema.Point{{0.123456, 60}, {math.NaN(), 120}}, Interval: 60}}
+	js, err := graphiteJSON(nil, series, -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	exp := `[{"target":"a","datapoints":[[0.123456,60],[null,120]]}]`
+	if string(js) != exp {
+		t.Fatalf("bad json output.\nexpected:%s\ngot:     %s\n", exp, js)
+	}
+}
+
+func TestPickle(t *testing.T) {
+	b, err := graphitePickle(nil, formatTestSeries)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// pickle.loads() of this is [{'name': 'a.b', 'pathExpression': 'a.b', 'start': 10, 'end': 30, 'step': 10, 'values': [1.5, None]}]
+	exp := []byte("\x80\x02](}(X\x04\x00\x00\x00nameX\x03\x00\x00\x00a.bX\x0e\x00\x00\x00pathExpressionX\x03\x00\x00\x00a.b" +
+		"X\x05\x00\x00\x00startJ\x0a\x00\x00\x00X\x03\x00\x00\x00endJ\x1e\x00\x00\x00X\x04\x00\x00\x00stepJ\x0a\x00\x00\x00" +
+		"X\x06\x00\x00\x00values](G\x3f\xf8\x00\x00\x00\x00\x00\x00Neue.")
+	if !bytes.Equal(b, exp) {
+		t.Fatalf("bad pickle output.\nexpected:%q\ngot:     %q\n", exp, b)
+	}
+}
+
+func TestMsgpack(t *testing.T) {
+	b, err := graphiteMsgpack(nil, formatTestSeries)
+	if err != nil {
+		t.Fatal(err)
+	}
+	n, b, err := msgp.ReadArrayHeaderBytes(b)
+	if err != nil || n != 1 {
+		t.Fatalf("expected an array of 1 series, got %d (%v)", n, err)
+	}
+	fields, b, err := msgp.ReadMapHeaderBytes(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var values []interface{}
+	for i := uint32(0); i < fields; i++ {
+		var key string
+		key, b, err = msgp.ReadStringBytes(b)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var val interface{}
+		val, b, err = msgp.ReadIntfBytes(b)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if key == "values" {
+			values = val.([]interface{})
+		}
+	}
+	if len(b) != 0 || len(values) != 2 || values[0] != 1.5 || values[1] != nil {
+		t.Fatalf("expected values [1.5, nil], got %v with %d bytes left", values, len(b))
+	}
+}
+
+func TestFindPickle(t *testing.T) {
+	b, err := findPickle([]idx.Node{{Path: "a.b", Leaf: false}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// pickle.loads() of this is [{'path': 'a.b', 'metric_path': 'a.b', 'is_leaf': False, 'isLeaf': False}]
+	exp := []byte("\x80\x02](}(X\x04\x00\x00\x00pathX\x03\x00\x00\x00a.bX\x0b\x00\x00\x00metric_pathX\x03\x00\x00\x00a.b" +
+		"X\x07\x00\x00\x00is_leaf\x89X\x06\x00\x00\x00isLeaf\x89ue.")
+	if !bytes.Equal(b, exp) {
+		t.Fatalf("bad pickle output.\nexpected:%q\ngot:     %q\n", exp, b)
+	}
+}
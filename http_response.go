@@ -14,6 +14,8 @@ const (
 	httpTypePickle              = iota
 	httpTypePNG                 = iota
 	httpTypeCSV                 = iota
+	httpTypeGob                 = iota
+	httpTypeMsgpack             = iota
 )
 
 func writeResponse(w http.ResponseWriter, b []byte, format httpType, jsonp string) {
@@ -45,6 +47,12 @@ func writeResponse(w http.ResponseWriter, b []byte, format httpType, jsonp strin
 	case httpTypePNG:
 		w.Header().Set("Content-Type", contentTypePNG)
 		w.Write(b)
+	case httpTypeGob:
+		w.Header().Set("Content-Type", contentTypeGob)
+		w.Write(b)
+	case httpTypeMsgpack:
+		w.Header().Set("Content-Type", contentTypeMsgpack)
+		w.Write(b)
 	}
 }
 
@@ -56,4 +64,6 @@ const (
 	contentTypePickle     = "application/pickle"
 	contentTypePNG        = "image/png"
 	contentTypeCSV        = "text/csv"
+	contentTypeGob        = "application/x-gob"
+	contentTypeMsgpack    = "application/x-msgpack"
 )
@@ -1,8 +1,17 @@
 package main
 
 import (
-	"gopkg.in/raintank/schema.v1"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
 	"testing"
+
+	"github.com/hydrogen18/stalecucumber"
+	"github.com/raintank/met/helper"
+	"github.com/raintank/metrictank/idx/memory"
+	"github.com/raintank/metrictank/mdata"
+	"gopkg.in/raintank/schema.v1"
 )
 
 func TestJsonMarshal(t *testing.T) {
@@ -68,7 +77,7 @@ func TestJsonMarshal(t *testing.T) {
 	}
 	js := bufPool.Get().([]byte)
 	for _, c := range cases {
-		js, err := graphiteRaintankJSON(js[:0], c.in)
+		js, err := graphiteRaintankJSON(js[:0], c.in, 3)
 		if err != nil {
 			panic(err)
 		}
@@ -98,7 +107,7 @@ func BenchmarkSeriesJson(b *testing.B) {
 	b.ResetTimer()
 	for n := 0; n < b.N; n++ {
 		js := bufPool.Get().([]byte)
-		js, err := graphiteRaintankJSON(js, data)
+		js, err := graphiteRaintankJSON(js, data, 3)
 		if err != nil || len(js) < 1000 {
 			panic(err)
 		}
@@ -131,10 +140,175 @@ func BenchmarkHttpRespJson(b *testing.B) {
 
 	for n := 0; n < b.N; n++ {
 		js := bufPool.Get().([]byte)
-		js, err := graphiteRaintankJSON(js, data)
+		js, err := graphiteRaintankJSON(js, data, 3)
 		if err != nil || len(js) < 1000 {
 			panic(err)
 		}
 		bufPool.Put(js[:0])
 	}
 }
+
+func TestDelete(t *testing.T) {
+	stats, _ := helper.New(false, "", "standard", "metrictank", "")
+	mdata.CluStatus = mdata.NewClusterStatus("default", false)
+	mdata.InitMetrics(stats)
+
+	store := mdata.NewDevnullStore()
+	aggSettings := []mdata.AggSetting{{600, 3600, 2, 86400, true}}
+	metrics = mdata.NewAggMetrics(store, 600, 10, 800, 8000, 10000, 0, 0, aggSettings, nil, nil)
+	metricIndex := memory.New()
+	metricIndex.Init(stats)
+
+	ids := make(map[string]string)
+	for _, name := range []string{"a.b.c", "a.b.d", "a.e"} {
+		data := &schema.MetricData{OrgId: 1, Name: name, Metric: name, Interval: 10, Time: 100, Mtype: "gauge"}
+		data.SetId()
+		metricIndex.Add(data)
+		metrics.GetOrCreate(data.Id, data.Name).Add(100, 1)
+		ids[name] = data.Id
+	}
+
+	del := func(dryRun string) (map[string]deletedSeries, int) {
+		req, _ := http.NewRequest("POST", "/metrics/delete?query=a.b&dryRun="+dryRun, nil)
+		req.Header.Set("x-org-id", "1")
+		w := httptest.NewRecorder()
+		Delete(metricIndex, store)(w, req)
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected status 200, got %d: %s", w.Code, w.Body.String())
+		}
+		var resp struct {
+			DeletedDefs   int
+			DeletedSeries []deletedSeries
+		}
+		if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+			t.Fatal(err)
+		}
+		series := make(map[string]deletedSeries)
+		for _, s := range resp.DeletedSeries {
+			series[s.Name] = s
+		}
+		return series, resp.DeletedDefs
+	}
+
+	for _, dryRun := range []string{"true", "false"} {
+		series, num := del(dryRun)
+		if num != 2 || len(series) != 2 {
+			t.Fatalf("dryRun=%s: expected 2 deleted series, got %d: %v", dryRun, num, series)
+		}
+		keys := series["a.b.c"].Keys
+		if len(keys) != 5 || keys[0] != ids["a.b.c"] || keys[1] != ids["a.b.c"]+"_min_600" {
+			t.Fatalf("dryRun=%s: expected the raw and the 4 rollup keys, got %v", dryRun, keys)
+		}
+		_, ok := metrics.Get(ids["a.b.c"])
+		if ok != (dryRun == "true") {
+			t.Fatalf("dryRun=%s: expected the series to be in memory: %t, got %t", dryRun, dryRun == "true", ok)
+		}
+	}
+	if _, ok := metrics.Get(ids["a.e"]); !ok {
+		t.Fatalf("expected the series that didn't match to be kept")
+	}
+	if series, num := del("false"); num != 0 || len(series) != 0 {
+		t.Fatalf("expected nothing left to delete, got %d: %v", num, series)
+	}
+}
+
+func TestGraphiteWebOrg(t *testing.T) {
+	defer func(org int) { *graphiteWebOrg = org }(*graphiteWebOrg)
+	req, _ := http.NewRequest("GET", "/metrics/find?query=*&format=pickle", nil)
+	*graphiteWebOrg = 0
+	if _, err := getGraphiteWebOrg(req); err == nil {
+		t.Fatalf("expected requests without header to fail when graphite-web-org is not set")
+	}
+	*graphiteWebOrg = 3
+	if org, err := getGraphiteWebOrg(req); err != nil || org != 3 {
+		t.Fatalf("expected requests without header to be served for org 3, got %d, %v", org, err)
+	}
+	req.Header.Set("x-org-id", "2")
+	if org, err := getGraphiteWebOrg(req); err != nil || org != 2 {
+		t.Fatalf("expected the header to take precedence, got %d, %v", org, err)
+	}
+}
+
+func TestGetSeriesOrg(t *testing.T) {
+	cases := []struct {
+		header  string
+		targets []string
+		org     int
+	}{
+		{"3", []string{"1.01234567890abcdef01234567890abcd"}, 3},
+		{"", []string{"2.01234567890abcdef01234567890abcd", "1.01234567890abcdef01234567890abcd"}, 2},
+		{"", []string{"consolidateBy(5.01234567890abcdef01234567890abcd,'max')"}, 5},
+	}
+	for i, c := range cases {
+		req, _ := http.NewRequest("GET", "/get?target="+strings.Join(c.targets, "&target="), nil)
+		if c.header != "" {
+			req.Header.Set("x-org-id", c.header)
+		}
+		org, err := getSeriesOrg(req)
+		if err != nil || org != c.org {
+			t.Fatalf("case %d: expected org %d, got %d, %v", i, c.org, org, err)
+		}
+	}
+}
+
+// graphite-web doesn't send maxDataPoints with its pickle requests, as it consolidates the data itself
+func TestGetPickleUnconsolidated(t *testing.T) {
+	stats, _ := helper.New(false, "", "standard", "metrictank", "")
+	mdata.CluStatus = mdata.NewClusterStatus("default", true)
+	mdata.InitMetrics(stats)
+	initMetrics(stats)
+
+	store := mdata.NewDevnullStore()
+	metrics = mdata.NewAggMetrics(store, 3600, 10, 800, 8000, 100000, 0, 0, make([]mdata.AggSetting, 0), nil, nil)
+	metricIndex := memory.New()
+	metricIndex.Init(stats)
+
+	data := &schema.MetricData{OrgId: 1, Name: "foo", Metric: "foo", Interval: 10, Time: 100, Mtype: "gauge"}
+	data.SetId()
+	metricIndex.Add(data)
+	m := metrics.GetOrCreate(data.Id, data.Name)
+	// 2000 points
+	for ts := uint32(3610); ts <= 23600; ts += 10 {
+		m.Add(ts, 1)
+	}
+
+	render := func(params string) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest("GET", "/render?target=foo&from=3600&until=23600&"+params, nil)
+		req.Header.Set("x-org-id", "1")
+		w := httptest.NewRecorder()
+		getLegacy(store, metricIndex, make([]mdata.AggSetting, 0), 0)(w, req)
+		if w.Code != http.StatusOK {
+			t.Fatalf("%s: expected status 200, got %d: %s", params, w.Code, w.Body.String())
+		}
+		return w
+	}
+	cases := []struct {
+		params string
+		step   int64
+		points int
+	}{
+		{"format=pickle", 10, 2000},
+		{"format=pickle&maxDataPoints=800", 30, 667},
+	}
+	for _, c := range cases {
+		w := render(c.params)
+		series, err := stalecucumber.ListOrTuple(stalecucumber.Unpickle(w.Body))
+		if err != nil || len(series) != 1 {
+			t.Fatalf("%s: expected 1 series, got %v: %v", c.params, series, err)
+		}
+		s, err := stalecucumber.DictString(series[0], nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		values, _ := stalecucumber.ListOrTuple(s["values"], nil)
+		if s["step"] != c.step || len(values) != c.points {
+			t.Fatalf("%s: expected %d points with a step of %d, got %d with a step of %v", c.params, c.points, c.step, len(values), s["step"])
+		}
+	}
+
+	// json requests are still consolidated by default
+	var out []struct{ Datapoints [][2]float64 }
+	if err := json.Unmarshal(render("format=json").Body.Bytes(), &out); err != nil || len(out) != 1 || len(out[0].Datapoints) > 800 {
+		t.Fatalf("expected at most 800 points, got %v: %v", out, err)
+	}
+}
@@ -21,10 +21,9 @@ type Node struct {
 }
 
 /*
-Currently the index is solely used for supporting Graphite style queries.
-So, the index only needs to be able to search by a pattern that matches the
-MetricDefinition.Name field. In future we plan to extend the searching
-capabilities to include the other fields in the definition.
+The index is used for supporting Graphite style queries, which search by a
+pattern that matches the MetricDefinition.Name field, and for querying by the
+metrics2.0 tags in the MetricDefinition.Tags field.
 
 Note:
 
@@ -66,6 +65,22 @@ Interface
   And the unix stimestamp is used to ignore series that have been stale since
   the timestmap.
 
+* Tags(int, string) ([]string, error):
+  This method returns the sorted list of tag keys used by the metricDefinitions
+  of the passed OrgId and OrgId -1. Tags without a value, like "foo", are
+  listed as a key. If the passed filter is not empty, only keys matching the
+  regular expression (anchored at the start) should be returned.
+
+* TagValues(int, string, string) ([]string, error):
+  This method returns the sorted list of values of the passed tag key for the
+  passed OrgId and OrgId -1, optionally filtered like Tags.
+
+* FindByTag(int, []string, int64) ([]Node, error):
+  This method searches series by their tags. The method is passed an OrgId,
+  a list of tag expressions (see ParseTagExpression) which all need to match,
+  and a unix timestamp used like in Find. It returns leaf nodes sorted by path,
+  with public series excluded in the same way as in Find.
+
 * Delete(int, string) ([]schema.MetricDefinition, error):
   This method is used for deleting items from the index. The method is passed
   an OrgId and a query pattern.  If the pattern matches a branch node, then
@@ -87,6 +102,9 @@ type MetricIndex interface {
 	Get(string) (schema.MetricDefinition, error)
 	Delete(int, string) ([]schema.MetricDefinition, error)
 	Find(int, string, int64) ([]Node, error)
+	Tags(int, string) ([]string, error)
+	TagValues(int, string, string) ([]string, error)
+	FindByTag(int, []string, int64) ([]Node, error)
 	List(int) []schema.MetricDefinition
 	Prune(int, time.Time) ([]schema.MetricDefinition, error)
 }
@@ -4,6 +4,7 @@ import (
 	"flag"
 	"fmt"
 	"regexp"
+	"sort"
 	"strings"
 	"sync"
 	"time"
@@ -16,13 +17,15 @@ import (
 )
 
 var (
-	idxOk             met.Count
-	idxFail           met.Count
-	idxAddDuration    met.Timer
-	idxGetDuration    met.Timer
-	idxListDuration   met.Timer
-	idxFindDuration   met.Timer
-	idxDeleteDuration met.Timer
+	idxOk                met.Count
+	idxFail              met.Count
+	idxAddDuration       met.Timer
+	idxGetDuration       met.Timer
+	idxListDuration      met.Timer
+	idxFindDuration      met.Timer
+	idxDeleteDuration    met.Timer
+	idxTagsDuration      met.Timer
+	idxFindByTagDuration met.Timer
 
 	Enabled bool
 )
@@ -51,17 +54,61 @@ func (n *Node) String() string {
 	return fmt.Sprintf("%s - %s", t, n.Path)
 }
 
+// TagIndex is an inverted index of the tags of an org's metricDefinitions.
+// it maps tag keys to tag values to the set of ids of the metricDefinitions which have that tag.
+type TagIndex map[string]map[string]map[string]struct{}
+
+func (t TagIndex) add(def *schema.MetricDefinition) {
+	for _, tag := range def.Tags {
+		key, value := idx.SplitTag(tag)
+		values, ok := t[key]
+		if !ok {
+			values = make(map[string]map[string]struct{})
+			t[key] = values
+		}
+		ids, ok := values[value]
+		if !ok {
+			ids = make(map[string]struct{})
+			values[value] = ids
+		}
+		ids[def.Id] = struct{}{}
+	}
+}
+
+func (t TagIndex) delete(def *schema.MetricDefinition) {
+	for _, tag := range def.Tags {
+		key, value := idx.SplitTag(tag)
+		values, ok := t[key]
+		if !ok {
+			continue
+		}
+		ids, ok := values[value]
+		if !ok {
+			continue
+		}
+		delete(ids, def.Id)
+		if len(ids) == 0 {
+			delete(values, value)
+		}
+		if len(values) == 0 {
+			delete(t, key)
+		}
+	}
+}
+
 // Implements the the "MetricIndex" interface
 type MemoryIdx struct {
 	sync.RWMutex
 	DefById map[string]*schema.MetricDefinition
 	Tree    map[int]*Tree
+	TagIdx  map[int]TagIndex
 }
 
 func New() *MemoryIdx {
 	return &MemoryIdx{
 		DefById: make(map[string]*schema.MetricDefinition),
 		Tree:    make(map[int]*Tree),
+		TagIdx:  make(map[int]TagIndex),
 	}
 }
 
@@ -73,6 +120,8 @@ func (m *MemoryIdx) Init(stats met.Backend) error {
 	idxListDuration = stats.NewTimer("idx.memory.list_duration", 0)
 	idxFindDuration = stats.NewTimer("idx.memory.find_duration", 0)
 	idxDeleteDuration = stats.NewTimer("idx.memory.delete_duration", 0)
+	idxTagsDuration = stats.NewTimer("idx.memory.tags_duration", 0)
+	idxFindByTagDuration = stats.NewTimer("idx.memory.find_by_tag_duration", 0)
 	return nil
 }
 
@@ -158,6 +207,7 @@ func (m *MemoryIdx) add(def *schema.MetricDefinition) {
 			}
 			log.Debug("memory-idx: existing index entry for %s. Adding %s as child", path, def.Id)
 			node.Children = append(node.Children, def.Id)
+			m.indexTags(def)
 			idxOk.Inc(1)
 			return
 		}
@@ -211,10 +261,23 @@ func (m *MemoryIdx) add(def *schema.MetricDefinition) {
 		Path:     path,
 		Children: []string{def.Id},
 	}
+	m.indexTags(def)
 	idxOk.Inc(1)
 	return
 }
 
+func (m *MemoryIdx) indexTags(def *schema.MetricDefinition) {
+	if len(def.Tags) == 0 {
+		return
+	}
+	tags, ok := m.TagIdx[def.OrgId]
+	if !ok {
+		tags = make(TagIndex)
+		m.TagIdx[def.OrgId] = tags
+	}
+	tags.add(def)
+}
+
 func (m *MemoryIdx) Get(id string) (schema.MetricDefinition, error) {
 	pre := time.Now()
 	m.RLock()
@@ -426,6 +489,149 @@ func (m *MemoryIdx) List(orgId int) []schema.MetricDefinition {
 	return defs
 }
 
+// Tags returns the sorted tag keys used by the metricDefinitions of the org and the public org -1.
+// if filter is not empty, only keys matching the regular expression are returned.
+func (m *MemoryIdx) Tags(orgId int, filter string) ([]string, error) {
+	pre := time.Now()
+	re, err := compileTagFilter(filter)
+	if err != nil {
+		return nil, err
+	}
+	m.RLock()
+	defer m.RUnlock()
+	seen := make(map[string]struct{})
+	for _, org := range []int{orgId, -1} {
+		for key := range m.TagIdx[org] {
+			if re == nil || re.MatchString(key) {
+				seen[key] = struct{}{}
+			}
+		}
+	}
+	idxTagsDuration.Value(time.Since(pre))
+	return sortedKeys(seen), nil
+}
+
+// TagValues returns the sorted values of the given tag key for the org and the public org -1.
+// if filter is not empty, only values matching the regular expression are returned.
+func (m *MemoryIdx) TagValues(orgId int, tag, filter string) ([]string, error) {
+	pre := time.Now()
+	re, err := compileTagFilter(filter)
+	if err != nil {
+		return nil, err
+	}
+	m.RLock()
+	defer m.RUnlock()
+	seen := make(map[string]struct{})
+	for _, org := range []int{orgId, -1} {
+		for value := range m.TagIdx[org][tag] {
+			if re == nil || re.MatchString(value) {
+				seen[value] = struct{}{}
+			}
+		}
+	}
+	idxTagsDuration.Value(time.Since(pre))
+	return sortedKeys(seen), nil
+}
+
+// FindByTag returns the leaf nodes of all series matching all of the tag expressions.
+// like Find, public series are excluded if the org has a series with the same path.
+func (m *MemoryIdx) FindByTag(orgId int, expressions []string, from int64) ([]idx.Node, error) {
+	pre := time.Now()
+	exprs, err := idx.ParseTagExpressions(expressions)
+	if err != nil {
+		return nil, err
+	}
+	m.RLock()
+	defer m.RUnlock()
+	byPath := make(map[string]*idx.Node)
+	for _, org := range []int{orgId, -1} {
+		orgPaths := make(map[string]struct{})
+		for _, def := range m.findByTag(org, exprs) {
+			if from != 0 && def.LastUpdate < from {
+				continue
+			}
+			node, ok := byPath[def.Name]
+			if ok {
+				if _, ours := orgPaths[def.Name]; !ours {
+					log.Debug("memory-idx: path %s already seen", def.Name)
+					continue
+				}
+			} else {
+				node = &idx.Node{
+					Path: def.Name,
+					Leaf: true,
+					Defs: make([]schema.MetricDefinition, 0, 1),
+				}
+				byPath[def.Name] = node
+				orgPaths[def.Name] = struct{}{}
+			}
+			node.Defs = append(node.Defs, *def)
+		}
+	}
+	paths := make([]string, 0, len(byPath))
+	for path := range byPath {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+	results := make([]idx.Node, len(paths))
+	for i, path := range paths {
+		results[i] = *byPath[path]
+	}
+	log.Debug("memory-idx: %d series matching tag expressions %v found", len(results), expressions)
+	idxFindByTagDuration.Value(time.Since(pre))
+	return results, nil
+}
+
+// findByTag returns the metricDefinitions of the org that match all expressions.
+// candidates are looked up in the inverted index using the first positive expression,
+// and then checked against all other expressions.
+func (m *MemoryIdx) findByTag(orgId int, exprs []idx.TagExpression) []*schema.MetricDefinition {
+	tags, ok := m.TagIdx[orgId]
+	if !ok {
+		return nil
+	}
+	var first idx.TagExpression
+	for _, e := range exprs {
+		if e.Positive() {
+			first = e
+			break
+		}
+	}
+	candidates := make(map[string]struct{})
+	for value, ids := range tags[first.Key] {
+		if !first.Matches(value) {
+			continue
+		}
+		for id := range ids {
+			candidates[id] = struct{}{}
+		}
+	}
+	defs := make([]*schema.MetricDefinition, 0, len(candidates))
+	for id := range candidates {
+		def := m.DefById[id]
+		if idx.MatchTags(def.Tags, exprs) {
+			defs = append(defs, def)
+		}
+	}
+	return defs
+}
+
+func compileTagFilter(filter string) (*regexp.Regexp, error) {
+	if filter == "" {
+		return nil, nil
+	}
+	return regexp.Compile("^(?:" + filter + ")")
+}
+
+func sortedKeys(set map[string]struct{}) []string {
+	keys := make([]string, 0, len(set))
+	for k := range set {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
 func (m *MemoryIdx) Delete(orgId int, pattern string) ([]schema.MetricDefinition, error) {
 	pre := time.Now()
 	m.Lock()
@@ -470,6 +676,9 @@ func (m *MemoryIdx) delete(orgId int, n *Node) ([]schema.MetricDefinition, error
 	for i, id := range n.Children {
 		log.Debug("memory-idx: deleteing %s from index", id)
 		deletedDefs[i] = *m.DefById[id]
+		if tags, ok := m.TagIdx[orgId]; ok {
+			tags.delete(m.DefById[id])
+		}
 		delete(m.DefById, id)
 	}
 	tree := m.Tree[orgId]
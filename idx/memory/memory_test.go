@@ -348,6 +348,99 @@ func TestPrune(t *testing.T) {
 
 }
 
+func TestTags(t *testing.T) {
+	ix := New()
+	stats, _ := helper.New(false, "", "standard", "metrictank", "")
+	ix.Init(stats)
+	add := func(orgId int, name string, tags ...string) {
+		data := &schema.MetricData{
+			Name:     name,
+			Metric:   name,
+			OrgId:    orgId,
+			Interval: 10,
+			Tags:     tags,
+			Time:     10 * 86400,
+		}
+		data.SetId()
+		ix.Add(data)
+	}
+	add(1, "web1.cpu", "dc:us-east", "role:web", "cpu")
+	add(1, "web2.cpu", "dc:us-west", "role:web", "cpu")
+	add(1, "db1.cpu", "dc:us-east", "role:db", "cpu")
+	add(1, "db1.disk", "dc:us-east", "role:db", "disk:sda")
+	add(-1, "public.cpu", "dc:us-east", "role:webproxy")
+	add(2, "other.cpu", "dc:eu", "role:web")
+
+	Convey("When listing tags", t, func() {
+		tags, err := ix.Tags(1, "")
+		So(err, ShouldBeNil)
+		So(tags, ShouldResemble, []string{"cpu", "dc", "disk", "role"})
+		tags, err = ix.Tags(1, "d")
+		So(err, ShouldBeNil)
+		So(tags, ShouldResemble, []string{"dc", "disk"})
+		Convey("and listing tag values", func() {
+			values, err := ix.TagValues(1, "dc", "")
+			So(err, ShouldBeNil)
+			So(values, ShouldResemble, []string{"us-east", "us-west"})
+			values, err = ix.TagValues(1, "role", "web")
+			So(err, ShouldBeNil)
+			So(values, ShouldResemble, []string{"web", "webproxy"})
+			values, err = ix.TagValues(2, "dc", "")
+			So(err, ShouldBeNil)
+			So(values, ShouldResemble, []string{"eu", "us-east"})
+		})
+	})
+
+	Convey("When finding series by tag", t, func() {
+		paths := func(nodes []idx.Node) []string {
+			p := make([]string, len(nodes))
+			for i, n := range nodes {
+				p[i] = n.Path
+				So(n.Leaf, ShouldBeTrue)
+				So(n.Defs, ShouldHaveLength, 1)
+			}
+			return p
+		}
+		nodes, err := ix.FindByTag(1, []string{"dc=us-east"}, 0)
+		So(err, ShouldBeNil)
+		So(paths(nodes), ShouldResemble, []string{"db1.cpu", "db1.disk", "public.cpu", "web1.cpu"})
+		nodes, err = ix.FindByTag(1, []string{"dc=us-east", "role=~web.*"}, 0)
+		So(err, ShouldBeNil)
+		So(paths(nodes), ShouldResemble, []string{"public.cpu", "web1.cpu"})
+		nodes, err = ix.FindByTag(1, []string{"role=~web.*", "dc!=us-east"}, 0)
+		So(err, ShouldBeNil)
+		So(paths(nodes), ShouldResemble, []string{"web2.cpu"})
+		nodes, err = ix.FindByTag(1, []string{"dc=~us-.*", "disk!=~sd.*", "role!=webproxy"}, 0)
+		So(err, ShouldBeNil)
+		So(paths(nodes), ShouldResemble, []string{"db1.cpu", "web1.cpu", "web2.cpu"})
+		nodes, err = ix.FindByTag(1, []string{"dc=us-east"}, 20*86400)
+		So(err, ShouldBeNil)
+		So(nodes, ShouldHaveLength, 0)
+		Convey("with invalid expressions", func() {
+			_, err := ix.FindByTag(1, []string{"dc!=us-east"}, 0)
+			So(err, ShouldEqual, idx.ErrNoPositiveTagMatch)
+			_, err = ix.FindByTag(1, []string{"dc"}, 0)
+			So(err, ShouldNotBeNil)
+			_, err = ix.FindByTag(1, []string{"dc=~us-(east"}, 0)
+			So(err, ShouldNotBeNil)
+		})
+	})
+
+	Convey("When deleting series", t, func() {
+		_, err := ix.Delete(1, "db1.*")
+		So(err, ShouldBeNil)
+		tags, err := ix.Tags(1, "")
+		So(err, ShouldBeNil)
+		So(tags, ShouldResemble, []string{"cpu", "dc", "role"})
+		values, err := ix.TagValues(1, "role", "")
+		So(err, ShouldBeNil)
+		So(values, ShouldResemble, []string{"web", "webproxy"})
+		nodes, err := ix.FindByTag(1, []string{"role=db"}, 0)
+		So(err, ShouldBeNil)
+		So(nodes, ShouldHaveLength, 0)
+	})
+}
+
 func BenchmarkIndexing(b *testing.B) {
 	ix := New()
 	stats, _ := helper.New(false, "", "standard", "metrictank", "")
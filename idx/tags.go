@@ -0,0 +1,168 @@
+package idx
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+var (
+	ErrInvalidTagExpression = errors.New("invalid tag expression")
+	ErrNoPositiveTagMatch   = errors.New("at least one tag expression must be of the form tag=value or tag=~regex")
+)
+
+type TagOperator int
+
+const (
+	TagEqual    TagOperator = iota // tag=value
+	TagNotEqual                    // tag!=value
+	TagMatch                       // tag=~regex
+	TagNotMatch                    // tag!=~regex
+)
+
+func (o TagOperator) String() string {
+	switch o {
+	case TagEqual:
+		return "="
+	case TagNotEqual:
+		return "!="
+	case TagMatch:
+		return "=~"
+	case TagNotMatch:
+		return "!=~"
+	}
+	return fmt.Sprintf("TagOperator(%d)", int(o))
+}
+
+// TagExpression is a single condition of a tag query, such as dc=us-east or role=~web.*
+type TagExpression struct {
+	Key      string
+	Operator TagOperator
+	Value    string
+	re       *regexp.Regexp
+}
+
+// ParseTagExpression parses an expression of the form tag=value, tag!=value, tag=~regex or tag!=~regex.
+// like in graphite, regular expressions are anchored at the start of the value.
+func ParseTagExpression(s string) (TagExpression, error) {
+	pos := strings.IndexAny(s, "=!")
+	if pos < 1 {
+		return TagExpression{}, fmt.Errorf("%s: %q", ErrInvalidTagExpression, s)
+	}
+	e := TagExpression{Key: s[:pos]}
+	rest := s[pos:]
+	switch {
+	case strings.HasPrefix(rest, "!=~"):
+		e.Operator = TagNotMatch
+	case strings.HasPrefix(rest, "!="):
+		e.Operator = TagNotEqual
+	case strings.HasPrefix(rest, "=~"):
+		e.Operator = TagMatch
+	case strings.HasPrefix(rest, "="):
+		e.Operator = TagEqual
+	default:
+		return TagExpression{}, fmt.Errorf("%s: %q", ErrInvalidTagExpression, s)
+	}
+	e.Value = rest[len(e.Operator.String()):]
+	if e.Operator == TagMatch || e.Operator == TagNotMatch {
+		re, err := regexp.Compile("^(?:" + e.Value + ")")
+		if err != nil {
+			return TagExpression{}, fmt.Errorf("%s: %q: %s", ErrInvalidTagExpression, s, err)
+		}
+		e.re = re
+	}
+	return e, nil
+}
+
+// ParseTagExpressions parses all expressions of a tag query.
+// a query must contain at least one positive expression, so that it can't match the entire index.
+func ParseTagExpressions(exprs []string) ([]TagExpression, error) {
+	parsed := make([]TagExpression, len(exprs))
+	positive := false
+	for i, s := range exprs {
+		e, err := ParseTagExpression(s)
+		if err != nil {
+			return nil, err
+		}
+		if e.Positive() {
+			positive = true
+		}
+		parsed[i] = e
+	}
+	if !positive {
+		return nil, ErrNoPositiveTagMatch
+	}
+	return parsed, nil
+}
+
+// Positive returns whether the expression can only match series that have the tag
+func (e TagExpression) Positive() bool {
+	switch e.Operator {
+	case TagEqual:
+		return e.Value != ""
+	case TagMatch:
+		return !e.re.MatchString("")
+	}
+	return false
+}
+
+// Matches returns whether a tag value satisfies the expression.
+// series which don't have the tag should be checked against the empty value.
+func (e TagExpression) Matches(value string) bool {
+	switch e.Operator {
+	case TagEqual:
+		return value == e.Value
+	case TagNotEqual:
+		return value != e.Value
+	case TagMatch:
+		return e.re.MatchString(value)
+	case TagNotMatch:
+		return !e.re.MatchString(value)
+	}
+	return false
+}
+
+// MatchTags returns whether the tags of a series satisfy all expressions.
+// if a tag key occurs multiple times, positive expressions need to match any of the values,
+// and negative expressions need to match all of them. A missing tag has the empty value.
+func MatchTags(tags []string, exprs []TagExpression) bool {
+	for _, e := range exprs {
+		values := make([]string, 0, 1)
+		for _, tag := range tags {
+			key, value := SplitTag(tag)
+			if key == e.Key {
+				values = append(values, value)
+			}
+		}
+		if len(values) == 0 {
+			values = append(values, "")
+		}
+		negative := e.Operator == TagNotEqual || e.Operator == TagNotMatch
+		matched := negative
+		for _, value := range values {
+			if e.Matches(value) != negative {
+				matched = !negative
+				break
+			}
+		}
+		if !matched {
+			return false
+		}
+	}
+	return true
+}
+
+func (e TagExpression) String() string {
+	return e.Key + e.Operator.String() + e.Value
+}
+
+// SplitTag splits a metrics2.0 tag into its key and value.
+// tags without a value, like "foo", have the empty value.
+func SplitTag(tag string) (string, string) {
+	pos := strings.Index(tag, ":")
+	if pos == -1 {
+		return tag, ""
+	}
+	return tag[:pos], tag[pos+1:]
+}
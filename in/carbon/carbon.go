@@ -4,10 +4,18 @@ package carbon
 
 import (
 	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
 	"flag"
+	"fmt"
 	"io"
+	"math"
+	"math/big"
 	"net"
+	"strconv"
 
+	"github.com/hydrogen18/stalecucumber"
 	"github.com/lomik/go-carbon/persister"
 	"github.com/metrics20/go-metrics20/carbon20"
 	"github.com/raintank/met"
@@ -19,24 +27,50 @@ import (
 	"github.com/rakyll/globalconf"
 )
 
+// maximum size of a pickle message. like in carbon, larger ones are rejected
+const maxPickleSize = 1024 * 1024
+
+var (
+	errPickleTooLarge = errors.New("pickle message too large")
+	errPickleFormat   = errors.New("pickle message is not a list of (name, (timestamp, value)) tuples")
+)
+
 type Carbon struct {
 	in.In
-	addrStr string
-	addr    *net.TCPAddr
-	schemas persister.WhisperSchemas
-	stats   met.Backend
+	addrStr    string
+	addr       *net.TCPAddr
+	udpAddr    *net.UDPAddr
+	pickleAddr *net.TCPAddr
+	schemas    persister.WhisperSchemas
+	stats      met.Backend
+
+	tcpDecodeErr    met.Count // metric carbon.tcp.metrics_decode_err is a count of times a line received over tcp failed to parse
+	udpDecodeErr    met.Count // metric carbon.udp.metrics_decode_err is a count of times a line received over udp failed to parse
+	pickleDecodeErr met.Count // metric carbon.pickle.metrics_decode_err is a count of times a pickle message, or a metric in it, failed to parse
 }
 
 var Enabled bool
 var addr string
+var udpAddr string
+var pickleAddr string
 var schemasFile string
+var useRetentions bool
 var schemas persister.WhisperSchemas
 
+// the chunkspans we pick from for the rollups of a retention. they all fit without remainders into mdata.Month_sec
+var chunkSpans = []uint32{3600, 2 * 3600, 3 * 3600, 6 * 3600, 12 * 3600, 86400, 2 * 86400, 4 * 86400, 7 * 86400, 14 * 86400, 28 * 86400}
+
+// minimum amount of points we want in a rollup chunk
+const minChunkPoints = 120
+
 func ConfigSetup() {
 	inCarbon := flag.NewFlagSet("carbon-in", flag.ExitOnError)
 	inCarbon.BoolVar(&Enabled, "enabled", false, "")
 	inCarbon.StringVar(&addr, "addr", ":2003", "tcp listen address")
+	inCarbon.StringVar(&udpAddr, "udp-addr", "", "udp listen address for the plaintext protocol. empty to disable")
+	inCarbon.StringVar(&pickleAddr, "pickle-addr", "", "tcp listen address for the pickle protocol. empty to disable")
 	inCarbon.StringVar(&schemasFile, "schemas-file", "/path/to/your/schemas-file", "see http://graphite.readthedocs.io/en/latest/config-carbon.html#storage-schemas-conf")
+	inCarbon.BoolVar(&useRetentions, "use-retentions", false, "use the retentions from the schemas file as the ttl and rollups of matching series, instead of ttl and agg-settings")
 	globalconf.Register("carbon-in", inCarbon)
 }
 
@@ -57,6 +91,12 @@ func ConfigProcess() {
 		if len(schema.Retentions) == 0 {
 			log.Fatal(4, "carbon-in: retention setting cannot be empty")
 		}
+		if useRetentions {
+			err := validateRetentions(schema)
+			if err != nil {
+				log.Fatal(4, "carbon-in: schema %q: %s", schema.Name, err)
+			}
+		}
 	}
 	if !defaultFound {
 		// good graphite health (not sure what graphite does if there's no .*)
@@ -66,37 +106,122 @@ func ConfigProcess() {
 
 }
 
+// validateRetentions checks that the retentions of a schema can be used as raw ttl and rollups:
+// each retention must have a coarser resolution than the one before it, which it must be a multiple of.
+func validateRetentions(schema persister.Schema) error {
+	for i, ret := range schema.Retentions {
+		if ret.SecondsPerPoint() <= 0 || ret.NumberOfPoints() <= 0 {
+			return fmt.Errorf("retention %d must have a positive interval and number of points", i)
+		}
+		if i == 0 {
+			continue
+		}
+		prev := schema.Retentions[i-1].SecondsPerPoint()
+		if ret.SecondsPerPoint() <= prev || ret.SecondsPerPoint()%prev != 0 {
+			return fmt.Errorf("interval %d of retention %d must be a higher multiple of the interval %d before it", ret.SecondsPerPoint(), i, prev)
+		}
+	}
+	return nil
+}
+
+// Schemas returns the ttl and rollups of each schema when use-retentions is enabled, nil otherwise.
+// the first retention is the raw data, the ones after it are rollups with the interval as span.
+func Schemas() mdata.Schemas {
+	if !Enabled || !useRetentions {
+		return nil
+	}
+	out := make(mdata.Schemas, 0, len(schemas))
+	for _, schema := range schemas {
+		s := mdata.Schema{
+			Name:    schema.Name,
+			Pattern: schema.Pattern,
+			Ttl:     uint32(schema.Retentions[0].MaxRetention()),
+		}
+		for _, ret := range schema.Retentions[1:] {
+			span := uint32(ret.SecondsPerPoint())
+			s.AggSettings = append(s.AggSettings, mdata.NewAggSetting(span, rollupChunkSpan(span), 2, uint32(ret.MaxRetention()), true))
+		}
+		out = append(out, s)
+	}
+	return out
+}
+
+// rollupChunkSpan returns the smallest chunkspan that holds at least minChunkPoints points of the given span
+func rollupChunkSpan(span uint32) uint32 {
+	for _, cs := range chunkSpans {
+		if cs/span >= minChunkPoints {
+			return cs
+		}
+	}
+	return chunkSpans[len(chunkSpans)-1]
+}
+
 func New(stats met.Backend) *Carbon {
 	addrT, err := net.ResolveTCPAddr("tcp", addr)
 	if err != nil {
 		log.Fatal(4, err.Error())
 	}
-	return &Carbon{
+	c := &Carbon{
 		addrStr: addr,
 		addr:    addrT,
 		schemas: schemas,
 		stats:   stats,
 	}
+	if udpAddr != "" {
+		c.udpAddr, err = net.ResolveUDPAddr("udp", udpAddr)
+		if err != nil {
+			log.Fatal(4, err.Error())
+		}
+	}
+	if pickleAddr != "" {
+		c.pickleAddr, err = net.ResolveTCPAddr("tcp", pickleAddr)
+		if err != nil {
+			log.Fatal(4, err.Error())
+		}
+	}
+	return c
 }
 
 func (c *Carbon) Start(metrics mdata.Metrics, metricIndex idx.MetricIndex, usg *usage.Usage) {
 	c.In = in.New(metrics, metricIndex, usg, "carbon", c.stats)
+	c.tcpDecodeErr = c.stats.NewCount("carbon.tcp.metrics_decode_err")
+	c.udpDecodeErr = c.stats.NewCount("carbon.udp.metrics_decode_err")
+	c.pickleDecodeErr = c.stats.NewCount("carbon.pickle.metrics_decode_err")
+
 	l, err := net.ListenTCP("tcp", c.addr)
 	if nil != err {
 		log.Fatal(4, err.Error())
 	}
 	log.Info("carbon-in: listening on %v/tcp", c.addr)
-	go c.accept(l)
+	go c.accept(l, c.handle)
+
+	if c.udpAddr != nil {
+		conn, err := net.ListenUDP("udp", c.udpAddr)
+		if err != nil {
+			log.Fatal(4, err.Error())
+		}
+		log.Info("carbon-in: listening on %v/udp", c.udpAddr)
+		go c.handleUDP(conn)
+	}
+
+	if c.pickleAddr != nil {
+		l, err := net.ListenTCP("tcp", c.pickleAddr)
+		if err != nil {
+			log.Fatal(4, err.Error())
+		}
+		log.Info("carbon-in: listening on %v/tcp for the pickle protocol", c.pickleAddr)
+		go c.accept(l, c.handlePickle)
+	}
 }
 
-func (c *Carbon) accept(l *net.TCPListener) {
+func (c *Carbon) accept(l *net.TCPListener, handle func(net.Conn)) {
 	for {
 		conn, err := l.AcceptTCP()
 		if nil != err {
 			log.Error(4, err.Error())
 			break
 		}
-		go c.handle(conn)
+		go handle(conn)
 	}
 }
 
@@ -115,18 +240,138 @@ func (c *Carbon) handle(conn net.Conn) {
 			break
 		}
 
-		key, val, ts, err := carbon20.ValidatePacket(buf, carbon20.Medium)
+		c.handleLine(buf, c.tcpDecodeErr)
+	}
+}
+
+// handleUDP processes datagrams, which may hold multiple lines
+func (c *Carbon) handleUDP(conn *net.UDPConn) {
+	buf := make([]byte, 65535)
+	for {
+		n, _, err := conn.ReadFromUDP(buf)
 		if err != nil {
+			log.Error(4, err.Error())
+			break
+		}
+		for _, line := range bytes.Split(buf[:n], []byte{'\n'}) {
+			line = bytes.TrimSpace(line)
+			if len(line) == 0 {
+				continue
+			}
+			c.handleLine(line, c.udpDecodeErr)
+		}
+	}
+}
+
+func (c *Carbon) handleLine(buf []byte, decodeErr met.Count) {
+	key, val, ts, err := carbon20.ValidatePacket(buf, carbon20.Medium)
+	if err != nil {
+		decodeErr.Inc(1)
+		c.In.MetricsDecodeErr.Inc(1)
+		log.Error(4, "carbon-in: invalid metric: %s", err.Error())
+		return
+	}
+	c.handleMetric(string(key), val, ts)
+}
+
+func (c *Carbon) handleMetric(name string, val float64, ts uint32) {
+	s, ok := c.schemas.Match(name)
+	if !ok {
+		log.Fatal(4, "carbon-in: couldn't find a schema for %q - this is impossible since we asserted there was a default with patt .*", name)
+	}
+	interval := s.Retentions[0].SecondsPerPoint()
+	c.HandleLegacy(name, val, ts, interval)
+}
+
+// handlePickle processes messages of the pickle protocol: a 4 byte big-endian length header,
+// followed by a pickled list of (name, (timestamp, value)) tuples
+func (c *Carbon) handlePickle(conn net.Conn) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	var header [4]byte
+	for {
+		_, err := io.ReadFull(r, header[:])
+		if err != nil {
+			if io.EOF != err {
+				log.Error(4, err.Error())
+			}
+			break
+		}
+		size := binary.BigEndian.Uint32(header[:])
+		if size > maxPickleSize {
+			// we can't skip over it, so the connection is unusable
+			c.pickleDecodeErr.Inc(1)
 			c.In.MetricsDecodeErr.Inc(1)
-			log.Error(4, "carbon-in: invalid metric: %s", err.Error())
+			log.Error(4, "carbon-in: %s: %d bytes", errPickleTooLarge, size)
+			break
+		}
+		msg := make([]byte, size)
+		_, err = io.ReadFull(r, msg)
+		if err != nil {
+			log.Error(4, err.Error())
+			break
+		}
+		items, err := stalecucumber.ListOrTuple(stalecucumber.Unpickle(bytes.NewReader(msg)))
+		if err != nil {
+			c.pickleDecodeErr.Inc(1)
+			c.In.MetricsDecodeErr.Inc(1)
+			log.Error(4, "carbon-in: invalid pickle message: %s", err.Error())
 			continue
 		}
-		name := string(key)
-		s, ok := c.schemas.Match(name)
-		if !ok {
-			log.Fatal(4, "carbon-in: couldn't find a schema for %q - this is impossible since we asserted there was a default with patt .*", name)
+		for _, item := range items {
+			name, val, ts, err := parsePickleItem(item)
+			if err != nil {
+				c.pickleDecodeErr.Inc(1)
+				c.In.MetricsDecodeErr.Inc(1)
+				log.Error(4, "carbon-in: invalid metric: %s", err.Error())
+				continue
+			}
+			c.handleMetric(name, val, ts)
 		}
-		interval := s.Retentions[0].SecondsPerPoint()
-		c.HandleLegacy(string(key), val, ts, interval)
 	}
 }
+
+// parsePickleItem parses a (name, (timestamp, value)) tuple.
+// like graphite, we accept numbers of any type, as well as strings holding them
+func parsePickleItem(item interface{}) (string, float64, uint32, error) {
+	tuple, err := stalecucumber.ListOrTuple(item, nil)
+	if err != nil || len(tuple) != 2 {
+		return "", 0, 0, errPickleFormat
+	}
+	name, err := stalecucumber.String(tuple[0], nil)
+	if err != nil || name == "" {
+		return "", 0, 0, errPickleFormat
+	}
+	point, err := stalecucumber.ListOrTuple(tuple[1], nil)
+	if err != nil || len(point) != 2 {
+		return "", 0, 0, errPickleFormat
+	}
+	err = carbon20.InitialValidationB([]byte(name), carbon20.GetVersionB([]byte(name)), carbon20.Medium)
+	if err != nil {
+		return "", 0, 0, err
+	}
+	ts, err := pickleNumber(point[0])
+	if err != nil || ts < 0 || ts > math.MaxUint32 {
+		return "", 0, 0, fmt.Errorf("%s: invalid timestamp %v", name, point[0])
+	}
+	val, err := pickleNumber(point[1])
+	if err != nil {
+		return "", 0, 0, fmt.Errorf("%s: invalid value %v", name, point[1])
+	}
+	return name, val, uint32(ts), nil
+}
+
+func pickleNumber(v interface{}) (float64, error) {
+	switch n := v.(type) {
+	case float64:
+		return n, nil
+	case int64:
+		return float64(n), nil
+	case *big.Int:
+		f, _ := new(big.Float).SetInt(n).Float64()
+		return f, nil
+	case string:
+		return strconv.ParseFloat(n, 64)
+	}
+	return 0, errPickleFormat
+}
@@ -0,0 +1,116 @@
+package carbon
+
+import (
+	"bytes"
+	"regexp"
+	"testing"
+
+	"github.com/hydrogen18/stalecucumber"
+	"github.com/lomik/go-carbon/persister"
+	"github.com/raintank/metrictank/mdata"
+)
+
+func TestParsePickle(t *testing.T) {
+	type item struct {
+		name string
+		val  float64
+		ts   uint32
+		ok   bool
+	}
+	msg := []interface{}{
+		[]interface{}{"foo.bar", []interface{}{int64(1483228800), 1.5}},
+		[]interface{}{"foo.int", []interface{}{1483228800.7, int64(42)}},
+		[]interface{}{"foo.str", []interface{}{"1483228800", "-3"}},
+		[]interface{}{"foo.bad-val", []interface{}{int64(1483228800), "abc"}},
+		[]interface{}{"foo.bad-ts", []interface{}{int64(-1), 1.0}},
+		[]interface{}{"foo.no-point", int64(1)},
+		[]interface{}{"foo\x00bar", []interface{}{int64(1483228800), 1.0}},
+		[]interface{}{"", []interface{}{int64(1483228800), 1.0}},
+	}
+	exp := []item{
+		{"foo.bar", 1.5, 1483228800, true},
+		{"foo.int", 42, 1483228800, true},
+		{"foo.str", -3, 1483228800, true},
+		{ok: false},
+		{ok: false},
+		{ok: false},
+		{ok: false},
+		{ok: false},
+	}
+
+	buf := new(bytes.Buffer)
+	if _, err := stalecucumber.NewPickler(buf).Pickle(msg); err != nil {
+		t.Fatal(err)
+	}
+	items, err := stalecucumber.ListOrTuple(stalecucumber.Unpickle(buf))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(items) != len(exp) {
+		t.Fatalf("expected %d items, got %d", len(exp), len(items))
+	}
+	for i, it := range items {
+		name, val, ts, err := parsePickleItem(it)
+		if (err == nil) != exp[i].ok {
+			t.Fatalf("item %d: expected ok %t, got error %v", i, exp[i].ok, err)
+		}
+		if err != nil {
+			continue
+		}
+		if name != exp[i].name || val != exp[i].val || ts != exp[i].ts {
+			t.Fatalf("item %d: expected %s %f %d, got %s %f %d", i, exp[i].name, exp[i].val, exp[i].ts, name, val, ts)
+		}
+	}
+}
+
+func TestSchemas(t *testing.T) {
+	schema := func(name, pattern, retentions string) persister.Schema {
+		rets, err := persister.ParseRetentionDefs(retentions)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return persister.Schema{Name: name, Pattern: regexp.MustCompile(pattern), RetentionStr: retentions, Retentions: rets}
+	}
+	schemas = persister.WhisperSchemas{
+		schema("collectd", "^collectd\\.", "10s:1d,1m:7d,1h:1y"),
+		schema("default", ".*", "1s:1d"),
+	}
+	for _, s := range schemas {
+		if err := validateRetentions(s); err != nil {
+			t.Fatalf("schema %q: expected valid retentions, got %s", s.Name, err)
+		}
+	}
+	if err := validateRetentions(schema("bad", ".*", "1m:1d,30s:7d")); err == nil {
+		t.Fatalf("expected an error for a retention with a lower interval than the one before it")
+	}
+	if err := validateRetentions(schema("bad", ".*", "1m:1d,90s:7d")); err == nil {
+		t.Fatalf("expected an error for a retention with an interval that isn't a multiple of the one before it")
+	}
+
+	Enabled, useRetentions = true, false
+	if Schemas() != nil {
+		t.Fatalf("expected no schemas without use-retentions")
+	}
+	useRetentions = true
+	got := Schemas()
+	exp := mdata.Schemas{
+		{Name: "collectd", Ttl: 86400, AggSettings: []mdata.AggSetting{
+			{60, 2 * 3600, 2, 7 * 86400, true},
+			{3600, 7 * 86400, 2, 365 * 86400, true},
+		}},
+		{Name: "default", Ttl: 86400},
+	}
+	if len(got) != len(exp) {
+		t.Fatalf("expected %d schemas, got %d", len(exp), len(got))
+	}
+	for i := range exp {
+		if got[i].Name != exp[i].Name || got[i].Pattern != schemas[i].Pattern || got[i].Ttl != exp[i].Ttl || len(got[i].AggSettings) != len(exp[i].AggSettings) {
+			t.Fatalf("schema %d: expected %v, got %v", i, exp[i], got[i])
+		}
+		for j := range exp[i].AggSettings {
+			if got[i].AggSettings[j] != exp[i].AggSettings[j] {
+				t.Fatalf("schema %d: expected aggSetting %v, got %v", i, exp[i].AggSettings[j], got[i].AggSettings[j])
+			}
+		}
+	}
+}
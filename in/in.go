@@ -8,6 +8,7 @@ import (
 
 	"github.com/raintank/met"
 	"github.com/raintank/metrictank/idx"
+	"github.com/raintank/metrictank/limits"
 	"github.com/raintank/metrictank/mdata"
 	"github.com/raintank/metrictank/usage"
 	"github.com/raintank/worldping-api/pkg/log"
@@ -15,11 +16,15 @@ import (
 	"gopkg.in/raintank/schema.v1/msg"
 )
 
+// Limits holds the per-org ingestion limits. nil means unlimited.
+// it must be set before the inputs are started.
+var Limits *limits.Ingest
+
 // In is a base handler for a metrics packet, aimed to be embedded by concrete implementations
 type In struct {
 	metricsPerMessage met.Meter
 	metricsReceived   met.Count
-	MetricsDecodeErr  met.Count // metric metrics_decode_err is a count of times an input message (MetricData, MetricDataArray or carbon line) failed to parse
+	MetricsDecodeErr  met.Count // metric metrics_decode_err is a count of times an input message (MetricData, MetricDataArray, carbon line or prometheus write request) failed to parse
 	MetricInvalid     met.Count // metric metric_invalid is a count of times a metric did not validate
 	msgsAge           met.Meter // in ms
 	tmp               msg.MetricData
@@ -44,7 +49,8 @@ func New(metrics mdata.Metrics, metricIndex idx.MetricIndex, usage *usage.Usage,
 	}
 }
 
-func (in In) process(metric *schema.MetricData) {
+// process ingests the metric. replayed tells whether we ingested it before, see limits.Ingest.Allow
+func (in In) process(metric *schema.MetricData, replayed bool) {
 	if metric == nil {
 		return
 	}
@@ -57,8 +63,11 @@ func (in In) process(metric *schema.MetricData) {
 	if metric.Time == 0 {
 		log.Warn("invalid metric. metric.Time is 0. %s", metric.Id)
 	} else {
+		if !in.allow(metric, replayed) {
+			return
+		}
 		in.metricIndex.Add(metric)
-		m := in.metrics.GetOrCreate(metric.Id)
+		m := in.metrics.GetOrCreate(metric.Id, metric.Name)
 		m.Add(uint32(metric.Time), metric.Value)
 		if in.usage != nil {
 			in.usage.Add(metric.OrgId, metric.Id)
@@ -66,6 +75,20 @@ func (in In) process(metric *schema.MetricData) {
 	}
 }
 
+// allow returns whether the per-org ingestion limits allow the point.
+// series are considered active when they received data in the current or the previous accounting period.
+func (in In) allow(metric *schema.MetricData, replayed bool) bool {
+	if Limits == nil {
+		return true
+	}
+	// a nil *usage.Usage would not be a nil limits.Series
+	var series limits.Series
+	if in.usage != nil {
+		series = in.usage
+	}
+	return Limits.Allow(metric.OrgId, metric.Id, series, replayed)
+}
+
 // HandleLegacy processes legacy datapoints. we don't track msgsAge here
 func (in In) HandleLegacy(name string, val float64, ts uint32, interval int) {
 	// TODO reuse?
@@ -83,11 +106,31 @@ func (in In) HandleLegacy(name string, val float64, ts uint32, interval int) {
 	md.SetId()
 	in.metricsPerMessage.Value(int64(1))
 	in.metricsReceived.Inc(1)
-	in.process(md)
+	in.process(md, false)
+}
+
+// HandleMetricData processes metrics that the input plugin decoded itself, from a message without produced timestamp,
+// so we don't track msgsAge here
+func (in In) HandleMetricData(metrics []*schema.MetricData) {
+	in.metricsPerMessage.Value(int64(len(metrics)))
+	in.metricsReceived.Inc(int64(len(metrics)))
+	for _, metric := range metrics {
+		in.process(metric, false)
+	}
 }
 
 // Handle processes simple messages without format spec or produced timestamp, so we don't track msgsAge here
 func (in In) Handle(data []byte) {
+	in.handle(data, false)
+}
+
+// HandleReplayed is like Handle, for messages that we ingested before, e.g. those consumed from kafka again on startup.
+// they don't count against the rate limits of the orgs.
+func (in In) HandleReplayed(data []byte) {
+	in.handle(data, true)
+}
+
+func (in In) handle(data []byte, replayed bool) {
 	// TODO reuse?
 	md := schema.MetricData{}
 	_, err := md.UnmarshalMsg(data)
@@ -98,7 +141,7 @@ func (in In) Handle(data []byte) {
 	}
 	in.metricsPerMessage.Value(int64(1))
 	in.metricsReceived.Inc(1)
-	in.process(&md)
+	in.process(&md, replayed)
 }
 
 // HandleArray processes MetricDataArray messages that have a format spec and produced timestamp.
@@ -121,6 +164,6 @@ func (in In) HandleArray(data []byte) {
 	in.metricsReceived.Inc(int64(len(in.tmp.Metrics)))
 
 	for _, metric := range in.tmp.Metrics {
-		in.process(metric)
+		in.process(metric, false)
 	}
 }
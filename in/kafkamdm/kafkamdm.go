@@ -2,6 +2,8 @@ package kafkamdm
 
 import (
 	"flag"
+	"sort"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
@@ -38,6 +40,8 @@ var brokerStr string
 var brokers []string
 var topicStr string
 var topics []string
+var partitionStr string
+var partitions []int32 // nil means all partitions
 var offsetStr string
 var dataDir string
 var config *sarama.Config
@@ -56,6 +60,7 @@ func ConfigSetup() {
 	inKafkaMdm.BoolVar(&Enabled, "enabled", false, "")
 	inKafkaMdm.StringVar(&brokerStr, "brokers", "kafka:9092", "tcp address for kafka (may be be given multiple times as a comma-separated list)")
 	inKafkaMdm.StringVar(&topicStr, "topics", "mdm", "kafka topic (may be given multiple times as a comma-separated list)")
+	inKafkaMdm.StringVar(&partitionStr, "partitions", "*", "kafka partitions to consume. use '*' or a comma separated list of id's. in a sharded cluster, every instance consumes a subset of the partitions")
 	inKafkaMdm.StringVar(&offsetStr, "offset", "last", "Set the offset to start consuming from. Can be one of newest, oldest,last or a time duration")
 	inKafkaMdm.DurationVar(&offsetCommitInterval, "offset-commit-interval", time.Second*5, "Interval at which offsets should be saved.")
 	inKafkaMdm.StringVar(&dataDir, "data-dir", "", "Directory to store partition offsets index")
@@ -68,6 +73,14 @@ func ConfigSetup() {
 	globalconf.Register("kafka-mdm-in", inKafkaMdm)
 }
 
+// ReplayWindow returns how far back in time the consumers start, when the offset is a duration. 0 otherwise
+func ReplayWindow() time.Duration {
+	if !Enabled {
+		return 0
+	}
+	return offsetDuration
+}
+
 func ConfigProcess(instance string) {
 	if !Enabled {
 		return
@@ -100,6 +113,16 @@ func ConfigProcess(instance string) {
 	}
 	brokers = strings.Split(brokerStr, ",")
 	topics = strings.Split(topicStr, ",")
+	if partitionStr != "*" {
+		for _, p := range strings.Split(partitionStr, ",") {
+			p = strings.TrimSpace(p)
+			i, err := strconv.Atoi(p)
+			if err != nil || i < 0 {
+				log.Fatal(4, "kafka-mdm: invalid partition id %q", p)
+			}
+			partitions = append(partitions, int32(i))
+		}
+	}
 
 	config = sarama.NewConfig()
 
@@ -140,13 +163,24 @@ func New(stats met.Backend) *KafkaMdm {
 
 func (k *KafkaMdm) Start(metrics mdata.Metrics, metricIndex idx.MetricIndex, usg *usage.Usage) {
 	k.In = in.New(metrics, metricIndex, usg, "kafka-mdm", k.stats)
+	owned := make(map[int32]struct{})
 	for _, topic := range topics {
 		// get partitions.
-		partitions, err := k.consumer.Partitions(topic)
+		available, err := k.consumer.Partitions(topic)
 		if err != nil {
 			log.Fatal(4, "kafka-mdm: Faild to get partitions for topic %s. %s", topic, err)
 		}
-		for _, partition := range partitions {
+		topicPartitions := available
+		if partitions != nil {
+			topicPartitions = partitions
+			for _, p := range partitions {
+				if !containsPartition(available, p) {
+					log.Fatal(4, "kafka-mdm: configured partition %d does not exist for topic %s. available partitions: %v", p, topic, available)
+				}
+			}
+		}
+		for _, partition := range topicPartitions {
+			owned[partition] = struct{}{}
 			var offset int64
 			switch offsetStr {
 			case "oldest":
@@ -161,13 +195,41 @@ func (k *KafkaMdm) Start(metrics mdata.Metrics, metricIndex idx.MetricIndex, usg
 			if err != nil {
 				log.Fatal(4, "kafka-mdm: Failed to get %q duration offset for %s:%d. %q", offsetStr, topic, partition, err)
 			}
-			go k.consumePartition(topic, partition, offset)
+			// the messages up to the newest offset were ingested before, by us or by the other instances
+			newest, err := k.client.GetOffset(topic, partition, -1)
+			if err != nil {
+				log.Fatal(4, "kafka-mdm: Failed to get newest offset for %s:%d. %q", topic, partition, err)
+			}
+			go k.consumePartition(topic, partition, offset, newest)
+		}
+	}
+	// advertise which partitions we have the data of, so that peers in a sharded cluster know.
+	ownedList := make([]int32, 0, len(owned))
+	for p := range owned {
+		ownedList = append(ownedList, p)
+	}
+	sort.Sort(int32Slice(ownedList))
+	mdata.CluStatus.SetPartitions(ownedList)
+}
+
+func containsPartition(partitions []int32, p int32) bool {
+	for _, partition := range partitions {
+		if partition == p {
+			return true
 		}
 	}
+	return false
 }
 
+type int32Slice []int32
+
+func (s int32Slice) Len() int           { return len(s) }
+func (s int32Slice) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+func (s int32Slice) Less(i, j int) bool { return s[i] < s[j] }
+
 // this will continually consume from the topic until k.stopConsuming is triggered.
-func (k *KafkaMdm) consumePartition(topic string, partition int32, partitionOffset int64) {
+// the messages before replayUntil are replayed: they don't count against the ingestion rate limits.
+func (k *KafkaMdm) consumePartition(topic string, partition int32, partitionOffset, replayUntil int64) {
 	k.wg.Add(1)
 	defer k.wg.Done()
 
@@ -185,12 +247,22 @@ func (k *KafkaMdm) consumePartition(topic string, partition int32, partitionOffs
 			if LogLevel < 2 {
 				log.Debug("kafka-mdm received message: Topic %s, Partition: %d, Offset: %d, Key: %x", msg.Topic, msg.Partition, msg.Offset, msg.Key)
 			}
-			k.In.Handle(msg.Value)
+			if msg.Offset < replayUntil {
+				k.In.HandleReplayed(msg.Value)
+			} else {
+				k.In.Handle(msg.Value)
+			}
 			currentOffset = msg.Offset
 		case <-ticker.C:
 			if err := offsetMgr.Commit(topic, partition, currentOffset); err != nil {
 				log.Error(3, "kafka-mdm failed to commit offset for %s:%d, %s", topic, partition, err)
 			}
+			// the high water mark is the offset of the next message that will be produced
+			lag := pc.HighWaterMarkOffset() - currentOffset - 1
+			if lag < 0 {
+				lag = 0
+			}
+			mdata.CluStatus.SetOffset(partition, currentOffset, lag)
 		case <-k.stopConsuming:
 			pc.Close()
 			if err := offsetMgr.Commit(topic, partition, currentOffset); err != nil {
@@ -0,0 +1,239 @@
+// package prometheus provides an input for the prometheus remote_write protocol,
+// so that metrictank can be used as long-term storage for prometheus servers.
+package prometheus
+
+import (
+	"flag"
+	"io/ioutil"
+	"math"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang/snappy"
+	"github.com/raintank/met"
+	"github.com/raintank/metrictank/idx"
+	"github.com/raintank/metrictank/in"
+	"github.com/raintank/metrictank/mdata"
+	"github.com/raintank/metrictank/prompb"
+	"github.com/raintank/metrictank/usage"
+	"github.com/raintank/worldping-api/pkg/log"
+	"github.com/rakyll/globalconf"
+	"gopkg.in/raintank/schema.v1"
+)
+
+// staleNaN is the value prometheus writes to mark a series as stale. it's not a real value, so we drop it.
+const staleNaN uint64 = 0x7ff0000000000002
+
+type Prometheus struct {
+	in.In
+	addr       string
+	interval   int
+	orgId      int
+	stats      met.Backend
+	gcInterval time.Duration
+	maxStale   uint32
+
+	sync.Mutex
+	series map[string]*series // state of the series that we infer the interval of, by name and tags
+}
+
+// series tracks the interval of a series. until it's known, we hold on to its first point
+// until the second one comes in, so the interval can be derived from the two.
+type series struct {
+	interval int
+	first    prompb.Sample
+	lastSeen uint32 // when we last received samples of the series
+}
+
+var Enabled bool
+var addr string
+var interval int
+var OrgId = 1
+
+func ConfigSetup() {
+	inPrometheus := flag.NewFlagSet("prometheus-in", flag.ExitOnError)
+	inPrometheus.BoolVar(&Enabled, "enabled", false, "")
+	inPrometheus.StringVar(&addr, "addr", ":9201", "http listen address for remote_write requests")
+	inPrometheus.IntVar(&interval, "interval", 0, "interval of the series in seconds. should match your scrape interval. 0 infers it per series from its first two points")
+	inPrometheus.IntVar(&OrgId, "org-id", 1, "org to store the series under. the prometheus remote read api serves it to requests without org header")
+	globalconf.Register("prometheus-in", inPrometheus)
+}
+
+func ConfigProcess() {
+	if !Enabled {
+		return
+	}
+	if interval < 0 {
+		log.Fatal(4, "prometheus-in: interval can't be negative")
+	}
+	if OrgId == 0 {
+		log.Fatal(4, "prometheus-in: org-id can't be 0")
+	}
+}
+
+// New returns the prometheus input. every gcInterval, it forgets the intervals of
+// the series that it didn't receive samples of in maxStale seconds, like the series in memory are purged.
+func New(stats met.Backend, gcInterval time.Duration, maxStale uint32) *Prometheus {
+	return &Prometheus{
+		addr:       addr,
+		interval:   interval,
+		orgId:      OrgId,
+		stats:      stats,
+		gcInterval: gcInterval,
+		maxStale:   maxStale,
+		series:     make(map[string]*series),
+	}
+}
+
+func (p *Prometheus) Start(metrics mdata.Metrics, metricIndex idx.MetricIndex, usg *usage.Usage) {
+	p.In = in.New(metrics, metricIndex, usg, "prometheus", p.stats)
+	l, err := net.Listen("tcp", p.addr)
+	if err != nil {
+		log.Fatal(4, err.Error())
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/write", p.handle)
+	log.Info("prometheus-in: listening on %v/tcp", l.Addr())
+	go func() {
+		log.Error(4, "prometheus-in: %s", http.Serve(l, mux))
+	}()
+	if p.interval == 0 {
+		go p.GC()
+	}
+}
+
+// GC periodically forgets the series that went stale
+func (p *Prometheus) GC() {
+	for {
+		unix := time.Duration(time.Now().UnixNano())
+		diff := p.gcInterval - (unix % p.gcInterval)
+		time.Sleep(diff + time.Minute)
+		pruned := p.prune(uint32(time.Now().Unix()) - p.maxStale)
+		log.Debug("prometheus-in: forgot the intervals of %d stale series", pruned)
+	}
+}
+
+// prune forgets the series that we didn't receive samples of since minTs, and returns how many
+func (p *Prometheus) prune(minTs uint32) int {
+	p.Lock()
+	defer p.Unlock()
+	pruned := 0
+	for key, s := range p.series {
+		if s.lastSeen < minTs {
+			delete(p.series, key)
+			pruned++
+		}
+	}
+	return pruned
+}
+
+func (p *Prometheus) handle(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+	compressed, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	buf, err := snappy.Decode(nil, compressed)
+	if err != nil {
+		p.In.MetricsDecodeErr.Inc(1)
+		log.Error(3, "prometheus-in: invalid snappy payload: %s", err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	var req prompb.WriteRequest
+	err = req.Unmarshal(buf)
+	if err != nil {
+		p.In.MetricsDecodeErr.Inc(1)
+		log.Error(3, "prometheus-in: invalid write request: %s", err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	p.HandleMetricData(p.metricData(req.Timeseries))
+}
+
+// metricData converts prometheus series to MetricData.
+// the __name__ label becomes the name, all other labels become tags of the form name:value
+func (p *Prometheus) metricData(timeseries []prompb.TimeSeries) []*schema.MetricData {
+	out := make([]*schema.MetricData, 0, len(timeseries))
+	for _, ts := range timeseries {
+		var name string
+		tags := make([]string, 0, len(ts.Labels))
+		for _, l := range ts.Labels {
+			if l.Name == "__name__" {
+				name = l.Value
+			} else {
+				tags = append(tags, l.Name+":"+l.Value)
+			}
+		}
+		if name == "" {
+			p.In.MetricInvalid.Inc(1)
+			log.Debug("prometheus-in: series without a name: %v", ts.Labels)
+			continue
+		}
+		samples := ts.Samples
+		interval := p.interval
+		if interval == 0 {
+			key := name + ";" + strings.Join(tags, ";")
+			interval, samples = p.inferInterval(key, samples, uint32(time.Now().Unix()))
+		}
+		for _, s := range samples {
+			if math.Float64bits(s.Value) == staleNaN {
+				continue
+			}
+			md := &schema.MetricData{
+				Name:     name,
+				Metric:   name,
+				Interval: interval,
+				Value:    s.Value,
+				Unit:     "unknown",
+				Time:     s.Timestamp / 1000,
+				Mtype:    "gauge",
+				Tags:     tags,
+				OrgId:    p.orgId,
+			}
+			md.SetId()
+			out = append(out, md)
+		}
+	}
+	return out
+}
+
+// inferInterval returns the interval of the series, and the samples that can be processed.
+// as long as the interval isn't known, samples are held back.
+func (p *Prometheus) inferInterval(key string, samples []prompb.Sample, now uint32) (int, []prompb.Sample) {
+	p.Lock()
+	defer p.Unlock()
+	s, ok := p.series[key]
+	if ok && len(samples) > 0 {
+		s.lastSeen = now
+	}
+	if ok && s.interval != 0 {
+		return s.interval, samples
+	}
+	if len(samples) == 0 {
+		return 0, nil
+	}
+	if !ok {
+		s = &series{first: samples[0], lastSeen: now}
+		p.series[key] = s
+		samples = samples[1:]
+	}
+	for i, sample := range samples {
+		// round to the nearest second, as scrapes don't happen exactly on time
+		delta := (sample.Timestamp - s.first.Timestamp + 500) / 1000
+		if delta <= 0 {
+			// duplicate or out of order point. we can't derive anything from it
+			continue
+		}
+		s.interval = int(delta)
+		return s.interval, append([]prompb.Sample{s.first}, samples[i:]...)
+	}
+	return 0, nil
+}
@@ -0,0 +1,116 @@
+package prometheus
+
+import (
+	"math"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/raintank/met/helper"
+	"github.com/raintank/metrictank/in"
+	"github.com/raintank/metrictank/prompb"
+)
+
+func newTestPrometheus(interval int) *Prometheus {
+	stats, _ := helper.New(false, "", "standard", "metrictank", "")
+	p := &Prometheus{
+		interval:   interval,
+		orgId:      3,
+		stats:      stats,
+		gcInterval: time.Hour,
+		maxStale:   3600,
+		series:     make(map[string]*series),
+	}
+	p.In = in.New(nil, nil, nil, "prometheus", stats)
+	return p
+}
+
+func TestMetricData(t *testing.T) {
+	name := prompb.Label{Name: "__name__", Value: "up"}
+	job := prompb.Label{Name: "job", Value: "node"}
+	stale := math.Float64frombits(staleNaN)
+	type point struct {
+		name     string
+		tags     []string
+		interval int
+		val      float64
+		ts       int64
+	}
+	cases := []struct {
+		interval int
+		series   []prompb.TimeSeries
+		exp      []point
+	}{
+		// labels become tags, and timestamps are converted to seconds
+		{15, []prompb.TimeSeries{{Labels: []prompb.Label{name, job}, Samples: []prompb.Sample{{1, 1483228800500}, {0, 1483228815000}}}},
+			[]point{{"up", []string{"job:node"}, 15, 1, 1483228800}, {"up", []string{"job:node"}, 15, 0, 1483228815}}},
+		// series without a name are invalid
+		{15, []prompb.TimeSeries{{Labels: []prompb.Label{job}, Samples: []prompb.Sample{{1, 1483228800000}}}}, nil},
+		// staleness markers are dropped
+		{15, []prompb.TimeSeries{{Labels: []prompb.Label{name}, Samples: []prompb.Sample{{stale, 1483228800000}, {2, 1483228815000}}}},
+			[]point{{"up", []string{}, 15, 2, 1483228815}}},
+		// without an interval, the first point is held back until the second one comes in
+		{0, []prompb.TimeSeries{{Labels: []prompb.Label{name}, Samples: []prompb.Sample{{1, 1483228800000}}}}, nil},
+		{0, []prompb.TimeSeries{{Labels: []prompb.Label{name}, Samples: []prompb.Sample{{1, 1483228800000}, {2, 1483228810000}}}},
+			[]point{{"up", []string{}, 10, 1, 1483228800}, {"up", []string{}, 10, 2, 1483228810}}},
+	}
+	for i, c := range cases {
+		p := newTestPrometheus(c.interval)
+		out := p.metricData(c.series)
+		if len(out) != len(c.exp) {
+			t.Fatalf("case %d: expected %d points, got %d: %v", i, len(c.exp), len(out), out)
+		}
+		for j, md := range out {
+			got := point{md.Name, md.Tags, md.Interval, md.Value, md.Time}
+			if !reflect.DeepEqual(got, c.exp[j]) {
+				t.Fatalf("case %d: expected point %d to be %v, got %v", i, j, c.exp[j], got)
+			}
+			if md.OrgId != 3 || md.Id == "" {
+				t.Fatalf("case %d: expected point %d to have an id in org 3, got id %q in org %d", i, j, md.Id, md.OrgId)
+			}
+		}
+	}
+}
+
+func TestInferInterval(t *testing.T) {
+	// each case is a series of calls, with the samples at the given timestamps in seconds
+	type call struct {
+		ts       []int64
+		interval int
+		out      int // how many samples can be processed
+	}
+	cases := [][]call{
+		// the interval is derived from the first two points
+		{{[]int64{100, 110, 120}, 10, 3}, {[]int64{130}, 10, 1}},
+		// the first point is held back until the second one comes in
+		{{[]int64{100}, 0, 0}, {nil, 0, 0}, {[]int64{115}, 15, 2}},
+		// duplicates don't count, and scrapes that are a bit late are rounded to the nearest second
+		{{[]int64{100}, 0, 0}, {[]int64{100}, 0, 0}, {[]int64{100, 109}, 9, 2}},
+	}
+	for i, calls := range cases {
+		p := newTestPrometheus(0)
+		for j, c := range calls {
+			samples := make([]prompb.Sample, 0, len(c.ts))
+			for _, ts := range c.ts {
+				// lateness of a few hundred milliseconds
+				samples = append(samples, prompb.Sample{Value: 1, Timestamp: ts*1000 + 300})
+			}
+			interval, out := p.inferInterval("up", samples, 1000)
+			if interval != c.interval || len(out) != c.out {
+				t.Fatalf("case %d call %d: expected interval %d and %d samples, got %d and %d", i, j, c.interval, c.out, interval, len(out))
+			}
+		}
+	}
+}
+
+func TestPrune(t *testing.T) {
+	p := newTestPrometheus(0)
+	p.inferInterval("old", []prompb.Sample{{1, 100000}, {1, 110000}}, 1000)
+	p.inferInterval("new", []prompb.Sample{{1, 100000}, {1, 110000}}, 1000)
+	p.inferInterval("new", []prompb.Sample{{1, 120000}}, 2000)
+	// calls without samples don't keep a series around
+	p.inferInterval("old", nil, 2000)
+	if pruned := p.prune(1500); pruned != 1 || len(p.series) != 1 || p.series["new"] == nil {
+		t.Fatalf("expected only the series without recent samples to be pruned, pruned %d and kept %v", pruned, p.series)
+	}
+}
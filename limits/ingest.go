@@ -0,0 +1,183 @@
+package limits
+
+import (
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/raintank/met"
+	"github.com/raintank/worldping-api/pkg/log"
+)
+
+// how often to log that an org is over its limits
+const ingestLogInterval = time.Minute
+
+// IngestOrg holds the ingestion limits of an org. 0 means unlimited
+type IngestOrg struct {
+	MaxSeries       int     // series that recently received data. points of new series beyond this are rejected
+	PointsPerSecond float64 // sustained rate of points. bursts of up to a second worth of points are allowed
+}
+
+// options returns the setters of the settings in the ingestion limits file, by their name
+func (o *IngestOrg) options() map[string]func(v string) error {
+	return map[string]func(v string) error{
+		"max-series": func(v string) (err error) {
+			o.MaxSeries, err = strconv.Atoi(v)
+			return
+		},
+		"points-per-second": func(v string) (err error) {
+			o.PointsPerSecond, err = strconv.ParseFloat(v, 64)
+			return
+		},
+	}
+}
+
+// ReadIngest reads an ingestion limits file, which is laid out like a query limits file, see Read
+func ReadIngest(file string) (IngestOrg, map[int]IngestOrg, error) {
+	var defaults IngestOrg
+	orgs := make(map[int]IngestOrg)
+	def, sections, err := readFile(file)
+	if err != nil {
+		return defaults, nil, err
+	}
+	if def != nil {
+		if err := parseSection(def, defaults.options()); err != nil {
+			return defaults, nil, err
+		}
+	}
+	for id, s := range sections {
+		o := defaults
+		if err := parseSection(s, o.options()); err != nil {
+			return defaults, nil, err
+		}
+		orgs[id] = o
+	}
+	return defaults, orgs, nil
+}
+
+// Series tells how many series the orgs have, like usage.Usage does
+type Series interface {
+	// Seen returns whether the series with the given key was seen recently, and how many series the org has
+	Seen(org int, key string) (bool, int)
+}
+
+// Ingest tracks the points ingested for each org, to enforce their limits.
+// all methods can be called on a nil *Ingest, which doesn't limit anything.
+type Ingest struct {
+	sync.Mutex
+	file     string
+	defaults IngestOrg
+	orgs     map[int]IngestOrg
+	buckets  map[int]*bucket
+	stats    met.Backend
+	rejected map[string]met.Count
+	logged   map[string]time.Time // when we last logged the rejections of an org, per reason
+}
+
+// NewIngest returns Ingest with the limits of the given file
+func NewIngest(file string, stats met.Backend) (*Ingest, error) {
+	l := &Ingest{
+		file:     file,
+		buckets:  make(map[int]*bucket),
+		stats:    stats,
+		rejected: make(map[string]met.Count),
+		logged:   make(map[string]time.Time),
+	}
+	return l, l.Reload()
+}
+
+// Reload re-reads the limits file. if that fails, the current limits are kept.
+func (l *Ingest) Reload() error {
+	if l == nil {
+		return nil
+	}
+	defaults, orgs, err := ReadIngest(l.file)
+	if err != nil {
+		return err
+	}
+	l.Lock()
+	l.defaults = defaults
+	l.orgs = orgs
+	// the rates may have changed
+	l.buckets = make(map[int]*bucket)
+	l.Unlock()
+	log.Info("limits: loaded the ingestion limits of %d orgs from %s", len(orgs), l.file)
+	return nil
+}
+
+// Get returns the limits of the org
+func (l *Ingest) Get(org int) IngestOrg {
+	if l == nil {
+		return IngestOrg{}
+	}
+	l.Lock()
+	defer l.Unlock()
+	return l.get(org)
+}
+
+// get returns the limits of the org. It must only be called while holding the lock
+func (l *Ingest) get(org int) IngestOrg {
+	if o, ok := l.orgs[org]; ok {
+		return o
+	}
+	return l.defaults
+}
+
+// Allow returns whether a point of the series with the given key can be ingested.
+// series tells whether the series is new and how many the org has. it's only consulted if the org has a series limit, nil means none are known.
+// replayed points were subject to the rate limit when they were first ingested, e.g. those consumed from kafka again on startup,
+// so they don't count against it: it would reject most of them, as their rate is much higher than the one they were sent at.
+// rejected points are counted in the ingest.rejected.org.<org>.<reason> metric, and logged every so often.
+func (l *Ingest) Allow(org int, key string, series Series, replayed bool) bool {
+	if l == nil {
+		return true
+	}
+	now := time.Now()
+	l.Lock()
+	o := l.get(org)
+	reason := ""
+	newSeries, num := false, 0
+	if o.MaxSeries != 0 && series != nil {
+		var seen bool
+		seen, num = series.Seen(org, key)
+		newSeries = !seen
+	}
+	if newSeries && num >= o.MaxSeries {
+		reason = ReasonSeries
+	} else if o.PointsPerSecond != 0 && !replayed {
+		b, ok := l.buckets[org]
+		if !ok {
+			b = newBucket(o.PointsPerSecond, now)
+			l.buckets[org] = b
+		}
+		if !b.take(now) {
+			reason = ReasonPoints
+		}
+	}
+	if reason == "" {
+		l.Unlock()
+		return true
+	}
+	name := fmt.Sprintf("ingest.rejected.org.%d.%s", org, reason)
+	c, ok := l.rejected[name]
+	if !ok {
+		c = l.stats.NewCount(name)
+		l.rejected[name] = c
+	}
+	logIt := now.Sub(l.logged[name]) >= ingestLogInterval
+	if logIt {
+		l.logged[name] = now
+	}
+	l.Unlock()
+
+	c.Inc(1)
+	if logIt {
+		if reason == ReasonSeries {
+			log.Warn("limits: org %d has reached its limit of %d series, rejecting the points of new series such as %s", org, o.MaxSeries, key)
+		} else {
+			log.Warn("limits: org %d is over its limit of %f points per second, rejecting points", org, o.PointsPerSecond)
+		}
+	}
+	return false
+}
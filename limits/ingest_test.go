@@ -0,0 +1,82 @@
+package limits
+
+import (
+	"os"
+	"testing"
+
+	"github.com/raintank/met/helper"
+)
+
+func TestReadIngest(t *testing.T) {
+	file := writeFile(t, "[default]\nmax-series = 100\n\n[3]\npoints-per-second = 10\n")
+	defer os.Remove(file)
+	defaults, orgs, err := ReadIngest(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if defaults != (IngestOrg{MaxSeries: 100}) {
+		t.Fatalf("bad defaults %+v", defaults)
+	}
+	if len(orgs) != 1 || orgs[3] != (IngestOrg{MaxSeries: 100, PointsPerSecond: 10}) {
+		t.Fatalf("expected org 3 to override the defaults, got %+v", orgs)
+	}
+
+	bad := writeFile(t, "[default]\nmax-concurrent-requests = 1\n")
+	defer os.Remove(bad)
+	if _, _, err := ReadIngest(bad); err == nil {
+		t.Fatalf("expected an error for a query limit")
+	}
+}
+
+func TestAllow(t *testing.T) {
+	stats, _ := helper.New(false, "", "standard", "metrictank", "")
+	file := writeFile(t, "[1]\nmax-series = 2\n[2]\npoints-per-second = 2\n")
+	defer os.Remove(file)
+	l, err := NewIngest(file, stats)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// org 1 may have 2 series
+	series := seriesList{"a"}
+	if !l.Allow(1, "b", series, false) {
+		t.Fatalf("expected a new series below the limit to be allowed")
+	}
+	series = append(series, "b")
+	if l.Allow(1, "c", series, false) {
+		t.Fatalf("expected a new series at the limit to be rejected")
+	}
+	if !l.Allow(1, "a", series, false) {
+		t.Fatalf("expected an existing series at the limit to be allowed")
+	}
+	if !l.Allow(1, "c", nil, false) {
+		t.Fatalf("expected points to be allowed without knowing the series")
+	}
+
+	// org 2 may ingest a burst of 2 points
+	if !l.Allow(2, "a", series, false) || !l.Allow(2, "a", series, false) || l.Allow(2, "a", series, false) {
+		t.Fatalf("expected a burst of 2 points to be allowed")
+	}
+	// replayed points don't count against the rate
+	if !l.Allow(2, "a", series, true) {
+		t.Fatalf("expected replayed points to be allowed")
+	}
+
+	// other orgs and a nil Ingest are unlimited
+	var none *Ingest
+	if !l.Allow(3, "c", series, false) || !none.Allow(1, "c", series, false) {
+		t.Fatalf("expected points without limits to be allowed")
+	}
+}
+
+// seriesList are the series of all orgs
+type seriesList []string
+
+func (s seriesList) Seen(org int, key string) (bool, int) {
+	for _, k := range s {
+		if k == key {
+			return true, len(s)
+		}
+	}
+	return false, len(s)
+}
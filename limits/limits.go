@@ -0,0 +1,300 @@
+// Package limits enforces per-org limits on the queries of the http api and on ingestion,
+// so that the heavy queries or the misbehaving clients of one org can't degrade the service for all others.
+package limits
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/alyu/configparser"
+	"github.com/raintank/met"
+	"github.com/raintank/worldping-api/pkg/log"
+)
+
+// reasons for rejecting a request, as used in the names of the rejection metrics
+const (
+	ReasonConcurrency = "concurrency"
+	ReasonRate        = "rate"
+	ReasonPoints      = "points"
+	ReasonSeries      = "series"
+)
+
+// Org holds the limits of an org. 0 means unlimited
+type Org struct {
+	MaxConcurrentRequests int     // requests being handled at the same time
+	RequestsPerSecond     float64 // sustained rate of requests. bursts of up to a second worth of requests are allowed
+	MaxPointsPerReq       int     // points requested by a query: the number of series times their maxDataPoints
+	MaxSeriesPerFind      int     // series returned by a find
+}
+
+// options returns the setters of the settings in the limits file, by their name
+func (o *Org) options() map[string]func(v string) error {
+	return map[string]func(v string) error{
+		"max-concurrent-requests": func(v string) (err error) {
+			o.MaxConcurrentRequests, err = strconv.Atoi(v)
+			return
+		},
+		"requests-per-second": func(v string) (err error) {
+			o.RequestsPerSecond, err = strconv.ParseFloat(v, 64)
+			return
+		},
+		"max-points-per-req": func(v string) (err error) {
+			o.MaxPointsPerReq, err = strconv.Atoi(v)
+			return
+		},
+		"max-series-per-find": func(v string) (err error) {
+			o.MaxSeriesPerFind, err = strconv.Atoi(v)
+			return
+		},
+	}
+}
+
+// Read reads a limits file: an ini file with the limits for orgs without their own section in a [default] section,
+// and those of specific orgs in sections named after their id. settings missing from the section of an org are taken from the defaults.
+func Read(file string) (Org, map[int]Org, error) {
+	var defaults Org
+	orgs := make(map[int]Org)
+	def, sections, err := readFile(file)
+	if err != nil {
+		return defaults, nil, err
+	}
+	if def != nil {
+		if err := parseSection(def, defaults.options()); err != nil {
+			return defaults, nil, err
+		}
+	}
+	for id, s := range sections {
+		o := defaults
+		if err := parseSection(s, o.options()); err != nil {
+			return defaults, nil, err
+		}
+		orgs[id] = o
+	}
+	return defaults, orgs, nil
+}
+
+// readFile reads an ini file with a [default] section, if any, and sections named after the id of an org
+func readFile(file string) (*configparser.Section, map[int]*configparser.Section, error) {
+	config, err := configparser.Read(file)
+	if err != nil {
+		return nil, nil, err
+	}
+	sections, err := config.AllSections()
+	if err != nil {
+		return nil, nil, err
+	}
+	var def *configparser.Section
+	orgs := make(map[int]*configparser.Section)
+	for _, s := range sections {
+		// the parser puts any options before the first section in a "global" one
+		name := strings.Trim(s.Name(), "[]")
+		if s.Name() == "global" || name == "" || strings.HasPrefix(name, "#") {
+			continue
+		}
+		if name == "default" {
+			def = s
+			continue
+		}
+		id, err := strconv.Atoi(name)
+		if err != nil {
+			return nil, nil, fmt.Errorf("section %q: not an org id", name)
+		}
+		orgs[id] = s
+	}
+	return def, orgs, nil
+}
+
+func parseSection(s *configparser.Section, options map[string]func(v string) error) error {
+	for name, value := range s.Options() {
+		// the parser keeps comments and empty lines as options without a value
+		if name == "" || strings.HasPrefix(name, "#") || strings.HasPrefix(name, ";") {
+			continue
+		}
+		set, ok := options[name]
+		if !ok {
+			return fmt.Errorf("section %s: unknown setting %q", s.Name(), name)
+		}
+		if err := set(strings.TrimSpace(value)); err != nil {
+			return fmt.Errorf("section %s: bad value for %s: %s", s.Name(), name, err)
+		}
+	}
+	return nil
+}
+
+// Limits tracks the requests of each org, to enforce their limits.
+// all methods can be called on a nil *Limits, which doesn't limit anything.
+type Limits struct {
+	sync.Mutex
+	file     string
+	defaults Org
+	orgs     map[int]Org
+	active   map[int]int // the number of requests being handled, per org
+	buckets  map[int]*bucket
+	stats    met.Backend
+	rejected map[string]met.Count
+}
+
+// New returns Limits with the limits of the given file
+func New(file string, stats met.Backend) (*Limits, error) {
+	l := &Limits{
+		file:     file,
+		active:   make(map[int]int),
+		buckets:  make(map[int]*bucket),
+		stats:    stats,
+		rejected: make(map[string]met.Count),
+	}
+	return l, l.Reload()
+}
+
+// Reload re-reads the limits file. if that fails, the current limits are kept.
+func (l *Limits) Reload() error {
+	if l == nil {
+		return nil
+	}
+	defaults, orgs, err := Read(l.file)
+	if err != nil {
+		return err
+	}
+	l.Lock()
+	l.defaults = defaults
+	l.orgs = orgs
+	// the rates may have changed
+	l.buckets = make(map[int]*bucket)
+	l.Unlock()
+	log.Info("limits: loaded the limits of %d orgs from %s", len(orgs), l.file)
+	return nil
+}
+
+// Get returns the limits of the org
+func (l *Limits) Get(org int) Org {
+	if l == nil {
+		return Org{}
+	}
+	l.Lock()
+	defer l.Unlock()
+	return l.get(org)
+}
+
+// get returns the limits of the org. It must only be called while holding the lock
+func (l *Limits) get(org int) Org {
+	if o, ok := l.orgs[org]; ok {
+		return o
+	}
+	return l.defaults
+}
+
+// Reject counts a rejected request of the org, in the api.rejected.org.<org>.<reason> metric
+func (l *Limits) Reject(org int, reason string) {
+	if l == nil {
+		return
+	}
+	name := fmt.Sprintf("api.rejected.org.%d.%s", org, reason)
+	l.Lock()
+	c, ok := l.rejected[name]
+	if !ok {
+		c = l.stats.NewCount(name)
+		l.rejected[name] = c
+	}
+	l.Unlock()
+	c.Inc(1)
+}
+
+// Error rejects the request with a 429 Too Many Requests, and counts it
+func (l *Limits) Error(w http.ResponseWriter, org int, reason, msg string) {
+	l.Reject(org, reason)
+	http.Error(w, msg, http.StatusTooManyRequests)
+}
+
+// start registers the start of a request of the org, if its limits allow it.
+// if they do, done must be called when the request has been handled.
+func (l *Limits) start(org int, now time.Time) (string, bool) {
+	l.Lock()
+	defer l.Unlock()
+	o := l.get(org)
+	if o.MaxConcurrentRequests != 0 && l.active[org] >= o.MaxConcurrentRequests {
+		return ReasonConcurrency, false
+	}
+	if o.RequestsPerSecond != 0 {
+		b, ok := l.buckets[org]
+		if !ok {
+			b = newBucket(o.RequestsPerSecond, now)
+			l.buckets[org] = b
+		}
+		if !b.take(now) {
+			return ReasonRate, false
+		}
+	}
+	l.active[org]++
+	return "", true
+}
+
+func (l *Limits) done(org int) {
+	l.Lock()
+	l.active[org]--
+	if l.active[org] == 0 {
+		delete(l.active, org)
+	}
+	l.Unlock()
+}
+
+// Handler enforces the limits on concurrent requests and requests per second of the org of the request,
+// as resolved by the given function, which must resolve it like the handler does.
+// requests of which the org can't be resolved pass, the handler rejects those.
+func (l *Limits) Handler(handler http.Handler, getOrg func(r *http.Request) (int, error)) http.Handler {
+	if l == nil {
+		return handler
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		org, err := getOrg(r)
+		if err != nil {
+			handler.ServeHTTP(w, r)
+			return
+		}
+		reason, ok := l.start(org, time.Now())
+		if !ok {
+			l.Error(w, org, reason, fmt.Sprintf("too many requests: %s limit of the org reached", reason))
+			return
+		}
+		defer l.done(org)
+		handler.ServeHTTP(w, r)
+	})
+}
+
+// bucket is a token bucket that refills at a fixed rate
+type bucket struct {
+	rate   float64 // tokens per second
+	tokens float64
+	last   time.Time
+}
+
+// newBucket returns a full bucket, which holds a second worth of tokens, and at least 1
+func newBucket(rate float64, now time.Time) *bucket {
+	b := &bucket{rate: rate, last: now}
+	b.tokens = b.size()
+	return b
+}
+
+func (b *bucket) size() float64 {
+	if b.rate < 1 {
+		return 1
+	}
+	return b.rate
+}
+
+// take takes a token from the bucket, if it has one
+func (b *bucket) take(now time.Time) bool {
+	b.tokens += now.Sub(b.last).Seconds() * b.rate
+	if b.tokens > b.size() {
+		b.tokens = b.size()
+	}
+	b.last = now
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
@@ -0,0 +1,130 @@
+package limits
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/raintank/met/helper"
+)
+
+func writeFile(t *testing.T, content string) string {
+	f, err := ioutil.TempFile("", "limits")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.WriteString(content)
+	f.Close()
+	return f.Name()
+}
+
+func TestRead(t *testing.T) {
+	file := writeFile(t, `
+# defaults
+[default]
+max-concurrent-requests = 10
+max-points-per-req = 1000
+
+[42]
+max-points-per-req = 5000
+requests-per-second = 2.5
+`)
+	defer os.Remove(file)
+	defaults, orgs, err := Read(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if defaults != (Org{MaxConcurrentRequests: 10, MaxPointsPerReq: 1000}) {
+		t.Fatalf("bad defaults %+v", defaults)
+	}
+	if len(orgs) != 1 || orgs[42] != (Org{MaxConcurrentRequests: 10, MaxPointsPerReq: 5000, RequestsPerSecond: 2.5}) {
+		t.Fatalf("expected org 42 to override the defaults, got %+v", orgs)
+	}
+
+	for _, content := range []string{"[foo]\nmax-points-per-req = 1\n", "[default]\nmax-points = 1\n", "[1]\nmax-points-per-req = many\n"} {
+		bad := writeFile(t, content)
+		if _, _, err := Read(bad); err == nil {
+			t.Fatalf("expected an error for %q", content)
+		}
+		os.Remove(bad)
+	}
+}
+
+func TestHandler(t *testing.T) {
+	stats, _ := helper.New(false, "", "standard", "metrictank", "")
+	file := writeFile(t, "[default]\nmax-concurrent-requests = 1\n[2]\nrequests-per-second = 1\n")
+	defer os.Remove(file)
+	l, err := New(file, stats)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	release := make(chan struct{})
+	started := make(chan struct{}, 1)
+	// like graphite-web requests, requests without header are for org 1
+	getOrg := func(r *http.Request) (int, error) {
+		if r.Header.Get("x-org-id") == "" {
+			return 1, nil
+		}
+		return strconv.Atoi(r.Header.Get("x-org-id"))
+	}
+	h := l.Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/slow" {
+			started <- struct{}{}
+			<-release
+		}
+	}), getOrg)
+	do := func(org, path string) int {
+		req, _ := http.NewRequest("GET", path, nil)
+		if org != "" {
+			req.Header.Set("x-org-id", org)
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		return w.Code
+	}
+
+	// org 1 may have 1 request at a time
+	done := make(chan int)
+	go func() { done <- do("1", "/slow") }()
+	<-started
+	if code := do("1", "/"); code != http.StatusTooManyRequests {
+		t.Fatalf("expected a concurrent request to be rejected, got %d", code)
+	}
+	if code := do("", "/"); code != http.StatusTooManyRequests {
+		t.Fatalf("expected a concurrent request without header to be rejected as one of org 1, got %d", code)
+	}
+	if code := do("bad", "/"); code != http.StatusOK {
+		t.Fatalf("expected requests without a valid org to pass, got %d", code)
+	}
+	close(release)
+	if code := <-done; code != http.StatusOK {
+		t.Fatalf("expected the first request to succeed, got %d", code)
+	}
+	if code := do("1", "/"); code != http.StatusOK {
+		t.Fatalf("expected a request after the first to succeed, got %d", code)
+	}
+
+	// org 2 may do 1 request per second
+	if code := do("2", "/"); code != http.StatusOK {
+		t.Fatalf("expected the first request to succeed, got %d", code)
+	}
+	if code := do("2", "/"); code != http.StatusTooManyRequests {
+		t.Fatalf("expected the second request to be rejected, got %d", code)
+	}
+}
+
+func TestBucket(t *testing.T) {
+	now := time.Now()
+	b := newBucket(2, now)
+	if !b.take(now) || !b.take(now) || b.take(now) {
+		t.Fatalf("expected a burst of 2 requests to be allowed")
+	}
+	if !b.take(now.Add(500*time.Millisecond)) || b.take(now.Add(500*time.Millisecond)) {
+		t.Fatalf("expected 1 request to be allowed after half a second")
+	}
+}
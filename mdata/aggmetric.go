@@ -18,11 +18,13 @@ import (
 // a t0 is a timestamp divisible by chunkSpan without a remainder (e.g. 2 hour boundaries)
 // firstT0's data is held at index 0, indexes go up and wrap around from numChunks-1 to 0
 // in addition, keep in mind that the last chunk is always a work in progress and not useable for aggregation
+// optionally, points first go through a reorder buffer, so that points that arrive out of order can still be added.
 // AggMetric is concurrency-safe
 type AggMetric struct {
 	store Store
 	sync.RWMutex
 	Key             string
+	name            string // the name of the series, if known. only used for snapshots
 	CurrentChunkPos int    // element in []Chunks that is active. All others are either finished or nil.
 	NumChunks       uint32 // max size of the circular buffer
 	ChunkSpan       uint32 // span of individual chunks in seconds
@@ -30,11 +32,13 @@ type AggMetric struct {
 	aggregators     []*Aggregator
 	firstChunkT0    uint32
 	ttl             uint32
+	rob             *ReorderBuffer // nil if the reorder window is 0
 }
 
 // NewAggMetric creates a metric with given key, it retains the given number of chunks each chunkSpan seconds long
-// it optionally also creates aggregations with the given settings
-func NewAggMetric(store Store, key string, chunkSpan, numChunks uint32, ttl uint32, aggsetting ...AggSetting) *AggMetric {
+// if reorderWindow is not 0, points which are at most that many seconds older than the newest point can arrive out of order.
+// it optionally also creates aggregations with the given settings, keeping the rollups of the given rule (all of them if nil)
+func NewAggMetric(store Store, key string, chunkSpan, numChunks uint32, ttl, reorderWindow uint32, aggRule *AggRule, aggsetting ...AggSetting) *AggMetric {
 	m := AggMetric{
 		store:     store,
 		Key:       key,
@@ -43,8 +47,11 @@ func NewAggMetric(store Store, key string, chunkSpan, numChunks uint32, ttl uint
 		Chunks:    make([]*chunk.Chunk, 0, numChunks),
 		ttl:       ttl,
 	}
+	if reorderWindow != 0 {
+		m.rob = NewReorderBuffer(reorderWindow)
+	}
 	for _, as := range aggsetting {
-		m.aggregators = append(m.aggregators, NewAggregator(store, key, as.Span, as.ChunkSpan, as.NumChunks, as.Ttl))
+		m.aggregators = append(m.aggregators, NewAggregator(store, key, as.Span, as.ChunkSpan, as.NumChunks, as.Ttl, aggRule))
 	}
 
 	return &m
@@ -160,21 +167,35 @@ func (a *AggMetric) GetAggregated(consolidator consolidation.Consolidator, aggSp
 	// no lock needed cause aggregators don't change at runtime
 	for _, a := range a.aggregators {
 		if a.span == aggSpan {
+			var agg *AggMetric
 			switch consolidator {
 			case consolidation.None:
 				panic("cannot get an archive for no consolidation")
 			case consolidation.Avg:
 				panic("avg consolidator has no matching Archive(). you need sum and cnt")
 			case consolidation.Cnt:
-				return a.cntMetric.Get(from, to)
+				agg = a.cntMetric
 			case consolidation.Min:
-				return a.minMetric.Get(from, to)
+				agg = a.minMetric
 			case consolidation.Max:
-				return a.maxMetric.Get(from, to)
+				agg = a.maxMetric
 			case consolidation.Sum:
-				return a.sumMetric.Get(from, to)
+				agg = a.sumMetric
+			case consolidation.Lst:
+				agg = a.lstMetric
+			case consolidation.P50:
+				agg = a.p50Metric
+			case consolidation.P90:
+				agg = a.p90Metric
+			case consolidation.P99:
+				agg = a.p99Metric
+			default:
+				panic(fmt.Sprintf("AggMetric.GetAggregated(): unknown consolidator %q", consolidator))
+			}
+			if agg == nil {
+				panic(fmt.Sprintf("AggMetric.GetAggregated(): the %s archive is not kept", consolidator.Archive()))
 			}
-			panic(fmt.Sprintf("AggMetric.GetAggregated(): unknown consolidator %q", consolidator))
+			return agg.Get(from, to)
 		}
 	}
 	panic(fmt.Sprintf("GetAggregated called with unknown aggSpan %d", aggSpan))
@@ -184,7 +205,6 @@ func (a *AggMetric) GetAggregated(consolidator consolidation.Consolidator, aggSp
 // more data then what's requested may be included
 // also returns oldest point we have, so that if your query needs data before it, the caller knows when to query cassandra
 func (a *AggMetric) Get(from, to uint32) (uint32, []iter.Iter) {
-	pre := time.Now()
 	if LogLevel < 2 {
 		log.Debug("AM %s Get(): %d - %d (%s - %s) span:%ds", a.Key, from, to, TS(from), TS(to), to-from-1)
 	}
@@ -194,6 +214,24 @@ func (a *AggMetric) Get(from, to uint32) (uint32, []iter.Iter) {
 	a.RLock()
 	defer a.RUnlock()
 
+	oldest, iters := a.get(from, to)
+	if a.rob == nil || a.rob.Len() == 0 {
+		return oldest, iters
+	}
+	// the points in the reorder buffer are always newer than the points in the chunks
+	if len(a.Chunks) == 0 && a.rob.Oldest() < oldest {
+		oldest = a.rob.Oldest()
+	}
+	if it, ok := a.rob.Iter(from, to); ok {
+		iters = append(iters, it)
+	}
+	return oldest, iters
+}
+
+// get returns the iterators for the data in the chunks, see Get. It must only be called while holding a.RLock()
+func (a *AggMetric) get(from, to uint32) (uint32, []iter.Iter) {
+	pre := time.Now()
+
 	if len(a.Chunks) == 0 {
 		// we dont have any data yet.
 		if LogLevel < 2 {
@@ -382,6 +420,18 @@ func (a *AggMetric) persist(pos int) {
 		previousChunk = a.Chunks[previousPos]
 	}
 
+	// let the store know which chunk precedes each chunk, so that the chunk cache can tell it has all chunks of a range.
+	// we only do this for the chunk of the previous span, as there may be chunks we don't know about in between.
+	for i := range pending {
+		prev := previousChunk
+		if i+1 < len(pending) {
+			prev = pending[i+1].chunk
+		}
+		if prev.T0+a.ChunkSpan == pending[i].chunk.T0 {
+			pending[i].prevT0 = prev.T0
+		}
+	}
+
 	if LogLevel < 2 {
 		log.Debug("AM persist(): sending %d chunks to write queue", len(pending))
 	}
@@ -413,6 +463,23 @@ func (a *AggMetric) Add(ts uint32, val float64) {
 	a.Lock()
 	defer a.Unlock()
 
+	if a.rob == nil {
+		a.add(ts, val)
+		return
+	}
+	flushed, err := a.rob.Add(ts, val)
+	if err != nil {
+		log.Debug("AM %s Add(): failed to add point %d to reorder buffer. %s", a.Key, ts, err)
+		metricsTooOld.Inc(1)
+		return
+	}
+	for _, p := range flushed {
+		a.add(p.Ts, p.Val)
+	}
+}
+
+// add pushes a point to the chunks and aggregators. This should only be called while holding a.Lock()
+func (a *AggMetric) add(ts uint32, val float64) {
 	t0 := ts - (ts % a.ChunkSpan)
 
 	if len(a.Chunks) == 0 {
@@ -495,6 +562,12 @@ func (a *AggMetric) Add(ts uint32, val float64) {
 func (a *AggMetric) GC(chunkMinTs, metricMinTs uint32) bool {
 	a.Lock()
 	defer a.Unlock()
+	if a.rob != nil && a.rob.Len() > 0 && a.rob.LastWrite < chunkMinTs {
+		// no new points have come in for a while, so we don't expect any late points either.
+		for _, p := range a.rob.Flush() {
+			a.add(p.Ts, p.Val)
+		}
+	}
 	currentChunk := a.getChunk(a.CurrentChunkPos)
 	if currentChunk == nil {
 		return false
@@ -73,7 +73,7 @@ func TestAggMetric(t *testing.T) {
 	CluStatus = NewClusterStatus("default", false)
 	InitMetrics(stats)
 
-	c := NewChecker(t, NewAggMetric(dnstore, "foo", 100, 5, 1, []AggSetting{}...))
+	c := NewChecker(t, NewAggMetric(dnstore, "foo", 100, 5, 1, 0, nil, []AggSetting{}...))
 
 	// basic case, single range
 	c.Add(101, 101)
@@ -173,12 +173,12 @@ func BenchmarkAggMetrics1000Metrics1Day(b *testing.B) {
 		keys[i] = fmt.Sprintf("hello.this.is.a.test.key.%d", i)
 	}
 
-	metrics := NewAggMetrics(dnstore, chunkSpan, numChunks, chunkMaxStale, metricMaxStale, ttl, 0, aggSettings)
+	metrics := NewAggMetrics(dnstore, chunkSpan, numChunks, chunkMaxStale, metricMaxStale, ttl, 0, 0, aggSettings, nil, nil)
 
 	maxT := 3600 * 24 * uint32(b.N) // b.N in days
 	for t := uint32(1); t < maxT; t += 10 {
 		for metricI := 0; metricI < 1000; metricI++ {
-			m := metrics.GetOrCreate(keys[metricI])
+			m := metrics.GetOrCreate(keys[metricI], keys[metricI])
 			m.Add(t, float64(t))
 		}
 	}
@@ -209,12 +209,12 @@ func BenchmarkAggMetrics1kSeries2Chunks1kQueueSize(b *testing.B) {
 		keys[i] = fmt.Sprintf("hello.this.is.a.test.key.%d", i)
 	}
 
-	metrics := NewAggMetrics(dnstore, chunkSpan, numChunks, chunkMaxStale, metricMaxStale, ttl, 0, aggSettings)
+	metrics := NewAggMetrics(dnstore, chunkSpan, numChunks, chunkMaxStale, metricMaxStale, ttl, 0, 0, aggSettings, nil, nil)
 
 	maxT := uint32(1200)
 	for t := uint32(1); t < maxT; t += 10 {
 		for metricI := 0; metricI < 1000; metricI++ {
-			m := metrics.GetOrCreate(keys[metricI])
+			m := metrics.GetOrCreate(keys[metricI], keys[metricI])
 			m.Add(t, float64(t))
 		}
 	}
@@ -245,12 +245,12 @@ func BenchmarkAggMetrics10kSeries2Chunks10kQueueSize(b *testing.B) {
 		keys[i] = fmt.Sprintf("hello.this.is.a.test.key.%d", i)
 	}
 
-	metrics := NewAggMetrics(dnstore, chunkSpan, numChunks, chunkMaxStale, metricMaxStale, ttl, 0, aggSettings)
+	metrics := NewAggMetrics(dnstore, chunkSpan, numChunks, chunkMaxStale, metricMaxStale, ttl, 0, 0, aggSettings, nil, nil)
 
 	maxT := uint32(1200)
 	for t := uint32(1); t < maxT; t += 10 {
 		for metricI := 0; metricI < 10000; metricI++ {
-			m := metrics.GetOrCreate(keys[metricI])
+			m := metrics.GetOrCreate(keys[metricI], keys[metricI])
 			m.Add(t, float64(t))
 		}
 	}
@@ -281,12 +281,12 @@ func BenchmarkAggMetrics100kSeries2Chunks100kQueueSize(b *testing.B) {
 		keys[i] = fmt.Sprintf("hello.this.is.a.test.key.%d", i)
 	}
 
-	metrics := NewAggMetrics(dnstore, chunkSpan, numChunks, chunkMaxStale, metricMaxStale, ttl, 0, aggSettings)
+	metrics := NewAggMetrics(dnstore, chunkSpan, numChunks, chunkMaxStale, metricMaxStale, ttl, 0, 0, aggSettings, nil, nil)
 
 	maxT := uint32(1200)
 	for t := uint32(1); t < maxT; t += 10 {
 		for metricI := 0; metricI < 100000; metricI++ {
-			m := metrics.GetOrCreate(keys[metricI])
+			m := metrics.GetOrCreate(keys[metricI], keys[metricI])
 			m.Add(t, float64(t))
 		}
 	}
@@ -13,23 +13,29 @@ type AggMetrics struct {
 	Metrics        map[string]*AggMetric
 	chunkSpan      uint32
 	numChunks      uint32
-	aggSettings    []AggSetting // for now we apply the same settings to all AggMetrics. later we may want to have different settings.
+	schemas        Schemas // per-pattern ttl and aggSettings. series that match none get the defaults
+	defaultSchema  Schema
+	aggRules       AggRules // per-pattern rollups to keep. series that match none keep all of them
 	chunkMaxStale  uint32
 	metricMaxStale uint32
-	ttl            uint32
+	reorderWindow  uint32
 	gcInterval     time.Duration
 }
 
-func NewAggMetrics(store Store, chunkSpan, numChunks, chunkMaxStale, metricMaxStale uint32, ttl uint32, gcInterval time.Duration, aggSettings []AggSetting) *AggMetrics {
+// NewAggMetrics creates the collection of AggMetrics. series get the ttl and aggSettings of the first schema their name matches,
+// or the given ttl and aggSettings if there is none. their rollups are those of the first aggRule their name matches.
+func NewAggMetrics(store Store, chunkSpan, numChunks, chunkMaxStale, metricMaxStale uint32, ttl, reorderWindow uint32, gcInterval time.Duration, aggSettings []AggSetting, schemas Schemas, aggRules AggRules) *AggMetrics {
 	ms := AggMetrics{
 		store:          store,
 		Metrics:        make(map[string]*AggMetric),
 		chunkSpan:      chunkSpan,
 		numChunks:      numChunks,
-		aggSettings:    aggSettings,
+		schemas:        schemas,
+		aggRules:       aggRules,
+		defaultSchema:  Schema{Name: "default", Ttl: ttl, AggSettings: aggSettings},
 		chunkMaxStale:  chunkMaxStale,
 		metricMaxStale: metricMaxStale,
-		ttl:            ttl,
+		reorderWindow:  reorderWindow,
 		gcInterval:     gcInterval,
 	}
 
@@ -95,11 +101,27 @@ func (ms *AggMetrics) Get(key string) (Metric, bool) {
 	return m, ok
 }
 
-func (ms *AggMetrics) GetOrCreate(key string) Metric {
+// Schema returns the storage settings for the series with the given name
+func (ms *AggMetrics) Schema(name string) *Schema {
+	if s, ok := ms.schemas.Match(name); ok {
+		return s
+	}
+	return &ms.defaultSchema
+}
+
+// AggRule returns the rollups to keep for the series with the given name. nil means all of them
+func (ms *AggMetrics) AggRule(name string) *AggRule {
+	r, _ := ms.aggRules.Match(name)
+	return r
+}
+
+func (ms *AggMetrics) GetOrCreate(key, name string) Metric {
 	ms.Lock()
 	m, ok := ms.Metrics[key]
 	if !ok {
-		m = NewAggMetric(ms.store, key, ms.chunkSpan, ms.numChunks, ms.ttl, ms.aggSettings...)
+		s := ms.Schema(name)
+		m = NewAggMetric(ms.store, key, ms.chunkSpan, ms.numChunks, s.Ttl, ms.reorderWindow, ms.AggRule(name), s.AggSettings...)
+		m.name = name
 		ms.Metrics[key] = m
 	}
 	ms.Unlock()
@@ -1,14 +1,21 @@
 package mdata
 
-import "math"
+import (
+	"math"
+
+	"github.com/raintank/metrictank/batch"
+	"github.com/raintank/metrictank/consolidation"
+)
 
 // Aggregation is a container for all summary statistics / aggregated data for 1 metric, in 1 time frame
 // if the cnt is 0, the numbers don't necessarily make sense.
 type Aggregation struct {
-	min float64
-	max float64
-	sum float64
-	cnt float64
+	min  float64
+	max  float64
+	sum  float64
+	cnt  float64
+	lst  float64
+	vals []float64 // all values, to compute percentiles from. only kept if not nil
 }
 
 func NewAggregation() *Aggregation {
@@ -23,6 +30,10 @@ func (a *Aggregation) Add(val float64) {
 	a.max = math.Max(val, a.max)
 	a.sum += val
 	a.cnt += 1
+	a.lst = val
+	if a.vals != nil {
+		a.vals = append(a.vals, val)
+	}
 }
 
 func (a *Aggregation) Reset() {
@@ -30,4 +41,32 @@ func (a *Aggregation) Reset() {
 	a.max = -math.MaxFloat64
 	a.sum = 0
 	a.cnt = 0
+	a.lst = 0
+	if a.vals != nil {
+		a.vals = a.vals[:0]
+	}
+}
+
+// value returns the value of the rollup of the given consolidator, which must have an archive.
+// for percentiles, the vals must be kept.
+func (a *Aggregation) value(consolidator consolidation.Consolidator) float64 {
+	switch consolidator {
+	case consolidation.Min:
+		return a.min
+	case consolidation.Max:
+		return a.max
+	case consolidation.Sum:
+		return a.sum
+	case consolidation.Cnt:
+		return a.cnt
+	case consolidation.Lst:
+		return a.lst
+	case consolidation.P50:
+		return batch.Percentile(a.vals, 50)
+	case consolidation.P90:
+		return batch.Percentile(a.vals, 90)
+	case consolidation.P99:
+		return batch.Percentile(a.vals, 99)
+	}
+	panic("aggregation: no value for consolidator " + consolidator.String())
 }
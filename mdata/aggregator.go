@@ -1,6 +1,11 @@
 package mdata
 
-import "fmt"
+import (
+	"fmt"
+
+	"github.com/raintank/metrictank/batch"
+	"github.com/raintank/metrictank/consolidation"
+)
 
 type AggSetting struct {
 	Span      uint32 // in seconds, controls how many input points go into an aggregated point.
@@ -43,28 +48,102 @@ type Aggregator struct {
 	maxMetric       *AggMetric
 	sumMetric       *AggMetric
 	cntMetric       *AggMetric
+	lstMetric       *AggMetric
+	p50Metric       *AggMetric
+	p90Metric       *AggMetric
+	p99Metric       *AggMetric
 }
 
-func NewAggregator(store Store, key string, aggSpan, aggChunkSpan, aggNumChunks uint32, ttl uint32) *Aggregator {
-	return &Aggregator{
-		key:       key,
-		span:      aggSpan,
-		agg:       NewAggregation(),
-		minMetric: NewAggMetric(store, fmt.Sprintf("%s_min_%d", key, aggSpan), aggChunkSpan, aggNumChunks, ttl),
-		maxMetric: NewAggMetric(store, fmt.Sprintf("%s_max_%d", key, aggSpan), aggChunkSpan, aggNumChunks, ttl),
-		sumMetric: NewAggMetric(store, fmt.Sprintf("%s_sum_%d", key, aggSpan), aggChunkSpan, aggNumChunks, ttl),
-		cntMetric: NewAggMetric(store, fmt.Sprintf("%s_cnt_%d", key, aggSpan), aggChunkSpan, aggNumChunks, ttl),
+// NewAggregator creates an aggregator that keeps the archives needed for the rollups of the given rule, or min, max, sum and cnt if nil.
+// the avg rollup is computed from the sum and cnt archives.
+// for percentiles, it holds on to all values of the current aggregation, so they should only be used for series with few points per span.
+func NewAggregator(store Store, key string, aggSpan, aggChunkSpan, aggNumChunks uint32, ttl uint32, rule *AggRule) *Aggregator {
+	agg := &Aggregator{
+		key:  key,
+		span: aggSpan,
+		agg:  NewAggregation(),
+	}
+	newMetric := func(archive string) *AggMetric {
+		return NewAggMetric(store, fmt.Sprintf("%s_%s_%d", key, archive, aggSpan), aggChunkSpan, aggNumChunks, ttl, 0, nil)
+	}
+	if rule.Has(consolidation.Min) {
+		agg.minMetric = newMetric("min")
+	}
+	if rule.Has(consolidation.Max) {
+		agg.maxMetric = newMetric("max")
+	}
+	if rule.Has(consolidation.Sum) {
+		agg.sumMetric = newMetric("sum")
+	}
+	if rule.Has(consolidation.Cnt) {
+		agg.cntMetric = newMetric("cnt")
 	}
+	if rule.Has(consolidation.Lst) {
+		agg.lstMetric = newMetric("lst")
+	}
+	if rule.Has(consolidation.P50) {
+		agg.p50Metric = newMetric("p50")
+	}
+	if rule.Has(consolidation.P90) {
+		agg.p90Metric = newMetric("p90")
+	}
+	if rule.Has(consolidation.P99) {
+		agg.p99Metric = newMetric("p99")
+	}
+	if agg.p50Metric != nil || agg.p90Metric != nil || agg.p99Metric != nil {
+		agg.agg.vals = make([]float64, 0)
+	}
+	return agg
 }
 func (agg *Aggregator) flush() {
-	agg.minMetric.Add(agg.currentBoundary, agg.agg.min)
-	agg.maxMetric.Add(agg.currentBoundary, agg.agg.max)
-	agg.sumMetric.Add(agg.currentBoundary, agg.agg.sum)
-	agg.cntMetric.Add(agg.currentBoundary, agg.agg.cnt)
+	if agg.minMetric != nil {
+		agg.minMetric.Add(agg.currentBoundary, agg.agg.min)
+	}
+	if agg.maxMetric != nil {
+		agg.maxMetric.Add(agg.currentBoundary, agg.agg.max)
+	}
+	if agg.sumMetric != nil {
+		agg.sumMetric.Add(agg.currentBoundary, agg.agg.sum)
+	}
+	if agg.cntMetric != nil {
+		agg.cntMetric.Add(agg.currentBoundary, agg.agg.cnt)
+	}
+	if agg.lstMetric != nil {
+		agg.lstMetric.Add(agg.currentBoundary, agg.agg.lst)
+	}
+	if agg.p50Metric != nil {
+		agg.p50Metric.Add(agg.currentBoundary, batch.Percentile(agg.agg.vals, 50))
+	}
+	if agg.p90Metric != nil {
+		agg.p90Metric.Add(agg.currentBoundary, batch.Percentile(agg.agg.vals, 90))
+	}
+	if agg.p99Metric != nil {
+		agg.p99Metric.Add(agg.currentBoundary, batch.Percentile(agg.agg.vals, 99))
+	}
 	//msg := fmt.Sprintf("flushed cnt %v sum %f min %f max %f, reset the block", agg.agg.cnt, agg.agg.sum, agg.agg.min, agg.agg.max)
 	agg.agg.Reset()
 }
 
+// archives returns the archives the aggregator keeps, by name
+func (agg *Aggregator) archives() map[string]*AggMetric {
+	archives := make(map[string]*AggMetric)
+	for archive, m := range map[string]*AggMetric{
+		"min": agg.minMetric,
+		"max": agg.maxMetric,
+		"sum": agg.sumMetric,
+		"cnt": agg.cntMetric,
+		"lst": agg.lstMetric,
+		"p50": agg.p50Metric,
+		"p90": agg.p90Metric,
+		"p99": agg.p99Metric,
+	} {
+		if m != nil {
+			archives[archive] = m
+		}
+	}
+	return archives
+}
+
 func (agg *Aggregator) Add(ts uint32, val float64) {
 	boundary := aggBoundary(ts, agg.span)
 
@@ -1,6 +1,7 @@
 package mdata
 
 import (
+	"github.com/raintank/metrictank/consolidation"
 	"gopkg.in/raintank/schema.v1"
 	"testing"
 )
@@ -60,13 +61,13 @@ func TestAggregator(t *testing.T) {
 		}
 		CluStatus.Set(false)
 	}
-	agg := NewAggregator(dnstore, "test", 60, 120, 10, 86400)
+	agg := NewAggregator(dnstore, "test", 60, 120, 10, 86400, nil)
 	agg.Add(100, 123.4)
 	agg.Add(110, 5)
 	expected := []schema.Point{}
 	compare("simple-min-unfinished", agg.minMetric, expected)
 
-	agg = NewAggregator(dnstore, "test", 60, 120, 10, 86400)
+	agg = NewAggregator(dnstore, "test", 60, 120, 10, 86400, nil)
 	agg.Add(100, 123.4)
 	agg.Add(110, 5)
 	agg.Add(130, 130)
@@ -75,7 +76,7 @@ func TestAggregator(t *testing.T) {
 	}
 	compare("simple-min-one-block", agg.minMetric, expected)
 
-	agg = NewAggregator(dnstore, "test", 60, 120, 10, 86400)
+	agg = NewAggregator(dnstore, "test", 60, 120, 10, 86400, nil)
 	agg.Add(100, 123.4)
 	agg.Add(110, 5)
 	agg.Add(120, 4)
@@ -84,7 +85,7 @@ func TestAggregator(t *testing.T) {
 	}
 	compare("simple-min-one-block-done-cause-last-point-just-right", agg.minMetric, expected)
 
-	agg = NewAggregator(dnstore, "test", 60, 120, 10, 86400)
+	agg = NewAggregator(dnstore, "test", 60, 120, 10, 86400, nil)
 	agg.Add(100, 123.4)
 	agg.Add(110, 5)
 	agg.Add(150, 1.123)
@@ -95,7 +96,7 @@ func TestAggregator(t *testing.T) {
 	}
 	compare("simple-min-two-blocks-done-cause-last-point-just-right", agg.minMetric, expected)
 
-	agg = NewAggregator(dnstore, "test", 60, 120, 10, 86400)
+	agg = NewAggregator(dnstore, "test", 60, 120, 10, 86400, nil)
 	agg.Add(100, 123.4)
 	agg.Add(110, 5)
 	agg.Add(190, 2451.123)
@@ -120,3 +121,54 @@ func TestAggregator(t *testing.T) {
 	})
 
 }
+
+func TestAggregatorRule(t *testing.T) {
+	agg := NewAggregator(dnstore, "test", 60, 120, 10, 86400, &AggRule{Methods: []consolidation.Consolidator{consolidation.Sum}})
+	if agg.minMetric != nil || agg.maxMetric != nil || agg.cntMetric != nil || agg.sumMetric == nil {
+		t.Fatalf("expected only a sum archive, got min %v max %v sum %v cnt %v", agg.minMetric, agg.maxMetric, agg.sumMetric, agg.cntMetric)
+	}
+	// flushing must skip the archives we don't keep
+	agg.Add(100, 1)
+	agg.Add(120, 2)
+
+	agg = NewAggregator(dnstore, "test", 60, 120, 10, 86400, &AggRule{Methods: []consolidation.Consolidator{consolidation.Avg}})
+	if agg.minMetric != nil || agg.maxMetric != nil || agg.cntMetric == nil || agg.sumMetric == nil {
+		t.Fatalf("expected sum and cnt archives, got min %v max %v sum %v cnt %v", agg.minMetric, agg.maxMetric, agg.sumMetric, agg.cntMetric)
+	}
+}
+
+func TestAggregatorLastAndPercentiles(t *testing.T) {
+	CluStatus = NewClusterStatus("default", false)
+	rule := &AggRule{Methods: []consolidation.Consolidator{consolidation.Lst, consolidation.P50, consolidation.P90}}
+	agg := NewAggregator(dnstore, "test", 60, 120, 10, 86400, rule)
+	if agg.minMetric != nil || agg.sumMetric != nil || agg.p99Metric != nil {
+		t.Fatalf("expected only the lst, p50 and p90 archives")
+	}
+	for i, val := range []float64{5, 1, 4, 2, 3} {
+		agg.Add(uint32(70+i*10), val)
+	}
+	// the next span flushes the previous one
+	agg.Add(130, 100)
+	for _, c := range []struct {
+		metric *AggMetric
+		exp    float64
+	}{
+		{agg.lstMetric, 3},
+		{agg.p50Metric, 3},
+		{agg.p90Metric, 5},
+	} {
+		CluStatus.Set(true)
+		_, iters := c.metric.Get(0, 1000)
+		CluStatus.Set(false)
+		var got []schema.Point
+		for _, it := range iters {
+			for it.Next() {
+				ts, val := it.Values()
+				got = append(got, schema.Point{Val: val, Ts: ts})
+			}
+		}
+		if len(got) != 1 || got[0].Val != c.exp || got[0].Ts != 120 {
+			t.Fatalf("%s: expected %v at 120, got %v", c.metric.Key, c.exp, got)
+		}
+	}
+}
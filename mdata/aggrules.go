@@ -0,0 +1,107 @@
+package mdata
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/alyu/configparser"
+	"github.com/raintank/metrictank/consolidation"
+)
+
+// AggRule holds which rollup functions to keep for the series of which the name matches the pattern,
+// like a section of a carbon storage-aggregation.conf file
+type AggRule struct {
+	Name    string
+	Pattern *regexp.Regexp
+	Methods []consolidation.Consolidator // the rollups to keep. the first one is the default consolidation function
+}
+
+// AggRules is a list of rules, in the order in which they should be matched
+type AggRules []AggRule
+
+// Match returns the first rule of which the pattern matches the name
+func (a AggRules) Match(name string) (*AggRule, bool) {
+	for i := range a {
+		if a[i].Pattern.MatchString(name) {
+			return &a[i], true
+		}
+	}
+	return nil, false
+}
+
+// Has returns whether the rule keeps the rollup archives needed to consolidate by the given consolidator.
+// the avg rollup is computed from the sum and cnt archives, so it keeps those for it as well.
+// a nil rule keeps min, max, sum and cnt, and thus avg.
+func (r *AggRule) Has(consolidator consolidation.Consolidator) bool {
+	if r == nil {
+		switch consolidator {
+		case consolidation.Avg, consolidation.Cnt, consolidation.Min, consolidation.Max, consolidation.Sum:
+			return true
+		}
+		return false
+	}
+	switch consolidator {
+	case consolidation.Avg:
+		return r.has(consolidation.Avg) || r.has(consolidation.Sum) && r.has(consolidation.Cnt)
+	case consolidation.Sum, consolidation.Cnt:
+		return r.has(consolidator) || r.has(consolidation.Avg)
+	}
+	return r.has(consolidator)
+}
+
+func (r *AggRule) has(consolidator consolidation.Consolidator) bool {
+	for _, m := range r.Methods {
+		if m == consolidator {
+			return true
+		}
+	}
+	return false
+}
+
+// ReadAggRules reads a storage-aggregation.conf style file.
+// unlike in graphite, aggregationMethod may be a comma-separated list of functions to keep rollups for, of which the first is the default.
+// besides graphite's avg, min, max, sum and last, the p50, p90 and p99 percentiles are supported.
+// the xFilesFactor setting is not supported and ignored.
+func ReadAggRules(file string) (AggRules, error) {
+	config, err := configparser.Read(file)
+	if err != nil {
+		return nil, err
+	}
+	sections, err := config.AllSections()
+	if err != nil {
+		return nil, err
+	}
+	var rules AggRules
+	for _, s := range sections {
+		// the parser puts any options before the first section in a "global" one
+		if s.Name() == "global" {
+			continue
+		}
+		name := strings.Trim(s.Name(), "[]")
+		if name == "" || strings.HasPrefix(name, "#") {
+			continue
+		}
+		rule := AggRule{Name: name}
+		rule.Pattern, err = regexp.Compile(s.ValueOf("pattern"))
+		if err != nil {
+			return nil, fmt.Errorf("aggregation %q: bad pattern: %s", name, err)
+		}
+		for _, method := range strings.Split(s.ValueOf("aggregationMethod"), ",") {
+			method = strings.TrimSpace(method)
+			if method == "" {
+				continue
+			}
+			consolidator, err := consolidation.FromConsolidateBy(method)
+			if err != nil {
+				return nil, fmt.Errorf("aggregation %q: %s %q", name, err, method)
+			}
+			rule.Methods = append(rule.Methods, consolidator)
+		}
+		if len(rule.Methods) == 0 {
+			return nil, fmt.Errorf("aggregation %q: aggregationMethod cannot be empty", name)
+		}
+		rules = append(rules, rule)
+	}
+	return rules, nil
+}
@@ -0,0 +1,97 @@
+package mdata
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/raintank/metrictank/consolidation"
+)
+
+func TestReadAggRules(t *testing.T) {
+	f, err := ioutil.TempFile("", "storage-aggregation")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	f.WriteString(`# comments are ignored
+[counters]
+pattern = \.count$
+xFilesFactor = 0
+aggregationMethod = sum
+
+[default]
+pattern = .*
+xFilesFactor = 0.5
+aggregationMethod = max, avg
+`)
+	f.Close()
+
+	rules, err := ReadAggRules(f.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rules) != 2 {
+		t.Fatalf("expected 2 rules, got %d: %v", len(rules), rules)
+	}
+	cases := []struct {
+		name    string
+		rule    string
+		methods []consolidation.Consolidator
+	}{
+		{"app.requests.count", "counters", []consolidation.Consolidator{consolidation.Sum}},
+		{"app.requests.latency", "default", []consolidation.Consolidator{consolidation.Max, consolidation.Avg}},
+	}
+	for _, c := range cases {
+		r, ok := rules.Match(c.name)
+		if !ok || r.Name != c.rule || len(r.Methods) != len(c.methods) {
+			t.Fatalf("expected %q to match rule %q with methods %v, got %v", c.name, c.rule, c.methods, r)
+		}
+		for i := range c.methods {
+			if r.Methods[i] != c.methods[i] {
+				t.Fatalf("expected %q to match rule %q with methods %v, got %v", c.name, c.rule, c.methods, r.Methods)
+			}
+		}
+	}
+}
+
+func TestAggRuleHas(t *testing.T) {
+	cases := []struct {
+		rule *AggRule
+		has  []consolidation.Consolidator
+		not  []consolidation.Consolidator
+	}{
+		{
+			nil,
+			[]consolidation.Consolidator{consolidation.Avg, consolidation.Cnt, consolidation.Min, consolidation.Max, consolidation.Sum},
+			[]consolidation.Consolidator{consolidation.Lst, consolidation.P50, consolidation.P90, consolidation.P99},
+		},
+		{
+			&AggRule{Methods: []consolidation.Consolidator{consolidation.Sum}},
+			[]consolidation.Consolidator{consolidation.Sum},
+			[]consolidation.Consolidator{consolidation.Avg, consolidation.Cnt, consolidation.Min, consolidation.Max},
+		},
+		{
+			&AggRule{Methods: []consolidation.Consolidator{consolidation.Avg}},
+			[]consolidation.Consolidator{consolidation.Avg, consolidation.Sum, consolidation.Cnt},
+			[]consolidation.Consolidator{consolidation.Min, consolidation.Max},
+		},
+		{
+			&AggRule{Methods: []consolidation.Consolidator{consolidation.Max, consolidation.Sum, consolidation.Cnt}},
+			[]consolidation.Consolidator{consolidation.Avg, consolidation.Sum, consolidation.Cnt, consolidation.Max},
+			[]consolidation.Consolidator{consolidation.Min},
+		},
+	}
+	for i, c := range cases {
+		for _, cons := range c.has {
+			if !c.rule.Has(cons) {
+				t.Fatalf("case %d: expected the rule to have %s", i, cons)
+			}
+		}
+		for _, cons := range c.not {
+			if c.rule.Has(cons) {
+				t.Fatalf("case %d: expected the rule not to have %s", i, cons)
+			}
+		}
+	}
+}
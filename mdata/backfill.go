@@ -0,0 +1,302 @@
+package mdata
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/raintank/metrictank/consolidation"
+	"github.com/raintank/metrictank/mdata/chunk"
+	"gopkg.in/raintank/schema.v1"
+)
+
+var (
+	errBackfillUnsorted = errors.New("points must be sorted by timestamp, without duplicates")
+	errBackfillOverlap  = errors.New("points overlap with the data in memory")
+)
+
+// BackfillRollup is historical data of a series that was rolled up already, like an archive of a whisper file:
+// like the points of rollup archives, each point has the Consolidator of the raw points of the Span that ends at its timestamp.
+type BackfillRollup struct {
+	Span         uint32
+	Consolidator consolidation.Consolidator
+	Points       []schema.Point
+}
+
+// backfillArchive is the data to backfill for the raw series, or one of its rollup archives
+type backfillArchive struct {
+	key       string
+	chunkSpan uint32
+	ttl       uint32
+	points    []schema.Point
+	mem       *AggMetric // the metric holding the data of the archive in memory, if any
+}
+
+// PreparedBackfill is the data of a series and its rollup archives to backfill, checked to be valid. see PrepareBackfill
+type PreparedBackfill struct {
+	archives []backfillArchive
+}
+
+// Keys returns the keys of the raw data and the rollup archives that the backfill saves chunks for
+func (b *PreparedBackfill) Keys() []string {
+	keys := make([]string, 0, len(b.archives))
+	for _, a := range b.archives {
+		if len(a.points) > 0 {
+			keys = append(keys, a.key)
+		}
+	}
+	return keys
+}
+
+// Backfill prepares the backfill of a series and saves it, see PrepareBackfill and SaveBackfill.
+// It returns the number of chunks it saved.
+func (ms *AggMetrics) Backfill(key, name string, interval uint32, points []schema.Point, rollups ...BackfillRollup) (int, error) {
+	b, err := ms.PrepareBackfill(key, name, interval, points, rollups...)
+	if err != nil {
+		return 0, err
+	}
+	return ms.SaveBackfill(b), nil
+}
+
+// PrepareBackfill checks the historical data of a series, and prepares the data of its rollup archives.
+// the backfill bypasses the chunks in memory, so the points must be older than those. the points must be sorted by timestamp.
+// the raw points have the given interval. rollups that were made already, are saved as the rollup archive with the same span,
+// the other rollup archives are built from the raw points and the rollups with a smaller span, for the time ranges they cover.
+func (ms *AggMetrics) PrepareBackfill(key, name string, interval uint32, points []schema.Point, rollups ...BackfillRollup) (*PreparedBackfill, error) {
+	if !sorted(points) {
+		return nil, errBackfillUnsorted
+	}
+	for _, r := range rollups {
+		if !sorted(r.Points) {
+			return nil, errBackfillUnsorted
+		}
+	}
+	s := ms.Schema(name)
+	rule := ms.AggRule(name)
+	m, _ := ms.Get(key)
+	mem, _ := m.(*AggMetric)
+
+	archives := []backfillArchive{{key, ms.chunkSpan, s.Ttl, points, mem}}
+	var consolidators []consolidation.Consolidator
+	for _, consolidator := range archiveConsolidators {
+		if rule.Has(consolidator) {
+			consolidators = append(consolidators, consolidator)
+		}
+	}
+	for _, as := range s.AggSettings {
+		var aggs map[consolidation.Consolidator][]schema.Point
+		if r, ok := findRollup(rollups, as.Span); ok {
+			aggs = fromRollup(r, interval, consolidators)
+		} else {
+			aggs = rollupFinest(points, rollups, interval, as.Span, consolidators)
+		}
+		for _, consolidator := range consolidators {
+			archive := backfillArchive{
+				key:       fmt.Sprintf("%s_%s_%d", key, consolidator.Archive(), as.Span),
+				chunkSpan: as.ChunkSpan,
+				ttl:       as.Ttl,
+				points:    aggs[consolidator],
+			}
+			if mem != nil {
+				archive.mem = mem.archive(as.Span, consolidator.Archive())
+			}
+			archives = append(archives, archive)
+		}
+	}
+
+	// don't write chunks the ones in memory would be saved over, or the other way around
+	for _, a := range archives {
+		if a.mem == nil || len(a.points) == 0 {
+			continue
+		}
+		last := a.points[len(a.points)-1].Ts
+		if oldest, ok := a.mem.oldestT0(); ok && last-(last%a.chunkSpan) >= oldest {
+			return nil, errBackfillOverlap
+		}
+	}
+	return &PreparedBackfill{archives}, nil
+}
+
+// SaveBackfill builds the chunks of a prepared backfill, and adds them to the store.
+// chunks are saved with what is left of their ttl, those that already expired are skipped.
+// any chunks in the store with the same key and t0 are overwritten, but reads may still be served the old ones from the
+// chunks the store caches. so the cached chunks of every key of the backfill are invalidated here, and those that other
+// instances cache must be invalidated as well. It returns the number of chunks it saved.
+func (ms *AggMetrics) SaveBackfill(b *PreparedBackfill) int {
+	now := uint32(time.Now().Unix())
+	saved := 0
+	for _, a := range b.archives {
+		if len(a.points) == 0 {
+			continue
+		}
+		prevT0 := uint32(0)
+		for len(a.points) > 0 {
+			t0 := a.points[0].Ts - (a.points[0].Ts % a.chunkSpan)
+			n := 0
+			for n < len(a.points) && a.points[n].Ts < t0+a.chunkSpan {
+				n++
+			}
+			c := chunk.Build(t0, a.points[:n])
+			a.points = a.points[n:]
+
+			// the ttl applies from the end of the chunk
+			if t0+a.chunkSpan+a.ttl <= now {
+				continue
+			}
+			cwr := &ChunkWriteRequest{
+				key:       a.key,
+				chunk:     c,
+				ttl:       t0 + a.chunkSpan + a.ttl - now,
+				timestamp: time.Now(),
+			}
+			if prevT0 != 0 && prevT0+a.chunkSpan == t0 {
+				cwr.prevT0 = prevT0
+			}
+			ms.store.Add(cwr)
+			prevT0 = t0
+			saved++
+		}
+		ms.store.Invalidate(a.key)
+	}
+	return saved
+}
+
+func sorted(points []schema.Point) bool {
+	for i := 1; i < len(points); i++ {
+		if points[i].Ts <= points[i-1].Ts {
+			return false
+		}
+	}
+	return true
+}
+
+// findRollup returns the rollup with the given span, if there is one
+func findRollup(rollups []BackfillRollup, span uint32) (BackfillRollup, bool) {
+	for _, r := range rollups {
+		if r.Span == span {
+			return r, true
+		}
+	}
+	return BackfillRollup{}, false
+}
+
+// fromRollup returns the points of the rollup archives for the given consolidators, from a rollup that was made already.
+// the rollup only has one consolidator, so the others are derived from it, assuming all points of each span had its average value.
+func fromRollup(r BackfillRollup, interval uint32, consolidators []consolidation.Consolidator) map[consolidation.Consolidator][]schema.Point {
+	cnt := float64(1)
+	if interval != 0 && r.Span > interval {
+		cnt = float64(r.Span / interval)
+	}
+	aggs := make(map[consolidation.Consolidator][]schema.Point)
+	for _, p := range r.Points {
+		avg := p.Val
+		if r.Consolidator == consolidation.Sum {
+			avg = p.Val / cnt
+		}
+		for _, consolidator := range consolidators {
+			val := avg
+			switch {
+			case consolidator == r.Consolidator:
+				val = p.Val
+			case consolidator == consolidation.Cnt:
+				val = cnt
+			case consolidator == consolidation.Sum:
+				val = avg * cnt
+			}
+			aggs[consolidator] = append(aggs[consolidator], schema.Point{Val: val, Ts: p.Ts})
+		}
+	}
+	return aggs
+}
+
+// rollupFinest returns the rollups for the given span and consolidators, from the data with the highest resolution
+// we have for each time range: the raw points, preceded by the rollups with a smaller span, for the time ranges before.
+// the rollups are rolled up further per consolidator, e.g. the sums of their sums, and the maxes of their maxes.
+func rollupFinest(points []schema.Point, rollups []BackfillRollup, interval, span uint32, consolidators []consolidation.Consolidator) map[consolidation.Consolidator][]schema.Point {
+	aggs := rollup(points, span, consolidators)
+	var finer []BackfillRollup
+	for _, r := range rollups {
+		if r.Span < span {
+			finer = append(finer, r)
+		}
+	}
+	sort.Sort(bySpan(finer))
+	for _, r := range finer {
+		derived := fromRollup(r, interval, consolidators)
+		for _, consolidator := range consolidators {
+			again := consolidator
+			if consolidator == consolidation.Cnt {
+				again = consolidation.Sum
+			}
+			before := rollup(derived[consolidator], span, []consolidation.Consolidator{again})[again]
+			out := aggs[consolidator]
+			if len(out) > 0 {
+				before = before[:sort.Search(len(before), func(i int) bool { return before[i].Ts >= out[0].Ts })]
+			}
+			aggs[consolidator] = append(before, out...)
+		}
+	}
+	return aggs
+}
+
+type bySpan []BackfillRollup
+
+func (b bySpan) Len() int           { return len(b) }
+func (b bySpan) Swap(i, j int)      { b[i], b[j] = b[j], b[i] }
+func (b bySpan) Less(i, j int) bool { return b[i].Span < b[j].Span }
+
+// rollup computes the rollups of the points for the given consolidators, like an Aggregator would.
+// unlike an Aggregator, it also returns the rollup of the last, possibly incomplete, span.
+func rollup(points []schema.Point, span uint32, consolidators []consolidation.Consolidator) map[consolidation.Consolidator][]schema.Point {
+	rollups := make(map[consolidation.Consolidator][]schema.Point)
+	agg := NewAggregation()
+	agg.vals = make([]float64, 0)
+	boundary := uint32(0)
+	flush := func() {
+		for _, consolidator := range consolidators {
+			rollups[consolidator] = append(rollups[consolidator], schema.Point{Val: agg.value(consolidator), Ts: boundary})
+		}
+		agg.Reset()
+	}
+	for _, p := range points {
+		b := aggBoundary(p.Ts, span)
+		if b != boundary && agg.cnt != 0 {
+			flush()
+		}
+		boundary = b
+		agg.Add(p.Val)
+	}
+	if agg.cnt != 0 {
+		flush()
+	}
+	return rollups
+}
+
+// oldestT0 returns the t0 of the oldest chunk in memory, if there is one
+func (a *AggMetric) oldestT0() (uint32, bool) {
+	a.RLock()
+	defer a.RUnlock()
+	if len(a.Chunks) == 0 {
+		return 0, false
+	}
+	oldest := a.Chunks[0].T0
+	for _, c := range a.Chunks {
+		if c.T0 < oldest {
+			oldest = c.T0
+		}
+	}
+	return oldest, true
+}
+
+// archive returns the metric of the given rollup archive, if the metric has it
+func (a *AggMetric) archive(span uint32, archive string) *AggMetric {
+	a.RLock()
+	defer a.RUnlock()
+	for _, agg := range a.aggregators {
+		if agg.span == span {
+			return agg.archives()[archive]
+		}
+	}
+	return nil
+}
@@ -0,0 +1,167 @@
+package mdata
+
+import (
+	"testing"
+	"time"
+
+	"github.com/raintank/met/helper"
+	"github.com/raintank/metrictank/consolidation"
+	"github.com/raintank/metrictank/iter"
+	"github.com/raintank/metrictank/mdata/chunk"
+	"gopkg.in/raintank/schema.v1"
+)
+
+// recordingStore keeps the chunk write requests it gets
+type recordingStore struct {
+	cwrs        []*ChunkWriteRequest
+	invalidated []string // keys of which the cached chunks were dropped
+}
+
+func (r *recordingStore) Add(cwr *ChunkWriteRequest) {
+	r.cwrs = append(r.cwrs, cwr)
+}
+
+func (r *recordingStore) Search(key string, start, end uint32) ([]iter.Iter, error) {
+	return nil, nil
+}
+
+func (r *recordingStore) SearchChunks(key string, start, end uint32) ([]chunk.IterGen, error) {
+	return nil, nil
+}
+
+func (r *recordingStore) Delete(key string, ttl, chunkSpan uint32) error {
+	return nil
+}
+
+func (r *recordingStore) Invalidate(key string) {
+	r.invalidated = append(r.invalidated, key)
+}
+
+func (r *recordingStore) Stop() {
+}
+
+func TestBackfill(t *testing.T) {
+	stats, _ := helper.New(false, "", "standard", "metrictank", "")
+	CluStatus = NewClusterStatus("default", true)
+	InitMetrics(stats)
+
+	store := &recordingStore{}
+	aggSettings := []AggSetting{{60, 600, 2, 7200, true}}
+	metrics := NewAggMetrics(store, 600, 3, 800, 8000, 3000, 0, 0, aggSettings, nil, nil)
+
+	// points every 30s, from about an hour ago until 15 minutes ago
+	now := uint32(time.Now().Unix())
+	start := now - now%600 - 3600
+	var points []schema.Point
+	for ts := start + 30; ts <= start+2700; ts += 30 {
+		points = append(points, schema.Point{Val: float64(ts - start), Ts: ts})
+	}
+	num, err := metrics.Backfill("1.01234567890123456789012345678901", "foo", 30, points)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if num != len(store.cwrs) {
+		t.Fatalf("expected %d saved chunks, got %d", len(store.cwrs), num)
+	}
+
+	byKey := make(map[string][]*ChunkWriteRequest)
+	for _, cwr := range store.cwrs {
+		byKey[cwr.key] = append(byKey[cwr.key], cwr)
+	}
+	// the first raw chunk expired already
+	raw := byKey["1.01234567890123456789012345678901"]
+	if len(raw) != 4 || raw[0].chunk.T0 != start+600 {
+		t.Fatalf("expected 4 raw chunks starting at %d, got %d starting at %d", start+600, len(raw), raw[0].chunk.T0)
+	}
+	for _, cwr := range raw {
+		// Backfill may have run a second later than we took the time
+		if exp := cwr.chunk.T0 + 600 + 3000 - now; cwr.ttl != exp && cwr.ttl != exp-1 {
+			t.Fatalf("expected chunk %d to have ttl %d, got %d", cwr.chunk.T0, exp, cwr.ttl)
+		}
+	}
+	if raw[1].prevT0 != raw[0].chunk.T0 {
+		t.Fatalf("expected chunks to be linked to the previous one")
+	}
+	sum := byKey["1.01234567890123456789012345678901_sum_60"]
+	if len(sum) != 5 || len(byKey) != 5 {
+		t.Fatalf("expected 5 chunks for each of the 4 rollups, got %d sum chunks and %d keys", len(sum), len(byKey))
+	}
+	it := sum[0].chunk.Iter()
+	it.Next()
+	ts, val := it.Values()
+	// the points at start+30 and start+60 make up the first rollup
+	if ts != start+60 || val != 90 {
+		t.Fatalf("expected first sum rollup to be 90@%d, got %f@%d", start+60, val, ts)
+	}
+
+	// the cached chunks of every key written are dropped
+	if len(store.invalidated) != len(byKey) {
+		t.Fatalf("expected the cached chunks of the %d keys to be invalidated, got %v", len(byKey), store.invalidated)
+	}
+	for _, key := range store.invalidated {
+		if _, ok := byKey[key]; !ok {
+			t.Fatalf("expected only keys that were written to be invalidated, got %s", key)
+		}
+	}
+
+	if _, err := metrics.Backfill("1.01234567890123456789012345678901", "foo", 30, []schema.Point{{1, 100}, {2, 100}}); err != errBackfillUnsorted {
+		t.Fatalf("expected %s, got %v", errBackfillUnsorted, err)
+	}
+	m := metrics.GetOrCreate("1.01234567890123456789012345678901", "foo")
+	m.Add(start+2400, 1)
+	if _, err := metrics.Backfill("1.01234567890123456789012345678901", "foo", 30, points); err != errBackfillOverlap {
+		t.Fatalf("expected %s, got %v", errBackfillOverlap, err)
+	}
+}
+
+func TestBackfillRollups(t *testing.T) {
+	stats, _ := helper.New(false, "", "standard", "metrictank", "")
+	CluStatus = NewClusterStatus("default", true)
+	InitMetrics(stats)
+
+	store := &recordingStore{}
+	aggSettings := []AggSetting{{60, 600, 2, 7200, true}, {600, 3600, 2, 7200, true}}
+	metrics := NewAggMetrics(store, 600, 3, 800, 8000, 7200, 0, 0, aggSettings, nil, nil)
+
+	// raw points every 30s for the last 10 minutes, and an average per minute for the 20 minutes before
+	now := uint32(time.Now().Unix())
+	start := now - now%600 - 1800
+	var points, avgs []schema.Point
+	for ts := start + 60; ts <= start+1200; ts += 60 {
+		avgs = append(avgs, schema.Point{Val: 3, Ts: ts})
+	}
+	for ts := start + 1230; ts <= start+1800; ts += 30 {
+		points = append(points, schema.Point{Val: 1, Ts: ts})
+	}
+	rollups := []BackfillRollup{{Span: 60, Consolidator: consolidation.Avg, Points: avgs}}
+	if _, err := metrics.Backfill("1.01234567890123456789012345678901", "foo", 30, points, rollups...); err != nil {
+		t.Fatal(err)
+	}
+	byKey := make(map[string][]schema.Point)
+	for _, cwr := range store.cwrs {
+		it := cwr.chunk.Iter()
+		for it.Next() {
+			ts, val := it.Values()
+			byKey[cwr.key] = append(byKey[cwr.key], schema.Point{Val: val, Ts: ts})
+		}
+	}
+	// the raw data only has the raw points
+	if raw := byKey["1.01234567890123456789012345678901"]; len(raw) != len(points) {
+		t.Fatalf("expected the %d raw points, got %d", len(points), len(raw))
+	}
+	// the rollup with a span of 60 is saved as that archive, with the other consolidators derived from it
+	sum := byKey["1.01234567890123456789012345678901_sum_60"]
+	cnt := byKey["1.01234567890123456789012345678901_cnt_60"]
+	if len(sum) != len(avgs) || sum[0] != (schema.Point{Val: 6, Ts: start + 60}) || cnt[0] != (schema.Point{Val: 2, Ts: start + 60}) {
+		t.Fatalf("expected the sum and cnt of the rollup, got sum %v and cnt %v", sum, cnt)
+	}
+	// the archive with a span of 600 has no matching rollup, so it's built from the finest data: the rollup, then the raw points
+	// the counts of the rollup are summed up, not counted
+	if cnt := byKey["1.01234567890123456789012345678901_cnt_600"]; len(cnt) != 3 || cnt[0].Val != 20 {
+		t.Fatalf("expected the first count of 10 minutes to be 20, got %v", cnt)
+	}
+	sum = byKey["1.01234567890123456789012345678901_sum_600"]
+	if len(sum) != 3 || sum[0].Val != 60 || sum[2].Val != 20 {
+		t.Fatalf("expected 3 sums of 10 minutes, the first of the rollup and the last of the raw points, got %v", sum)
+	}
+}
@@ -0,0 +1,150 @@
+package mdata
+
+import (
+	"container/list"
+	"sync"
+
+	"github.com/raintank/metrictank/mdata/chunk"
+)
+
+// ChunkCache keeps recently read and saved chunks in memory, so that repeated reads of the same
+// historical data don't all have to go to cassandra.
+// chunks are only useful to a read if we know we have all the chunks of the requested range,
+// so for each chunk we also track the t0 of the chunk that comes after it in the store, if we know it.
+// when the total size of the chunks exceeds the max size, the least recently used ones are evicted.
+// ChunkCache is concurrency-safe
+type ChunkCache struct {
+	sync.Mutex
+	maxSize uint64
+	size    uint64
+	series  map[string]map[uint32]*cacheChunk // by key, by t0
+	lru     *list.List                        // of *cacheChunk, most recently used at the front
+}
+
+type cacheChunk struct {
+	key  string
+	next uint32 // t0 of the next chunk of the series, 0 if unknown
+	ig   chunk.IterGen
+	elem *list.Element
+}
+
+func NewChunkCache(maxSize uint64) *ChunkCache {
+	return &ChunkCache{
+		maxSize: maxSize,
+		series:  make(map[string]map[uint32]*cacheChunk),
+		lru:     list.New(),
+	}
+}
+
+// Add adds a chunk. prev is the t0 of the chunk that comes right before it in the store, or 0 if unknown.
+func (c *ChunkCache) Add(key string, prev uint32, ig chunk.IterGen) {
+	c.Lock()
+	defer c.Unlock()
+	if prev != 0 {
+		if p, ok := c.series[key][prev]; ok {
+			p.next = ig.T0
+		}
+	}
+	c.add(key, ig)
+	c.evict()
+}
+
+// AddRange adds chunks that are consecutive in the store, sorted by t0, such as those returned by a search.
+func (c *ChunkCache) AddRange(key string, igs []chunk.IterGen) {
+	c.Lock()
+	defer c.Unlock()
+	for i, ig := range igs {
+		cc := c.add(key, ig)
+		if i+1 < len(igs) {
+			cc.next = igs[i+1].T0
+		}
+	}
+	c.evict()
+}
+
+// add adds the chunk. if we already have a chunk with its t0, it's replaced, as the chunk may have been saved again
+// with different data, and marked as recently used. the caller must evict afterwards, as the cache may have grown.
+func (c *ChunkCache) add(key string, ig chunk.IterGen) *cacheChunk {
+	chunks, ok := c.series[key]
+	if !ok {
+		chunks = make(map[uint32]*cacheChunk)
+		c.series[key] = chunks
+	}
+	if cc, ok := chunks[ig.T0]; ok {
+		c.size = c.size - cc.ig.Size() + ig.Size()
+		cc.ig = ig
+		c.lru.MoveToFront(cc.elem)
+		return cc
+	}
+	cc := &cacheChunk{key: key, ig: ig}
+	cc.elem = c.lru.PushFront(cc)
+	chunks[ig.T0] = cc
+	c.size += ig.Size()
+	return cc
+}
+
+// evict removes the least recently used chunks until we're within the max size
+func (c *ChunkCache) evict() {
+	for c.size > c.maxSize {
+		cc := c.lru.Remove(c.lru.Back()).(*cacheChunk)
+		c.size -= cc.ig.Size()
+		delete(c.series[cc.key], cc.ig.T0)
+		if len(c.series[cc.key]) == 0 {
+			delete(c.series, cc.key)
+		}
+		cacheEvict.Inc(1)
+	}
+	cacheSize.Value(int64(c.size))
+}
+
+// Delete removes all chunks of the series
+func (c *ChunkCache) Delete(key string) {
+	c.Lock()
+	defer c.Unlock()
+	for _, cc := range c.series[key] {
+		c.lru.Remove(cc.elem)
+		c.size -= cc.ig.Size()
+	}
+	delete(c.series, key)
+	cacheSize.Value(int64(c.size))
+}
+
+// Search returns the chunks that a search of the store for the given range would return
+// (the last chunk with a t0 <= start, followed by all chunks with a t0 < end),
+// but only if we have all of them. start inclusive, end exclusive
+func (c *ChunkCache) Search(key string, start, end uint32) ([]chunk.IterGen, bool) {
+	c.Lock()
+	defer c.Unlock()
+	chunks, ok := c.series[key]
+	if !ok {
+		cacheMiss.Inc(1)
+		return nil, false
+	}
+	var first *cacheChunk
+	for t0, cc := range chunks {
+		if t0 <= start && (first == nil || t0 > first.ig.T0) {
+			first = cc
+		}
+	}
+	var result []*cacheChunk
+	for cc := first; cc != nil; cc = chunks[cc.next] {
+		result = append(result, cc)
+		if cc.next == 0 {
+			// we don't know if there are more chunks in the store
+			break
+		}
+		if cc.next >= end {
+			for _, cc := range result {
+				c.lru.MoveToFront(cc.elem)
+			}
+			igs := make([]chunk.IterGen, len(result))
+			for i, cc := range result {
+				igs[i] = cc.ig
+			}
+			cacheHit.Inc(1)
+			return igs, true
+		}
+	}
+	cacheMiss.Inc(1)
+	return nil, false
+}
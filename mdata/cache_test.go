@@ -0,0 +1,111 @@
+package mdata
+
+import (
+	"testing"
+
+	"github.com/raintank/met/helper"
+	"github.com/raintank/metrictank/mdata/chunk"
+)
+
+func ig(t0 uint32) chunk.IterGen {
+	return chunk.NewIterGen(t0, make([]byte, 10))
+}
+
+func t0s(igs []chunk.IterGen) []uint32 {
+	var out []uint32
+	for _, ig := range igs {
+		out = append(out, ig.T0)
+	}
+	return out
+}
+
+func TestChunkCacheSearch(t *testing.T) {
+	stats, _ := helper.New(false, "", "standard", "metrictank", "")
+	InitMetrics(stats)
+
+	c := NewChunkCache(1000)
+	c.AddRange("a", []chunk.IterGen{ig(600), ig(1200), ig(1800)})
+	// saved chunks extend the range
+	c.Add("a", 1800, ig(2400))
+	// but not if we don't know what comes before them
+	c.Add("a", 0, ig(3600))
+
+	cases := []struct {
+		start, end uint32
+		ok         bool
+		t0s        []uint32
+	}{
+		{600, 1200, true, []uint32{600}},
+		{700, 1900, true, []uint32{600, 1200, 1800}},
+		{1200, 2400, true, []uint32{1200, 1800}},
+		{1300, 2401, false, nil}, // we don't know what comes after 2400
+		{500, 1200, false, nil},  // we don't know what comes before 600
+		{3600, 3700, false, nil},
+	}
+	for i, tc := range cases {
+		igs, ok := c.Search("a", tc.start, tc.end)
+		if ok != tc.ok {
+			t.Fatalf("case %d: expected ok %t, got %t", i, tc.ok, ok)
+		}
+		got := t0s(igs)
+		if len(got) != len(tc.t0s) {
+			t.Fatalf("case %d: expected chunks %v, got %v", i, tc.t0s, got)
+		}
+		for j := range got {
+			if got[j] != tc.t0s[j] {
+				t.Fatalf("case %d: expected chunks %v, got %v", i, tc.t0s, got)
+			}
+		}
+	}
+	if _, ok := c.Search("b", 600, 1200); ok {
+		t.Fatalf("expected a miss for an unknown series")
+	}
+}
+
+func TestChunkCacheEvict(t *testing.T) {
+	stats, _ := helper.New(false, "", "standard", "metrictank", "")
+	InitMetrics(stats)
+
+	c := NewChunkCache(30)
+	c.AddRange("a", []chunk.IterGen{ig(600), ig(1200), ig(1800)})
+	// using the chunk makes it the most recently used one
+	if _, ok := c.Search("a", 600, 1200); !ok {
+		t.Fatalf("expected a hit")
+	}
+	c.AddRange("b", []chunk.IterGen{ig(600)})
+	if c.size != 30 {
+		t.Fatalf("expected size 30, got %d", c.size)
+	}
+	if _, ok := c.series["a"][1200]; ok {
+		t.Fatalf("expected the least recently used chunk to be evicted")
+	}
+	if _, ok := c.series["a"][600]; !ok {
+		t.Fatalf("expected the recently used chunk to be kept")
+	}
+	// with a chunk of the range gone, we can no longer serve it
+	if _, ok := c.Search("a", 600, 1900); ok {
+		t.Fatalf("expected a miss after eviction")
+	}
+}
+
+func TestChunkCacheReplace(t *testing.T) {
+	stats, _ := helper.New(false, "", "standard", "metrictank", "")
+	InitMetrics(stats)
+
+	c := NewChunkCache(1000)
+	c.AddRange("a", []chunk.IterGen{ig(600), ig(1200)})
+	// the chunk at 600 is saved again, with other data
+	c.Add("a", 0, chunk.NewIterGen(600, []byte{1, 2, 3}))
+	igs, ok := c.Search("a", 600, 1200)
+	if !ok || len(igs) != 1 || len(igs[0].B) != 3 || igs[0].B[0] != 1 {
+		t.Fatalf("expected the chunk that was saved last, got %v", igs)
+	}
+	if c.size != 13 {
+		t.Fatalf("expected the size to account for the new chunk, got %d", c.size)
+	}
+	// chunks that grow can push others out
+	c.Add("a", 0, chunk.NewIterGen(600, make([]byte, 995)))
+	if _, ok := c.series["a"][1200]; ok || c.size != 995 {
+		t.Fatalf("expected the other chunk to be evicted, size is %d", c.size)
+	}
+}
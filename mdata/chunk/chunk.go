@@ -5,6 +5,7 @@ import (
 	"time"
 
 	"github.com/dgryski/go-tsz"
+	"gopkg.in/raintank/schema.v1"
 )
 
 var TotalPoints chan int
@@ -30,6 +31,21 @@ func New(t0 uint32) *Chunk {
 	return &Chunk{tsz.New(t0), 0, 0, false, false, uint32(time.Now().Unix())}
 }
 
+// Build creates a finished chunk holding the given points, which must be sorted by timestamp.
+// unlike chunks filled with Push, it is not accounted for in TotalPoints, as such chunks are meant to be saved rather than kept in memory.
+func Build(t0 uint32, points []schema.Point) *Chunk {
+	c := New(t0)
+	for _, p := range points {
+		c.Series.Push(p.Ts, p.Val)
+	}
+	c.Finish()
+	c.NumPoints = uint32(len(points))
+	if len(points) > 0 {
+		c.LastTs = points[len(points)-1].Ts
+	}
+	return c
+}
+
 func (c *Chunk) String() string {
 	return fmt.Sprintf("<chunk T0=%d, LastTs=%d, NumPoints=%d, Saved=%t>", c.T0, c.LastTs, c.NumPoints, c.Saved)
 
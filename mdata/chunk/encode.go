@@ -0,0 +1,120 @@
+package chunk
+
+import (
+	"encoding/binary"
+	"errors"
+	"math"
+
+	"github.com/dgryski/go-tsz"
+	"github.com/golang/snappy"
+)
+
+var (
+	ErrChunkTooSmall      = errors.New("unpossibly small chunk")
+	ErrUnknownChunkFormat = errors.New("unrecognized chunk format")
+	errCorruptDeltaInt    = errors.New("corrupt delta-int chunk")
+)
+
+// integer values beyond this can't be represented exactly as float64, nor safely be subtracted from each other
+const maxInt = 1 << 53
+
+// Encode returns the data of the chunk, prefixed with the byte of the format it is encoded in.
+// FormatDeltaOfDeltaInt can only encode integer values. chunks with other values are encoded in FormatStandardGoTsz instead.
+func (c *Chunk) Encode(format Format) ([]byte, error) {
+	switch format {
+	case FormatStandardGoTsz:
+		return append([]byte{byte(FormatStandardGoTsz)}, c.Series.Bytes()...), nil
+	case FormatSnappyGoTsz:
+		return append([]byte{byte(FormatSnappyGoTsz)}, snappy.Encode(nil, c.Series.Bytes())...), nil
+	case FormatDeltaOfDeltaInt:
+		if data, ok := c.encodeDeltaInt(); ok {
+			return data, nil
+		}
+		return c.Encode(FormatStandardGoTsz)
+	}
+	return nil, ErrUnknownChunkFormat
+}
+
+// encodeDeltaInt encodes the chunk as the t0, followed by the delta-of-delta of the timestamps and the values of all points, as varints.
+// since the interval and the rate of counters tend to be constant, most of these end up as a single byte.
+func (c *Chunk) encodeDeltaInt() ([]byte, bool) {
+	buf := make([]byte, 1, 1+binary.MaxVarintLen32+int(c.NumPoints)*4)
+	buf[0] = byte(FormatDeltaOfDeltaInt)
+	tmp := make([]byte, binary.MaxVarintLen64)
+	buf = append(buf, tmp[:binary.PutUvarint(tmp, uint64(c.T0))]...)
+
+	prevTs, prevVal := int64(c.T0), int64(0)
+	var deltaTs, deltaVal int64
+	it := c.Series.Iter()
+	for it.Next() {
+		ts, val := it.Values()
+		if val != math.Trunc(val) || val >= maxInt || val <= -maxInt {
+			return nil, false
+		}
+		d := int64(ts) - prevTs
+		buf = append(buf, tmp[:binary.PutVarint(tmp, d-deltaTs)]...)
+		deltaTs, prevTs = d, int64(ts)
+
+		d = int64(val) - prevVal
+		buf = append(buf, tmp[:binary.PutVarint(tmp, d-deltaVal)]...)
+		deltaVal, prevVal = d, int64(val)
+	}
+	return buf, it.Err() == nil
+}
+
+// NewIterator returns an iterator over the points of a chunk encoded by Encode
+func NewIterator(data []byte) (*tsz.Iter, error) {
+	if len(data) < 2 {
+		return nil, ErrChunkTooSmall
+	}
+	switch Format(data[0]) {
+	case FormatStandardGoTsz:
+		return tsz.NewIterator(data[1:])
+	case FormatSnappyGoTsz:
+		b, err := snappy.Decode(nil, data[1:])
+		if err != nil {
+			return nil, err
+		}
+		return tsz.NewIterator(b)
+	case FormatDeltaOfDeltaInt:
+		return decodeDeltaInt(data[1:])
+	}
+	return nil, ErrUnknownChunkFormat
+}
+
+// decodeDeltaInt decodes the points into a tsz series, so that we can iterate it like the other formats
+func decodeDeltaInt(data []byte) (*tsz.Iter, error) {
+	t0, n := binary.Uvarint(data)
+	if n <= 0 || t0 > math.MaxUint32 {
+		return nil, errCorruptDeltaInt
+	}
+	data = data[n:]
+	s := tsz.New(uint32(t0))
+
+	ts, val := int64(t0), int64(0)
+	var deltaTs, deltaVal int64
+	for len(data) > 0 {
+		dod, n := binary.Varint(data)
+		if n <= 0 {
+			return nil, errCorruptDeltaInt
+		}
+		data = data[n:]
+		deltaTs += dod
+		ts += deltaTs
+
+		dod, n = binary.Varint(data)
+		if n <= 0 {
+			return nil, errCorruptDeltaInt
+		}
+		data = data[n:]
+		deltaVal += dod
+		val += deltaVal
+
+		if ts < 0 || ts > math.MaxUint32 {
+			return nil, errCorruptDeltaInt
+		}
+		s.Push(uint32(ts), float64(val))
+	}
+	s.Finish()
+	return s.Iter(), nil
+}
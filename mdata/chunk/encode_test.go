@@ -0,0 +1,68 @@
+package chunk
+
+import (
+	"testing"
+)
+
+type point struct {
+	ts  uint32
+	val float64
+}
+
+func TestEncodeDecode(t *testing.T) {
+	counter := []point{{1010, 100}, {1020, 150}, {1030, 200}, {1040, 260}, {1060, 255}, {1070, -3}}
+	gauge := []point{{1010, 1.5}, {1020, 2}, {1030, 0.25}}
+	cases := []struct {
+		format Format
+		points []point
+		stored Format
+	}{
+		{FormatStandardGoTsz, counter, FormatStandardGoTsz},
+		{FormatSnappyGoTsz, counter, FormatSnappyGoTsz},
+		{FormatDeltaOfDeltaInt, counter, FormatDeltaOfDeltaInt},
+		{FormatDeltaOfDeltaInt, gauge, FormatStandardGoTsz},
+	}
+	for i, c := range cases {
+		chunk := New(1000)
+		for _, p := range c.points {
+			chunk.Push(p.ts, p.val)
+		}
+		chunk.Finish()
+		data, err := chunk.Encode(c.format)
+		if err != nil {
+			t.Fatalf("case %d: %s", i, err)
+		}
+		if Format(data[0]) != c.stored {
+			t.Fatalf("case %d: expected chunk to be stored in format %d, got %d", i, c.stored, data[0])
+		}
+		it, err := NewIterator(data)
+		if err != nil {
+			t.Fatalf("case %d: %s", i, err)
+		}
+		if it.T0 != 1000 {
+			t.Fatalf("case %d: expected t0 1000, got %d", i, it.T0)
+		}
+		var got []point
+		for it.Next() {
+			ts, val := it.Values()
+			got = append(got, point{ts, val})
+		}
+		if len(got) != len(c.points) {
+			t.Fatalf("case %d: expected points %v, got %v", i, c.points, got)
+		}
+		for j := range got {
+			if got[j] != c.points[j] {
+				t.Fatalf("case %d: expected points %v, got %v", i, c.points, got)
+			}
+		}
+	}
+}
+
+func TestNewIteratorErrors(t *testing.T) {
+	if _, err := NewIterator([]byte{byte(FormatStandardGoTsz)}); err != ErrChunkTooSmall {
+		t.Fatalf("expected %s, got %v", ErrChunkTooSmall, err)
+	}
+	if _, err := NewIterator([]byte{255, 1, 2}); err != ErrUnknownChunkFormat {
+		t.Fatalf("expected %s, got %v", ErrUnknownChunkFormat, err)
+	}
+}
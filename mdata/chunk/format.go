@@ -1,5 +1,7 @@
 package chunk
 
+import "fmt"
+
 // this exists so that we can later add more formats, perhaps for int/uint/float32/bool specific optimisations, or other encoding/decoding/compression algorithms
 // and have an easy time distinguishing the binary blobs
 
@@ -8,6 +10,22 @@ package chunk
 type Format uint8
 
 // identifier of message format
+// note: the values are stored along with the data, so never change the existing ones
 const (
-	FormatStandardGoTsz Format = iota
+	FormatStandardGoTsz   Format = iota
+	FormatSnappyGoTsz            // go-tsz data, snappy compressed
+	FormatDeltaOfDeltaInt        // delta-of-delta encoded timestamps and integer values, for counters and such
 )
+
+// ParseFormat returns the format matching the given name, as used in the config
+func ParseFormat(name string) (Format, error) {
+	switch name {
+	case "tsz":
+		return FormatStandardGoTsz, nil
+	case "tsz-snappy":
+		return FormatSnappyGoTsz, nil
+	case "delta-int":
+		return FormatDeltaOfDeltaInt, nil
+	}
+	return 0, fmt.Errorf("unknown chunk format %q", name)
+}
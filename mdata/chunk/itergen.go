@@ -0,0 +1,23 @@
+package chunk
+
+import "github.com/dgryski/go-tsz"
+
+// IterGen is a chunk as it is stored, from which we can create iterators over its points
+type IterGen struct {
+	T0 uint32
+	B  []byte // the encoded chunk, see Encode
+}
+
+func NewIterGen(t0 uint32, b []byte) IterGen {
+	return IterGen{t0, b}
+}
+
+// Get returns an iterator over the points of the chunk
+func (ig IterGen) Get() (*tsz.Iter, error) {
+	return NewIterator(ig.B)
+}
+
+// Size returns the size of the encoded chunk in bytes
+func (ig IterGen) Size() uint64 {
+	return uint64(len(ig.B))
+}
@@ -150,6 +150,16 @@ func (c *ClKafka) Send(sc SavedChunk) {
 	c.in <- sc
 }
 
+func (c *ClKafka) SendHeartbeat(data []byte) {
+	payload := &sarama.ProducerMessage{
+		Topic: cfg.Topic,
+		Value: sarama.ByteEncoder(data),
+	}
+	if _, _, err := c.producer.SendMessage(payload); err != nil {
+		log.Warn("CLU kafka-cluster failed to publish heartbeat. %s", err)
+	}
+}
+
 func (c *ClKafka) produce() {
 	ticker := time.NewTicker(time.Second)
 	max := 5000
@@ -77,6 +77,16 @@ func (c *ClNSQ) Send(sc SavedChunk) {
 	c.in <- sc
 }
 
+func (c *ClNSQ) SendHeartbeat(data []byte) {
+	hostPoolResponse := hostPool.Get()
+	prod := producers[hostPoolResponse.Host()]
+	err := prod.Publish(cfg.Topic, data)
+	hostPoolResponse.Mark(err)
+	if err != nil {
+		log.Warn("CLU nsq-cluster failed to publish heartbeat to %s. %s", hostPoolResponse.Host(), err)
+	}
+}
+
 func (c *ClNSQ) run() {
 	ticker := time.NewTicker(time.Second)
 	max := 5000
@@ -22,6 +22,8 @@ var (
 
 type ClusterHandler interface {
 	Send(SavedChunk)
+	// SendHeartbeat publishes an encoded heartbeat. it only tries once, as the next one is never far off.
+	SendHeartbeat([]byte)
 }
 
 //PersistMessage format version
@@ -31,9 +33,16 @@ const PersistMessageBatchV1 = 1
 // it's only for json marshaling. use the accessor methods.
 type ClusterStatus struct {
 	sync.Mutex
-	Instance   string    `json:"instance"`
-	Primary    bool      `json:"primary"`
-	LastChange time.Time `json:"lastChange"`
+	Instance   string                    `json:"instance"`
+	Primary    bool                      `json:"primary"`
+	LastChange time.Time                 `json:"lastChange"`
+	Partitions []int32                   `json:"partitions"` // kafka partitions we consume, and hence have the data of in memory. the instances consuming the same ones form a shard in the primary election
+	Offsets    map[int32]PartitionOffset `json:"offsets"`    // how far we got consuming our kafka partitions
+	WarmAt     time.Time                 `json:"warmAt"`     // when the warm-up period ends. zero while not known yet
+	ReadyAt    time.Time                 `json:"readyAt"`    // when we can save complete chunks, so we can be promoted. zero while not known yet
+
+	Election *ElectionStatus `json:"election,omitempty"` // only set when the primary is elected
+	Nodes    []Node          `json:"nodes,omitempty"`    // the instances we have heard from on the cluster transport
 }
 
 func NewClusterStatus(instance string, initialState bool) *ClusterStatus {
@@ -45,7 +54,14 @@ func NewClusterStatus(instance string, initialState bool) *ClusterStatus {
 }
 
 func (c *ClusterStatus) Marshal() ([]byte, error) {
+	var election *ElectionStatus
+	if CluElection != nil {
+		election = CluElection.Status()
+	}
+	nodes := CluNodes.List()
 	c.Lock()
+	c.Election = election
+	c.Nodes = nodes
 	defer c.Unlock()
 	return json.Marshal(c)
 }
@@ -57,6 +73,51 @@ func (c *ClusterStatus) Set(newState bool) {
 	c.Unlock()
 }
 
+func (c *ClusterStatus) SetPartitions(partitions []int32) {
+	c.Lock()
+	c.Partitions = partitions
+	c.Unlock()
+}
+
+// SetOffset sets how far we got consuming a kafka partition
+func (c *ClusterStatus) SetOffset(partition int32, offset, lag int64) {
+	c.Lock()
+	if c.Offsets == nil {
+		c.Offsets = make(map[int32]PartitionOffset)
+	}
+	c.Offsets[partition] = PartitionOffset{Offset: offset, Lag: lag}
+	c.Unlock()
+}
+
+// SetWarmUp sets when we are done warming up, and when we can be promoted
+func (c *ClusterStatus) SetWarmUp(warmAt, readyAt time.Time) {
+	c.Lock()
+	c.WarmAt = warmAt
+	c.ReadyAt = readyAt
+	c.Unlock()
+}
+
+// heartbeat returns our heartbeat as of now
+func (c *ClusterStatus) heartbeat(now time.Time) Heartbeat {
+	c.Lock()
+	defer c.Unlock()
+	offsets := make(map[int32]PartitionOffset, len(c.Offsets))
+	for p, o := range c.Offsets {
+		offsets[p] = o
+	}
+	warmedUp := !c.WarmAt.IsZero() && !now.Before(c.WarmAt)
+	return Heartbeat{
+		Instance:   c.Instance,
+		Sent:       now,
+		Primary:    c.Primary,
+		Since:      c.LastChange,
+		WarmedUp:   warmedUp,
+		Ready:      warmedUp && !c.ReadyAt.IsZero() && !now.Before(c.ReadyAt),
+		Partitions: c.Partitions,
+		Offsets:    offsets,
+	}
+}
+
 func (c *ClusterStatus) IsPrimary() bool {
 	c.Lock()
 	defer c.Unlock()
@@ -77,6 +138,10 @@ func (c *ClusterStatus) HttpHandler(w http.ResponseWriter, req *http.Request) {
 }
 
 func (c *ClusterStatus) setClusterStatus(w http.ResponseWriter, req *http.Request) {
+	if CluElection != nil {
+		http.Error(w, "the primary is elected. disable primary-election to set it manually.", http.StatusConflict)
+		return
+	}
 	req.ParseForm()
 	newState := req.Form.Get("primary")
 	if newState == "" {
@@ -131,6 +196,7 @@ func InitCluster(stats met.Backend, handlers ...ClusterHandler) {
 	messagesPublished = stats.NewCount("cluster.messages-published")
 	messagesSize = stats.NewMeter("cluster.message_size", 0)
 	clusterHandlers = handlers
+	CluNodes = NewNodes()
 }
 
 type Cl struct {
@@ -140,7 +206,16 @@ type Cl struct {
 
 func (cl Cl) Handle(data []byte) {
 	version := uint8(data[0])
-	if version == uint8(PersistMessageBatchV1) {
+	if version == uint8(HeartbeatV1) {
+		hb := Heartbeat{}
+		err := json.Unmarshal(data[1:], &hb)
+		if err != nil {
+			log.Error(3, "failed to unmarshal heartbeat message. skipping. %s", err)
+			return
+		}
+		// unlike persist messages, we want to see our own heartbeats, to know our link to the cluster works
+		CluNodes.receive(hb, time.Now())
+	} else if version == uint8(PersistMessageBatchV1) {
 		// new batch format.
 		batch := PersistMessageBatch{}
 		err := json.Unmarshal(data[1:], &batch)
@@ -148,6 +223,7 @@ func (cl Cl) Handle(data []byte) {
 			log.Error(3, "failed to unmarsh batch message. skipping.", err)
 			return
 		}
+		CluNodes.heard(batch.Instance, time.Now())
 		if batch.Instance == cl.instance {
 			log.Debug("CLU skipping batch message we generated.")
 			return
@@ -165,6 +241,7 @@ func (cl Cl) Handle(data []byte) {
 			log.Error(3, "skipping message. %s", err)
 			return
 		}
+		CluNodes.heard(ms.Instance, time.Now())
 		if ms.Instance == cl.instance {
 			log.Debug("CLU skipping message we generated. %s - %s:%d", ms.Instance, ms.Key, ms.T0)
 			return
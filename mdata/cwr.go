@@ -18,6 +18,7 @@ type ChunkReadRequest struct {
 type ChunkWriteRequest struct {
 	key       string
 	chunk     *chunk.Chunk
+	prevT0    uint32 // t0 of the chunk right before this one, if we know it. 0 otherwise
 	ttl       uint32
 	timestamp time.Time
 }
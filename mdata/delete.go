@@ -0,0 +1,92 @@
+package mdata
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/raintank/metrictank/consolidation"
+)
+
+// how long we remember that a series was deleted, to cancel the writes of its chunks that were queued before.
+// chunks that waited longer than this in the write queue are still saved
+const deletedRetention = time.Hour
+
+// the consolidators that have their own rollup archive
+var archiveConsolidators = []consolidation.Consolidator{
+	consolidation.Min,
+	consolidation.Max,
+	consolidation.Sum,
+	consolidation.Cnt,
+	consolidation.Lst,
+	consolidation.P50,
+	consolidation.P90,
+	consolidation.P99,
+}
+
+// StoredKeys returns the keys under which the chunks of the series with the given key and name are stored:
+// its own key, followed by those of its rollup archives, based on the current schemas and aggregation rules.
+// it also returns the longest ttl and the longest chunkspan of them.
+// rollups of archives that the schemas or aggregation rules had before, e.g. with other spans or consolidators,
+// are not returned, and so are left behind in the store when the series is deleted: they expire with their ttl.
+func (ms *AggMetrics) StoredKeys(key, name string) ([]string, uint32, uint32) {
+	s := ms.Schema(name)
+	rule := ms.AggRule(name)
+	keys := []string{key}
+	ttl := s.Ttl
+	chunkSpan := ms.chunkSpan
+	for _, as := range s.AggSettings {
+		for _, consolidator := range archiveConsolidators {
+			if rule.Has(consolidator) {
+				keys = append(keys, fmt.Sprintf("%s_%s_%d", key, consolidator.Archive(), as.Span))
+			}
+		}
+		if as.Ttl > ttl {
+			ttl = as.Ttl
+		}
+		if as.ChunkSpan > chunkSpan {
+			chunkSpan = as.ChunkSpan
+		}
+	}
+	return keys, ttl, chunkSpan
+}
+
+// Remove removes the series, including its rollups, from memory. it returns whether we had it.
+// the writes of its chunks that are still queued are not affected by this, but the store's Delete of the keys cancels them.
+func (ms *AggMetrics) Remove(key string) bool {
+	ms.Lock()
+	_, ok := ms.Metrics[key]
+	delete(ms.Metrics, key)
+	ms.Unlock()
+	return ok
+}
+
+// deletions are the series that were deleted recently, by key, so that stores can cancel the writes
+// of their chunks that were queued before. the zero value is ready to use.
+type deletions struct {
+	sync.Mutex
+	at map[string]time.Time
+}
+
+// add records that the series with the given key was deleted at the given time
+func (d *deletions) add(key string, now time.Time) {
+	d.Lock()
+	defer d.Unlock()
+	if d.at == nil {
+		d.at = make(map[string]time.Time)
+	}
+	for k, t := range d.at {
+		if now.Sub(t) > deletedRetention {
+			delete(d.at, k)
+		}
+	}
+	d.at[key] = now
+}
+
+// canceled returns whether the write request was queued before its series got deleted
+func (d *deletions) canceled(cwr *ChunkWriteRequest) bool {
+	d.Lock()
+	t, ok := d.at[cwr.key]
+	d.Unlock()
+	return ok && !cwr.timestamp.After(t)
+}
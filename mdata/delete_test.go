@@ -0,0 +1,26 @@
+package mdata
+
+import (
+	"testing"
+	"time"
+)
+
+func TestDeletionsCancelQueuedWrites(t *testing.T) {
+	var d deletions
+	now := time.Now()
+	queued := &ChunkWriteRequest{key: "a", timestamp: now.Add(-time.Second)}
+	later := &ChunkWriteRequest{key: "a", timestamp: now.Add(time.Second)}
+	other := &ChunkWriteRequest{key: "b", timestamp: now.Add(-time.Second)}
+	if d.canceled(queued) {
+		t.Fatalf("expected writes of series that weren't deleted to go ahead")
+	}
+	d.add("a", now)
+	if !d.canceled(queued) || d.canceled(later) || d.canceled(other) {
+		t.Fatalf("expected only the writes of a queued before its deletion to be canceled")
+	}
+	// deletions are forgotten after a while
+	d.add("b", now.Add(2*deletedRetention))
+	if d.canceled(queued) {
+		t.Fatalf("expected the deletion of a to be forgotten")
+	}
+}
@@ -0,0 +1,149 @@
+package mdata
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/raintank/worldping-api/pkg/log"
+)
+
+// CluElection elects the primary amongst the instances on the cluster transport. nil when the primary status is set manually.
+var CluElection *Election
+
+// Election promotes an instance to primary when its shard has none, and demotes primaries when their shard has several.
+// it's decided on the heartbeats of the instances, which include our own.
+// an instance is considered gone when we haven't had a heartbeat of it for a lease. Then:
+//   - when a shard has no primary, the ready secondary with the lowest instance name promotes itself,
+//     provided it sees its own heartbeats, so that the others hear from it too.
+//   - when a shard has several primaries, all but the one that has been primary the longest demote themselves.
+//
+// each decision is made by the instance itself, so no instance ever changes the status of another.
+type Election struct {
+	sync.Mutex
+	status  *ClusterStatus
+	nodes   *Nodes
+	lease   time.Duration
+	started time.Time
+	reason  string // why the primary status last changed
+}
+
+// NewElection returns an election for the instance with the given status, amongst the given nodes
+func NewElection(status *ClusterStatus, nodes *Nodes, lease time.Duration) *Election {
+	return &Election{
+		status:  status,
+		nodes:   nodes,
+		lease:   lease,
+		started: time.Now(),
+		reason:  "initial state",
+	}
+}
+
+// elect changes our primary status if the election says so
+func (e *Election) elect(now time.Time) {
+	self := e.status.heartbeat(now)
+	primary := self.Primary
+	e.Lock()
+	promote, reason := e.decide(self, now)
+	if promote != primary {
+		e.reason = reason
+	}
+	e.Unlock()
+	if promote == primary {
+		return
+	}
+	e.status.Set(promote)
+	if promote {
+		log.Info("CLU election: promoted to primary: %s", reason)
+	} else {
+		log.Warn("CLU election: demoted to secondary: %s", reason)
+	}
+}
+
+// decide returns the primary status we should have, given our current heartbeat, and why.
+// It must only be called while holding the lock
+func (e *Election) decide(self Heartbeat, now time.Time) (bool, string) {
+	// we need to have heard from everyone before we can make up our mind
+	if now.Sub(e.started) < e.lease {
+		return self.Primary, ""
+	}
+	live := e.nodes.heartbeats(now.Add(-e.lease))
+	shard := inShard(live, self.Partitions)
+	if self.Primary {
+		// not seeing our own heartbeats doesn't make us step down: a transport hiccup would leave the shard without primary.
+		// only another live primary that wins the tie-break does.
+		for _, c := range shard {
+			if c.Primary && c.Instance != self.Instance && (c.Since.Before(self.Since) || c.Since.Equal(self.Since) && c.Instance < self.Instance) {
+				return false, fmt.Sprintf("%s has been primary for longer", c.Instance)
+			}
+		}
+		return true, ""
+	}
+	seen := false
+	for _, c := range shard {
+		if c.Instance == self.Instance {
+			seen = true
+		}
+	}
+	if !seen {
+		return false, ""
+	}
+	for _, c := range shard {
+		if c.Primary {
+			return false, ""
+		}
+	}
+	for _, c := range shard {
+		if c.Ready {
+			// the shard is sorted by instance name
+			if c.Instance == self.Instance {
+				return true, fmt.Sprintf("no primary heard from in %s", e.lease)
+			}
+			return false, ""
+		}
+	}
+	return false, ""
+}
+
+// inShard returns the heartbeats of the instances that consume the given partitions
+func inShard(hbs []Heartbeat, partitions []int32) []Heartbeat {
+	var shard []Heartbeat
+	for _, hb := range hbs {
+		if samePartitions(hb.Partitions, partitions) {
+			shard = append(shard, hb)
+		}
+	}
+	return shard
+}
+
+func samePartitions(a, b []int32) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	set := make(map[int32]struct{}, len(a))
+	for _, p := range a {
+		set[p] = struct{}{}
+	}
+	for _, p := range b {
+		if _, ok := set[p]; !ok {
+			return false
+		}
+	}
+	return true
+}
+
+// ElectionStatus is the state of the election, as seen by this instance
+type ElectionStatus struct {
+	Lease  string `json:"lease"`
+	Reason string `json:"reason"` // why our primary status last changed
+}
+
+// Status returns the state of the election
+func (e *Election) Status() *ElectionStatus {
+	e.Lock()
+	defer e.Unlock()
+	return &ElectionStatus{
+		Lease:  e.lease.String(),
+		Reason: e.reason,
+	}
+}
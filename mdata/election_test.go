@@ -0,0 +1,81 @@
+package mdata
+
+import (
+	"testing"
+	"time"
+)
+
+func newTestElection(instance string, primary bool, lease time.Duration) *Election {
+	return NewElection(NewClusterStatus(instance, primary), NewNodes(), lease)
+}
+
+func TestElectionPromotesFirstReadySecondary(t *testing.T) {
+	lease := 30 * time.Second
+	a := newTestElection("a", false, lease)
+	b := newTestElection("b", false, lease)
+	c := newTestElection("c", false, lease)
+	// the election is only decided once we have listened for a lease
+	now := time.Now().Add(lease)
+	for _, e := range []*Election{a, b, c} {
+		e.nodes.receive(Heartbeat{Instance: "a", Ready: false, Sent: now}, now)
+		e.nodes.receive(Heartbeat{Instance: "b", Ready: true, Sent: now}, now)
+		e.nodes.receive(Heartbeat{Instance: "c", Ready: true, Sent: now}, now)
+		e.elect(now)
+	}
+	if a.status.IsPrimary() || !b.status.IsPrimary() || c.status.IsPrimary() {
+		t.Fatalf("expected b, the first ready instance, to be the only primary. got a:%t b:%t c:%t", a.status.IsPrimary(), b.status.IsPrimary(), c.status.IsPrimary())
+	}
+	if reason := b.Status().Reason; reason != "no primary heard from in 30s" {
+		t.Fatalf("unexpected reason %q", reason)
+	}
+
+	// while b is around, c stays a secondary
+	later := now.Add(lease / 2)
+	c.nodes.receive(Heartbeat{Instance: "b", Primary: true, Ready: true, Sent: later}, later)
+	c.nodes.receive(Heartbeat{Instance: "c", Ready: true, Sent: later}, later)
+	c.elect(later)
+	if c.status.IsPrimary() {
+		t.Fatalf("expected c to stay secondary while b is primary")
+	}
+
+	// once b is gone, c takes over
+	gone := later.Add(lease)
+	c.nodes.receive(Heartbeat{Instance: "c", Ready: true, Sent: gone}, gone)
+	c.elect(gone)
+	if !c.status.IsPrimary() {
+		t.Fatalf("expected c to be promoted after b was gone for a lease")
+	}
+}
+
+func TestElectionDemotes(t *testing.T) {
+	lease := 30 * time.Second
+
+	// a primary that doesn't see its own heartbeats stays primary
+	a := newTestElection("a", true, lease)
+	now := time.Now().Add(lease)
+	a.elect(now)
+	if !a.status.IsPrimary() {
+		t.Fatalf("expected a primary without heartbeats to stay primary")
+	}
+
+	// of 2 primaries, the one that was primary last steps down
+	b := newTestElection("b", true, lease)
+	now = time.Now().Add(lease)
+	b.nodes.receive(Heartbeat{Instance: "a", Primary: true, Since: now.Add(-time.Hour), Sent: now}, now)
+	b.nodes.receive(Heartbeat{Instance: "b", Primary: true, Since: now, Sent: now}, now)
+	b.elect(now)
+	if b.status.IsPrimary() {
+		t.Fatalf("expected b to step down for a, which has been primary for longer")
+	}
+
+	// instances of other shards don't count
+	c := newTestElection("c", true, lease)
+	c.status.SetPartitions([]int32{0})
+	now = time.Now().Add(lease)
+	c.nodes.receive(Heartbeat{Instance: "a", Primary: true, Since: now.Add(-time.Hour), Partitions: []int32{1}, Sent: now}, now)
+	c.nodes.receive(Heartbeat{Instance: "c", Primary: true, Since: now, Partitions: []int32{0}, Sent: now}, now)
+	c.elect(now)
+	if !c.status.IsPrimary() {
+		t.Fatalf("expected c to stay primary of its shard")
+	}
+}
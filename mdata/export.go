@@ -0,0 +1,82 @@
+package mdata
+
+import (
+	"math"
+	"sort"
+
+	"github.com/raintank/metrictank/mdata/chunk"
+	"gopkg.in/raintank/schema.v1"
+)
+
+// ChunkSpan returns the chunk span of the raw data of the series
+func (ms *AggMetrics) ChunkSpan() uint32 {
+	return ms.chunkSpan
+}
+
+// ExportChunks returns the chunks of the raw data of the series that hold data between start (inclusive) and end (exclusive),
+// sorted by t0: those in the store, followed by those in memory.
+// chunks in memory may still be receiving data, so they are returned as finished copies, in FormatStandardGoTsz.
+// points in the reorder buffer are not in a chunk yet, so they are not included.
+func (ms *AggMetrics) ExportChunks(key string, start, end uint32) ([]chunk.IterGen, error) {
+	until := end
+	var mem []chunk.IterGen
+	if m, ok := ms.Get(key); ok {
+		oldest, igs, err := m.(*AggMetric).exportChunks(start, end)
+		if err != nil {
+			return nil, err
+		}
+		if oldest < until {
+			until = oldest
+		}
+		mem = igs
+	}
+	igs := make([]chunk.IterGen, 0)
+	if start < until {
+		stored, err := ms.store.SearchChunks(key, start, until)
+		if err != nil {
+			return nil, err
+		}
+		igs = append(igs, stored...)
+	}
+	return append(igs, mem...), nil
+}
+
+// exportChunks returns the t0 of the oldest chunk in memory that we serve data from (math.MaxUint32 if none),
+// and finished copies of those that hold data between start (inclusive) and end (exclusive), sorted by t0.
+// like Get, secondaries leave the first chunk, which is likely only partial, to the store.
+func (a *AggMetric) exportChunks(start, end uint32) (uint32, []chunk.IterGen, error) {
+	a.RLock()
+	defer a.RUnlock()
+	oldest := uint32(math.MaxUint32)
+	igs := make([]chunk.IterGen, 0)
+	for _, c := range a.Chunks {
+		if !CluStatus.IsPrimary() && c.T0 == a.firstChunkT0 {
+			continue
+		}
+		if c.T0 < oldest {
+			oldest = c.T0
+		}
+		if c.NumPoints == 0 || c.T0 >= end || c.T0+a.ChunkSpan <= start {
+			continue
+		}
+		points := make([]schema.Point, 0, c.NumPoints)
+		it := c.Iter()
+		for it.Next() {
+			ts, val := it.Values()
+			points = append(points, schema.Point{Val: val, Ts: ts})
+		}
+		data, err := chunk.Build(c.T0, points).Encode(chunk.FormatStandardGoTsz)
+		if err != nil {
+			return 0, nil, err
+		}
+		igs = append(igs, chunk.NewIterGen(c.T0, data))
+	}
+	sort.Sort(igsByT0(igs))
+	return oldest, igs, nil
+}
+
+type igsByT0 []chunk.IterGen
+
+func (a igsByT0) Len() int           { return len(a) }
+func (a igsByT0) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
+func (a igsByT0) Less(i, j int) bool { return a[i].T0 < a[j].T0 }
@@ -5,7 +5,7 @@ import "github.com/raintank/metrictank/iter"
 
 type Metrics interface {
 	Get(key string) (Metric, bool)
-	GetOrCreate(key string) Metric
+	GetOrCreate(key, name string) Metric
 }
 
 type Metric interface {
@@ -14,8 +14,12 @@ var (
 	// metric metrics_too_old is points that go back in time.
 	// E.g. for any given series, when a point has a timestamp
 	// that is not higher than the timestamp of the last written timestamp for that series.
+	// when a reorder window is configured, these are points that arrived too late to be reordered, or duplicates.
 	metricsTooOld met.Count
 
+	// metric metrics_reordered is points that arrived out of order, but were put back in order by the reorder buffer.
+	metricsReordered met.Count
+
 	// metric add_to_saving_chunk is points received - by the primary node - for the most recent chunk
 	// when that chunk is already being saved (or has been saved).
 	// this indicates that your GC is actively sealing chunks and saving them before you have the chance to send
@@ -29,6 +33,12 @@ var (
 
 	memToIterDuration met.Timer
 	persistDuration   met.Timer
+	snapshotDuration  met.Timer // metric snapshot_duration is how long it takes to write a snapshot of the in-memory data to disk
+
+	cacheHit   met.Count // metric cache.hit is how many searches of the store were served from the chunk cache
+	cacheMiss  met.Count // metric cache.miss is how many searches of the store could not be served from the chunk cache
+	cacheEvict met.Count // metric cache.evict is how many chunks were evicted from the chunk cache to make room for new ones
+	cacheSize  met.Gauge // metric cache.size is the size in bytes of the chunks in the chunk cache
 
 	metricsActive met.Gauge // metric metrics_active is the amount of currently known metrics (excl rollup series), measured every second
 	gcMetric      met.Count // metric gc_metric is the amount of times the metrics GC is about to inspect a metric (series)
@@ -39,11 +49,18 @@ func InitMetrics(stats met.Backend) {
 	chunkClear = stats.NewCount("chunks.clear")
 
 	metricsTooOld = stats.NewCount("metrics_too_old")
+	metricsReordered = stats.NewCount("metrics_reordered")
 	addToSavingChunk = stats.NewCount("add_to_saving_chunk")
 	addToSavedChunk = stats.NewCount("add_to_saved_chunk")
 
 	memToIterDuration = stats.NewTimer("mem.to_iter_duration", 0)
 	persistDuration = stats.NewTimer("persist_duration", 0)
+	snapshotDuration = stats.NewTimer("snapshot_duration", 0)
+
+	cacheHit = stats.NewCount("cache.hit")
+	cacheMiss = stats.NewCount("cache.miss")
+	cacheEvict = stats.NewCount("cache.evict")
+	cacheSize = stats.NewGauge("cache.size", 0)
 
 	gcMetric = stats.NewCount("gc_metric")
 	metricsActive = stats.NewGauge("metrics_active", 0)
@@ -0,0 +1,169 @@
+package mdata
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/raintank/worldping-api/pkg/log"
+)
+
+// HeartbeatV1 is the format version of heartbeat messages on the cluster transport
+const HeartbeatV1 = 2
+
+// CluNodes are the instances we have heard from on the cluster transport, including ourself
+var CluNodes *Nodes
+
+// PartitionOffset is how far an instance got consuming a kafka partition
+type PartitionOffset struct {
+	Offset int64 `json:"offset"` // the last offset we consumed
+	Lag    int64 `json:"lag"`    // how many messages the partition has past Offset
+}
+
+// Heartbeat is what an instance announces about itself on the cluster transport, every heartbeat-interval
+type Heartbeat struct {
+	Instance   string                    `json:"instance"`
+	Sent       time.Time                 `json:"sent"` // so that we can tell heartbeats replayed from the transport
+	Primary    bool                      `json:"primary"`
+	Since      time.Time                 `json:"since"`      // when the primary status last changed
+	WarmedUp   bool                      `json:"warmedUp"`   // done with the warm-up period, so it serves requests
+	Ready      bool                      `json:"ready"`      // warmed up and able to save complete chunks, so it can be promoted
+	Partitions []int32                   `json:"partitions"` // the kafka partitions consumed. the instances of a shard compete with each other only in the primary election
+	Offsets    map[int32]PartitionOffset `json:"offsets"`    // by partition
+}
+
+// encodeHeartbeat returns the message for the cluster transport
+func encodeHeartbeat(hb Heartbeat) ([]byte, error) {
+	data, err := json.Marshal(&hb)
+	if err != nil {
+		return nil, err
+	}
+	buf := new(bytes.Buffer)
+	binary.Write(buf, binary.LittleEndian, uint8(HeartbeatV1))
+	buf.Write(data)
+	return buf.Bytes(), nil
+}
+
+// RunHeartbeats sends our heartbeat every interval, until stop is closed.
+// the primary election, if enabled, is decided right before, so that the heartbeat has the outcome.
+func RunHeartbeats(interval time.Duration, stop chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case now := <-ticker.C:
+			if CluElection != nil {
+				CluElection.elect(now)
+			}
+			data, err := encodeHeartbeat(CluStatus.heartbeat(now))
+			if err != nil {
+				log.Error(3, "CLU failed to marshal heartbeat. %s", err)
+				continue
+			}
+			for _, h := range clusterHandlers {
+				h.SendHeartbeat(data)
+			}
+		}
+	}
+}
+
+// Node is an instance on the cluster transport
+type Node struct {
+	Heartbeat               // the last heartbeat of the instance. only the instance is set when we haven't received any
+	LastHeard     time.Time `json:"lastHeard"`     // the last message of any kind
+	LastHeartbeat time.Time `json:"lastHeartbeat"` // zero for instances that don't send heartbeats, like older versions
+}
+
+// Nodes tracks the instances on the cluster transport, by the messages they publish.
+// all methods can be called on a nil *Nodes, which doesn't track anything.
+type Nodes struct {
+	sync.Mutex
+	nodes map[string]Node
+}
+
+func NewNodes() *Nodes {
+	return &Nodes{
+		nodes: make(map[string]Node),
+	}
+}
+
+// heard records a message of any kind from the instance
+func (n *Nodes) heard(instance string, now time.Time) {
+	if n == nil {
+		return
+	}
+	n.Lock()
+	node := n.nodes[instance]
+	node.Instance = instance
+	node.LastHeard = now
+	n.nodes[instance] = node
+	n.Unlock()
+}
+
+// receive records a heartbeat, unless we have a more recent one of the instance already
+func (n *Nodes) receive(hb Heartbeat, now time.Time) {
+	if n == nil {
+		return
+	}
+	n.Lock()
+	defer n.Unlock()
+	if hb.Sent.Before(n.nodes[hb.Instance].Sent) {
+		return
+	}
+	n.nodes[hb.Instance] = Node{
+		Heartbeat:     hb,
+		LastHeard:     now,
+		LastHeartbeat: now,
+	}
+}
+
+// heartbeats returns the last heartbeats of the instances that sent one since the given time, sorted by instance name.
+// the heartbeats must have been received since then as well: heartbeats we only got now, may have been sent long ago,
+// e.g. when the kafka-cluster consumer replays its topic at startup.
+func (n *Nodes) heartbeats(since time.Time) []Heartbeat {
+	if n == nil {
+		return nil
+	}
+	n.Lock()
+	defer n.Unlock()
+	var hbs []Heartbeat
+	for _, node := range n.nodes {
+		if node.LastHeartbeat.After(since) && node.Sent.After(since) {
+			hbs = append(hbs, node.Heartbeat)
+		}
+	}
+	sort.Sort(heartbeatsByInstance(hbs))
+	return hbs
+}
+
+// List returns all instances we have heard from, sorted by instance name
+func (n *Nodes) List() []Node {
+	if n == nil {
+		return nil
+	}
+	n.Lock()
+	defer n.Unlock()
+	nodes := make([]Node, 0, len(n.nodes))
+	for _, node := range n.nodes {
+		nodes = append(nodes, node)
+	}
+	sort.Sort(nodesByInstance(nodes))
+	return nodes
+}
+
+type heartbeatsByInstance []Heartbeat
+
+func (h heartbeatsByInstance) Len() int           { return len(h) }
+func (h heartbeatsByInstance) Swap(i, j int)      { h[i], h[j] = h[j], h[i] }
+func (h heartbeatsByInstance) Less(i, j int) bool { return h[i].Instance < h[j].Instance }
+
+type nodesByInstance []Node
+
+func (n nodesByInstance) Len() int           { return len(n) }
+func (n nodesByInstance) Swap(i, j int)      { n[i], n[j] = n[j], n[i] }
+func (n nodesByInstance) Less(i, j int) bool { return n[i].Instance < n[j].Instance }
@@ -0,0 +1,64 @@
+package mdata
+
+import (
+	"testing"
+	"time"
+)
+
+func TestNodes(t *testing.T) {
+	n := NewNodes()
+	now := time.Now()
+	n.receive(Heartbeat{Instance: "b", Primary: true, Sent: now.Add(-time.Minute), Offsets: map[int32]PartitionOffset{0: {Offset: 100, Lag: 2}}}, now.Add(-time.Minute))
+	n.heard("b", now)
+	n.heard("a", now)
+
+	nodes := n.List()
+	if len(nodes) != 2 || nodes[0].Instance != "a" || nodes[1].Instance != "b" {
+		t.Fatalf("expected nodes a and b, got %+v", nodes)
+	}
+	if !nodes[0].LastHeartbeat.IsZero() || !nodes[0].LastHeard.Equal(now) {
+		t.Fatalf("expected a to only have been heard from, got %+v", nodes[0])
+	}
+	if !nodes[1].Primary || nodes[1].Offsets[0].Lag != 2 || !nodes[1].LastHeard.Equal(now) || !nodes[1].LastHeartbeat.Equal(now.Add(-time.Minute)) {
+		t.Fatalf("expected b to keep its heartbeat after a persist message, got %+v", nodes[1])
+	}
+	if hbs := n.heartbeats(now.Add(-30 * time.Second)); len(hbs) != 0 {
+		t.Fatalf("expected no heartbeats in the last 30s, got %+v", hbs)
+	}
+}
+
+func TestClusterHeartbeat(t *testing.T) {
+	c := NewClusterStatus("a", false)
+	c.SetPartitions([]int32{0, 1})
+	c.SetOffset(1, 42, 0)
+	now := time.Now()
+	if hb := c.heartbeat(now); hb.WarmedUp || hb.Ready {
+		t.Fatalf("expected an instance that doesn't know its warm-up yet, not to be ready. got %+v", hb)
+	}
+	c.SetWarmUp(now.Add(-time.Minute), now.Add(time.Minute))
+	hb := c.heartbeat(now)
+	if !hb.WarmedUp || hb.Ready || !hb.Sent.Equal(now) || hb.Offsets[1].Offset != 42 || len(hb.Partitions) != 2 {
+		t.Fatalf("expected a warmed up instance that can't be promoted yet, got %+v", hb)
+	}
+	if hb := c.heartbeat(now.Add(time.Minute)); !hb.Ready {
+		t.Fatalf("expected the instance to be ready, got %+v", hb)
+	}
+}
+
+func TestNodesIgnoreReplayedHeartbeats(t *testing.T) {
+	lease := 30 * time.Second
+	now := time.Now()
+	n := NewNodes()
+	// a heartbeat that was sent long ago, but that we only get now, e.g. when the transport is replayed at startup
+	n.receive(Heartbeat{Instance: "a", Primary: true, Sent: now.Add(-time.Hour)}, now)
+	if hbs := n.heartbeats(now.Add(-lease)); len(hbs) != 0 {
+		t.Fatalf("expected replayed heartbeats to be ignored, got %v", hbs)
+	}
+	// an older heartbeat doesn't replace a newer one
+	n.receive(Heartbeat{Instance: "a", Primary: false, Sent: now}, now)
+	n.receive(Heartbeat{Instance: "a", Primary: true, Sent: now.Add(-time.Second)}, now)
+	hbs := n.heartbeats(now.Add(-lease))
+	if len(hbs) != 1 || hbs[0].Primary {
+		t.Fatalf("expected the newest heartbeat of a, got %v", hbs)
+	}
+}
@@ -0,0 +1,112 @@
+package mdata
+
+import (
+	"errors"
+	"sort"
+	"time"
+
+	"github.com/dgryski/go-tsz"
+	"github.com/raintank/metrictank/iter"
+	"gopkg.in/raintank/schema.v1"
+)
+
+var (
+	errTooOld    = errors.New("point is older than the reorder window")
+	errDuplicate = errors.New("point has the same timestamp as a buffered point")
+)
+
+// ReorderBuffer keeps the most recent points of a series, sorted by timestamp,
+// so that points that arrive out of order can still be pushed into the chunks in order.
+// points stay in the buffer until they are more than window seconds older than the newest point.
+// points that arrive after newer points have already been flushed out of the buffer can't be added anymore.
+// ReorderBuffer is not concurrency-safe.
+type ReorderBuffer struct {
+	window      uint32
+	lastFlushed uint32         // ts of the most recent point flushed out of the buffer
+	LastWrite   uint32         // wall clock time of the last Add, like chunk.Chunk's LastWrite
+	points      []schema.Point // buffered points, sorted by ts
+	flushed     []schema.Point // points returned by the last Add or Flush call, reused between calls
+}
+
+func NewReorderBuffer(window uint32) *ReorderBuffer {
+	return &ReorderBuffer{
+		window:    window,
+		LastWrite: uint32(time.Now().Unix()),
+	}
+}
+
+// Add adds a point to the buffer and returns the points that fell out of the window, in order.
+// they must be pushed to the chunks before calling Add or Flush again, as the returned slice gets reused.
+// if the point can't be added, because a newer point was already flushed, an error is returned.
+func (rob *ReorderBuffer) Add(ts uint32, val float64) ([]schema.Point, error) {
+	rob.flushed = rob.flushed[:0]
+	if ts <= rob.lastFlushed {
+		return rob.flushed, errTooOld
+	}
+	rob.LastWrite = uint32(time.Now().Unix())
+
+	pos := sort.Search(len(rob.points), func(i int) bool { return rob.points[i].Ts >= ts })
+	if pos < len(rob.points) {
+		if rob.points[pos].Ts == ts {
+			return rob.flushed, errDuplicate
+		}
+		metricsReordered.Inc(1)
+	}
+	rob.points = append(rob.points, schema.Point{})
+	copy(rob.points[pos+1:], rob.points[pos:])
+	rob.points[pos] = schema.Point{Val: val, Ts: ts}
+
+	newest := rob.points[len(rob.points)-1].Ts
+	if newest <= rob.window {
+		return rob.flushed, nil
+	}
+	cutoff := newest - rob.window
+	num := 0
+	for num < len(rob.points) && rob.points[num].Ts <= cutoff {
+		num++
+	}
+	return rob.flush(num), nil
+}
+
+// Flush removes all points from the buffer and returns them, in order.
+// the returned slice gets reused by the next Add or Flush call.
+func (rob *ReorderBuffer) Flush() []schema.Point {
+	rob.flushed = rob.flushed[:0]
+	return rob.flush(len(rob.points))
+}
+
+// flush moves the oldest num points from the buffer into the flushed slice
+func (rob *ReorderBuffer) flush(num int) []schema.Point {
+	if num == 0 {
+		return rob.flushed
+	}
+	rob.flushed = append(rob.flushed, rob.points[:num]...)
+	rob.lastFlushed = rob.points[num-1].Ts
+	rob.points = rob.points[:copy(rob.points, rob.points[num:])]
+	return rob.flushed
+}
+
+// Len returns the number of buffered points
+func (rob *ReorderBuffer) Len() int {
+	return len(rob.points)
+}
+
+// Oldest returns the ts of the oldest buffered point. it must only be called if the buffer is not empty
+func (rob *ReorderBuffer) Oldest() uint32 {
+	return rob.points[0].Ts
+}
+
+// Iter returns an iterator over the buffered points in the from <= ts < to range
+// and whether there were any such points.
+func (rob *ReorderBuffer) Iter(from, to uint32) (iter.Iter, bool) {
+	start := sort.Search(len(rob.points), func(i int) bool { return rob.points[i].Ts >= from })
+	end := sort.Search(len(rob.points), func(i int) bool { return rob.points[i].Ts >= to })
+	if start == end {
+		return iter.Iter{}, false
+	}
+	s := tsz.New(rob.points[start].Ts)
+	for _, p := range rob.points[start:end] {
+		s.Push(p.Ts, p.Val)
+	}
+	return iter.New(s.Iter(), false), true
+}
@@ -0,0 +1,89 @@
+package mdata
+
+import (
+	"testing"
+
+	"github.com/raintank/met/helper"
+)
+
+func TestReorderBuffer(t *testing.T) {
+	stats, _ := helper.New(false, "", "standard", "metrictank", "")
+	InitMetrics(stats)
+
+	rob := NewReorderBuffer(10)
+	type add struct {
+		ts      uint32
+		err     error
+		flushed []uint32
+	}
+	cases := []add{
+		{100, nil, nil},
+		{105, nil, nil},
+		{102, nil, nil},
+		{105, errDuplicate, nil},
+		{111, nil, []uint32{100}},
+		{101, nil, []uint32{101}}, // already out of the window, but still newer than all flushed points
+		{120, nil, []uint32{102, 105}},
+		{108, nil, []uint32{108}},
+		{106, errTooOld, nil},
+		{115, nil, nil},
+		{140, nil, []uint32{111, 115, 120}},
+	}
+	for i, c := range cases {
+		flushed, err := rob.Add(c.ts, float64(c.ts))
+		if err != c.err {
+			t.Fatalf("case %d: adding %d: expected error %v, got %v", i, c.ts, c.err, err)
+		}
+		if len(flushed) != len(c.flushed) {
+			t.Fatalf("case %d: adding %d: expected flushed %v, got %v", i, c.ts, c.flushed, flushed)
+		}
+		for j, p := range flushed {
+			if p.Ts != c.flushed[j] || p.Val != float64(c.flushed[j]) {
+				t.Fatalf("case %d: adding %d: expected flushed %v, got %v", i, c.ts, c.flushed, flushed)
+			}
+		}
+	}
+	if rob.Len() != 1 || rob.Oldest() != 140 {
+		t.Fatalf("expected only point 140 to be buffered, got %d points", rob.Len())
+	}
+	flushed := rob.Flush()
+	if len(flushed) != 1 || flushed[0].Ts != 140 || rob.Len() != 0 {
+		t.Fatalf("expected Flush to return point 140, got %v", flushed)
+	}
+	if _, err := rob.Add(135, 135); err != errTooOld {
+		t.Fatalf("expected point older than flushed point to be rejected, got %v", err)
+	}
+}
+
+func TestAggMetricReorder(t *testing.T) {
+	stats, _ := helper.New(false, "", "standard", "metrictank", "")
+	CluStatus = NewClusterStatus("default", false)
+	InitMetrics(stats)
+
+	c := NewChecker(t, NewAggMetric(dnstore, "foo", 100, 5, 1, 20, nil, []AggSetting{}...))
+	agg := c.agg
+
+	// the checker expects points in order, so we add them to the AggMetric out of order ourselves
+	for _, ts := range []uint32{101, 115, 110, 131, 120} {
+		agg.Add(ts, float64(ts))
+	}
+	for _, ts := range []uint32{101, 110, 115, 120, 131} {
+		c.points = append(c.points, point{ts, float64(ts)})
+	}
+	// 101 and 110 have been flushed into the chunk, the others are still in the reorder buffer
+	c.Verify(true, 100, 200, 101, 131)
+	// the chunk is returned entirely, of the buffer only the requested range
+	c.Verify(true, 112, 125, 101, 120)
+
+	// flushes 131, only 151 stays buffered
+	c.Add(151, 151)
+	c.Verify(true, 100, 200, 101, 151)
+	// 151 gets flushed, 205 is buffered and no chunk exists for it yet
+	c.Add(205, 205)
+	c.Verify(true, 100, 300, 101, 205)
+	c.Verify(true, 200, 300, 205, 205)
+
+	// too old to be reordered: should not show up
+	agg.Add(150, 150)
+	c.Verify(true, 100, 300, 101, 205)
+}
@@ -0,0 +1,25 @@
+package mdata
+
+import "regexp"
+
+// Schema holds the storage settings for the series of which the name matches the pattern,
+// like a section of a carbon storage-schemas.conf file
+type Schema struct {
+	Name        string
+	Pattern     *regexp.Regexp
+	Ttl         uint32       // how many seconds to keep the raw chunks in cassandra
+	AggSettings []AggSetting // the rollups to create
+}
+
+// Schemas is a list of schemas, in the order in which they should be matched
+type Schemas []Schema
+
+// Match returns the first schema of which the pattern matches the name
+func (s Schemas) Match(name string) (*Schema, bool) {
+	for i := range s {
+		if s[i].Pattern.MatchString(name) {
+			return &s[i], true
+		}
+	}
+	return nil, false
+}
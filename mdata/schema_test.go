@@ -0,0 +1,45 @@
+package mdata
+
+import (
+	"regexp"
+	"testing"
+)
+
+func TestSchemasMatch(t *testing.T) {
+	schemas := Schemas{
+		{Name: "collectd", Pattern: regexp.MustCompile("^collectd\\."), Ttl: 86400},
+		{Name: "default", Pattern: regexp.MustCompile(".*"), Ttl: 3600},
+	}
+	cases := []struct {
+		name   string
+		schema string
+	}{
+		{"collectd.host.cpu", "collectd"},
+		{"app.collectd.requests", "default"},
+		{"foo", "default"},
+	}
+	for _, c := range cases {
+		s, ok := schemas.Match(c.name)
+		if !ok || s.Name != c.schema {
+			t.Fatalf("expected %q to match schema %q, got %v", c.name, c.schema, s)
+		}
+	}
+	if _, ok := schemas[:1].Match("foo"); ok {
+		t.Fatalf("expected no schema to match")
+	}
+}
+
+func TestAggMetricsSchema(t *testing.T) {
+	schemas := Schemas{
+		{Name: "collectd", Pattern: regexp.MustCompile("^collectd\\."), Ttl: 86400, AggSettings: []AggSetting{{600, 21600, 2, 864000, true}}},
+	}
+	metrics := NewAggMetrics(NewDevnullStore(), 600, 10, 800, 8000, 3600, 0, 0, nil, schemas, nil)
+	m := metrics.GetOrCreate("1.01234567890123456789012345678901", "collectd.host.cpu").(*AggMetric)
+	if m.ttl != 86400 || len(m.aggregators) != 1 {
+		t.Fatalf("expected the ttl and rollups of the collectd schema, got ttl %d and %d aggregators", m.ttl, len(m.aggregators))
+	}
+	m = metrics.GetOrCreate("1.11234567890123456789012345678901", "foo").(*AggMetric)
+	if m.ttl != 3600 || len(m.aggregators) != 0 {
+		t.Fatalf("expected the default ttl and rollups, got ttl %d and %d aggregators", m.ttl, len(m.aggregators))
+	}
+}
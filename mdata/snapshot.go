@@ -0,0 +1,251 @@
+package mdata
+
+import (
+	"bufio"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"github.com/raintank/metrictank/mdata/chunk"
+	"github.com/raintank/worldping-api/pkg/log"
+	"gopkg.in/raintank/schema.v1"
+)
+
+// snapshots hold the data of all AggMetrics, so that we can restore it after a restart instead of having to
+// replay it from the message bus or waiting for it to come in again.
+// they consist of a snapshotHeader followed by a metricSnapshot for each series, gob encoded.
+// as chunks are encoded deterministically, we simply store their points and push them into new chunks when restoring.
+
+const snapshotVersion = 1
+
+var errSnapshotVersion = errors.New("unsupported snapshot version")
+
+type snapshotHeader struct {
+	Version int
+	Created int64 // unix timestamp
+}
+
+type metricSnapshot struct {
+	Key          string
+	Name         string
+	FirstChunkT0 uint32
+	Chunks       []chunkSnapshot // oldest first
+	Reorder      []schema.Point  // points in the reorder buffer
+	Aggregators  []aggregatorSnapshot
+}
+
+type chunkSnapshot struct {
+	T0     uint32
+	Saved  bool
+	Points []schema.Point
+}
+
+type aggregatorSnapshot struct {
+	Span            uint32
+	CurrentBoundary uint32
+	Min             float64
+	Max             float64
+	Sum             float64
+	Cnt             float64
+	Lst             float64
+	Vals            []float64
+	Archives        map[string]metricSnapshot // by archive name, e.g. "min"
+}
+
+// snapshot returns the state of the metric, including that of its aggregators
+func (a *AggMetric) snapshot() metricSnapshot {
+	a.RLock()
+	defer a.RUnlock()
+	s := metricSnapshot{
+		Key:          a.Key,
+		Name:         a.name,
+		FirstChunkT0: a.firstChunkT0,
+	}
+	for i := range a.Chunks {
+		// start at the oldest chunk
+		c := a.Chunks[(a.CurrentChunkPos+1+i)%len(a.Chunks)]
+		cs := chunkSnapshot{T0: c.T0, Saved: c.Saved, Points: make([]schema.Point, 0, c.NumPoints)}
+		it := c.Iter()
+		for it.Next() {
+			ts, val := it.Values()
+			cs.Points = append(cs.Points, schema.Point{Val: val, Ts: ts})
+		}
+		s.Chunks = append(s.Chunks, cs)
+	}
+	if a.rob != nil {
+		s.Reorder = append(s.Reorder, a.rob.points...)
+	}
+	for _, agg := range a.aggregators {
+		as := aggregatorSnapshot{
+			Span:            agg.span,
+			CurrentBoundary: agg.currentBoundary,
+			Min:             agg.agg.min,
+			Max:             agg.agg.max,
+			Sum:             agg.agg.sum,
+			Cnt:             agg.agg.cnt,
+			Lst:             agg.agg.lst,
+			Vals:            append([]float64(nil), agg.agg.vals...),
+			Archives:        make(map[string]metricSnapshot),
+		}
+		for archive, m := range agg.archives() {
+			as.Archives[archive] = m.snapshot()
+		}
+		s.Aggregators = append(s.Aggregators, as)
+	}
+	return s
+}
+
+// restore loads the state of a snapshot into a new metric.
+// chunks that were being saved are not marked as saved, as we don't know whether the write made it.
+// aggregators that are no longer configured are ignored.
+func (a *AggMetric) restore(s metricSnapshot) {
+	a.Lock()
+	defer a.Unlock()
+	chunks := s.Chunks
+	if len(chunks) > int(a.NumChunks) {
+		chunks = chunks[len(chunks)-int(a.NumChunks):]
+	}
+	for _, cs := range chunks {
+		c := chunk.New(cs.T0)
+		for _, p := range cs.Points {
+			c.Push(p.Ts, p.Val)
+		}
+		c.Saved = cs.Saved
+		a.Chunks = append(a.Chunks, c)
+	}
+	a.CurrentChunkPos = len(a.Chunks) - 1
+	a.firstChunkT0 = s.FirstChunkT0
+	for _, as := range s.Aggregators {
+		for _, agg := range a.aggregators {
+			if agg.span != as.Span {
+				continue
+			}
+			agg.currentBoundary = as.CurrentBoundary
+			agg.agg.min, agg.agg.max, agg.agg.sum, agg.agg.cnt, agg.agg.lst = as.Min, as.Max, as.Sum, as.Cnt, as.Lst
+			if agg.agg.vals != nil {
+				agg.agg.vals = append(agg.agg.vals, as.Vals...)
+			}
+			for archive, m := range agg.archives() {
+				if ms, ok := as.Archives[archive]; ok {
+					m.restore(ms)
+				}
+			}
+		}
+	}
+	for _, p := range s.Reorder {
+		if a.rob == nil {
+			a.add(p.Ts, p.Val)
+			continue
+		}
+		flushed, _ := a.rob.Add(p.Ts, p.Val)
+		for _, f := range flushed {
+			a.add(f.Ts, f.Val)
+		}
+	}
+}
+
+// Snapshot writes the state of all metrics to w
+func (ms *AggMetrics) Snapshot(w io.Writer) error {
+	enc := gob.NewEncoder(w)
+	err := enc.Encode(snapshotHeader{Version: snapshotVersion, Created: time.Now().Unix()})
+	if err != nil {
+		return err
+	}
+	ms.RLock()
+	metrics := make([]*AggMetric, 0, len(ms.Metrics))
+	for _, m := range ms.Metrics {
+		metrics = append(metrics, m)
+	}
+	ms.RUnlock()
+	for _, m := range metrics {
+		err = enc.Encode(m.snapshot())
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Restore creates the metrics of a snapshot, using the current schemas and aggregation rules.
+// it should be called before any data comes in. It returns when the snapshot was created and how many metrics it had.
+func (ms *AggMetrics) Restore(r io.Reader) (time.Time, int, error) {
+	dec := gob.NewDecoder(r)
+	var header snapshotHeader
+	err := dec.Decode(&header)
+	if err != nil {
+		return time.Time{}, 0, err
+	}
+	if header.Version != snapshotVersion {
+		return time.Time{}, 0, fmt.Errorf("%s %d", errSnapshotVersion, header.Version)
+	}
+	created := time.Unix(header.Created, 0)
+	num := 0
+	for {
+		var s metricSnapshot
+		err = dec.Decode(&s)
+		if err == io.EOF {
+			return created, num, nil
+		}
+		if err != nil {
+			return created, num, err
+		}
+		ms.GetOrCreate(s.Key, s.Name).(*AggMetric).restore(s)
+		num++
+	}
+}
+
+// SnapshotFile writes a snapshot to the given file. it writes to a temporary file first,
+// so that a crash while writing doesn't leave us with a broken snapshot.
+func (ms *AggMetrics) SnapshotFile(path string) error {
+	pre := time.Now()
+	tmp, err := os.Create(path + ".tmp")
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(tmp)
+	err = ms.Snapshot(w)
+	if err == nil {
+		err = w.Flush()
+	}
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	err = os.Rename(tmp.Name(), path)
+	if err != nil {
+		return err
+	}
+	snapshotDuration.Value(time.Now().Sub(pre))
+	return nil
+}
+
+// RestoreFile restores the snapshot in the given file
+func (ms *AggMetrics) RestoreFile(path string) (time.Time, int, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return time.Time{}, 0, err
+	}
+	defer f.Close()
+	return ms.Restore(bufio.NewReader(f))
+}
+
+// RunSnapshots periodically writes a snapshot to the given file
+func (ms *AggMetrics) RunSnapshots(path string, interval time.Duration) {
+	for range time.Tick(interval) {
+		err := ms.SnapshotFile(path)
+		if err != nil {
+			log.Error(3, "failed to write snapshot to %s: %s", path, err)
+			continue
+		}
+		log.Info("wrote snapshot to %s", path)
+	}
+}
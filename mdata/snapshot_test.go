@@ -0,0 +1,103 @@
+package mdata
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/raintank/met/helper"
+	"github.com/raintank/metrictank/consolidation"
+	"gopkg.in/raintank/schema.v1"
+)
+
+func points(m Metric, from, to uint32) []schema.Point {
+	_, iters := m.Get(from, to)
+	var out []schema.Point
+	for _, it := range iters {
+		for it.Next() {
+			ts, val := it.Values()
+			out = append(out, schema.Point{Val: val, Ts: ts})
+		}
+	}
+	return out
+}
+
+func aggPoints(m Metric, consolidator consolidation.Consolidator, span, from, to uint32) []schema.Point {
+	_, iters := m.GetAggregated(consolidator, span, from, to)
+	var out []schema.Point
+	for _, it := range iters {
+		for it.Next() {
+			ts, val := it.Values()
+			out = append(out, schema.Point{Val: val, Ts: ts})
+		}
+	}
+	return out
+}
+
+func comparePoints(t *testing.T, desc string, exp, got []schema.Point) {
+	if len(exp) != len(got) {
+		t.Fatalf("%s: expected %v, got %v", desc, exp, got)
+	}
+	for i := range exp {
+		if exp[i] != got[i] {
+			t.Fatalf("%s: expected %v, got %v", desc, exp, got)
+		}
+	}
+}
+
+func TestSnapshotRestore(t *testing.T) {
+	stats, _ := helper.New(false, "", "standard", "metrictank", "")
+	CluStatus = NewClusterStatus("default", true)
+	InitMetrics(stats)
+
+	aggSettings := []AggSetting{{60, 120, 10, 86400, true}}
+	newMetrics := func() *AggMetrics {
+		return NewAggMetrics(dnstore, 100, 3, 800, 8000, 3600, 20, 0, aggSettings, nil, nil)
+	}
+	metrics := newMetrics()
+	a := metrics.GetOrCreate("1.01234567890123456789012345678901", "foo")
+	b := metrics.GetOrCreate("1.11234567890123456789012345678901", "bar")
+	// the points span 4 raw chunks, of which we keep 3. the last ones are still in the reorder buffer
+	for ts := uint32(10); ts <= 400; ts += 10 {
+		a.Add(ts, float64(ts))
+		if ts%20 == 0 {
+			b.Add(ts, float64(ts)*2)
+		}
+	}
+
+	var buf bytes.Buffer
+	if err := metrics.Snapshot(&buf); err != nil {
+		t.Fatal(err)
+	}
+	restored := newMetrics()
+	_, num, err := restored.Restore(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if num != 2 {
+		t.Fatalf("expected 2 restored series, got %d", num)
+	}
+
+	// new points should end up the same way in both, also the ones that complete an aggregation that started before the snapshot
+	for _, m := range []*AggMetrics{metrics, restored} {
+		a, _ := m.Get("1.01234567890123456789012345678901")
+		a.Add(410, 410)
+		a.Add(500, 500)
+	}
+	for _, key := range []string{"1.01234567890123456789012345678901", "1.11234567890123456789012345678901"} {
+		orig, _ := metrics.Get(key)
+		got, ok := restored.Get(key)
+		if !ok {
+			t.Fatalf("series %s was not restored", key)
+		}
+		comparePoints(t, key+" raw", points(orig, 1, 1000), points(got, 1, 1000))
+		for _, c := range []consolidation.Consolidator{consolidation.Min, consolidation.Max, consolidation.Sum, consolidation.Cnt} {
+			comparePoints(t, key+" "+c.String(), aggPoints(orig, c, 60, 1, 1000), aggPoints(got, c, 60, 1, 1000))
+		}
+	}
+	if len(points(a, 1, 1000)) == 0 || len(aggPoints(a, consolidation.Sum, 60, 1, 1000)) == 0 {
+		t.Fatalf("expected the series to have data")
+	}
+	if restored.Metrics["1.01234567890123456789012345678901"].name != "foo" {
+		t.Fatalf("expected the name of the series to be restored")
+	}
+}
@@ -2,10 +2,19 @@ package mdata
 
 import (
 	"github.com/raintank/metrictank/iter"
+	"github.com/raintank/metrictank/mdata/chunk"
 )
 
 type Store interface {
 	Add(cwr *ChunkWriteRequest)
 	Search(key string, start, end uint32) ([]iter.Iter, error)
+	// like Search, but returns the chunks as stored
+	SearchChunks(key string, start, end uint32) ([]chunk.IterGen, error)
+	// deletes all chunks of the series saved in the last ttl seconds. as chunks are saved once they are complete,
+	// those have a t0 up to chunkSpan before that.
+	Delete(key string, ttl, chunkSpan uint32) error
+	// drops the chunks of the series that the store caches, if any, so that chunks that were
+	// saved again with other data, such as by a backfill, are read back from the store.
+	Invalidate(key string)
 	Stop()
 }
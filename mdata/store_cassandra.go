@@ -1,15 +1,12 @@
 package mdata
 
 import (
-	"bytes"
-	"encoding/binary"
 	"errors"
 	"fmt"
 	"sort"
 	"strings"
 	"time"
 
-	"github.com/dgryski/go-tsz"
 	"github.com/gocql/gocql"
 	"github.com/hailocab/go-hostpool"
 	"github.com/raintank/met"
@@ -34,9 +31,7 @@ const table_schema = `CREATE TABLE IF NOT EXISTS %s.metric (
     AND compression = {'sstable_compression': 'org.apache.cassandra.io.compress.LZ4Compressor'}`
 
 var (
-	errChunkTooSmall      = errors.New("unpossibly small chunk in cassandra")
-	errUnknownChunkFormat = errors.New("unrecognized chunk format in cassandra")
-	errStartBeforeEnd     = errors.New("start must be before end.")
+	errStartBeforeEnd = errors.New("start must be before end.")
 
 	cassGetExecDuration met.Timer
 	cassGetWaitDuration met.Timer
@@ -68,9 +63,12 @@ type cassandraStore struct {
 	readQueue        chan *ChunkReadRequest
 	writeQueueMeters []met.Meter
 	metrics          cassandra.Metrics
+	chunkFormat      chunk.Format // the format to save chunks in. chunks are read in whatever format they were saved in
+	cache            *ChunkCache  // nil if disabled
+	deleted          deletions
 }
 
-func NewCassandraStore(stats met.Backend, addrs, keyspace, consistency, hostSelectionPolicy string, timeout, readers, writers, readqsize, writeqsize, retries, protoVer int) (*cassandraStore, error) {
+func NewCassandraStore(stats met.Backend, addrs, keyspace, consistency, hostSelectionPolicy string, timeout, readers, writers, readqsize, writeqsize, retries, protoVer int, chunkFormat chunk.Format, cacheSize uint64) (*cassandraStore, error) {
 	cluster := gocql.NewCluster(strings.Split(addrs, ",")...)
 	cluster.Consistency = gocql.ParseConsistency(consistency)
 	cluster.Timeout = time.Duration(timeout) * time.Millisecond
@@ -130,6 +128,10 @@ func NewCassandraStore(stats met.Backend, addrs, keyspace, consistency, hostSele
 		writeQueues:      make([]chan *ChunkWriteRequest, writers),
 		readQueue:        make(chan *ChunkReadRequest, readqsize),
 		writeQueueMeters: make([]met.Meter, writers),
+		chunkFormat:      chunkFormat,
+	}
+	if cacheSize > 0 {
+		c.cache = NewChunkCache(cacheSize)
 	}
 
 	for i := 0; i < writers; i++ {
@@ -185,23 +187,49 @@ func (c *cassandraStore) processWriteQueue(queue chan *ChunkWriteRequest, meter
 			meter.Value(int64(len(queue)))
 		case cwr := <-queue:
 			meter.Value(int64(len(queue)))
+			if c.deleted.canceled(cwr) {
+				log.Debug("CS: not saving %s:%d, the series was deleted", cwr.key, cwr.chunk.T0)
+				continue
+			}
 			log.Debug("CS: starting to save %s:%d %v", cwr.key, cwr.chunk.T0, cwr.chunk)
 			//log how long the chunk waited in the queue before we attempted to save to cassandra
 			cassPutWaitDuration.Value(time.Now().Sub(cwr.timestamp))
 
-			data := cwr.chunk.Series.Bytes()
+			data, err := cwr.chunk.Encode(c.chunkFormat)
+			if err != nil {
+				log.Error(3, "CS: failed to encode chunk %s:%d: %s", cwr.key, cwr.chunk.T0, err)
+				continue
+			}
 			chunkSizeAtSave.Value(int64(len(data)))
-			version := chunk.FormatStandardGoTsz
-			buf := new(bytes.Buffer)
-			binary.Write(buf, binary.LittleEndian, uint8(version))
-			buf.Write(data)
 			success := false
 			attempts := 0
+			inserted := false
 			for !success {
-				err := c.insertChunk(cwr.key, cwr.chunk.T0, buf.Bytes(), int(cwr.ttl))
+				var err error
+				if c.deleted.canceled(cwr) {
+					if !inserted {
+						break
+					}
+					// the series got deleted while we were saving the chunk, possibly after Delete deleted its row.
+					err = c.deleteRow(cwr.key, cwr.chunk.T0/Month_sec)
+					if err == nil {
+						break
+					}
+				} else {
+					err = c.insertChunk(cwr.key, cwr.chunk.T0, data, int(cwr.ttl))
+					if err == nil {
+						inserted = true
+						if c.deleted.canceled(cwr) {
+							continue
+						}
+					}
+				}
 				if err == nil {
 					success = true
 					cwr.chunk.Saved = true
+					if c.cache != nil {
+						c.cache.Add(cwr.key, cwr.prevT0, chunk.NewIterGen(cwr.chunk.T0, data))
+					}
 					SendPersistMessage(cwr.key, cwr.chunk.T0)
 					log.Debug("CS: save complete. %s:%d %v", cwr.key, cwr.chunk.T0, cwr.chunk)
 					chunkSaveOk.Inc(1)
@@ -265,9 +293,27 @@ func (c *cassandraStore) processReadQueue() {
 // Basic search of cassandra.
 // start inclusive, end exclusive
 func (c *cassandraStore) Search(key string, start, end uint32) ([]iter.Iter, error) {
-	iters := make([]iter.Iter, 0)
+	igs, err := c.SearchChunks(key, start, end)
+	if err != nil {
+		return make([]iter.Iter, 0), err
+	}
+	pre := time.Now()
+	iters, err := toIters(igs)
+	cassToIterDuration.Value(time.Now().Sub(pre))
+	return iters, err
+}
+
+// SearchChunks returns the chunks as stored in cassandra, or in the chunk cache.
+// start inclusive, end exclusive
+func (c *cassandraStore) SearchChunks(key string, start, end uint32) ([]chunk.IterGen, error) {
 	if start > end {
-		return iters, errStartBeforeEnd
+		return nil, errStartBeforeEnd
+	}
+
+	if c.cache != nil {
+		if igs, ok := c.cache.Search(key, start, end); ok {
+			return igs, nil
+		}
 	}
 
 	pre := time.Now()
@@ -331,46 +377,97 @@ func (c *cassandraStore) Search(key string, start, end uint32) ([]iter.Iter, err
 		}
 	}
 	cassGetChunksDuration.Value(time.Since(pre))
-	pre = time.Now()
 	// we have all of the results, but they could have arrived in any order.
 	sort.Sort(asc(outcomes))
 
-	var b []byte
+	var igs []chunk.IterGen
 	var ts int
+	failed := false
 	for _, outcome := range outcomes {
 		chunks := int64(0)
+		var b []byte
 		for outcome.i.Scan(&ts, &b) {
 			chunks += 1
 			chunkSizeAtLoad.Value(int64(len(b)))
-			if len(b) < 2 {
-				log.Error(3, errChunkTooSmall.Error())
-				return iters, errChunkTooSmall
-			}
-			if chunk.Format(b[0]) != chunk.FormatStandardGoTsz {
-				log.Error(3, errUnknownChunkFormat.Error())
-				return iters, errUnknownChunkFormat
-			}
-			it, err := tsz.NewIterator(b[1:])
-			if err != nil {
-				log.Error(3, "failed to unpack cassandra payload. %s", err)
-				return iters, err
-			}
-			iters = append(iters, iter.New(it, true))
+			igs = append(igs, chunk.NewIterGen(uint32(ts), b))
+			b = nil // make sure the next Scan doesn't reuse the slice we kept
 		}
 		err := outcome.i.Close()
 		if err != nil {
 			log.Error(3, "cassandra query error. %s", err)
 			c.metrics.Inc(err)
+			failed = true
 		} else {
 			cassChunksPerRow.Value(chunks)
 		}
 	}
-	cassToIterDuration.Value(time.Now().Sub(pre))
+	// if a query failed, we may be missing chunks, so the result is not fit to be cached
+	if c.cache != nil && !failed {
+		c.cache.AddRange(key, igs)
+	}
 	cassRowsPerResponse.Value(int64(len(outcomes)))
-	log.Debug("CS: searchCassandra(): %d outcomes (queries), %d total iters", len(outcomes), len(iters))
+	log.Debug("CS: searchCassandra(): %d outcomes (queries), %d total chunks", len(outcomes), len(igs))
+	return igs, nil
+}
+
+// toIters creates iterators over the chunks
+func toIters(igs []chunk.IterGen) ([]iter.Iter, error) {
+	iters := make([]iter.Iter, 0, len(igs))
+	for _, ig := range igs {
+		// chunks may have been saved in different formats over time, the first byte tells us which one
+		it, err := ig.Get()
+		if err != nil {
+			log.Error(3, "failed to unpack chunk. %s", err)
+			return iters, err
+		}
+		iters = append(iters, iter.New(it, true))
+	}
 	return iters, nil
 }
 
+// Delete deletes the rows of the series for all months that may still hold chunks saved in the last ttl seconds:
+// the rows are by the month of the t0 of the chunks, which is up to chunkSpan before they were saved.
+// the writes of its chunks that are still queued, are canceled.
+func (c *cassandraStore) Delete(key string, ttl, chunkSpan uint32) error {
+	c.deleted.add(key, time.Now())
+	// for unit tests
+	if c.session == nil {
+		return nil
+	}
+	now := uint32(time.Now().Unix())
+	start := uint32(0)
+	if ttl+chunkSpan < now {
+		start = now - ttl - chunkSpan
+	}
+	for month := start / Month_sec; month <= now/Month_sec; month++ {
+		if err := c.deleteRow(key, month); err != nil {
+			c.metrics.Inc(err)
+			return err
+		}
+	}
+	if c.cache != nil {
+		c.cache.Delete(key)
+	}
+	return nil
+}
+
+// Invalidate drops the chunks of the series from the chunk cache
+func (c *cassandraStore) Invalidate(key string) {
+	if c.cache != nil {
+		c.cache.Delete(key)
+	}
+}
+
+// deleteRow deletes the row of the series for the given month
+func (c *cassandraStore) deleteRow(key string, month uint32) error {
+	// for unit tests
+	if c.session == nil {
+		return nil
+	}
+	row_key := fmt.Sprintf("%s_%d", key, month)
+	return c.session.Query("DELETE FROM metric WHERE key = ?", row_key).Exec()
+}
+
 func (c *cassandraStore) Stop() {
 	c.session.Close()
 }
@@ -1,6 +1,9 @@
 package mdata
 
-import "github.com/raintank/metrictank/iter"
+import (
+	"github.com/raintank/metrictank/iter"
+	"github.com/raintank/metrictank/mdata/chunk"
+)
 
 type devnullStore struct {
 }
@@ -17,5 +20,16 @@ func (c *devnullStore) Search(key string, start, end uint32) ([]iter.Iter, error
 	return nil, nil
 }
 
+func (c *devnullStore) SearchChunks(key string, start, end uint32) ([]chunk.IterGen, error) {
+	return nil, nil
+}
+
+func (c *devnullStore) Delete(key string, ttl, chunkSpan uint32) error {
+	return nil
+}
+
+func (c *devnullStore) Invalidate(key string) {
+}
+
 func (c *devnullStore) Stop() {
 }
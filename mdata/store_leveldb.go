@@ -0,0 +1,254 @@
+package mdata
+
+import (
+	"encoding/binary"
+	"os"
+	"time"
+
+	"github.com/raintank/met"
+	"github.com/raintank/metrictank/iter"
+	"github.com/raintank/metrictank/mdata/chunk"
+	"github.com/raintank/worldping-api/pkg/log"
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/opt"
+	"github.com/syndtr/goleveldb/leveldb/storage"
+	"github.com/syndtr/goleveldb/leveldb/util"
+)
+
+// store chunks in a local leveldb database, for setups that don't need or want a cassandra cluster.
+// each chunk is stored under a key made of the series key and its t0, so that the chunks of a series are sorted by t0,
+// and its value holds when the chunk expires, followed by the encoded chunk.
+// leveldb has no notion of ttl's, so we periodically delete the expired chunks ourselves,
+// and skip the ones that expired in the meantime when searching.
+
+type leveldbStore struct {
+	db          *leveldb.DB
+	writeQueue  chan *ChunkWriteRequest
+	chunkFormat chunk.Format // the format to save chunks in. chunks are read in whatever format they were saved in
+	deleted     deletions
+}
+
+// NewLevelDBStore opens (or creates) the database in the given directory.
+func NewLevelDBStore(dir string, writeqsize int, cleanupInterval time.Duration, chunkFormat chunk.Format) (*leveldbStore, error) {
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		return nil, err
+	}
+	db, err := leveldb.OpenFile(dir, &opt.Options{})
+	if err != nil {
+		if _, ok := err.(*storage.ErrCorrupted); !ok {
+			return nil, err
+		}
+		log.Warn("LS: leveldb database in %s is corrupt. Recovering.", dir)
+		db, err = leveldb.RecoverFile(dir, &opt.Options{})
+		if err != nil {
+			return nil, err
+		}
+	}
+	log.Info("LS: opened leveldb database in %s", dir)
+	l := &leveldbStore{
+		db:          db,
+		writeQueue:  make(chan *ChunkWriteRequest, writeqsize),
+		chunkFormat: chunkFormat,
+	}
+	go l.processWriteQueue()
+	if cleanupInterval > 0 {
+		go l.cleanup(cleanupInterval)
+	}
+	return l, nil
+}
+
+func (l *leveldbStore) InitMetrics(stats met.Backend) {
+	chunkSaveOk = stats.NewCount("chunks.save_ok")
+	chunkSaveFail = stats.NewCount("chunks.save_fail")
+	chunkSizeAtSave = stats.NewMeter("chunk_size.at_save", 0)
+	chunkSizeAtLoad = stats.NewMeter("chunk_size.at_load", 0)
+}
+
+// leveldbPrefix returns the prefix of the keys of all chunks of the series
+func leveldbPrefix(key string) []byte {
+	// series keys never contain a 0 byte, so the prefix of one series can't be the prefix of another
+	return append([]byte("c"+key), 0)
+}
+
+func leveldbKey(key string, t0 uint32) []byte {
+	k := leveldbPrefix(key)
+	buf := make([]byte, 4)
+	binary.BigEndian.PutUint32(buf, t0)
+	return append(k, buf...)
+}
+
+func (l *leveldbStore) Add(cwr *ChunkWriteRequest) {
+	l.writeQueue <- cwr
+}
+
+func (l *leveldbStore) processWriteQueue() {
+	for cwr := range l.writeQueue {
+		if l.deleted.canceled(cwr) {
+			log.Debug("LS: not saving %s:%d, the series was deleted", cwr.key, cwr.chunk.T0)
+			continue
+		}
+		log.Debug("LS: starting to save %s:%d %v", cwr.key, cwr.chunk.T0, cwr.chunk)
+		data, err := cwr.chunk.Encode(l.chunkFormat)
+		if err != nil {
+			log.Error(3, "LS: failed to encode chunk %s:%d: %s", cwr.key, cwr.chunk.T0, err)
+			continue
+		}
+		chunkSizeAtSave.Value(int64(len(data)))
+		value := make([]byte, 4, 4+len(data))
+		binary.BigEndian.PutUint32(value, uint32(time.Now().Unix())+cwr.ttl)
+		value = append(value, data...)
+		attempts := 0
+		for {
+			err = l.db.Put(leveldbKey(cwr.key, cwr.chunk.T0), value, nil)
+			if err == nil {
+				break
+			}
+			if (attempts % 20) == 0 {
+				log.Warn("LS: failed to save chunk to leveldb after %d attempts. %v, %s", attempts+1, cwr.chunk, err)
+			}
+			chunkSaveFail.Inc(1)
+			sleepTime := 100 * attempts
+			if sleepTime > 2000 {
+				sleepTime = 2000
+			}
+			time.Sleep(time.Duration(sleepTime) * time.Millisecond)
+			attempts++
+		}
+		if l.deleted.canceled(cwr) {
+			// the series got deleted while we were saving the chunk, possibly after Delete deleted its chunks
+			if err := l.db.Delete(leveldbKey(cwr.key, cwr.chunk.T0), nil); err != nil {
+				log.Error(3, "LS: failed to delete chunk %s:%d of a deleted series. %s", cwr.key, cwr.chunk.T0, err)
+			}
+			continue
+		}
+		cwr.chunk.Saved = true
+		SendPersistMessage(cwr.key, cwr.chunk.T0)
+		log.Debug("LS: save complete. %s:%d %v", cwr.key, cwr.chunk.T0, cwr.chunk)
+		chunkSaveOk.Inc(1)
+	}
+}
+
+// Search returns iterators over the same chunks as the cassandra store would: the last chunk with a t0 <= start,
+// followed by all chunks with a t0 < end.
+// start inclusive, end exclusive
+func (l *leveldbStore) Search(key string, start, end uint32) ([]iter.Iter, error) {
+	igs, err := l.SearchChunks(key, start, end)
+	if err != nil {
+		return make([]iter.Iter, 0), err
+	}
+	return toIters(igs)
+}
+
+// SearchChunks returns the chunks as stored, see Search.
+// start inclusive, end exclusive
+func (l *leveldbStore) SearchChunks(key string, start, end uint32) ([]chunk.IterGen, error) {
+	if start > end {
+		return nil, errStartBeforeEnd
+	}
+	now := uint32(time.Now().Unix())
+	it := l.db.NewIterator(util.BytesPrefix(leveldbPrefix(key)), nil)
+	defer it.Release()
+
+	var igs []chunk.IterGen
+	// the value is only valid until the iterator moves, so we have to copy it
+	add := func() bool {
+		value := it.Value()
+		if len(value) < 4 || binary.BigEndian.Uint32(value) <= now {
+			return false
+		}
+		k := it.Key()
+		t0 := binary.BigEndian.Uint32(k[len(k)-4:])
+		chunkSizeAtLoad.Value(int64(len(value) - 4))
+		igs = append(igs, chunk.NewIterGen(t0, append([]byte(nil), value[4:]...)))
+		return true
+	}
+
+	// find the last chunk with a t0 <= start, by going back from the first one after it
+	var ok bool
+	if it.Seek(leveldbKey(key, start+1)) {
+		ok = it.Prev()
+	} else {
+		ok = it.Last()
+	}
+	for ; ok; ok = it.Prev() {
+		if add() {
+			break
+		}
+	}
+	for ok = it.Seek(leveldbKey(key, start+1)); ok; ok = it.Next() {
+		k := it.Key()
+		if binary.BigEndian.Uint32(k[len(k)-4:]) >= end {
+			break
+		}
+		add()
+	}
+	if err := it.Error(); err != nil {
+		log.Error(3, "LS: leveldb search error. %s", err)
+		return nil, err
+	}
+	log.Debug("LS: search(): %d total chunks", len(igs))
+	return igs, nil
+}
+
+// cleanup periodically deletes the chunks that have expired
+func (l *leveldbStore) cleanup(interval time.Duration) {
+	for range time.Tick(interval) {
+		deleted, err := l.deleteExpired(uint32(time.Now().Unix()))
+		if err != nil {
+			log.Error(3, "LS: failed to delete expired chunks. %s", err)
+			continue
+		}
+		log.Info("LS: deleted %d expired chunks", deleted)
+	}
+}
+
+// deleteExpired deletes the chunks that have expired at the given time, and returns how many it deleted
+func (l *leveldbStore) deleteExpired(now uint32) (int, error) {
+	it := l.db.NewIterator(util.BytesPrefix([]byte("c")), nil)
+	defer it.Release()
+	batch := new(leveldb.Batch)
+	deleted := 0
+	for it.Next() {
+		value := it.Value()
+		if len(value) >= 4 && binary.BigEndian.Uint32(value) > now {
+			continue
+		}
+		batch.Delete(append([]byte(nil), it.Key()...))
+		deleted++
+		if batch.Len() >= 1000 {
+			if err := l.db.Write(batch, nil); err != nil {
+				return deleted, err
+			}
+			batch.Reset()
+		}
+	}
+	if err := it.Error(); err != nil {
+		return deleted, err
+	}
+	return deleted, l.db.Write(batch, nil)
+}
+
+// Delete deletes all chunks of the series, and cancels the writes of its chunks that are still queued.
+// as we delete expired chunks ourselves, the ttl and chunkSpan don't matter.
+func (l *leveldbStore) Delete(key string, ttl, chunkSpan uint32) error {
+	l.deleted.add(key, time.Now())
+	it := l.db.NewIterator(util.BytesPrefix(leveldbPrefix(key)), nil)
+	defer it.Release()
+	batch := new(leveldb.Batch)
+	for it.Next() {
+		batch.Delete(append([]byte(nil), it.Key()...))
+	}
+	if err := it.Error(); err != nil {
+		return err
+	}
+	return l.db.Write(batch, nil)
+}
+
+// Invalidate is a noop, as we don't cache chunks
+func (l *leveldbStore) Invalidate(key string) {
+}
+
+func (l *leveldbStore) Stop() {
+	l.db.Close()
+}
@@ -0,0 +1,87 @@
+package mdata
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/raintank/met/helper"
+	"github.com/raintank/metrictank/mdata/chunk"
+)
+
+func TestLevelDBStore(t *testing.T) {
+	stats, _ := helper.New(false, "", "standard", "metrictank", "")
+	InitMetrics(stats)
+	dir, err := ioutil.TempDir("", "metrictank-leveldb")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	store, err := NewLevelDBStore(dir, 10, 0, chunk.FormatSnappyGoTsz)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Stop()
+	store.InitMetrics(stats)
+
+	// chunk 600 expires right away. "b" is there to make sure we don't read chunks of other series
+	var cwrs []*ChunkWriteRequest
+	for _, c := range []struct {
+		key string
+		t0  uint32
+		ttl uint32
+	}{{"a", 600, 0}, {"a", 1200, 3600}, {"a", 1800, 3600}, {"a", 2400, 3600}, {"b", 3000, 3600}} {
+		ch := chunk.New(c.t0)
+		ch.Push(c.t0+10, float64(c.t0))
+		ch.Finish()
+		cwr := &ChunkWriteRequest{key: c.key, chunk: ch, ttl: c.ttl, timestamp: time.Now()}
+		cwrs = append(cwrs, cwr)
+		store.Add(cwr)
+	}
+	// the write queue is processed in order, so once the last one is saved, they all are
+	for !cwrs[len(cwrs)-1].chunk.Saved {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	cases := []struct {
+		start, end uint32
+		t0s        []uint32
+	}{
+		{1300, 1900, []uint32{1200, 1800}},
+		{1200, 1800, []uint32{1200}},
+		{1800, 10000, []uint32{1800, 2400}},
+		{600, 1300, []uint32{1200}}, // 600 expired
+		{10, 600, nil},
+	}
+	for i, c := range cases {
+		iters, err := store.Search("a", c.start, c.end)
+		if err != nil {
+			t.Fatalf("case %d: %s", i, err)
+		}
+		if len(iters) != len(c.t0s) {
+			t.Fatalf("case %d: expected %d chunks, got %d", i, len(c.t0s), len(iters))
+		}
+		for j, it := range iters {
+			if it.T0 != c.t0s[j] {
+				t.Fatalf("case %d: expected chunk %d to have t0 %d, got %d", i, j, c.t0s[j], it.T0)
+			}
+			if !it.Next() {
+				t.Fatalf("case %d: expected chunk %d to have a point", i, j)
+			}
+			ts, val := it.Values()
+			if ts != c.t0s[j]+10 || val != float64(c.t0s[j]) {
+				t.Fatalf("case %d: expected chunk %d to have point %d@%d, got %f@%d", i, j, c.t0s[j], c.t0s[j]+10, val, ts)
+			}
+		}
+	}
+
+	deleted, err := store.deleteExpired(uint32(time.Now().Unix()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if deleted != 1 {
+		t.Fatalf("expected 1 expired chunk to be deleted, got %d", deleted)
+	}
+}
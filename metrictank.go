@@ -30,22 +30,26 @@ import (
 	inKafkaMdam "github.com/raintank/metrictank/in/kafkamdam"
 	inKafkaMdm "github.com/raintank/metrictank/in/kafkamdm"
 	inNSQ "github.com/raintank/metrictank/in/nsq"
+	inPrometheus "github.com/raintank/metrictank/in/prometheus"
+	"github.com/raintank/metrictank/limits"
 	"github.com/raintank/metrictank/mdata"
 	"github.com/raintank/metrictank/mdata/chunk"
 	clKafka "github.com/raintank/metrictank/mdata/clkafka"
 	clNSQ "github.com/raintank/metrictank/mdata/clnsq"
+	"github.com/raintank/metrictank/promstats"
 	"github.com/raintank/metrictank/usage"
 	"github.com/raintank/worldping-api/pkg/log"
 	"github.com/rakyll/globalconf"
 )
 
 var (
-	inCarbonInst    *inCarbon.Carbon
-	inKafkaMdmInst  *inKafkaMdm.KafkaMdm
-	inKafkaMdamInst *inKafkaMdam.KafkaMdam
-	inNSQInst       *inNSQ.NSQ
-	clKafkaInst     *mdata.ClKafka
-	clNSQInst       *mdata.ClNSQ
+	inCarbonInst     *inCarbon.Carbon
+	inKafkaMdmInst   *inKafkaMdm.KafkaMdm
+	inKafkaMdamInst  *inKafkaMdam.KafkaMdam
+	inNSQInst        *inNSQ.NSQ
+	inPrometheusInst *inPrometheus.Prometheus
+	clKafkaInst      *mdata.ClKafka
+	clNSQInst        *mdata.ClNSQ
 
 	logLevel     int
 	warmupPeriod time.Duration
@@ -60,28 +64,49 @@ var (
 	listenAddr  = flag.String("listen", ":6060", "http listener address.")
 	confFile    = flag.String("config", "/etc/raintank/metrictank.ini", "configuration file path")
 
+	graphiteWebOrg = flag.Int("graphite-web-org", 0, "org to serve requests in the pickle format without X-Org-Id header for, as graphite-web can't set it. 0 requires the header")
+
 	accountingPeriodStr = flag.String("accounting-period", "5min", "accounting period to track per-org usage metrics")
+	ingestLimitsFile    = flag.String("ingest-limits-file", "", "file with per-org limits on ingestion: active series and points per second. series are active when they received data in the last 1 to 2 accounting periods. reloaded on SIGHUP. empty disables per-org limits")
 
 	// Clustering:
-	instance    = flag.String("instance", "default", "cluster node name and value used to differentiate metrics between nodes")
-	primaryNode = flag.Bool("primary-node", false, "the primary node writes data to cassandra. There should only be 1 primary node per cluster of nodes.")
+	instance       = flag.String("instance", "default", "cluster node name and value used to differentiate metrics between nodes")
+	primaryNode    = flag.Bool("primary-node", false, "the primary node writes data to cassandra. There should only be 1 primary node per cluster of nodes.")
+	primaryElect   = flag.Bool("primary-election", false, "elect the primary automatically amongst the instances on the cluster transport, instead of setting it with primary-node and the http api. primary-node is the initial state")
+	primaryLease   = flag.String("primary-lease", "30s", "how long an instance may go without a heartbeat on the cluster transport, before it's considered gone by the primary election. must be at least twice the heartbeat-interval")
+	heartbeatStr   = flag.String("heartbeat-interval", "0", "interval at which instances announce their status on the cluster transport, see GET /cluster. 0 disables the heartbeats, which older instances on the transport don't understand")
+	peersStr       = flag.String("peers", "", "http addresses (host:port) of the other instances of a sharded cluster, to fan out queries to (may be given multiple times as comma-separated list)")
+	peerTimeoutStr = flag.String("peer-timeout", "10s", "timeout for queries to peers")
 
 	// Data:
 	chunkSpanStr = flag.String("chunkspan", "2h", "duration of raw chunks")
 	numChunksInt = flag.Int("numchunks", 5, "number of raw chunks to keep in memory. should be at least 1 more than what's needed to satisfy aggregation rules")
 	ttlStr       = flag.String("ttl", "35d", "minimum wait before metrics are removed from storage")
 
+	reorderWindowStr = flag.String("reorder-window", "0", "points at most this much older than the newest point of a series are buffered and put in order before being added to the chunks. 0 disables reordering")
+
 	chunkMaxStaleStr  = flag.String("chunk-max-stale", "1h", "max age for a chunk before to be considered stale and to be persisted to Cassandra.")
 	metricMaxStaleStr = flag.String("metric-max-stale", "6h", "max age for a metric before to be considered stale and to be purged from memory.")
 	gcIntervalStr     = flag.String("gc-interval", "1h", "Interval to run garbage collection job.")
 	warmUpPeriodStr   = flag.String("warm-up-period", "1h", "duration before secondary nodes start serving requests")
 
-	aggSettings = flag.String("agg-settings", "", "aggregation settings: <agg span in seconds>:<agg chunkspan in seconds>:<agg numchunks>:<ttl in seconds>[:<ready as bool. default true>] (may be given multiple times as comma-separated list)")
+	aggSettings  = flag.String("agg-settings", "", "aggregation settings: <agg span in seconds>:<agg chunkspan in seconds>:<agg numchunks>:<ttl in seconds>[:<ready as bool. default true>] (may be given multiple times as comma-separated list)")
+	aggRulesFile = flag.String("aggregations-file", "", "storage-aggregation.conf style file with the rollup functions to keep per pattern, the first being the default consolidation function. empty keeps min, max, sum and cnt for all series")
+
+	snapshotFile        = flag.String("snapshot-file", "", "file to periodically write a snapshot of the in-memory data to, and to restore it from at startup. empty disables snapshots")
+	snapshotIntervalStr = flag.String("snapshot-interval", "5min", "interval to write snapshots at")
 
 	// http:
 
 	maxPointsPerReq = flag.Int("max-points-per-req", 1000000, "max points could be requested in one request. 1M allows 500 series at a MaxDataPoints of 2000. (0 disables limit)")
 	maxDaysPerReq   = flag.Int("max-days-per-req", 365000, "max amount of days range for one request. the default allows 500 series of 2 year each. (0 disables limit")
+	queryLimitsFile = flag.String("query-limits-file", "", "file with per-org limits on queries: concurrent requests, requests per second, points per request and series per find. reloaded on SIGHUP. empty disables per-org limits")
+
+	// Storage:
+	storeType                 = flag.String("store", "cassandra", "where to store the metric data (cassandra|leveldb)")
+	leveldbDir                = flag.String("leveldb-dir", "/var/lib/metrictank", "directory of the leveldb database, when using the leveldb store")
+	leveldbWriteQueueSize     = flag.Int("leveldb-write-queue-size", 100000, "max number of chunks waiting to be saved to leveldb before blocking")
+	leveldbCleanupIntervalStr = flag.String("leveldb-cleanup-interval", "1h", "interval at which to delete the chunks of which the ttl expired from leveldb")
 
 	// Cassandra:
 	cassandraAddrs               = flag.String("cassandra-addrs", "localhost", "cassandra host (may be given multiple times as comma-separated list)")
@@ -95,6 +120,8 @@ var (
 	cassandraWriteQueueSize      = flag.Int("cassandra-write-queue-size", 100000, "write queue size per cassandra worker. should be large engough to hold all at least the total number of series expected, divided by how many workers you have")
 	cassandraRetries             = flag.Int("cassandra-retries", 0, "how many times to retry a query before failing it")
 	cqlProtocolVersion           = flag.Int("cql-protocol-version", 4, "cql protocol version to use")
+	cassandraCacheSize           = flag.Uint64("cassandra-cache-size", 256*1024*1024, "max size in bytes of the cache of chunks read from and saved to cassandra. 0 disables the cache")
+	cassandraChunkFormat         = flag.String("cassandra-chunk-format", "tsz", "format to save chunks in (tsz|tsz-snappy|delta-int). delta-int is for integer values such as counters, and falls back to tsz for chunks with other values")
 
 	// Profiling, instrumentation and logging:
 	blockProfileRate = flag.Int("block-profile-rate", 0, "see https://golang.org/pkg/runtime/#SetBlockProfileRate")
@@ -104,6 +131,8 @@ var (
 	statsdAddr    = flag.String("statsd-addr", "localhost:8125", "statsd address")
 	statsdType    = flag.String("statsd-type", "standard", "statsd type: standard or datadog")
 
+	promEnabled = flag.Bool("prometheus-enabled", false, "expose the instrumentation in the prometheus format on /metrics, next to or instead of sending it to statsd")
+
 	proftrigPath       = flag.String("proftrigger-path", "/tmp", "path to store triggered profiles")
 	proftrigFreqStr    = flag.String("proftrigger-freq", "60s", "inspect status frequency. set to 0 to disable")
 	proftrigMinDiffStr = flag.String("proftrigger-min-diff", "1h", "minimum time between triggered profiles")
@@ -111,6 +140,9 @@ var (
 
 	logMinDurStr = flag.String("log-min-dur", "5min", "only log incoming requests if their timerange is at least this duration. Use 0 to disable")
 
+	queryLimits *limits.Limits
+	promStats   *promstats.Backend // nil unless prometheus-enabled
+
 	reqSpanMem  met.Meter
 	reqSpanBoth met.Meter
 
@@ -122,8 +154,10 @@ var (
 	// just 1 global timer of request handling time. includes mem/cassandra gets, chunk decode/iters, json building etc
 	// there is such a thing as too many metrics.  we have this, and cassandra timings, that should be enough for realtime profiling
 	reqHandleDuration met.Timer
-	inItems           met.Meter
-	points            met.Gauge
+	// metric peer_request_duration is how long successful internal api requests to peers take
+	peerRequestDuration met.Timer
+	inItems             met.Meter
+	points              met.Gauge
 
 	// metric bytes_alloc.not_freed is a gauge of currently allocated (within the runtime) memory.
 	// it does not include freed data so it drops at every GC run.
@@ -166,6 +200,7 @@ func main() {
 		inKafkaMdm.ConfigSetup()
 		inKafkaMdam.ConfigSetup()
 		inNSQ.ConfigSetup()
+		inPrometheus.ConfigSetup()
 
 		// load config for cluster handlers
 		clNSQ.ConfigSetup()
@@ -215,10 +250,11 @@ func main() {
 	inKafkaMdm.ConfigProcess(*instance)
 	inKafkaMdam.ConfigProcess(*instance)
 	inNSQ.ConfigProcess()
+	inPrometheus.ConfigProcess()
 	clNSQ.ConfigProcess()
 	clKafka.ConfigProcess(*instance)
 
-	if !inCarbon.Enabled && !inKafkaMdm.Enabled && !inKafkaMdam.Enabled && !inNSQ.Enabled {
+	if !inCarbon.Enabled && !inKafkaMdm.Enabled && !inKafkaMdam.Enabled && !inNSQ.Enabled && !inPrometheus.Enabled {
 		log.Fatal(4, "you should enable at least 1 input plugin")
 	}
 
@@ -227,13 +263,21 @@ func main() {
 		log.Fatal(4, "failed to lookup hostname. %s", err)
 	}
 
-	if !*statsdEnabled {
-		log.Warn("running metrictank without statsd instrumentation.")
+	if !*statsdEnabled && !*promEnabled {
+		log.Warn("running metrictank without statsd or prometheus instrumentation.")
 	}
 	stats, err := helper.New(*statsdEnabled, *statsdAddr, *statsdType, "metrictank", strings.Replace(hostname, ".", "_", -1))
 	if err != nil {
 		log.Fatal(4, "failed to initialize statsd. %s", err)
 	}
+	if *promEnabled {
+		promStats = promstats.New("metrictank")
+		if *statsdEnabled {
+			stats = promstats.Multi(stats, promStats)
+		} else {
+			stats = promStats
+		}
+	}
 
 	runtime.SetBlockProfileRate(*blockProfileRate)
 	runtime.MemProfileRate = *memProfileRate
@@ -247,10 +291,38 @@ func main() {
 
 	// set our cluster state before we start consuming messages.
 	mdata.CluStatus = mdata.NewClusterStatus(*instance, *primaryNode)
+	initPeers(*peersStr, time.Duration(dur.MustParseUNsec("peer-timeout", *peerTimeoutStr))*time.Second)
 
 	promotionReadyAtChan = make(chan uint32)
 	initMetrics(stats)
 
+	if *queryLimitsFile != "" {
+		queryLimits, err = limits.New(*queryLimitsFile, stats)
+		if err != nil {
+			log.Fatal(4, "can't read query limits file %q: %s", *queryLimitsFile, err)
+		}
+	}
+	if *ingestLimitsFile != "" {
+		in.Limits, err = limits.NewIngest(*ingestLimitsFile, stats)
+		if err != nil {
+			log.Fatal(4, "can't read ingest limits file %q: %s", *ingestLimitsFile, err)
+		}
+	}
+	if queryLimits != nil || in.Limits != nil {
+		hupChan := make(chan os.Signal, 1)
+		signal.Notify(hupChan, syscall.SIGHUP)
+		go func() {
+			for range hupChan {
+				if err := queryLimits.Reload(); err != nil {
+					log.Error(3, "failed to reload query limits file %q, keeping the current limits. %s", *queryLimitsFile, err)
+				}
+				if err := in.Limits.Reload(); err != nil {
+					log.Error(3, "failed to reload ingest limits file %q, keeping the current limits. %s", *ingestLimitsFile, err)
+				}
+			}
+		}()
+	}
+
 	logMinDur := dur.MustParseUsec("log-min-dur", *logMinDurStr)
 	chunkSpan := dur.MustParseUNsec("chunkspan", *chunkSpanStr)
 	numChunks := uint32(*numChunksInt)
@@ -258,6 +330,7 @@ func main() {
 	metricMaxStale := dur.MustParseUNsec("metric-max-stale", *metricMaxStaleStr)
 	gcInterval := time.Duration(dur.MustParseUNsec("gc-interval", *gcIntervalStr)) * time.Second
 	ttl := dur.MustParseUNsec("ttl", *ttlStr)
+	reorderWindow := dur.MustParseUsec("reorder-window", *reorderWindowStr)
 	if (mdata.Month_sec % chunkSpan) != 0 {
 		panic("chunkSpan must fit without remainders into month_sec (28*24*60*60)")
 	}
@@ -290,6 +363,19 @@ func main() {
 		}
 		finalSettings = append(finalSettings, mdata.NewAggSetting(aggSpan, aggChunkSpan, aggNumChunks, aggTTL, ready))
 	}
+	var aggRules mdata.AggRules
+	if *aggRulesFile != "" {
+		aggRules, err = mdata.ReadAggRules(*aggRulesFile)
+		if err != nil {
+			log.Fatal(4, "can't read aggregations file %q: %s", *aggRulesFile, err)
+		}
+	}
+	schemas := inCarbon.Schemas()
+	for _, schema := range schemas {
+		for _, agg := range schema.AggSettings {
+			highestChunkSpan = max(highestChunkSpan, agg.ChunkSpan)
+		}
+	}
 	proftrigFreq := dur.MustParseUsec("proftrigger-freq", *proftrigFreqStr)
 	proftrigMinDiff := int(dur.MustParseUNsec("proftrigger-min-diff", *proftrigMinDiffStr))
 	if proftrigFreq > 0 {
@@ -303,11 +389,30 @@ func main() {
 		go trigger.Run()
 	}
 
-	store, err := mdata.NewCassandraStore(stats, *cassandraAddrs, *cassandraKeyspace, *cassandraConsistency, *cassandraHostSelectionPolicy, *cassandraTimeout, *cassandraReadConcurrency, *cassandraWriteConcurrency, *cassandraReadQueueSize, *cassandraWriteQueueSize, *cassandraRetries, *cqlProtocolVersion)
+	chunkFormat, err := chunk.ParseFormat(*cassandraChunkFormat)
 	if err != nil {
-		log.Fatal(4, "failed to initialize cassandra. %s", err)
+		log.Fatal(4, "cassandra-chunk-format: %s", err)
+	}
+	var store mdata.Store
+	switch *storeType {
+	case "cassandra":
+		cassandraStore, err := mdata.NewCassandraStore(stats, *cassandraAddrs, *cassandraKeyspace, *cassandraConsistency, *cassandraHostSelectionPolicy, *cassandraTimeout, *cassandraReadConcurrency, *cassandraWriteConcurrency, *cassandraReadQueueSize, *cassandraWriteQueueSize, *cassandraRetries, *cqlProtocolVersion, chunkFormat, *cassandraCacheSize)
+		if err != nil {
+			log.Fatal(4, "failed to initialize cassandra. %s", err)
+		}
+		cassandraStore.InitMetrics(stats)
+		store = cassandraStore
+	case "leveldb":
+		leveldbCleanupInterval := dur.MustParseUsec("leveldb-cleanup-interval", *leveldbCleanupIntervalStr)
+		leveldbStore, err := mdata.NewLevelDBStore(*leveldbDir, *leveldbWriteQueueSize, time.Duration(leveldbCleanupInterval)*time.Second, chunkFormat)
+		if err != nil {
+			log.Fatal(4, "failed to initialize leveldb. %s", err)
+		}
+		leveldbStore.InitMetrics(stats)
+		store = leveldbStore
+	default:
+		log.Fatal(4, "unknown store %q", *storeType)
 	}
-	store.InitMetrics(stats)
 
 	// note. all these New functions must either return a valid instance or call log.Fatal
 
@@ -327,9 +432,39 @@ func main() {
 		inNSQInst = inNSQ.New(stats)
 	}
 
+	if inPrometheus.Enabled {
+		inPrometheusInst = inPrometheus.New(stats, gcInterval, metricMaxStale)
+	}
+
 	accountingPeriod := dur.MustParseUNsec("accounting-period", *accountingPeriodStr)
 
-	metrics = mdata.NewAggMetrics(store, chunkSpan, numChunks, chunkMaxStale, metricMaxStale, ttl, gcInterval, finalSettings)
+	metrics = mdata.NewAggMetrics(store, chunkSpan, numChunks, chunkMaxStale, metricMaxStale, ttl, reorderWindow, gcInterval, finalSettings, schemas, aggRules)
+	if *snapshotFile != "" {
+		pre := time.Now()
+		created, num, err := metrics.RestoreFile(*snapshotFile)
+		if err == nil {
+			// we have our data back, up to when the snapshot was created. we only have the data since as well if the input
+			// replays it, which is only the case if the replay window of the kafka-mdm input covers the snapshot's age.
+			// otherwise, the data since is missing, and we only shorten the warm-up period by the snapshot's age, unless it's older than that
+			age := time.Now().Sub(created)
+			if age < inKafkaMdm.ReplayWindow() {
+				log.Info("restored %d series from snapshot of %s in %s. skipping warm-up period", num, created, time.Now().Sub(pre))
+				warmupPeriod = 0
+			} else {
+				if age < warmupPeriod {
+					warmupPeriod -= age
+				}
+				log.Info("restored %d series from snapshot of %s in %s. the data since is not replayed, so the warm-up period is %s", num, created, time.Now().Sub(pre), warmupPeriod)
+			}
+		} else if os.IsNotExist(err) {
+			log.Info("no snapshot found at %s", *snapshotFile)
+		} else {
+			// we may have restored part of it. better than nothing
+			log.Error(3, "failed to restore snapshot %s after %d series: %s", *snapshotFile, num, err)
+		}
+		snapshotInterval := time.Duration(dur.MustParseUNsec("snapshot-interval", *snapshotIntervalStr)) * time.Second
+		go metrics.RunSnapshots(*snapshotFile, snapshotInterval)
+	}
 	pre := time.Now()
 
 	if memory.Enabled {
@@ -376,6 +511,21 @@ func main() {
 
 	mdata.InitCluster(stats, handlers...)
 
+	stopHeartbeats := make(chan struct{})
+	heartbeatInterval := time.Duration(dur.MustParseUsec("heartbeat-interval", *heartbeatStr)) * time.Second
+	if len(handlers) != 0 && heartbeatInterval != 0 {
+		if *primaryElect {
+			lease := time.Duration(dur.MustParseUNsec("primary-lease", *primaryLease)) * time.Second
+			if lease < 2*heartbeatInterval {
+				log.Fatal(4, "primary-lease must be at least twice the heartbeat-interval")
+			}
+			mdata.CluElection = mdata.NewElection(mdata.CluStatus, mdata.CluNodes, lease)
+		}
+		go mdata.RunHeartbeats(heartbeatInterval, stopHeartbeats)
+	} else if *primaryElect {
+		log.Fatal(4, "primary-election requires a cluster transport with heartbeats. enable kafka-cluster or nsq-cluster, and set heartbeat-interval")
+	}
+
 	if inCarbon.Enabled {
 		inCarbonInst.Start(metrics, metricIndex, usg)
 	}
@@ -391,21 +541,38 @@ func main() {
 	if inNSQ.Enabled {
 		inNSQInst.Start(metrics, metricIndex, usg)
 	}
+	if inPrometheus.Enabled {
+		inPrometheusInst.Start(metrics, metricIndex, usg)
+	}
 
-	promotionReadyAtChan <- (uint32(time.Now().Unix())/highestChunkSpan + 1) * highestChunkSpan
+	promotionReadyAt := (uint32(time.Now().Unix())/highestChunkSpan + 1) * highestChunkSpan
+	promotionReadyAtChan <- promotionReadyAt
+	mdata.CluStatus.SetWarmUp(startupTime.Add(warmupPeriod), time.Unix(int64(promotionReadyAt), 0))
 
 	go func() {
 		http.HandleFunc("/", appStatus)
-		http.Handle("/get", RecoveryHandler(get(store, metricIndex, finalSettings, logMinDur)))                        // metrictank native api which deals with ID's, not target strings
-		http.Handle("/get/", RecoveryHandler(get(store, metricIndex, finalSettings, logMinDur)))                       // metrictank native api which deals with ID's, not target strings
-		http.Handle("/render", RecoveryHandler(corsHandler(getLegacy(store, metricIndex, finalSettings, logMinDur))))  // traditional graphite api, still lacking a lot of the api
-		http.Handle("/render/", RecoveryHandler(corsHandler(getLegacy(store, metricIndex, finalSettings, logMinDur)))) // traditional graphite api, still lacking a lot of the api
-		http.Handle("/metrics/index.json", RecoveryHandler(corsHandler(IndexJson(metricIndex))))
-		http.Handle("/metrics/find", RecoveryHandler(corsHandler(Find(metricIndex))))
-		http.Handle("/metrics/find/", RecoveryHandler(corsHandler(Find(metricIndex))))
-		http.Handle("/metrics/delete", RecoveryHandler(corsHandler(Delete(metricIndex))))
+		http.Handle("/get", RecoveryHandler(queryLimits.Handler(get(store, metricIndex, finalSettings, logMinDur), getSeriesOrg)))                        // metrictank native api which deals with ID's, not target strings
+		http.Handle("/get/", RecoveryHandler(queryLimits.Handler(get(store, metricIndex, finalSettings, logMinDur), getSeriesOrg)))                       // metrictank native api which deals with ID's, not target strings
+		http.Handle("/render", RecoveryHandler(queryLimits.Handler(corsHandler(getLegacy(store, metricIndex, finalSettings, logMinDur)), getFormatOrg)))  // traditional graphite api, still lacking a lot of the api
+		http.Handle("/render/", RecoveryHandler(queryLimits.Handler(corsHandler(getLegacy(store, metricIndex, finalSettings, logMinDur)), getFormatOrg))) // traditional graphite api, still lacking a lot of the api
+		http.Handle("/metrics/index.json", RecoveryHandler(queryLimits.Handler(corsHandler(IndexJson(metricIndex)), getOrg)))
+		http.Handle("/metrics/find", RecoveryHandler(queryLimits.Handler(corsHandler(Find(metricIndex)), getFormatOrg)))
+		http.Handle("/metrics/find/", RecoveryHandler(queryLimits.Handler(corsHandler(Find(metricIndex)), getFormatOrg)))
+		http.Handle("/metrics/delete", RecoveryHandler(corsHandler(Delete(metricIndex, store))))
+		http.Handle("/metrics/backfill", RecoveryHandler(Backfill(metricIndex)))
+		http.Handle("/export", RecoveryHandler(queryLimits.Handler(Export(metricIndex, store), getOrg)))
+		http.Handle("/tags", RecoveryHandler(queryLimits.Handler(corsHandler(Tags(metricIndex)), getOrg)))
+		http.Handle("/tags/", RecoveryHandler(queryLimits.Handler(corsHandler(Tags(metricIndex)), getOrg)))
+		http.Handle("/prometheus/read", RecoveryHandler(queryLimits.Handler(PrometheusRead(store, metricIndex, finalSettings), getPrometheusOrg)))
+		http.Handle("/internal/index/find", RecoveryHandler(IndexFind(metricIndex)))            // used by peers in a sharded cluster
+		http.Handle("/internal/getdata", RecoveryHandler(GetData(store)))                       // used by peers in a sharded cluster
+		http.Handle("/internal/index/delete", RecoveryHandler(IndexDelete(metricIndex, store))) // used by peers in a sharded cluster
+		http.Handle("/internal/cache/invalidate", RecoveryHandler(CacheInvalidate(store)))      // used by peers in a sharded cluster
 		http.HandleFunc("/cluster", mdata.CluStatus.HttpHandler)
 		http.HandleFunc("/cluster/", mdata.CluStatus.HttpHandler)
+		if promStats != nil {
+			http.Handle("/metrics", promStats)
+		}
 		log.Info("starting listener for metrics and http/debug on %s", *listenAddr)
 		log.Info("%s", http.ListenAndServe(*listenAddr, nil))
 	}()
@@ -440,6 +607,8 @@ func main() {
 		})
 	}
 	<-sigChan
+	// stop our heartbeats, so that if we're the primary, another instance takes over
+	close(stopHeartbeats)
 	for _, w := range waiters {
 		log.Info("Shutting down %s consumer", w.key)
 		w.plugin.Stop()
@@ -450,6 +619,13 @@ func main() {
 		<-w.ch
 		log.Info("%s consumer finished shutdown", w.key)
 	}
+	if *snapshotFile != "" {
+		log.Info("writing snapshot to %s", *snapshotFile)
+		err := metrics.SnapshotFile(*snapshotFile)
+		if err != nil {
+			log.Error(3, "failed to write snapshot to %s: %s", *snapshotFile, err)
+		}
+	}
 	log.Info("closing store")
 	store.Stop()
 	metricIndex.Stop()
@@ -467,6 +643,7 @@ func initMetrics(stats met.Backend) {
 	itersToPointsDuration = stats.NewTimer("iters_to_points_duration", 0)
 	messagesSize = stats.NewMeter("message_size", 0)
 	reqHandleDuration = stats.NewTimer("request_handle_duration", 0)
+	peerRequestDuration = stats.NewTimer("peer_request_duration", 0)
 	inItems = stats.NewMeter("in.items", 0)
 	points = stats.NewGauge("total_points", 0)
 	alloc = stats.NewGauge("bytes_alloc.not_freed", 0)
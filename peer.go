@@ -0,0 +1,483 @@
+package main
+
+import (
+	"bytes"
+	"encoding/gob"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/raintank/metrictank/consolidation"
+	"github.com/raintank/metrictank/idx"
+	"github.com/raintank/metrictank/mdata"
+	"github.com/raintank/worldping-api/pkg/log"
+	"gopkg.in/raintank/schema.v1"
+)
+
+// Peer is another metrictank instance in a sharded cluster.
+// every instance consumes a subset of the kafka partitions, so it only has the data of those in memory.
+// queries are fanned out to all peers, which use the internal api to answer them from their own index and memory.
+type Peer struct {
+	Addr string // host:port of the http listener
+}
+
+func (p *Peer) String() string {
+	return p.Addr
+}
+
+var (
+	peers      []*Peer
+	peerClient http.Client
+)
+
+func initPeers(addrs string, timeout time.Duration) {
+	for _, addr := range strings.Split(addrs, ",") {
+		addr = strings.TrimSpace(addr)
+		if addr == "" {
+			continue
+		}
+		peers = append(peers, &Peer{Addr: addr})
+	}
+	peerClient.Timeout = timeout
+	if len(peers) > 0 {
+		log.Info("fanning out queries to peers %v", peers)
+	}
+}
+
+// post sends the gob encoded in to the internal api endpoint of the peer, and decodes the response into out
+func (p *Peer) post(path string, in, out interface{}) error {
+	pre := time.Now()
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(in); err != nil {
+		return err
+	}
+	resp, err := peerClient.Post("http://"+p.Addr+path, contentTypeGob, &buf)
+	if err != nil {
+		return fmt.Errorf("peer %s: %s", p, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		body, _ := ioutil.ReadAll(resp.Body)
+		return fmt.Errorf("peer %s: %s: %s", p, resp.Status, strings.TrimSpace(string(body)))
+	}
+	if err := gob.NewDecoder(resp.Body).Decode(out); err != nil {
+		return fmt.Errorf("peer %s: %s", p, err)
+	}
+	peerRequestDuration.Value(time.Now().Sub(pre))
+	return nil
+}
+
+// findReq is the search for a leaf (or for the /metrics/find api) that we send to the index of peers
+type findReq struct {
+	Org      int
+	Pattern  string   // name or graphite pattern. unused if TagExprs or Id is set
+	TagExprs []string // expressions of a seriesByTag() call
+	Id       string   // id of a metricDefinition, for the native api, which queries series by id
+	From     int64
+}
+
+// findResp is what a peer returns for a findReq
+type findResp struct {
+	Nodes    []idx.Node
+	InMemory map[string]bool // ids of the metricDefinitions the peer has data in memory for
+}
+
+// peerReq is a Req in a form that can be encoded and sent to peers
+type peerReq struct {
+	Key          string
+	Target       string
+	From         uint32
+	To           uint32
+	MaxPoints    uint32
+	RawInterval  uint32
+	Consolidator consolidation.Consolidator
+	Archive      int
+	ArchInterval uint32
+	OutInterval  uint32
+	AggNum       uint32
+}
+
+func newPeerReq(r Req) peerReq {
+	return peerReq{r.key, r.target, r.from, r.to, r.maxPoints, r.rawInterval, r.consolidator, r.archive, r.archInterval, r.outInterval, r.aggNum}
+}
+
+func (r peerReq) Req() Req {
+	req := NewReq(r.Key, r.Target, r.From, r.To, r.MaxPoints, r.RawInterval, r.Consolidator)
+	req.archive = r.Archive
+	req.archInterval = r.ArchInterval
+	req.outInterval = r.OutInterval
+	req.aggNum = r.AggNum
+	return req
+}
+
+// findLocal executes the search against the local index
+func findLocal(metricIndex idx.MetricIndex, f findReq) (findResp, error) {
+	var nodes []idx.Node
+	var err error
+	if f.Id != "" {
+		def, e := metricIndex.Get(f.Id)
+		if e == nil {
+			nodes = []idx.Node{{Path: def.Name, Leaf: true, Defs: []schema.MetricDefinition{def}}}
+		} else if e != idx.DefNotFound {
+			err = e
+		}
+	} else if len(f.TagExprs) > 0 {
+		nodes, err = metricIndex.FindByTag(f.Org, f.TagExprs, f.From)
+	} else {
+		nodes, err = metricIndex.Find(f.Org, f.Pattern, f.From)
+	}
+	if err != nil {
+		return findResp{}, err
+	}
+	resp := findResp{
+		Nodes:    nodes,
+		InMemory: make(map[string]bool),
+	}
+	for _, n := range nodes {
+		for _, def := range n.Defs {
+			if _, ok := metrics.Get(def.Id); ok {
+				resp.InMemory[def.Id] = true
+			}
+		}
+	}
+	return resp, nil
+}
+
+// findPeers executes the searches against the index of all peers.
+// the results are returned by peer, in the same order as the searches.
+func findPeers(finds []findReq) (map[*Peer][]findResp, error) {
+	results := make(map[*Peer][]findResp, len(peers))
+	if len(peers) == 0 {
+		return results, nil
+	}
+	var lock sync.Mutex
+	var wg sync.WaitGroup
+	var err error
+	for _, p := range peers {
+		wg.Add(1)
+		go func(p *Peer) {
+			defer wg.Done()
+			var resp []findResp
+			e := p.post("/internal/index/find", finds, &resp)
+			if e == nil && len(resp) != len(finds) {
+				e = fmt.Errorf("peer %s: returned %d results for %d searches", p, len(resp), len(finds))
+			}
+			lock.Lock()
+			if e != nil {
+				err = e
+			} else {
+				results[p] = resp
+			}
+			lock.Unlock()
+		}(p)
+	}
+	wg.Wait()
+	return results, err
+}
+
+// deleteReq is a delete that we send to peers
+type deleteReq struct {
+	Org    int
+	Query  string
+	DryRun bool
+}
+
+// deleteResp is what an instance deleted for a deleteReq
+type deleteResp struct {
+	Series []deletedSeries
+	Defs   []string // ids of the metricDefinitions deleted from the index
+}
+
+// deletePeers executes the delete on all peers, and returns their results by peer
+func deletePeers(d deleteReq) (map[*Peer]deleteResp, error) {
+	results := make(map[*Peer]deleteResp, len(peers))
+	var lock sync.Mutex
+	var wg sync.WaitGroup
+	var err error
+	for _, p := range peers {
+		wg.Add(1)
+		go func(p *Peer) {
+			defer wg.Done()
+			var resp deleteResp
+			e := p.post("/internal/index/delete", d, &resp)
+			lock.Lock()
+			if e != nil {
+				err = e
+			} else {
+				results[p] = resp
+			}
+			lock.Unlock()
+		}(p)
+	}
+	wg.Wait()
+	return results, err
+}
+
+// invalidatePeers drops the cached chunks of the keys from the stores of all peers
+func invalidatePeers(keys []string) error {
+	if len(keys) == 0 {
+		return nil
+	}
+	var lock sync.Mutex
+	var wg sync.WaitGroup
+	var err error
+	for _, p := range peers {
+		wg.Add(1)
+		go func(p *Peer) {
+			defer wg.Done()
+			var num int
+			e := p.post("/internal/cache/invalidate", keys, &num)
+			if e != nil {
+				lock.Lock()
+				err = e
+				lock.Unlock()
+			}
+		}(p)
+	}
+	wg.Wait()
+	return err
+}
+
+// mergeDeleted merges what the instances deleted: the series deduplicated by id, and the number of distinct
+// metricDefinitions deleted from the indexes, which instances may share.
+func mergeDeleted(resps ...deleteResp) ([]deletedSeries, int) {
+	series := make([]deletedSeries, 0)
+	seenSeries := make(map[string]struct{})
+	seenDefs := make(map[string]struct{})
+	for _, resp := range resps {
+		for _, s := range resp.Series {
+			if _, ok := seenSeries[s.Id]; !ok {
+				seenSeries[s.Id] = struct{}{}
+				series = append(series, s)
+			}
+		}
+		for _, id := range resp.Defs {
+			seenDefs[id] = struct{}{}
+		}
+	}
+	return series, len(seenDefs)
+}
+
+// findCluster executes the search against the local index and the ones of all peers, and merges the results.
+// nodes are deduplicated by path, and their metricDefinitions by id.
+func findCluster(metricIndex idx.MetricIndex, f findReq) ([]idx.Node, error) {
+	local, err := findLocal(metricIndex, f)
+	if err != nil {
+		return nil, err
+	}
+	if len(peers) == 0 {
+		return local.Nodes, nil
+	}
+	remote, err := findPeers([]findReq{f})
+	if err != nil {
+		return nil, err
+	}
+	results := [][]idx.Node{local.Nodes}
+	for _, p := range peers {
+		results = append(results, remote[p][0].Nodes)
+	}
+	return mergeNodes(results...), nil
+}
+
+// findSeries executes the searches against the local index and the ones of all peers.
+// it returns the metricDefinitions found for each search, and by id the instance to fetch the data from:
+// the first one that has it in memory. if none does, it only exists in the store and any instance that
+// knows it can fetch it, so we pick ourselves if we can. a nil Peer means ourselves.
+func findSeries(metricIndex idx.MetricIndex, finds []findReq) ([][]schema.MetricDefinition, map[string]*Peer, error) {
+	remote, err := findPeers(finds)
+	if err != nil {
+		return nil, nil, err
+	}
+	found := make([][]schema.MetricDefinition, len(finds))
+	sources := make(map[string]*Peer)
+	inMemory := make(map[string]bool)
+	for i, f := range finds {
+		local, err := findLocal(metricIndex, f)
+		if err != nil {
+			return nil, nil, err
+		}
+		seen := make(map[string]struct{})
+		addDefs := func(resp findResp, peer *Peer) {
+			for _, node := range resp.Nodes {
+				for _, def := range node.Defs {
+					if _, ok := seen[def.Id]; !ok {
+						seen[def.Id] = struct{}{}
+						found[i] = append(found[i], def)
+					}
+					if _, ok := sources[def.Id]; !ok {
+						sources[def.Id] = peer
+						inMemory[def.Id] = resp.InMemory[def.Id]
+					} else if !inMemory[def.Id] && resp.InMemory[def.Id] {
+						sources[def.Id] = peer
+						inMemory[def.Id] = true
+					}
+				}
+			}
+		}
+		addDefs(local, nil)
+		for _, p := range peers {
+			addDefs(remote[p][i], p)
+		}
+	}
+	return found, sources, nil
+}
+
+// mergeNodes merges lists of nodes, preserving the order in which paths are first seen
+func mergeNodes(lists ...[]idx.Node) []idx.Node {
+	merged := make([]idx.Node, 0)
+	byPath := make(map[string]int)
+	seenDefs := make(map[string]struct{})
+	for _, nodes := range lists {
+		for _, n := range nodes {
+			i, ok := byPath[n.Path]
+			if !ok {
+				i = len(merged)
+				byPath[n.Path] = i
+				merged = append(merged, idx.Node{Path: n.Path, Leaf: n.Leaf})
+			}
+			for _, def := range n.Defs {
+				if _, ok := seenDefs[def.Id]; ok {
+					continue
+				}
+				seenDefs[def.Id] = struct{}{}
+				merged[i].Defs = append(merged[i].Defs, def)
+			}
+		}
+	}
+	return merged
+}
+
+// fetchTargets gets the data for all requests, either locally or from the peer they were resolved to
+func fetchTargets(store mdata.Store, reqs []Req) ([]Series, error) {
+	local := make([]Req, 0, len(reqs))
+	byPeer := make(map[*Peer][]peerReq)
+	for _, r := range reqs {
+		if r.peer == nil {
+			local = append(local, r)
+		} else {
+			byPeer[r.peer] = append(byPeer[r.peer], newPeerReq(r))
+		}
+	}
+	if len(byPeer) == 0 {
+		return getTargets(store, reqs)
+	}
+
+	var lock sync.Mutex
+	var wg sync.WaitGroup
+	var err error
+	out := make([]Series, 0, len(reqs))
+	for p, preqs := range byPeer {
+		wg.Add(1)
+		go func(p *Peer, preqs []peerReq) {
+			defer wg.Done()
+			var series []Series
+			e := p.post("/internal/getdata", preqs, &series)
+			lock.Lock()
+			if e != nil {
+				err = e
+			} else {
+				out = append(out, series...)
+			}
+			lock.Unlock()
+		}(p, preqs)
+	}
+	series, localErr := getTargets(store, local)
+	wg.Wait()
+	out = append(out, series...)
+	if localErr != nil {
+		return out, localErr
+	}
+	return out, err
+}
+
+// IndexFind is the internal api for peers to search our index
+func IndexFind(metricIndex idx.MetricIndex) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var finds []findReq
+		if err := gob.NewDecoder(r.Body).Decode(&finds); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		resp := make([]findResp, len(finds))
+		for i, f := range finds {
+			var err error
+			resp[i], err = findLocal(metricIndex, f)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+		}
+		writeGob(w, resp)
+	}
+}
+
+// IndexDelete is the internal api for peers to delete series from our index, memory and store
+func IndexDelete(metricIndex idx.MetricIndex, store mdata.Store) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var d deleteReq
+		if err := gob.NewDecoder(r.Body).Decode(&d); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		resp, code, err := deleteLocal(metricIndex, store, d)
+		if err != nil {
+			http.Error(w, err.Error(), code)
+			return
+		}
+		writeGob(w, resp)
+	}
+}
+
+// CacheInvalidate is the internal api for peers to drop the cached chunks of series from our store,
+// e.g. after they backfilled them. it returns the number of keys.
+func CacheInvalidate(store mdata.Store) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var keys []string
+		if err := gob.NewDecoder(r.Body).Decode(&keys); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		for _, key := range keys {
+			store.Invalidate(key)
+		}
+		writeGob(w, len(keys))
+	}
+}
+
+// GetData is the internal api for peers to fetch data from us. the requests are already aligned by the peer.
+func GetData(store mdata.Store) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var preqs []peerReq
+		if err := gob.NewDecoder(r.Body).Decode(&preqs); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		reqs := make([]Req, len(preqs))
+		for i, r := range preqs {
+			reqs[i] = r.Req()
+		}
+		out, err := getTargets(store, reqs)
+		if err != nil {
+			log.Error(0, err.Error())
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		writeGob(w, out)
+		for _, serie := range out {
+			pointSlicePool.Put(serie.Datapoints[:0])
+		}
+	}
+}
+
+func writeGob(w http.ResponseWriter, v interface{}) {
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(v); err != nil {
+		log.Error(0, err.Error())
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	writeResponse(w, buf.Bytes(), httpTypeGob, "")
+}
@@ -0,0 +1,252 @@
+package main
+
+import (
+	"encoding/gob"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/raintank/met/helper"
+	"github.com/raintank/metrictank/consolidation"
+	"github.com/raintank/metrictank/idx"
+	"github.com/raintank/metrictank/idx/memory"
+	"github.com/raintank/metrictank/mdata"
+	"gopkg.in/raintank/schema.v1"
+)
+
+func TestMergeNodes(t *testing.T) {
+	a := schema.MetricDefinition{Id: "1.a", Name: "foo.a"}
+	b := schema.MetricDefinition{Id: "1.b", Name: "foo.b"}
+	b2 := schema.MetricDefinition{Id: "2.b", Name: "foo.b"}
+	merged := mergeNodes(
+		[]idx.Node{{Path: "foo.a", Leaf: true, Defs: []schema.MetricDefinition{a}}},
+		[]idx.Node{{Path: "foo.b", Leaf: true, Defs: []schema.MetricDefinition{b}}, {Path: "foo.a", Leaf: true, Defs: []schema.MetricDefinition{a}}},
+		[]idx.Node{{Path: "foo.b", Leaf: true, Defs: []schema.MetricDefinition{b, b2}}},
+	)
+	if len(merged) != 2 {
+		t.Fatalf("expected 2 nodes, got %d: %v", len(merged), merged)
+	}
+	if merged[0].Path != "foo.a" || len(merged[0].Defs) != 1 {
+		t.Fatalf("expected node foo.a with 1 def, got %v", merged[0])
+	}
+	if merged[1].Path != "foo.b" || len(merged[1].Defs) != 2 || merged[1].Defs[0].Id != "1.b" || merged[1].Defs[1].Id != "2.b" {
+		t.Fatalf("expected node foo.b with defs 1.b and 2.b, got %v", merged[1])
+	}
+}
+
+func TestPeerReq(t *testing.T) {
+	req := NewReq("1.a", "foo.a", 100, 200, 800, 10, consolidation.Max)
+	req.archive = 1
+	req.archInterval = 60
+	req.outInterval = 120
+	req.aggNum = 2
+	req.peer = &Peer{Addr: "localhost:6060"}
+	got := newPeerReq(req).Req()
+	req.peer = nil
+	if got != req {
+		t.Fatalf("expected %v, got %v", req, got)
+	}
+}
+
+// the local index knows both series, like with a shared cassandra index, but only has the data of foo.local in memory.
+// the peer has the data of foo.remote in memory, so that's where it should be fetched from.
+func TestFanOut(t *testing.T) {
+	stats, _ := helper.New(false, "", "standard", "metrictank", "")
+	mdata.CluStatus = mdata.NewClusterStatus("default", false)
+	initMetrics(stats)
+	mdata.InitMetrics(stats)
+
+	store := mdata.NewDevnullStore()
+	metrics = mdata.NewAggMetrics(store, 600, 10, 800, 8000, 10000, 0, 0, make([]mdata.AggSetting, 0), nil, nil)
+	metricIndex := memory.New()
+	metricIndex.Init(stats)
+
+	var defs []*schema.MetricDefinition
+	for _, name := range []string{"foo.local", "foo.remote"} {
+		data := &schema.MetricData{OrgId: 1, Name: name, Metric: name, Interval: 10, Time: time.Now().Unix(), Mtype: "gauge"}
+		data.SetId()
+		metricIndex.Add(data)
+		defs = append(defs, schema.MetricDefinitionFromMetricData(data))
+	}
+	metrics.GetOrCreate(defs[0].Id, defs[0].Name)
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/internal/index/find", func(w http.ResponseWriter, r *http.Request) {
+		var finds []findReq
+		if err := gob.NewDecoder(r.Body).Decode(&finds); err != nil {
+			t.Error(err)
+			return
+		}
+		resp := make([]findResp, len(finds))
+		for i := range finds {
+			resp[i] = findResp{
+				Nodes:    []idx.Node{{Path: "foo.remote", Leaf: true, Defs: []schema.MetricDefinition{*defs[1]}}},
+				InMemory: map[string]bool{defs[1].Id: true},
+			}
+		}
+		writeGob(w, resp)
+	})
+	mux.HandleFunc("/internal/getdata", func(w http.ResponseWriter, r *http.Request) {
+		var preqs []peerReq
+		if err := gob.NewDecoder(r.Body).Decode(&preqs); err != nil {
+			t.Error(err)
+			return
+		}
+		out := make([]Series, 0, len(preqs))
+		for _, req := range preqs {
+			if req.Key != defs[1].Id {
+				t.Errorf("peer was asked for %q, expected only %q", req.Key, defs[1].Id)
+			}
+			out = append(out, Series{Target: req.Target, Datapoints: []schema.Point{{Val: 42, Ts: req.From}}, Interval: req.OutInterval})
+		}
+		writeGob(w, out)
+	})
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+	peers = []*Peer{{Addr: strings.TrimPrefix(srv.URL, "http://")}}
+	defer func() { peers = nil }()
+
+	_, leaves, err := parseTargets([]string{"sumSeries(foo.*)"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := uint32(time.Now().Unix())
+	reqs, err := resolveLeaves(metricIndex, 1, leaves, now-600, now, 800)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(reqs) != 2 {
+		t.Fatalf("expected 2 requests, got %d", len(reqs))
+	}
+	for _, req := range reqs {
+		if req.key == defs[0].Id && req.peer != nil {
+			t.Fatalf("expected foo.local to be fetched locally, got peer %s", req.peer)
+		}
+		if req.key == defs[1].Id && req.peer != peers[0] {
+			t.Fatalf("expected foo.remote to be fetched from the peer, got %v", req.peer)
+		}
+	}
+	reqs, err = alignRequests(reqs, make([]mdata.AggSetting, 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	series, err := fetchTargets(store, reqs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(series) != 2 {
+		t.Fatalf("expected 2 series, got %d", len(series))
+	}
+	for _, s := range series {
+		if s.Target == "foo.remote" && (len(s.Datapoints) != 1 || s.Datapoints[0].Val != 42) {
+			t.Fatalf("expected the data of the peer for foo.remote, got %v", s.Datapoints)
+		}
+	}
+}
+
+// the native api queries series by id. the local index doesn't know the series, so it must be looked up in the one of the peer.
+func TestResolveIds(t *testing.T) {
+	stats, _ := helper.New(false, "", "standard", "metrictank", "")
+	mdata.CluStatus = mdata.NewClusterStatus("default", false)
+	initMetrics(stats)
+	mdata.InitMetrics(stats)
+
+	metrics = mdata.NewAggMetrics(mdata.NewDevnullStore(), 600, 10, 800, 8000, 10000, 0, 0, make([]mdata.AggSetting, 0), nil, nil)
+	metricIndex := memory.New()
+	metricIndex.Init(stats)
+
+	data := &schema.MetricData{OrgId: 1, Name: "foo.remote", Metric: "foo.remote", Interval: 10, Time: time.Now().Unix(), Mtype: "gauge"}
+	data.SetId()
+	def := schema.MetricDefinitionFromMetricData(data)
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/internal/index/find", func(w http.ResponseWriter, r *http.Request) {
+		var finds []findReq
+		if err := gob.NewDecoder(r.Body).Decode(&finds); err != nil {
+			t.Error(err)
+			return
+		}
+		resp := make([]findResp, len(finds))
+		for i, f := range finds {
+			if f.Id == def.Id {
+				resp[i] = findResp{
+					Nodes:    []idx.Node{{Path: def.Name, Leaf: true, Defs: []schema.MetricDefinition{*def}}},
+					InMemory: map[string]bool{def.Id: true},
+				}
+			}
+		}
+		writeGob(w, resp)
+	})
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+	peers = []*Peer{{Addr: strings.TrimPrefix(srv.URL, "http://")}}
+	defer func() { peers = nil }()
+
+	now := uint32(time.Now().Unix())
+	reqs, err := resolveIds(metricIndex, []string{"consolidateBy(" + def.Id + ",'max')"}, now-600, now, 800)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(reqs) != 1 || reqs[0].key != def.Id || reqs[0].peer != peers[0] || reqs[0].consolidator != consolidation.Max {
+		t.Fatalf("expected a request for the max of %s from the peer, got %v", def.Id, reqs)
+	}
+	if _, err := resolveIds(metricIndex, []string{"1.01234567890abcdef01234567890abcd"}, now-600, now, 800); err == nil {
+		t.Fatalf("expected an error for an unknown id")
+	}
+}
+
+func TestDeleteFanOut(t *testing.T) {
+	stats, _ := helper.New(false, "", "standard", "metrictank", "")
+	mdata.CluStatus = mdata.NewClusterStatus("default", false)
+	mdata.InitMetrics(stats)
+
+	store := mdata.NewDevnullStore()
+	metrics = mdata.NewAggMetrics(store, 600, 10, 800, 8000, 10000, 0, 0, make([]mdata.AggSetting, 0), nil, nil)
+	metricIndex := memory.New()
+	metricIndex.Init(stats)
+	data := &schema.MetricData{OrgId: 1, Name: "foo.local", Metric: "foo.local", Interval: 10, Time: 100, Mtype: "gauge"}
+	data.SetId()
+	metricIndex.Add(data)
+
+	var got deleteReq
+	mux := http.NewServeMux()
+	mux.HandleFunc("/internal/index/delete", func(w http.ResponseWriter, r *http.Request) {
+		if err := gob.NewDecoder(r.Body).Decode(&got); err != nil {
+			t.Error(err)
+			return
+		}
+		// the peer shares our index, and has a series of its own
+		writeGob(w, deleteResp{
+			Series: []deletedSeries{{Id: data.Id, Name: "foo.local"}, {Id: "1.remote", Name: "foo.remote"}},
+			Defs:   []string{data.Id, "1.remote"},
+		})
+	})
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+	peers = []*Peer{{Addr: strings.TrimPrefix(srv.URL, "http://")}}
+	defer func() { peers = nil }()
+
+	req, _ := http.NewRequest("POST", "/metrics/delete?query=foo.*", nil)
+	req.Header.Set("x-org-id", "1")
+	w := httptest.NewRecorder()
+	Delete(metricIndex, store)(w, req)
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d: %s", w.Code, w.Body.String())
+	}
+	if got != (deleteReq{Org: 1, Query: "foo.*"}) {
+		t.Fatalf("expected the delete to be sent to the peer, got %+v", got)
+	}
+	var resp struct {
+		DeletedDefs   int
+		DeletedSeries []deletedSeries
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+		t.Fatal(err)
+	}
+	if resp.DeletedDefs != 2 || len(resp.DeletedSeries) != 2 {
+		t.Fatalf("expected the 2 distinct series of us and the peer, got %+v", resp)
+	}
+}
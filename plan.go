@@ -0,0 +1,258 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/raintank/metrictank/consolidation"
+	"github.com/raintank/metrictank/expr"
+	"github.com/raintank/metrictank/idx"
+	"github.com/raintank/metrictank/mdata"
+	"gopkg.in/raintank/schema.v1"
+)
+
+// leaf is a name or pattern in a target expression, or a seriesByTag() call, which needs to be resolved via the index and fetched
+type leaf struct {
+	pattern       string // the name/pattern, or the seriesByTag() call if byTag is set
+	byTag         bool
+	consolidateBy string // consolidation function to fetch the data with. empty means the default for the metric
+}
+
+// leafTarget returns the target we use for the request of a concrete metric name fetched for a leaf.
+// it must be unique for every name/consolidateBy combination, because requests for the same target get merged.
+func leafTarget(name, consolidateBy string) string {
+	if consolidateBy == "" {
+		return name
+	}
+	return fmt.Sprintf("consolidateBy(%s,'%s')", name, consolidateBy)
+}
+
+// parseTargets parses the graphite target expressions and returns them, along with all leaves they need.
+// the leaves map to the concrete metric names they resolve to, which is filled in by resolveLeaves
+func parseTargets(targets []string) ([]*expr.Expr, map[leaf][]string, error) {
+	exprs := make([]*expr.Expr, 0, len(targets))
+	leaves := make(map[leaf][]string)
+	for _, target := range targets {
+		e, err := expr.Parse(target)
+		if err != nil {
+			return nil, nil, fmt.Errorf("%s: %s", errTargetParse, err)
+		}
+		if e.Type != expr.EtName && e.Type != expr.EtFunc {
+			return nil, nil, fmt.Errorf("%s: target %q is not a series", errTargetParse, target)
+		}
+		err = collectLeaves(e, "", leaves)
+		if err != nil {
+			return nil, nil, err
+		}
+		exprs = append(exprs, e)
+	}
+	return exprs, leaves, nil
+}
+
+// collectLeaves validates the expression and records all its leaves.
+// note that consolidateBy() applies to all the series it wraps, not only to names directly within it,
+// because in metrictank consolidation happens while fetching the data.
+func collectLeaves(e *expr.Expr, consolidateBy string, leaves map[leaf][]string) error {
+	if e.Type == expr.EtName {
+		leaves[leaf{pattern: e.Str, consolidateBy: consolidateBy}] = nil
+		return nil
+	}
+	f, err := validateCall(e)
+	if err != nil {
+		return err
+	}
+	if f.fn == nil {
+		if _, err := idx.ParseTagExpressions(tagExpressions(e)); err != nil {
+			return fmt.Errorf("%s: %s", errTargetParse, err)
+		}
+		leaves[leaf{pattern: e.String(), byTag: true, consolidateBy: consolidateBy}] = nil
+		return nil
+	}
+	if e.Str == "consolidateBy" {
+		consolidateBy = e.Args[1].Str
+	}
+	for _, arg := range e.Args {
+		if arg.Type != expr.EtName && arg.Type != expr.EtFunc {
+			continue
+		}
+		if err := collectLeaves(arg, consolidateBy, leaves); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// resolveLeaves finds the metrics matching each leaf, records their names in the leaves map
+// and returns the requests needed to fetch them.
+// in a sharded cluster, the index of all peers is searched as well, and each metric is fetched from
+// an instance that has its data in memory, preferring ourselves.
+func resolveLeaves(metricIndex idx.MetricIndex, org int, leaves map[leaf][]string, from, to, maxDataPoints uint32) ([]Req, error) {
+	ls := make([]leaf, 0, len(leaves))
+	finds := make([]findReq, 0, len(leaves))
+	for l := range leaves {
+		f := findReq{Org: org, Pattern: l.pattern, From: seenAfter(from)}
+		if l.byTag {
+			e, err := expr.Parse(l.pattern)
+			if err != nil {
+				return nil, err
+			}
+			f.TagExprs = tagExpressions(e)
+		}
+		ls = append(ls, l)
+		finds = append(finds, f)
+	}
+	found, sources, err := findSeries(metricIndex, finds)
+	if err != nil {
+		return nil, err
+	}
+
+	reqs := make([]Req, 0)
+	for i, l := range ls {
+		defs := found[i]
+		if len(defs) == 0 {
+			return nil, errMetricNotFound
+		}
+		names := make([]string, 0, len(defs))
+		for _, def := range defs {
+			aggRule := metrics.AggRule(def.Name)
+			consolidator, err := getConsolidator(&def, l.consolidateBy, aggRule)
+			if err != nil {
+				return nil, err
+			}
+			req := NewReq(def.Id, leafTarget(def.Name, l.consolidateBy), from, to, maxDataPoints, uint32(def.Interval), consolidator)
+			req.peer = sources[def.Id]
+			req.schema = metrics.Schema(def.Name)
+			req.aggRule = aggRule
+			reqs = append(reqs, req)
+			names = append(names, def.Name)
+		}
+		sort.Strings(names)
+		leaves[l] = uniq(names)
+	}
+	return reqs, nil
+}
+
+// resolveIds finds the metrics with the ids requested by the targets of the native api,
+// and returns the requests needed to fetch them. like resolveLeaves, it looks them up in
+// the index of all peers as well, and fetches each from an instance that has it in memory.
+func resolveIds(metricIndex idx.MetricIndex, targets []string, from, to, maxDataPoints uint32) ([]Req, error) {
+	finds := make([]findReq, len(targets))
+	consolidateBys := make([]string, len(targets))
+	for i, target := range targets {
+		id, consolidateBy, err := parseIdTarget(target)
+		if err != nil {
+			return nil, err
+		}
+		finds[i] = findReq{Id: id}
+		consolidateBys[i] = consolidateBy
+	}
+	found, sources, err := findSeries(metricIndex, finds)
+	if err != nil {
+		return nil, err
+	}
+
+	reqs := make([]Req, 0, len(targets))
+	for i, target := range targets {
+		if len(found[i]) == 0 {
+			return nil, fmt.Errorf("metric %q not found", finds[i].Id)
+		}
+		def := found[i][0]
+		aggRule := metrics.AggRule(def.Name)
+		consolidator, err := getConsolidator(&def, consolidateBys[i], aggRule)
+		if err != nil {
+			return nil, err
+		}
+		req := NewReq(def.Id, target, from, to, maxDataPoints, uint32(def.Interval), consolidator)
+		req.peer = sources[def.Id]
+		req.schema = metrics.Schema(def.Name)
+		req.aggRule = aggRule
+		reqs = append(reqs, req)
+	}
+	return reqs, nil
+}
+
+// getConsolidator returns the consolidator to use for a series: the preferred one if set,
+// otherwise the default of its aggregation rule, or the one guessed from its metric type if it has none.
+func getConsolidator(def *schema.MetricDefinition, pref string, aggRule *mdata.AggRule) (consolidation.Consolidator, error) {
+	if pref == "" && aggRule != nil {
+		return aggRule.Methods[0], nil
+	}
+	return consolidation.GetConsolidator(def, pref)
+}
+
+// seenAfter returns the LastUpdate timestamp from which metricDefs are relevant for data from the given timestamp on.
+// metricDefs only get updated periodically, so we add a 1day (86400seconds) buffer when
+// filtering by our From timestamp.  This should be moved to a configuration option,
+// but that will require significant refactoring to expose the updateInterval used
+// in the MetricIdx.
+func seenAfter(from uint32) int64 {
+	if from == 0 {
+		return 0
+	}
+	return int64(from) - 86400
+}
+
+// uniq removes consecutive duplicates from the sorted list
+func uniq(sorted []string) []string {
+	out := make([]string, 0, len(sorted))
+	for _, s := range sorted {
+		if len(out) == 0 || s != out[len(out)-1] {
+			out = append(out, s)
+		}
+	}
+	return out
+}
+
+// tagExpressions returns the tag expressions passed to a seriesByTag() call
+func tagExpressions(e *expr.Expr) []string {
+	exprs := make([]string, len(e.Args))
+	for i, arg := range e.Args {
+		exprs[i] = arg.Str
+	}
+	return exprs
+}
+
+// evalTargets computes the output series of all target expressions, based on the fetched and merged series of all leaves
+func evalTargets(exprs []*expr.Expr, leaves map[leaf][]string, fetched []Series) ([]Series, error) {
+	byTarget := make(map[string]Series, len(fetched))
+	for _, s := range fetched {
+		byTarget[s.Target] = s
+	}
+	data := make(map[leaf][]Series, len(leaves))
+	for l, names := range leaves {
+		series := make([]Series, 0, len(names))
+		for _, name := range names {
+			s, ok := byTarget[leafTarget(name, l.consolidateBy)]
+			if !ok {
+				continue
+			}
+			s.Target = name
+			series = append(series, s)
+		}
+		data[l] = series
+	}
+	out := make([]Series, 0, len(fetched))
+	for _, e := range exprs {
+		series, err := evalExpr(e, "", data)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, series...)
+	}
+	return out, nil
+}
+
+// parseIdTarget parses a target of the low-level api: a metric id, optionally wrapped in consolidateBy()
+func parseIdTarget(target string) (string, string, error) {
+	e, err := expr.Parse(target)
+	if err != nil {
+		return "", "", fmt.Errorf("%s: %s", errTargetParse, err)
+	}
+	if e.Type == expr.EtName {
+		return e.Str, "", nil
+	}
+	if e.Type == expr.EtFunc && e.Str == "consolidateBy" && len(e.Args) == 2 && e.Args[0].Type == expr.EtName && e.Args[1].Type == expr.EtString {
+		return e.Args[0].Str, e.Args[1].Str, nil
+	}
+	return "", "", errTargetParse
+}
@@ -0,0 +1,267 @@
+package main
+
+import (
+	"errors"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/golang/snappy"
+	"github.com/raintank/metrictank/idx"
+	inPrometheus "github.com/raintank/metrictank/in/prometheus"
+	"github.com/raintank/metrictank/limits"
+	"github.com/raintank/metrictank/mdata"
+	"github.com/raintank/metrictank/prompb"
+	"github.com/raintank/worldping-api/pkg/log"
+	"gopkg.in/raintank/schema.v1"
+)
+
+var errNoPositiveMatcher = errors.New("query must have a __name__=<name> matcher or a matcher that only matches a non-empty label value")
+
+// prometheus refuses queries that would return more than 11000 points per series,
+// so that's what we allow by default before falling back to rollups
+const promDefaultMaxDataPoints = 11000
+
+// promQuery is a prometheus remote read query translated to what we can resolve via the index
+type promQuery struct {
+	find    findReq
+	filter  []idx.TagExpression // all matchers, to check the found series against
+	from    uint32
+	to      uint32
+	results []schema.MetricDefinition
+}
+
+// labels returns the prometheus labels of a series: its name as the __name__ label, and its tags.
+// tags without a value have no prometheus equivalent and are left out.
+func labels(def schema.MetricDefinition) []prompb.Label {
+	l := []prompb.Label{{Name: "__name__", Value: def.Name}}
+	for _, tag := range def.Tags {
+		key, value := idx.SplitTag(tag)
+		if value != "" {
+			l = append(l, prompb.Label{Name: key, Value: value})
+		}
+	}
+	sort.Sort(labelsByName(l))
+	return l
+}
+
+type labelsByName []prompb.Label
+
+func (l labelsByName) Len() int           { return len(l) }
+func (l labelsByName) Swap(i, j int)      { l[i], l[j] = l[j], l[i] }
+func (l labelsByName) Less(i, j int) bool { return l[i].Name < l[j].Name }
+
+// labelsKey returns a string that uniquely identifies a set of labels
+func labelsKey(labels []prompb.Label) string {
+	parts := make([]string, len(labels))
+	for i, l := range labels {
+		parts[i] = strconv.Quote(l.Name) + "=" + strconv.Quote(l.Value)
+	}
+	return "{" + strings.Join(parts, ",") + "}"
+}
+
+// parsePromQuery translates the label matchers of a query to tag expressions.
+// the __name__ label is matched against the name of the series, all other labels against its tags.
+// the index needs either the name, or a tag expression that only matches series having the tag, to resolve the query.
+func parsePromQuery(org int, q prompb.Query) (promQuery, error) {
+	// prometheus' range is inclusive on both ends, ours is exclusive on the end
+	from := uint32(q.StartTimestampMs / 1000)
+	to := uint32(q.EndTimestampMs/1000) + 1
+	if from >= to {
+		return promQuery{}, errors.New("end must be higher than start")
+	}
+	pq := promQuery{
+		find: findReq{Org: org, From: seenAfter(from)},
+		from: from,
+		to:   to,
+	}
+	for _, m := range q.Matchers {
+		var op, value string
+		switch m.Type {
+		case prompb.MatchEqual:
+			op, value = "=", m.Value
+		case prompb.MatchNotEqual:
+			op, value = "!=", m.Value
+		case prompb.MatchRegexp:
+			// prometheus regular expressions are fully anchored, ours only at the start.
+			// the group makes the end anchor apply to all alternatives of the expression.
+			op, value = "=~", "(?:"+m.Value+")$"
+		case prompb.MatchNotRegexp:
+			op, value = "!=~", "(?:"+m.Value+")$"
+		default:
+			return promQuery{}, errors.New("unknown matcher type " + strconv.Itoa(int(m.Type)))
+		}
+		s := m.Name + op + value
+		e, err := idx.ParseTagExpression(s)
+		if err != nil {
+			return promQuery{}, err
+		}
+		pq.filter = append(pq.filter, e)
+		if m.Name == "__name__" {
+			if m.Type == prompb.MatchEqual && pq.find.Pattern == "" {
+				pq.find.Pattern = m.Value
+			}
+		} else if e.Positive() {
+			pq.find.TagExprs = append(pq.find.TagExprs, s)
+		}
+	}
+	if len(pq.find.TagExprs) > 0 {
+		// a tag query is more selective than a name, and the name gets checked by the filter anyway
+		pq.find.Pattern = ""
+	} else if pq.find.Pattern == "" {
+		return promQuery{}, errNoPositiveMatcher
+	}
+	return pq, nil
+}
+
+// getPrometheusOrg returns the org of a request of prometheus. prometheus can't set headers,
+// so without one we query the org that the prometheus input writes to
+func getPrometheusOrg(r *http.Request) (int, error) {
+	if r.Header.Get("x-org-id") == "" {
+		return inPrometheus.OrgId, nil
+	}
+	return getOrg(r)
+}
+
+// PrometheusRead serves the prometheus remote_read protocol: snappy compressed protobuf ReadRequests,
+// of which each query selects series via label matchers and returns their samples in a time range.
+func PrometheusRead(store mdata.Store, metricIndex idx.MetricIndex, aggSettings []mdata.AggSetting) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		pre := time.Now()
+		org, err := getPrometheusOrg(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		r.ParseForm()
+		maxDataPoints := uint32(promDefaultMaxDataPoints)
+		maxDataPointsStr := r.Form.Get("maxDataPoints")
+		if maxDataPointsStr != "" {
+			tmp, err := strconv.Atoi(maxDataPointsStr)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			maxDataPoints = uint32(tmp)
+		}
+
+		compressed, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		buf, err := snappy.Decode(nil, compressed)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		var readReq prompb.ReadRequest
+		err = readReq.Unmarshal(buf)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		queries := make([]promQuery, len(readReq.Queries))
+		finds := make([]findReq, len(readReq.Queries))
+		for i, q := range readReq.Queries {
+			queries[i], err = parsePromQuery(org, q)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			finds[i] = queries[i].find
+		}
+		found, sources, err := findSeries(metricIndex, finds)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		numSeries := 0
+		for i := range queries {
+			for _, def := range found[i] {
+				tags := append([]string{"__name__:" + def.Name}, def.Tags...)
+				if idx.MatchTags(tags, queries[i].filter) {
+					queries[i].results = append(queries[i].results, def)
+				}
+			}
+			numSeries += len(queries[i].results)
+		}
+		if *maxPointsPerReq != 0 && numSeries*int(maxDataPoints) > *maxPointsPerReq {
+			http.Error(w, "too many series/maxDataPoints requested", http.StatusBadRequest)
+			return
+		}
+		if max := queryLimits.Get(org).MaxPointsPerReq; max != 0 && numSeries*int(maxDataPoints) > max {
+			queryLimits.Error(w, org, limits.ReasonPoints, "too many series/maxDataPoints requested for the limits of the org")
+			return
+		}
+
+		resp := prompb.ReadResponse{Results: make([]prompb.QueryResult, len(queries))}
+		for i, q := range queries {
+			resp.Results[i], err = promFetch(store, aggSettings, q, sources, maxDataPoints)
+			if err != nil {
+				log.Error(0, err.Error())
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+		}
+
+		w.Header().Set("Content-Encoding", "snappy")
+		reqHandleDuration.Value(time.Now().Sub(pre))
+		writeResponse(w, snappy.Encode(nil, resp.Marshal(nil)), httpTypeProtobuf, "")
+	}
+}
+
+// promFetch gets the data of the series of a query.
+// series with the same labels, such as ones of which the interval changed, are merged.
+func promFetch(store mdata.Store, aggSettings []mdata.AggSetting, q promQuery, sources map[string]*Peer, maxDataPoints uint32) (prompb.QueryResult, error) {
+	var result prompb.QueryResult
+	if len(q.results) == 0 {
+		return result, nil
+	}
+	reqs := make([]Req, 0, len(q.results))
+	labelsByKey := make(map[string][]prompb.Label)
+	for _, def := range q.results {
+		l := labels(def)
+		key := labelsKey(l)
+		labelsByKey[key] = l
+		aggRule := metrics.AggRule(def.Name)
+		consolidator, err := getConsolidator(&def, "", aggRule)
+		if err != nil {
+			return result, err
+		}
+		req := NewReq(def.Id, key, q.from, q.to, maxDataPoints, uint32(def.Interval), consolidator)
+		req.peer = sources[def.Id]
+		req.schema = metrics.Schema(def.Name)
+		req.aggRule = aggRule
+		reqs = append(reqs, req)
+	}
+	reqs, err := alignRequests(reqs, aggSettings)
+	if err != nil {
+		return result, err
+	}
+	out, err := fetchTargets(store, reqs)
+	if err != nil {
+		return result, err
+	}
+	merged := mergeSeries(out)
+	sort.Sort(SeriesByTarget(merged))
+	for _, serie := range merged {
+		ts := prompb.TimeSeries{Labels: labelsByKey[serie.Target]}
+		for _, p := range serie.Datapoints {
+			// prometheus has no notion of null points. there's simply no sample
+			if !math.IsNaN(p.Val) {
+				ts.Samples = append(ts.Samples, prompb.Sample{Value: p.Val, Timestamp: int64(p.Ts) * 1000})
+			}
+		}
+		result.Timeseries = append(result.Timeseries, ts)
+	}
+	for _, serie := range out {
+		pointSlicePool.Put(serie.Datapoints[:0])
+	}
+	return result, nil
+}
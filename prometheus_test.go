@@ -0,0 +1,160 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/golang/snappy"
+	"github.com/raintank/met/helper"
+	"github.com/raintank/metrictank/idx/memory"
+	"github.com/raintank/metrictank/mdata"
+	"github.com/raintank/metrictank/prompb"
+	"gopkg.in/raintank/schema.v1"
+)
+
+func TestParsePromQuery(t *testing.T) {
+	cases := []struct {
+		matchers []prompb.LabelMatcher
+		pattern  string
+		tagExprs []string
+		err      error
+	}{
+		{
+			[]prompb.LabelMatcher{{prompb.MatchEqual, "__name__", "up"}},
+			"up",
+			nil,
+			nil,
+		},
+		{
+			[]prompb.LabelMatcher{{prompb.MatchEqual, "__name__", "up"}, {prompb.MatchNotEqual, "job", "api"}},
+			"up",
+			nil,
+			nil,
+		},
+		{
+			[]prompb.LabelMatcher{{prompb.MatchEqual, "__name__", "up"}, {prompb.MatchRegexp, "job", "api|web"}},
+			"",
+			[]string{"job=~(?:api|web)$"},
+			nil,
+		},
+		{
+			[]prompb.LabelMatcher{{prompb.MatchRegexp, "__name__", "up|down"}, {prompb.MatchEqual, "job", "api"}},
+			"",
+			[]string{"job=api"},
+			nil,
+		},
+		{
+			[]prompb.LabelMatcher{{prompb.MatchRegexp, "__name__", "up|down"}},
+			"",
+			nil,
+			errNoPositiveMatcher,
+		},
+		{
+			[]prompb.LabelMatcher{{prompb.MatchRegexp, "job", ".*"}},
+			"",
+			nil,
+			errNoPositiveMatcher,
+		},
+	}
+	for i, c := range cases {
+		q, err := parsePromQuery(1, prompb.Query{StartTimestampMs: 1000, EndTimestampMs: 2000, Matchers: c.matchers})
+		if err != c.err {
+			t.Fatalf("case %d: expected error %v, got %v", i, c.err, err)
+		}
+		if err != nil {
+			continue
+		}
+		if q.find.Pattern != c.pattern {
+			t.Fatalf("case %d: expected pattern %q, got %q", i, c.pattern, q.find.Pattern)
+		}
+		if len(q.find.TagExprs) != len(c.tagExprs) {
+			t.Fatalf("case %d: expected tag expressions %v, got %v", i, c.tagExprs, q.find.TagExprs)
+		}
+		for j := range c.tagExprs {
+			if q.find.TagExprs[j] != c.tagExprs[j] {
+				t.Fatalf("case %d: expected tag expressions %v, got %v", i, c.tagExprs, q.find.TagExprs)
+			}
+		}
+		if len(q.filter) != len(c.matchers) || q.from != 1 || q.to != 3 {
+			t.Fatalf("case %d: expected %d filters in range 1-3, got %d in range %d-%d", i, len(c.matchers), len(q.filter), q.from, q.to)
+		}
+	}
+}
+
+func TestPrometheusRead(t *testing.T) {
+	stats, _ := helper.New(false, "", "standard", "metrictank", "")
+	mdata.CluStatus = mdata.NewClusterStatus("default", false)
+	initMetrics(stats)
+	mdata.InitMetrics(stats)
+
+	store := mdata.NewDevnullStore()
+	metrics = mdata.NewAggMetrics(store, 600, 10, 800, 8000, 10000, 0, 0, make([]mdata.AggSetting, 0), nil, nil)
+	metricIndex := memory.New()
+	metricIndex.Init(stats)
+
+	now := uint32(time.Now().Unix()) / 10 * 10
+	for _, job := range []string{"api", "web", "db"} {
+		data := &schema.MetricData{OrgId: 1, Name: "up", Metric: "up", Interval: 10, Time: int64(now), Mtype: "gauge", Tags: []string{"job:" + job}}
+		data.SetId()
+		metricIndex.Add(data)
+		m := metrics.GetOrCreate(data.Id, data.Name)
+		m.Add(now-20, 1)
+		m.Add(now-10, 2)
+	}
+
+	readReq := prompb.ReadRequest{Queries: []prompb.Query{
+		{
+			StartTimestampMs: int64(now-20) * 1000,
+			EndTimestampMs:   int64(now-10) * 1000,
+			Matchers:         []prompb.LabelMatcher{{prompb.MatchEqual, "__name__", "up"}, {prompb.MatchRegexp, "job", "api|web"}},
+		},
+		{
+			StartTimestampMs: int64(now-20) * 1000,
+			EndTimestampMs:   int64(now-10) * 1000,
+			Matchers:         []prompb.LabelMatcher{{prompb.MatchEqual, "__name__", "down"}},
+		},
+	}}
+	body := snappy.Encode(nil, readReq.Marshal(nil))
+	req, _ := http.NewRequest("POST", "/prometheus/read", bytes.NewReader(body))
+	w := httptest.NewRecorder()
+	PrometheusRead(store, metricIndex, make([]mdata.AggSetting, 0))(w, req)
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d: %s", w.Code, w.Body.String())
+	}
+	if w.Header().Get("Content-Encoding") != "snappy" {
+		t.Fatalf("expected a snappy encoded response, got %q", w.Header().Get("Content-Encoding"))
+	}
+	compressed, _ := ioutil.ReadAll(w.Body)
+	buf, err := snappy.Decode(nil, compressed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var resp prompb.ReadResponse
+	if err := resp.Unmarshal(buf); err != nil {
+		t.Fatal(err)
+	}
+	if len(resp.Results) != 2 {
+		t.Fatalf("expected 2 results, got %d", len(resp.Results))
+	}
+	if len(resp.Results[1].Timeseries) != 0 {
+		t.Fatalf("expected no series for the second query, got %v", resp.Results[1].Timeseries)
+	}
+	series := resp.Results[0].Timeseries
+	if len(series) != 2 {
+		t.Fatalf("expected 2 series for the first query, got %v", series)
+	}
+	for i, job := range []string{"api", "web"} {
+		exp := []prompb.Label{{"__name__", "up"}, {"job", job}}
+		if labelsKey(series[i].Labels) != labelsKey(exp) {
+			t.Fatalf("expected series %d to have labels %v, got %v", i, exp, series[i].Labels)
+		}
+		samples := series[i].Samples
+		if len(samples) != 2 || samples[0] != (prompb.Sample{1, int64(now-20) * 1000}) || samples[1] != (prompb.Sample{2, int64(now-10) * 1000}) {
+			t.Fatalf("expected series %d to have samples 1@%d and 2@%d, got %v", i, now-20, now-10, samples)
+		}
+	}
+}
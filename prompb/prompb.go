@@ -0,0 +1,380 @@
+// Package prompb implements the protocol buffer messages of the prometheus remote storage api.
+// the messages are few and simple, so rather than vendoring the protobuf runtime and the prometheus tree
+// for their generated code, we encode and decode the wire format ourselves.
+// see https://github.com/prometheus/prometheus/blob/master/storage/remote/remote.proto
+package prompb
+
+import (
+	"encoding/binary"
+	"errors"
+	"math"
+)
+
+var (
+	ErrUnexpectedEOF = errors.New("prompb: unexpected end of message")
+	ErrOverflow      = errors.New("prompb: varint overflows 64 bits")
+	ErrWireType      = errors.New("prompb: unsupported wire type")
+)
+
+// protobuf wire types
+const (
+	wireVarint  = 0
+	wireFixed64 = 1
+	wireBytes   = 2
+	wireFixed32 = 5
+)
+
+// Label is a name/value pair of a series. the __name__ label holds the metric name
+type Label struct {
+	Name  string
+	Value string
+}
+
+// Sample is a single point. Timestamp is in milliseconds
+type Sample struct {
+	Value     float64
+	Timestamp int64
+}
+
+type TimeSeries struct {
+	Labels  []Label
+	Samples []Sample
+}
+
+// WriteRequest is the body of a remote_write request
+type WriteRequest struct {
+	Timeseries []TimeSeries
+}
+
+type MatchType int
+
+const (
+	MatchEqual     MatchType = iota // EQ
+	MatchNotEqual                   // NEQ
+	MatchRegexp                     // RE
+	MatchNotRegexp                  // NRE
+)
+
+// LabelMatcher selects series by label. regular expressions are fully anchored
+type LabelMatcher struct {
+	Type  MatchType
+	Name  string
+	Value string
+}
+
+// Query asks for the samples in the start-end range (inclusive, in milliseconds) of all series matching all matchers
+type Query struct {
+	StartTimestampMs int64
+	EndTimestampMs   int64
+	Matchers         []LabelMatcher
+}
+
+// ReadRequest is the body of a remote_read request
+type ReadRequest struct {
+	Queries []Query
+}
+
+type QueryResult struct {
+	Timeseries []TimeSeries
+}
+
+// ReadResponse is the body of the response to a remote_read request. it has a result for each query, in the same order
+type ReadResponse struct {
+	Results []QueryResult
+}
+
+func (l *Label) Marshal(b []byte) []byte {
+	b = appendString(b, 1, l.Name)
+	return appendString(b, 2, l.Value)
+}
+
+func (l *Label) Unmarshal(b []byte) error {
+	return decode(b, func(field int, wire int, v uint64, data []byte) error {
+		switch field {
+		case 1:
+			l.Name = string(data)
+		case 2:
+			l.Value = string(data)
+		}
+		return nil
+	})
+}
+
+func (s *Sample) Marshal(b []byte) []byte {
+	b = appendKey(b, 1, wireFixed64)
+	b = appendFixed64(b, math.Float64bits(s.Value))
+	b = appendKey(b, 2, wireVarint)
+	return appendVarint(b, uint64(s.Timestamp))
+}
+
+func (s *Sample) Unmarshal(b []byte) error {
+	return decode(b, func(field int, wire int, v uint64, data []byte) error {
+		switch field {
+		case 1:
+			s.Value = math.Float64frombits(v)
+		case 2:
+			s.Timestamp = int64(v)
+		}
+		return nil
+	})
+}
+
+func (ts *TimeSeries) Marshal(b []byte) []byte {
+	for i := range ts.Labels {
+		b = appendMessage(b, 1, ts.Labels[i].Marshal)
+	}
+	for i := range ts.Samples {
+		b = appendMessage(b, 2, ts.Samples[i].Marshal)
+	}
+	return b
+}
+
+func (ts *TimeSeries) Unmarshal(b []byte) error {
+	return decode(b, func(field int, wire int, v uint64, data []byte) error {
+		switch field {
+		case 1:
+			var l Label
+			if err := l.Unmarshal(data); err != nil {
+				return err
+			}
+			ts.Labels = append(ts.Labels, l)
+		case 2:
+			var s Sample
+			if err := s.Unmarshal(data); err != nil {
+				return err
+			}
+			ts.Samples = append(ts.Samples, s)
+		}
+		return nil
+	})
+}
+
+func (w *WriteRequest) Marshal(b []byte) []byte {
+	for i := range w.Timeseries {
+		b = appendMessage(b, 1, w.Timeseries[i].Marshal)
+	}
+	return b
+}
+
+func (w *WriteRequest) Unmarshal(b []byte) error {
+	return decode(b, func(field int, wire int, v uint64, data []byte) error {
+		if field == 1 {
+			var ts TimeSeries
+			if err := ts.Unmarshal(data); err != nil {
+				return err
+			}
+			w.Timeseries = append(w.Timeseries, ts)
+		}
+		return nil
+	})
+}
+
+func (m *LabelMatcher) Marshal(b []byte) []byte {
+	b = appendKey(b, 1, wireVarint)
+	b = appendVarint(b, uint64(m.Type))
+	b = appendString(b, 2, m.Name)
+	return appendString(b, 3, m.Value)
+}
+
+func (m *LabelMatcher) Unmarshal(b []byte) error {
+	return decode(b, func(field int, wire int, v uint64, data []byte) error {
+		switch field {
+		case 1:
+			m.Type = MatchType(v)
+		case 2:
+			m.Name = string(data)
+		case 3:
+			m.Value = string(data)
+		}
+		return nil
+	})
+}
+
+func (q *Query) Marshal(b []byte) []byte {
+	b = appendKey(b, 1, wireVarint)
+	b = appendVarint(b, uint64(q.StartTimestampMs))
+	b = appendKey(b, 2, wireVarint)
+	b = appendVarint(b, uint64(q.EndTimestampMs))
+	for i := range q.Matchers {
+		b = appendMessage(b, 3, q.Matchers[i].Marshal)
+	}
+	return b
+}
+
+func (q *Query) Unmarshal(b []byte) error {
+	return decode(b, func(field int, wire int, v uint64, data []byte) error {
+		switch field {
+		case 1:
+			q.StartTimestampMs = int64(v)
+		case 2:
+			q.EndTimestampMs = int64(v)
+		case 3:
+			var m LabelMatcher
+			if err := m.Unmarshal(data); err != nil {
+				return err
+			}
+			q.Matchers = append(q.Matchers, m)
+		}
+		return nil
+	})
+}
+
+func (r *ReadRequest) Marshal(b []byte) []byte {
+	for i := range r.Queries {
+		b = appendMessage(b, 1, r.Queries[i].Marshal)
+	}
+	return b
+}
+
+func (r *ReadRequest) Unmarshal(b []byte) error {
+	return decode(b, func(field int, wire int, v uint64, data []byte) error {
+		if field == 1 {
+			var q Query
+			if err := q.Unmarshal(data); err != nil {
+				return err
+			}
+			r.Queries = append(r.Queries, q)
+		}
+		return nil
+	})
+}
+
+func (r *QueryResult) Marshal(b []byte) []byte {
+	for i := range r.Timeseries {
+		b = appendMessage(b, 1, r.Timeseries[i].Marshal)
+	}
+	return b
+}
+
+func (r *QueryResult) Unmarshal(b []byte) error {
+	return decode(b, func(field int, wire int, v uint64, data []byte) error {
+		if field == 1 {
+			var ts TimeSeries
+			if err := ts.Unmarshal(data); err != nil {
+				return err
+			}
+			r.Timeseries = append(r.Timeseries, ts)
+		}
+		return nil
+	})
+}
+
+func (r *ReadResponse) Marshal(b []byte) []byte {
+	for i := range r.Results {
+		b = appendMessage(b, 1, r.Results[i].Marshal)
+	}
+	return b
+}
+
+func (r *ReadResponse) Unmarshal(b []byte) error {
+	return decode(b, func(field int, wire int, v uint64, data []byte) error {
+		if field == 1 {
+			var qr QueryResult
+			if err := qr.Unmarshal(data); err != nil {
+				return err
+			}
+			r.Results = append(r.Results, qr)
+		}
+		return nil
+	})
+}
+
+// decode walks over the fields of a message and calls fn for each of them.
+// for varint and fixed width fields the value is passed as v, for length-delimited fields as data.
+// fields that the caller doesn't know about should be ignored, as in any protobuf decoder.
+func decode(b []byte, fn func(field int, wire int, v uint64, data []byte) error) error {
+	for len(b) > 0 {
+		key, n, err := readVarint(b)
+		if err != nil {
+			return err
+		}
+		b = b[n:]
+		field, wire := int(key>>3), int(key&7)
+		var v uint64
+		var data []byte
+		switch wire {
+		case wireVarint:
+			v, n, err = readVarint(b)
+			if err != nil {
+				return err
+			}
+			b = b[n:]
+		case wireFixed64:
+			if len(b) < 8 {
+				return ErrUnexpectedEOF
+			}
+			v = binary.LittleEndian.Uint64(b)
+			b = b[8:]
+		case wireFixed32:
+			if len(b) < 4 {
+				return ErrUnexpectedEOF
+			}
+			v = uint64(binary.LittleEndian.Uint32(b))
+			b = b[4:]
+		case wireBytes:
+			l, n, err := readVarint(b)
+			if err != nil {
+				return err
+			}
+			b = b[n:]
+			if uint64(len(b)) < l {
+				return ErrUnexpectedEOF
+			}
+			data = b[:l]
+			b = b[l:]
+		default:
+			return ErrWireType
+		}
+		if err := fn(field, wire, v, data); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func readVarint(b []byte) (uint64, int, error) {
+	var v uint64
+	for i := 0; i < len(b); i++ {
+		if i == 10 {
+			return 0, 0, ErrOverflow
+		}
+		v |= uint64(b[i]&0x7f) << (7 * uint(i))
+		if b[i] < 0x80 {
+			return v, i + 1, nil
+		}
+	}
+	return 0, 0, ErrUnexpectedEOF
+}
+
+func appendVarint(b []byte, v uint64) []byte {
+	for v >= 0x80 {
+		b = append(b, byte(v)|0x80)
+		v >>= 7
+	}
+	return append(b, byte(v))
+}
+
+func appendFixed64(b []byte, v uint64) []byte {
+	var buf [8]byte
+	binary.LittleEndian.PutUint64(buf[:], v)
+	return append(b, buf[:]...)
+}
+
+func appendKey(b []byte, field int, wire int) []byte {
+	return appendVarint(b, uint64(field)<<3|uint64(wire))
+}
+
+func appendString(b []byte, field int, s string) []byte {
+	b = appendKey(b, field, wireBytes)
+	b = appendVarint(b, uint64(len(s)))
+	return append(b, s...)
+}
+
+// appendMessage appends an embedded message. as its length prefix must precede it,
+// it's marshaled separately first.
+func appendMessage(b []byte, field int, marshal func([]byte) []byte) []byte {
+	msg := marshal(nil)
+	b = appendKey(b, field, wireBytes)
+	b = appendVarint(b, uint64(len(msg)))
+	return append(b, msg...)
+}
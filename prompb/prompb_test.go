@@ -0,0 +1,58 @@
+package prompb
+
+import (
+	"math"
+	"reflect"
+	"testing"
+)
+
+func TestWriteRequestRoundTrip(t *testing.T) {
+	in := WriteRequest{
+		Timeseries: []TimeSeries{
+			{
+				Labels:  []Label{{"__name__", "http_requests_total"}, {"job", "api"}, {"path", "/ünïcode"}},
+				Samples: []Sample{{1.5, 1483228800000}, {-2, 1483228815001}, {math.Inf(1), 0}},
+			},
+			{
+				Labels:  []Label{{"__name__", "up"}, {"empty", ""}},
+				Samples: []Sample{{0, -1}},
+			},
+		},
+	}
+	var out WriteRequest
+	if err := out.Unmarshal(in.Marshal(nil)); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(in, out) {
+		t.Fatalf("expected %v, got %v", in, out)
+	}
+}
+
+// a message as encoded by the official protobuf implementation, with an unknown field added to the label
+func TestUnmarshalReference(t *testing.T) {
+	b := []byte{
+		0x0a, 0x21, // timeseries, 33 bytes
+		0x0a, 0x11, 0x0a, 0x08, '_', '_', 'n', 'a', 'm', 'e', '_', '_', 0x12, 0x02, 'u', 'p', // label __name__=up
+		0x1a, 0x01, 'x', // unknown field of the label
+		0x12, 0x0c, 0x09, 0, 0, 0, 0, 0, 0, 0xf0, 0x3f, 0x10, 0xe8, 0x07, // sample 1.0@1000
+	}
+	var w WriteRequest
+	if err := w.Unmarshal(b); err != nil {
+		t.Fatal(err)
+	}
+	exp := WriteRequest{Timeseries: []TimeSeries{{Labels: []Label{{"__name__", "up"}}, Samples: []Sample{{1, 1000}}}}}
+	if !reflect.DeepEqual(w, exp) {
+		t.Fatalf("expected %v, got %v", exp, w)
+	}
+}
+
+func TestUnmarshalTruncated(t *testing.T) {
+	w := WriteRequest{Timeseries: []TimeSeries{{Labels: []Label{{"__name__", "up"}}, Samples: []Sample{{1, 1000}}}}}
+	b := w.Marshal(nil)
+	for i := 1; i < len(b); i++ {
+		var out WriteRequest
+		if err := out.Unmarshal(b[:i]); err == nil {
+			t.Fatalf("expected an error decoding the message truncated to %d bytes", i)
+		}
+	}
+}
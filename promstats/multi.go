@@ -0,0 +1,90 @@
+package promstats
+
+import (
+	"time"
+
+	"github.com/raintank/met"
+)
+
+// Multi returns a met.Backend that sends all measurements to all given backends, e.g. to both statsd and prometheus
+func Multi(backends ...met.Backend) met.Backend {
+	return multi(backends)
+}
+
+type multi []met.Backend
+
+func (m multi) NewCount(key string) met.Count {
+	c := make(multiCount, len(m))
+	for i, b := range m {
+		c[i] = b.NewCount(key)
+	}
+	return c
+}
+
+func (m multi) NewGauge(key string, val int64) met.Gauge {
+	g := make(multiGauge, len(m))
+	for i, b := range m {
+		g[i] = b.NewGauge(key, val)
+	}
+	return g
+}
+
+func (m multi) NewMeter(key string, val int64) met.Meter {
+	mt := make(multiMeter, len(m))
+	for i, b := range m {
+		mt[i] = b.NewMeter(key, val)
+	}
+	return mt
+}
+
+func (m multi) NewTimer(key string, val time.Duration) met.Timer {
+	t := make(multiTimer, len(m))
+	for i, b := range m {
+		t[i] = b.NewTimer(key, val)
+	}
+	return t
+}
+
+type multiCount []met.Count
+
+func (m multiCount) Inc(val int64) {
+	for _, c := range m {
+		c.Inc(val)
+	}
+}
+
+type multiGauge []met.Gauge
+
+func (m multiGauge) Dec(val int64) {
+	for _, g := range m {
+		g.Dec(val)
+	}
+}
+
+func (m multiGauge) Inc(val int64) {
+	for _, g := range m {
+		g.Inc(val)
+	}
+}
+
+func (m multiGauge) Value(val int64) {
+	for _, g := range m {
+		g.Value(val)
+	}
+}
+
+type multiMeter []met.Meter
+
+func (m multiMeter) Value(val int64) {
+	for _, mt := range m {
+		mt.Value(val)
+	}
+}
+
+type multiTimer []met.Timer
+
+func (m multiTimer) Value(val time.Duration) {
+	for _, t := range m {
+		t.Value(val)
+	}
+}
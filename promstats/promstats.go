@@ -0,0 +1,252 @@
+// Package promstats is a met.Backend that keeps the instrumentation in memory, and serves it in the prometheus text format,
+// so that prometheus can scrape it, instead of or next to sending it to statsd.
+package promstats
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/raintank/met"
+	"github.com/raintank/worldping-api/pkg/log"
+)
+
+// meterBuckets are the upper bounds of the histogram buckets of meters, which measure all kinds of values: sizes, counts, durations in ms, ...
+var meterBuckets = bounds(0, 9)
+
+// timerBuckets are the upper bounds of the histogram buckets of timers, in seconds
+var timerBuckets = bounds(-4, 2)
+
+// bounds returns the 1-2-5 steps from 10^min up to and including 10^max
+func bounds(min, max int) []float64 {
+	var b []float64
+	for exp := min; exp <= max; exp++ {
+		for _, step := range []float64{1, 2, 5} {
+			if exp == max && step > 1 {
+				break
+			}
+			// parse the formatted value, so that we get 0.0002 rather than 0.00020000000000000001
+			v, _ := strconv.ParseFloat(strconv.FormatFloat(step*math.Pow10(exp), 'g', 6, 64), 64)
+			b = append(b, v)
+		}
+	}
+	return b
+}
+
+// metric is a metric in the prometheus text format
+type metric interface {
+	typ() string
+	write(b []byte, name string) []byte
+}
+
+// Backend holds the metrics, by their prometheus name
+type Backend struct {
+	sync.Mutex
+	prefix  string
+	metrics map[string]metric
+}
+
+// New returns a Backend that names the metrics after their key, with the given prefix
+func New(prefix string) *Backend {
+	return &Backend{
+		prefix:  prefix,
+		metrics: make(map[string]metric),
+	}
+}
+
+// Name returns the prometheus name for the given key: the prefix and the key joined by an underscore,
+// with all characters that prometheus doesn't allow, such as the dots, replaced by underscores.
+func Name(prefix, key, suffix string) string {
+	b := []byte(prefix + "_" + key + suffix)
+	for i, c := range b {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c == '_' || c == ':' || i > 0 && c >= '0' && c <= '9') {
+			b[i] = '_'
+		}
+	}
+	return string(b)
+}
+
+// register returns the metric with the given name, which is created with create if we don't have it yet.
+// metrics that are registered more than once, are shared.
+func (b *Backend) register(name string, create func() metric) metric {
+	b.Lock()
+	defer b.Unlock()
+	m, ok := b.metrics[name]
+	if !ok {
+		m = create()
+		b.metrics[name] = m
+		return m
+	}
+	if n := create(); n.typ() != m.typ() {
+		// it still works, we just can't expose it
+		log.Warn("promstats: %s is a %s already, can't expose it as a %s", name, m.typ(), n.typ())
+		return n
+	}
+	return m
+}
+
+func (b *Backend) NewCount(key string) met.Count {
+	return b.register(Name(b.prefix, key, "_total"), func() metric { return &count{} }).(*count)
+}
+
+func (b *Backend) NewGauge(key string, val int64) met.Gauge {
+	g := b.register(Name(b.prefix, key, ""), func() metric { return &gauge{} }).(*gauge)
+	g.Value(val)
+	return g
+}
+
+// NewMeter returns a meter, as a histogram. unlike statsd, it doesn't record the initial value:
+// it's only there to make statsd send the metric before it has any real values.
+func (b *Backend) NewMeter(key string, val int64) met.Meter {
+	return meter{b.register(Name(b.prefix, key, ""), func() metric { return newHistogram(meterBuckets) }).(*histogram)}
+}
+
+// NewTimer returns a timer, as a histogram in seconds. like NewMeter, it doesn't record the initial value.
+func (b *Backend) NewTimer(key string, val time.Duration) met.Timer {
+	return timer{b.register(Name(b.prefix, key, "_seconds"), func() metric { return newHistogram(timerBuckets) }).(*histogram)}
+}
+
+// ServeHTTP serves all metrics in the prometheus text format, sorted by name
+func (b *Backend) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	b.Lock()
+	names := make([]string, 0, len(b.metrics))
+	for name := range b.metrics {
+		names = append(names, name)
+	}
+	metrics := make([]metric, len(names))
+	sort.Strings(names)
+	for i, name := range names {
+		metrics[i] = b.metrics[name]
+	}
+	b.Unlock()
+
+	var buf []byte
+	for i, m := range metrics {
+		buf = append(buf, fmt.Sprintf("# TYPE %s %s\n", names[i], m.typ())...)
+		buf = m.write(buf, names[i])
+	}
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	w.Write(buf)
+}
+
+type count struct {
+	val int64
+}
+
+func (c *count) Inc(val int64) {
+	atomic.AddInt64(&c.val, val)
+}
+
+func (c *count) typ() string { return "counter" }
+
+func (c *count) write(b []byte, name string) []byte {
+	return appendSample(b, name, "", float64(atomic.LoadInt64(&c.val)))
+}
+
+type gauge struct {
+	val int64
+}
+
+func (g *gauge) Dec(val int64) {
+	atomic.AddInt64(&g.val, -val)
+}
+
+func (g *gauge) Inc(val int64) {
+	atomic.AddInt64(&g.val, val)
+}
+
+func (g *gauge) Value(val int64) {
+	atomic.StoreInt64(&g.val, val)
+}
+
+func (g *gauge) typ() string { return "gauge" }
+
+func (g *gauge) write(b []byte, name string) []byte {
+	return appendSample(b, name, "", float64(atomic.LoadInt64(&g.val)))
+}
+
+type histogram struct {
+	sync.Mutex
+	bounds []float64
+	counts []uint64 // per bucket, not cumulative
+	count  uint64
+	sum    float64
+}
+
+func newHistogram(bounds []float64) *histogram {
+	return &histogram{
+		bounds: bounds,
+		counts: make([]uint64, len(bounds)),
+	}
+}
+
+func (h *histogram) observe(v float64) {
+	i := sort.SearchFloat64s(h.bounds, v)
+	h.Lock()
+	if i < len(h.counts) {
+		h.counts[i]++
+	}
+	h.count++
+	h.sum += v
+	h.Unlock()
+}
+
+func (h *histogram) typ() string { return "histogram" }
+
+func (h *histogram) write(b []byte, name string) []byte {
+	h.Lock()
+	defer h.Unlock()
+	var cumulative uint64
+	for i, bound := range h.bounds {
+		cumulative += h.counts[i]
+		b = appendSample(b, name+"_bucket", `le="`+formatFloat(bound)+`"`, float64(cumulative))
+	}
+	b = appendSample(b, name+"_bucket", `le="+Inf"`, float64(h.count))
+	b = appendSample(b, name+"_sum", "", h.sum)
+	return appendSample(b, name+"_count", "", float64(h.count))
+}
+
+type meter struct {
+	*histogram
+}
+
+func (m meter) Value(val int64) {
+	m.observe(float64(val))
+}
+
+type timer struct {
+	*histogram
+}
+
+func (t timer) Value(val time.Duration) {
+	t.observe(val.Seconds())
+}
+
+func appendSample(b []byte, name, labels string, v float64) []byte {
+	b = append(b, name...)
+	if labels != "" {
+		b = append(b, '{')
+		b = append(b, labels...)
+		b = append(b, '}')
+	}
+	b = append(b, ' ')
+	b = append(b, formatFloat(v)...)
+	return append(b, '\n')
+}
+
+func formatFloat(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	case math.IsNaN(v):
+		return "NaN"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
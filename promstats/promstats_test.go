@@ -0,0 +1,78 @@
+package promstats
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/raintank/met/helper"
+)
+
+func TestName(t *testing.T) {
+	if name := Name("metrictank", "cluster.messages-published", "_total"); name != "metrictank_cluster_messages_published_total" {
+		t.Fatalf("unexpected name %q", name)
+	}
+}
+
+func TestBounds(t *testing.T) {
+	b := bounds(-1, 1)
+	exp := []float64{0.1, 0.2, 0.5, 1, 2, 5, 10}
+	if len(b) != len(exp) {
+		t.Fatalf("expected bounds %v, got %v", exp, b)
+	}
+	for i := range exp {
+		if b[i] != exp[i] {
+			t.Fatalf("expected bounds %v, got %v", exp, b)
+		}
+	}
+}
+
+func TestServeHTTP(t *testing.T) {
+	b := New("mt")
+	c := b.NewCount("a.count")
+	c.Inc(2)
+	// registering a metric again shares it
+	b.NewCount("a.count").Inc(3)
+	g := b.NewGauge("a.gauge", 5)
+	g.Dec(1)
+	m := b.NewMeter("a.meter", 0)
+	m.Value(3)
+	m.Value(30)
+	tm := b.NewTimer("a.timer", 0)
+	tm.Value(1500 * time.Millisecond)
+
+	w := httptest.NewRecorder()
+	b.ServeHTTP(w, nil)
+	body := w.Body.String()
+	for _, exp := range []string{
+		"# TYPE mt_a_count_total counter\nmt_a_count_total 5\n",
+		"# TYPE mt_a_gauge gauge\nmt_a_gauge 4\n",
+		"# TYPE mt_a_meter histogram\nmt_a_meter_bucket{le=\"1\"} 0\nmt_a_meter_bucket{le=\"2\"} 0\nmt_a_meter_bucket{le=\"5\"} 1\n",
+		"mt_a_meter_bucket{le=\"50\"} 2\n",
+		"mt_a_meter_bucket{le=\"+Inf\"} 2\nmt_a_meter_sum 33\nmt_a_meter_count 2\n",
+		"mt_a_timer_seconds_bucket{le=\"1\"} 0\nmt_a_timer_seconds_bucket{le=\"2\"} 1\n",
+		"mt_a_timer_seconds_sum 1.5\n",
+	} {
+		if !strings.Contains(body, exp) {
+			t.Fatalf("expected output to contain %q, got:\n%s", exp, body)
+		}
+	}
+	if i, j := strings.Index(body, "mt_a_count_total"), strings.Index(body, "mt_a_timer_seconds"); i > j {
+		t.Fatalf("expected the metrics to be sorted by name")
+	}
+}
+
+func TestMulti(t *testing.T) {
+	statsd, _ := helper.New(false, "", "standard", "metrictank", "")
+	b := New("mt")
+	m := Multi(statsd, b)
+	m.NewCount("a").Inc(1)
+	m.NewGauge("b", 2)
+
+	w := httptest.NewRecorder()
+	b.ServeHTTP(w, nil)
+	if body := w.Body.String(); !strings.Contains(body, "mt_a_total 1\n") || !strings.Contains(body, "mt_b 2\n") {
+		t.Fatalf("expected the measurements to make it to all backends, got:\n%s", body)
+	}
+}
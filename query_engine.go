@@ -25,18 +25,39 @@ func (a archives) Len() int           { return len(a) }
 func (a archives) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
 func (a archives) Less(i, j int) bool { return a[i].interval < a[j].interval }
 
+// rollupArchive returns the archive index of the ready rollup with the given span, in the given span-sorted aggSettings
+func rollupArchive(aggs mdata.AggSettingsSpanAsc, span uint32) (int, bool) {
+	for j, agg := range aggs {
+		if agg.Span == span && agg.Ready {
+			return j + 1, true
+		}
+	}
+	return 0, false
+}
+
 // updates the requests with all details for fetching, making sure all metrics are in the same, optimal interval
-// luckily, all metrics still use the same aggSettings, making this a bit simpler
+// requests use the aggSettings of their schema, or the given ones if they have none.
+// we can only pick rollups that all requests have, and that keep the archives for their consolidators, so those are the ones we consider.
 // note: it is assumed that all requests have the same from, to and maxdatapoints!
 // this function ignores the TTL values. it is assumed that you've set sensible TTL's
 func alignRequests(reqs []Req, aggSettings []mdata.AggSetting) ([]Req, error) {
 
 	// model all the archives for each requested metric
 	// the 0th archive is always the raw series, with highest res (lowest interval)
-	aggs := mdata.AggSettingsSpanAsc(aggSettings)
-	sort.Sort(aggs)
+	// note: the settings may be shared with other queries, so we sort copies of them.
+	reqAggs := make([]mdata.AggSettingsSpanAsc, len(reqs))
+	for i, req := range reqs {
+		settings := aggSettings
+		if req.schema != nil {
+			settings = req.schema.AggSettings
+		}
+		aggs := make(mdata.AggSettingsSpanAsc, len(settings))
+		copy(aggs, settings)
+		sort.Sort(aggs)
+		reqAggs[i] = aggs
+	}
 
-	options := make([]archive, 1, len(aggs)+1)
+	options := make([]archive, 1, len(reqAggs[0])+1)
 
 	minInterval := uint32(0) // will contain the smallest rawInterval from all requested series
 	rawIntervals := make(map[uint32]struct{})
@@ -50,14 +71,26 @@ func alignRequests(reqs []Req, aggSettings []mdata.AggSetting) ([]Req, error) {
 
 	// note: not all series necessarily have the same raw settings, will be fixed further down
 	options[0] = archive{minInterval, tsRange / minInterval, false}
-	// now model the archives we get from the aggregations
+	// now model the archives we get from the aggregations that are ready for all requests
 	// note that during the processing, we skip non-ready aggregations for simplicity, but at the
-	// end we need to convert the index back to the real index in the full (incl non-ready) aggSettings array.
-	aggRef := []int{0}
-	for j, agg := range aggs {
-		if agg.Ready {
+	// end we need to convert the span back to the real index in each request's full (incl non-ready) aggSettings array.
+	// rollups can only be used if they have the archives for the consolidator of each request
+	haveArchives := true
+	for _, req := range reqs {
+		if !req.aggRule.Has(req.consolidator) {
+			haveArchives = false
+		}
+	}
+	for _, agg := range reqAggs[0] {
+		common := agg.Ready && haveArchives
+		for _, aggs := range reqAggs[1:] {
+			if !common {
+				break
+			}
+			_, common = rollupArchive(aggs, agg.Span)
+		}
+		if common {
 			options = append(options, archive{agg.Span, tsRange / agg.Span, false})
-			aggRef = append(aggRef, j+1)
 		}
 	}
 
@@ -144,7 +177,10 @@ func alignRequests(reqs []Req, aggSettings []mdata.AggSetting) ([]Req, error) {
 	*/
 	for i := range reqs {
 		req := &reqs[i]
-		req.archive = aggRef[selected]
+		req.archive = 0
+		if selected > 0 {
+			req.archive, _ = rollupArchive(reqAggs[i], options[selected].interval)
+		}
 		req.archInterval = options[selected].interval
 		req.outInterval = chosenInterval
 		req.aggNum = 1
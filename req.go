@@ -3,6 +3,7 @@ package main
 import (
 	"fmt"
 	"github.com/raintank/metrictank/consolidation"
+	"github.com/raintank/metrictank/mdata"
 )
 
 type Req struct {
@@ -20,6 +21,10 @@ type Req struct {
 	archInterval uint32 // the interval corresponding to the archive we'll fetch
 	outInterval  uint32 // the interval of the output data, after any runtime consolidation
 	aggNum       uint32 // how many points to consolidate together at runtime, after fetching from the archive
+
+	peer    *Peer          // the peer to fetch the data from, in a sharded cluster. nil means we fetch it ourselves
+	schema  *mdata.Schema  // storage settings of the series, which determine the rollups we can read from. nil means the default aggSettings
+	aggRule *mdata.AggRule // which rollup functions the series has. nil means all of them
 }
 
 func NewReq(key, target string, from, to, maxPoints, rawInterval uint32, consolidator consolidation.Consolidator) Req {
@@ -35,6 +40,9 @@ func NewReq(key, target string, from, to, maxPoints, rawInterval uint32, consoli
 		0,  // this is supposed to be updated still
 		0,  // this is supposed to be updated still
 		0,  // this is supposed to be updated still
+		nil,
+		nil,
+		nil,
 	}
 }
 
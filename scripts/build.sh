@@ -20,3 +20,4 @@ export CGO_ENABLED=0
 # Build binary
 cd $GOPATH/src/github.com/raintank/metrictank
 go build -ldflags "-X main.GitHash=$GITVERSION" -o $BUILDDIR/metrictank
+go build -ldflags "-X main.GitHash=$GITVERSION" -o $BUILDDIR/mt-whisper-importer ./cmd/mt-whisper-importer
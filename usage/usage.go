@@ -63,6 +63,23 @@ func (u *Usage) Add(org int, key string) {
 	u.Unlock()
 }
 
+// Seen returns whether the series with the given key was seen in the current or the previous accounting period,
+// and how many series the org has, being the largest count of both periods.
+func (u *Usage) Seen(org int, key string) (bool, int) {
+	u.Lock()
+	defer u.Unlock()
+	now, prev := u.now[org], u.prev[org]
+	_, seen := now.keys[key]
+	if !seen {
+		_, seen = prev.keys[key]
+	}
+	series := len(now.keys)
+	if len(prev.keys) > series {
+		series = len(prev.keys)
+	}
+	return seen, series
+}
+
 // a bit of a hack only for package-internal use (e.g. testing) to manipulate the internal counter
 func (u *Usage) set(org int, key string, points uint32) {
 	u.Lock()
@@ -101,7 +118,7 @@ func (u *Usage) Report() {
 		met.Value = val
 		met.SetId()
 
-		m := metrics.GetOrCreate(met.Id)
+		m := metrics.GetOrCreate(met.Id, met.Name)
 		m.Add(uint32(met.Time), met.Value)
 		metricIndex.Add(met)
 	}